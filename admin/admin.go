@@ -0,0 +1,292 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rode/collector-sonarqube/internal/httpjson"
+	"github.com/rode/collector-sonarqube/listener"
+	"github.com/rode/collector-sonarqube/store"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultLimit = 50
+	maxLimit     = 1000
+	// reprocessTimeout matches the time allowed for a webhook event
+	reprocessTimeout = 60 * time.Second
+)
+
+// Options configure the admin api.
+type Options struct {
+	// Token must be sent as a bearer token with every request
+	Token string
+}
+
+// EventSummary is the listing of an event, without the event itself or its attempts.
+type EventSummary struct {
+	TaskId          string           `json:"taskId"`
+	ProjectKey      string           `json:"projectKey,omitempty"`
+	FirstReceivedAt time.Time        `json:"firstReceivedAt"`
+	LastProcessedAt time.Time        `json:"lastProcessedAt"`
+	Outcome         listener.Outcome `json:"outcome"`
+	Reason          string           `json:"reason,omitempty"`
+	ResourceUri     string           `json:"resourceUri,omitempty"`
+	Attempts        int              `json:"attempts"`
+}
+
+// ReprocessRequest is the optional body of a request to reprocess an event.
+type ReprocessRequest struct {
+	// ResourceUri is used in place of the resource uri derived from the event
+	ResourceUri string `json:"resourceUri,omitempty"`
+}
+
+type server struct {
+	logger   *zap.Logger
+	store    *store.Store
+	listener listener.Listener
+}
+
+// NewHandler returns the admin api, which lists the events in the store, shows the details of each, reprocesses them,
+// and purges the dead letters: events whose most recent attempt failed to record in Rode.
+func NewHandler(logger *zap.Logger, st *store.Store, l listener.Listener, options *Options) http.Handler {
+	s := &server{
+		logger:   logger,
+		store:    st,
+		listener: l,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.listEvents)
+	mux.HandleFunc("/events/", s.event)
+	mux.HandleFunc("/dead-letters", s.deadLetters)
+
+	return Authenticate(options.Token, mux)
+}
+
+// Authenticate only allows requests that send the token, either as a bearer token or as the password of basic auth so
+// that pages can be viewed in a browser. Every request is rejected when the token is empty.
+func Authenticate(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		sent := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if _, password, ok := request.BasicAuth(); ok {
+			sent = password
+		}
+
+		if token == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+			w.Header().Add("WWW-Authenticate", "Bearer")
+			w.Header().Add("WWW-Authenticate", `Basic realm="rode-collector-sonarqube"`)
+			httpjson.WriteErrors(w, http.StatusUnauthorized, "a valid token is required")
+			return
+		}
+
+		next.ServeHTTP(w, request)
+	})
+}
+
+// listEvents returns the most recently processed events, optionally filtered by the outcome, source and project query
+// parameters.
+func (s *server) listEvents(w http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		httpjson.WriteErrors(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s is not allowed", request.Method))
+		return
+	}
+
+	query := request.URL.Query()
+	limit, err := parseLimit(query.Get("limit"))
+	if err != nil {
+		httpjson.WriteErrors(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	outcome := listener.Outcome(strings.ToUpper(query.Get("outcome")))
+	source := listener.Source(strings.ToUpper(query.Get("source")))
+	project := query.Get("project")
+
+	records, err := s.store.List(limit, func(r *store.Record) bool {
+		if outcome != "" && r.Outcome != outcome {
+			return false
+		}
+		if project != "" && r.ProjectKey != project {
+			return false
+		}
+		if source != "" && (len(r.Attempts) == 0 || r.Attempts[len(r.Attempts)-1].Source != source) {
+			return false
+		}
+
+		return true
+	})
+	if err != nil {
+		s.logger.Error("error listing events", zap.Error(err))
+		httpjson.WriteErrors(w, http.StatusInternalServerError, "error listing events")
+		return
+	}
+
+	httpjson.Write(w, http.StatusOK, summarize(records))
+}
+
+// event routes /events/{taskId} and /events/{taskId}/reprocess
+func (s *server) event(w http.ResponseWriter, request *http.Request) {
+	path := strings.TrimPrefix(request.URL.Path, "/events/")
+	taskId, action := path, ""
+	if i := strings.Index(path, "/"); i != -1 {
+		taskId, action = path[:i], path[i+1:]
+	}
+
+	switch {
+	case taskId == "":
+		httpjson.WriteErrors(w, http.StatusNotFound, "a task id is required")
+	case action == "" && request.Method == http.MethodGet:
+		s.getEvent(w, taskId)
+	case action == "reprocess" && request.Method == http.MethodPost:
+		s.reprocessEvent(w, request, taskId)
+	case action == "" || action == "reprocess":
+		httpjson.WriteErrors(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s is not allowed", request.Method))
+	default:
+		httpjson.WriteErrors(w, http.StatusNotFound, fmt.Sprintf("unknown action %q", action))
+	}
+}
+
+func (s *server) getEvent(w http.ResponseWriter, taskId string) {
+	record, ok := s.getRecord(w, taskId)
+	if !ok {
+		return
+	}
+
+	httpjson.Write(w, http.StatusOK, record)
+}
+
+// reprocessEvent processes the event as it was last received, and responds with the result.
+func (s *server) reprocessEvent(w http.ResponseWriter, request *http.Request, taskId string) {
+	log := s.logger.With(zap.String("taskId", taskId))
+
+	body := &ReprocessRequest{}
+	if err := json.NewDecoder(request.Body).Decode(body); err != nil && !errors.Is(err, io.EOF) {
+		httpjson.WriteErrors(w, http.StatusBadRequest, fmt.Sprintf("error decoding request: %v", err))
+		return
+	}
+
+	record, ok := s.getRecord(w, taskId)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(request.Context(), reprocessTimeout)
+	defer cancel()
+
+	log.Info("reprocessing event", zap.String("resourceUri", body.ResourceUri))
+	result, err := s.listener.Process(ctx, record.Event, &listener.ProcessOptions{
+		Source:      listener.SOURCE_ADMIN,
+		ResourceUri: body.ResourceUri,
+	})
+
+	var validationErr *listener.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		httpjson.WriteErrors(w, http.StatusBadRequest, validationErr.Problems...)
+	case err != nil && result == nil:
+		log.Error("error reprocessing event", zap.Error(err))
+		httpjson.WriteErrors(w, http.StatusInternalServerError, err.Error())
+	case err != nil:
+		log.Error("error reprocessing event", zap.Error(err))
+		httpjson.Write(w, http.StatusInternalServerError, result)
+	default:
+		httpjson.Write(w, http.StatusOK, result)
+	}
+}
+
+// deadLetters lists or purges the events whose most recent attempt failed.
+func (s *server) deadLetters(w http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		records, err := s.store.List(0, store.DeadLetter)
+		if err != nil {
+			s.logger.Error("error listing dead letters", zap.Error(err))
+			httpjson.WriteErrors(w, http.StatusInternalServerError, "error listing dead letters")
+			return
+		}
+
+		httpjson.Write(w, http.StatusOK, summarize(records))
+	case http.MethodDelete:
+		purged, err := s.store.Delete(store.DeadLetter)
+		if err != nil {
+			s.logger.Error("error purging dead letters", zap.Error(err))
+			httpjson.WriteErrors(w, http.StatusInternalServerError, "error purging dead letters")
+			return
+		}
+
+		s.logger.Info("purged dead letters", zap.Int("purged", purged))
+		httpjson.Write(w, http.StatusOK, map[string]int{"purged": purged})
+	default:
+		httpjson.WriteErrors(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s is not allowed", request.Method))
+	}
+}
+
+func (s *server) getRecord(w http.ResponseWriter, taskId string) (*store.Record, bool) {
+	record, err := s.store.Get(taskId)
+	if errors.Is(err, store.ErrNotFound) {
+		httpjson.WriteErrors(w, http.StatusNotFound, fmt.Sprintf("no event found for task %s", taskId))
+		return nil, false
+	}
+
+	if err != nil {
+		s.logger.Error("error reading event", zap.String("taskId", taskId), zap.Error(err))
+		httpjson.WriteErrors(w, http.StatusInternalServerError, "error reading event")
+		return nil, false
+	}
+
+	return record, true
+}
+
+func parseLimit(value string) (int, error) {
+	if value == "" {
+		return defaultLimit, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 || limit > maxLimit {
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxLimit)
+	}
+
+	return limit, nil
+}
+
+func summarize(records []*store.Record) []*EventSummary {
+	summaries := []*EventSummary{}
+	for _, r := range records {
+		summaries = append(summaries, &EventSummary{
+			TaskId:          r.TaskId,
+			ProjectKey:      r.ProjectKey,
+			FirstReceivedAt: r.FirstReceivedAt,
+			LastProcessedAt: r.LastProcessedAt,
+			Outcome:         r.Outcome,
+			Reason:          r.Reason,
+			ResourceUri:     r.ResourceUri,
+			Attempts:        len(r.Attempts),
+		})
+	}
+
+	return summaries
+}
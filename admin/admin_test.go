@@ -0,0 +1,299 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/collector-sonarqube/listener"
+	"github.com/rode/collector-sonarqube/sonar"
+	"github.com/rode/collector-sonarqube/store"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type fakeListener struct {
+	listener.Listener
+
+	events  []*sonar.Event
+	options []*listener.ProcessOptions
+	result  *listener.Result
+	err     error
+}
+
+func (f *fakeListener) ProcessEvent(http.ResponseWriter, *http.Request) {}
+
+func (f *fakeListener) Process(_ context.Context, event *sonar.Event, options *listener.ProcessOptions) (*listener.Result, error) {
+	f.events = append(f.events, event)
+	f.options = append(f.options, options)
+
+	return f.result, f.err
+}
+
+var _ = Describe("Admin", func() {
+	const TOKEN = "s3cret"
+
+	var (
+		dir      string
+		st       *store.Store
+		l        *fakeListener
+		handler  http.Handler
+		response *httptest.ResponseRecorder
+	)
+
+	record := func(taskId, projectKey string, source listener.Source, outcome listener.Outcome) {
+		event := &sonar.Event{
+			TaskId:  taskId,
+			Status:  sonar.STATUS_SUCCESS,
+			Project: &sonar.Project{Key: projectKey},
+		}
+
+		Expect(st.Record(context.Background(), event, &listener.ProcessOptions{Source: source}, &listener.Result{
+			TaskId:  taskId,
+			Outcome: outcome,
+		})).To(Succeed())
+	}
+
+	request := func(method, path string, body io.Reader) {
+		req := httptest.NewRequest(method, path, body)
+		req.Header.Set("Authorization", "Bearer "+TOKEN)
+
+		response = httptest.NewRecorder()
+		handler.ServeHTTP(response, req)
+	}
+
+	decodeSummaries := func() []string {
+		var summaries []*EventSummary
+		Expect(json.NewDecoder(response.Body).Decode(&summaries)).To(Succeed())
+
+		var ids []string
+		for _, s := range summaries {
+			ids = append(ids, s.TaskId)
+		}
+
+		return ids
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "admin")
+		Expect(err).ToNot(HaveOccurred())
+
+		st, err = store.Open(logger, filepath.Join(dir, "state.db"), &store.Options{})
+		Expect(err).ToNot(HaveOccurred())
+
+		l = &fakeListener{}
+		handler = NewHandler(logger, st, l, &Options{Token: TOKEN})
+
+		record("first", "project-a", listener.SOURCE_WEBHOOK, listener.OUTCOME_RECORDED)
+		record("second", "project-b", listener.SOURCE_POLL, listener.OUTCOME_FAILED)
+		record("third", "project-a", listener.SOURCE_WEBHOOK, listener.OUTCOME_FAILED)
+	})
+
+	AfterEach(func() {
+		Expect(st.Close()).To(Succeed())
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	Describe("authentication", func() {
+		It("should reject requests without the token", func() {
+			response = httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/events", nil))
+
+			Expect(response.Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should reject requests with the wrong token", func() {
+			req := httptest.NewRequest(http.MethodGet, "/events", nil)
+			req.Header.Set("Authorization", "Bearer "+fake.Password(true, true, true, false, false, 12))
+			response = httptest.NewRecorder()
+			handler.ServeHTTP(response, req)
+
+			Expect(response.Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should accept the token as a basic auth password", func() {
+			req := httptest.NewRequest(http.MethodGet, "/events", nil)
+			req.SetBasicAuth("admin", TOKEN)
+			response = httptest.NewRecorder()
+			handler.ServeHTTP(response, req)
+
+			Expect(response.Code).To(Equal(http.StatusOK))
+		})
+
+		When("no token is configured", func() {
+			BeforeEach(func() {
+				handler = NewHandler(logger, st, l, &Options{})
+			})
+
+			It("should reject every request", func() {
+				req := httptest.NewRequest(http.MethodGet, "/events", nil)
+				req.Header.Set("Authorization", "Bearer ")
+				response = httptest.NewRecorder()
+				handler.ServeHTTP(response, req)
+
+				Expect(response.Code).To(Equal(http.StatusUnauthorized))
+			})
+		})
+	})
+
+	Describe("listing events", func() {
+		It("should return the most recent events first", func() {
+			request(http.MethodGet, "/events", nil)
+
+			Expect(response.Code).To(Equal(http.StatusOK))
+			Expect(decodeSummaries()).To(Equal([]string{"third", "second", "first"}))
+		})
+
+		It("should filter by outcome, project and source", func() {
+			request(http.MethodGet, "/events?outcome=failed&project=project-a", nil)
+			Expect(decodeSummaries()).To(Equal([]string{"third"}))
+
+			request(http.MethodGet, "/events?source=poll", nil)
+			Expect(decodeSummaries()).To(Equal([]string{"second"}))
+		})
+
+		It("should limit the number of events", func() {
+			request(http.MethodGet, "/events?limit=1", nil)
+
+			Expect(decodeSummaries()).To(Equal([]string{"third"}))
+		})
+
+		It("should reject an invalid limit", func() {
+			request(http.MethodGet, "/events?limit=-1", nil)
+
+			Expect(response.Code).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Describe("getting an event", func() {
+		It("should return the record", func() {
+			request(http.MethodGet, "/events/second", nil)
+
+			Expect(response.Code).To(Equal(http.StatusOK))
+			r := &store.Record{}
+			Expect(json.NewDecoder(response.Body).Decode(r)).To(Succeed())
+			Expect(r.TaskId).To(Equal("second"))
+			Expect(r.Event.Project.Key).To(Equal("project-b"))
+			Expect(r.Attempts).To(HaveLen(1))
+		})
+
+		It("should return not found for an unknown task", func() {
+			request(http.MethodGet, "/events/unknown", nil)
+
+			Expect(response.Code).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("reprocessing an event", func() {
+		BeforeEach(func() {
+			l.result = &listener.Result{TaskId: "second", Outcome: listener.OUTCOME_RECORDED}
+		})
+
+		It("should process the stored event", func() {
+			request(http.MethodPost, "/events/second/reprocess", nil)
+
+			Expect(response.Code).To(Equal(http.StatusOK))
+			Expect(l.events).To(HaveLen(1))
+			Expect(l.events[0].TaskId).To(Equal("second"))
+			Expect(l.options[0].Source).To(Equal(listener.SOURCE_ADMIN))
+			Expect(l.options[0].ResourceUri).To(BeEmpty())
+		})
+
+		It("should override the resource uri", func() {
+			request(http.MethodPost, "/events/second/reprocess", strings.NewReader(`{"resourceUri": "git://example.com/repo@abc123"}`))
+
+			Expect(response.Code).To(Equal(http.StatusOK))
+			Expect(l.options[0].ResourceUri).To(Equal("git://example.com/repo@abc123"))
+		})
+
+		It("should reject an invalid body", func() {
+			request(http.MethodPost, "/events/second/reprocess", strings.NewReader("{"))
+
+			Expect(response.Code).To(Equal(http.StatusBadRequest))
+			Expect(l.events).To(BeEmpty())
+		})
+
+		It("should return not found for an unknown task", func() {
+			request(http.MethodPost, "/events/unknown/reprocess", nil)
+
+			Expect(response.Code).To(Equal(http.StatusNotFound))
+			Expect(l.events).To(BeEmpty())
+		})
+
+		It("should only allow posts", func() {
+			request(http.MethodGet, "/events/second/reprocess", nil)
+
+			Expect(response.Code).To(Equal(http.StatusMethodNotAllowed))
+		})
+
+		When("the event is invalid", func() {
+			BeforeEach(func() {
+				l.result = &listener.Result{Outcome: listener.OUTCOME_REJECTED}
+				l.err = &listener.ValidationError{Problems: []string{"missing revision"}}
+			})
+
+			It("should return the problems", func() {
+				request(http.MethodPost, "/events/second/reprocess", nil)
+
+				Expect(response.Code).To(Equal(http.StatusBadRequest))
+				Expect(response.Body.String()).To(ContainSubstring("missing revision"))
+			})
+		})
+
+		When("the event can't be recorded", func() {
+			BeforeEach(func() {
+				l.result = &listener.Result{Outcome: listener.OUTCOME_FAILED, Reason: "rode is unavailable"}
+				l.err = errors.New("rode is unavailable")
+			})
+
+			It("should return the result", func() {
+				request(http.MethodPost, "/events/second/reprocess", nil)
+
+				Expect(response.Code).To(Equal(http.StatusInternalServerError))
+				result := &listener.Result{}
+				Expect(json.NewDecoder(response.Body).Decode(result)).To(Succeed())
+				Expect(result.Reason).To(Equal("rode is unavailable"))
+			})
+		})
+	})
+
+	Describe("dead letters", func() {
+		It("should list the events whose last attempt failed", func() {
+			request(http.MethodGet, "/dead-letters", nil)
+
+			Expect(response.Code).To(Equal(http.StatusOK))
+			Expect(decodeSummaries()).To(Equal([]string{"third", "second"}))
+		})
+
+		It("should purge them", func() {
+			request(http.MethodDelete, "/dead-letters", nil)
+
+			Expect(response.Code).To(Equal(http.StatusOK))
+			Expect(response.Body.String()).To(MatchJSON(`{"purged": 2}`))
+
+			request(http.MethodGet, "/events", nil)
+			Expect(decodeSummaries()).To(Equal([]string{"first"}))
+		})
+	})
+})
@@ -0,0 +1,339 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	FORMAT_FILES      = "files"
+	FORMAT_JSONL_GZIP = "jsonl.gz"
+
+	filePrefix = "webhook-"
+	redacted   = "REDACTED"
+)
+
+// headers that carry credentials are never written to disk. The webhook signature is kept, since it's needed to prove
+// what SonarQube sent.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// Record is a raw webhook request, exactly as it was received.
+type Record struct {
+	ReceivedAt time.Time   `json:"receivedAt"`
+	Method     string      `json:"method"`
+	Path       string      `json:"path"`
+	RemoteAddr string      `json:"remoteAddr"`
+	Headers    http.Header `json:"headers"`
+	Body       string      `json:"body"`
+	// Truncated is set when the body was larger than the listener accepts, and only its start was archived
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+type Archiver interface {
+	Archive(*Record) error
+	// RunRetention removes expired archive files once per interval until the context is canceled
+	RunRetention(ctx context.Context, interval time.Duration)
+	Close() error
+}
+
+// Options configure where records are written and how long they're kept. A zero MaxAge or MaxTotalBytes disables that
+// form of retention.
+type Options struct {
+	Directory     string
+	Format        string
+	MaxAge        time.Duration
+	MaxTotalBytes int64
+	// MaxFileBytes is the size at which a compressed archive is rotated
+	MaxFileBytes int64
+}
+
+// New returns an archiver that writes each record to its own file, or appends records to compressed JSON-lines files,
+// depending on the configured format.
+func New(logger *zap.Logger, options *Options) (Archiver, error) {
+	if err := os.MkdirAll(options.Directory, 0755); err != nil {
+		return nil, fmt.Errorf("error creating archive directory: %v", err)
+	}
+
+	switch options.Format {
+	case FORMAT_FILES:
+		return &fileArchiver{archiver: archiver{logger: logger, options: options}}, nil
+	case FORMAT_JSONL_GZIP:
+		return &gzipArchiver{archiver: archiver{logger: logger, options: options}}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported archive format %q", options.Format)
+}
+
+// NewRecord captures the request and its body, redacting any credentials from the headers.
+func NewRecord(request *http.Request, body []byte) *Record {
+	headers := request.Header.Clone()
+	for _, header := range redactedHeaders {
+		if headers.Get(header) != "" {
+			headers.Set(header, redacted)
+		}
+	}
+
+	return &Record{
+		ReceivedAt: time.Now().UTC(),
+		Method:     request.Method,
+		Path:       request.URL.Path,
+		RemoteAddr: request.RemoteAddr,
+		Headers:    headers,
+		Body:       string(body),
+	}
+}
+
+// Handler archives the raw body of each request before passing it on to the next handler. It's meant to wrap the
+// request limits, so that rejected requests are archived too; bodies larger than maxBodyBytes are truncated, and the
+// next handler still receives the whole body. Failing to archive a request doesn't prevent it from being processed.
+func Handler(logger *zap.Logger, archiver Archiver, maxBodyBytes int64, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, request *http.Request) {
+		// one byte more than the limit is read, so that the next handler can still tell that the body is too large
+		body, err := ioutil.ReadAll(io.LimitReader(request.Body, maxBodyBytes+1))
+		if err != nil {
+			logger.Error("error reading request body", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		record := NewRecord(request, body)
+		if int64(len(body)) > maxBodyBytes {
+			record.Body = string(body[:maxBodyBytes])
+			record.Truncated = true
+		}
+
+		if err := archiver.Archive(record); err != nil {
+			logger.Error("error archiving request", zap.Error(err))
+		}
+
+		request.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), request.Body))
+		next(w, request)
+	}
+}
+
+type archiver struct {
+	logger  *zap.Logger
+	options *Options
+	mu      sync.Mutex
+	// active is the file that's currently being written to, which is never removed
+	active string
+}
+
+// RunRetention enforces the retention limits once per interval until the context is canceled. Listing the archive
+// directory on every request would slow down the listener as the archive grows.
+func (a *archiver) RunRetention(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		a.mu.Lock()
+		a.enforceRetention()
+		a.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// enforceRetention removes archive files that are older than the maximum age, then removes the oldest files until the
+// archive fits within the maximum size. The file that's currently being written to is never removed. The caller must
+// hold the lock.
+func (a *archiver) enforceRetention() {
+	files, err := ioutil.ReadDir(a.options.Directory)
+	if err != nil {
+		a.logger.Error("error listing archive directory", zap.Error(err))
+		return
+	}
+
+	var archived []os.FileInfo
+	var totalBytes int64
+	for _, f := range files {
+		if f.IsDir() || !strings.HasPrefix(f.Name(), filePrefix) {
+			continue
+		}
+
+		archived = append(archived, f)
+		totalBytes += f.Size()
+	}
+
+	sort.Slice(archived, func(i, j int) bool {
+		return archived[i].ModTime().Before(archived[j].ModTime())
+	})
+
+	cutoff := time.Now().Add(-a.options.MaxAge)
+	for _, f := range archived {
+		if f.Name() == a.active {
+			continue
+		}
+
+		expired := a.options.MaxAge > 0 && f.ModTime().Before(cutoff)
+		oversized := a.options.MaxTotalBytes > 0 && totalBytes > a.options.MaxTotalBytes
+		if !expired && !oversized {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(a.options.Directory, f.Name())); err != nil {
+			a.logger.Error("error removing archived file", zap.String("file", f.Name()), zap.Error(err))
+			continue
+		}
+
+		a.logger.Debug("removed archived file", zap.String("file", f.Name()))
+		totalBytes -= f.Size()
+	}
+}
+
+func fileName(t time.Time, extension string) string {
+	return fmt.Sprintf("%s%s%s", filePrefix, t.UTC().Format("20060102T150405.000000000Z"), extension)
+}
+
+// fileArchiver writes each record to a separate JSON file.
+type fileArchiver struct {
+	archiver
+}
+
+func (f *fileArchiver) Archive(record *Record) error {
+	body, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := filepath.Join(f.options.Directory, fileName(record.ReceivedAt, ".json"))
+	// write to a temporary file first so that partial records are never left behind
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, body, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func (f *fileArchiver) Close() error {
+	return nil
+}
+
+// gzipArchiver appends records to gzip compressed JSON-lines files, starting a new file once the current one reaches
+// the maximum file size.
+type gzipArchiver struct {
+	archiver
+
+	file    *os.File
+	writer  *gzip.Writer
+	counter *countingWriter
+}
+
+func (g *gzipArchiver) Archive(record *Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.file == nil {
+		if err := g.open(record.ReceivedAt); err != nil {
+			return err
+		}
+	}
+
+	if _, err := g.writer.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	// flush so that the record can be read back even if the process stops before the file is closed
+	if err := g.writer.Flush(); err != nil {
+		return err
+	}
+
+	// a rotated file counts towards the size of the archive, so retention is enforced as soon as it's closed
+	if g.options.MaxFileBytes > 0 && g.counter.n >= g.options.MaxFileBytes {
+		if err := g.close(); err != nil {
+			return err
+		}
+		g.enforceRetention()
+	}
+
+	return nil
+}
+
+func (g *gzipArchiver) open(t time.Time) error {
+	file, err := os.OpenFile(filepath.Join(g.options.Directory, fileName(t, ".jsonl.gz")), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	g.file = file
+	g.active = filepath.Base(file.Name())
+	g.counter = &countingWriter{w: file}
+	g.writer = gzip.NewWriter(g.counter)
+
+	return nil
+}
+
+func (g *gzipArchiver) close() error {
+	if g.file == nil {
+		return nil
+	}
+
+	err := g.writer.Close()
+	if closeErr := g.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	g.file, g.writer, g.counter, g.active = nil, nil, nil, ""
+
+	return err
+}
+
+func (g *gzipArchiver) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.close()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+
+	return n, err
+}
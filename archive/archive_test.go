@@ -0,0 +1,287 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var _ = Describe("archive", func() {
+	var (
+		dir     string
+		options *Options
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "archive")
+		Expect(err).ToNot(HaveOccurred())
+
+		options = &Options{
+			Directory: dir,
+			Format:    FORMAT_FILES,
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	newRecord := func() *Record {
+		request := httptest.NewRequest(http.MethodPost, "/webhook/event", nil)
+		request.Header.Set("X-Sonar-Webhook-HMAC-SHA256", fake.LetterN(64))
+		request.Header.Set("Authorization", "Basic "+fake.LetterN(10))
+
+		return NewRecord(request, []byte(`{"taskId":"`+fake.LetterN(10)+`"}`))
+	}
+
+	// pruned enforces retention once, as RunRetention does when it starts
+	pruned := func(archiver Archiver) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		archiver.RunRetention(ctx, time.Hour)
+	}
+
+	archivedFiles := func() []string {
+		files, err := filepath.Glob(filepath.Join(dir, filePrefix+"*"))
+		Expect(err).ToNot(HaveOccurred())
+
+		return files
+	}
+
+	Context("NewRecord", func() {
+		It("should keep the webhook signature and redact credentials", func() {
+			record := newRecord()
+
+			Expect(record.Headers.Get("X-Sonar-Webhook-HMAC-SHA256")).To(HaveLen(64))
+			Expect(record.Headers.Get("Authorization")).To(Equal(redacted))
+			Expect(record.Path).To(Equal("/webhook/event"))
+		})
+	})
+
+	Context("files format", func() {
+		It("should write each record to its own file", func() {
+			archiver, err := New(logger, options)
+			Expect(err).ToNot(HaveOccurred())
+
+			first, second := newRecord(), newRecord()
+			Expect(archiver.Archive(first)).To(Succeed())
+			Expect(archiver.Archive(second)).To(Succeed())
+
+			files := archivedFiles()
+			Expect(files).To(HaveLen(2))
+
+			contents, err := ioutil.ReadFile(files[0])
+			Expect(err).ToNot(HaveOccurred())
+
+			actual := &Record{}
+			Expect(json.Unmarshal(contents, actual)).To(Succeed())
+			Expect(actual.Body).To(Equal(first.Body))
+		})
+	})
+
+	Context("jsonl.gz format", func() {
+		BeforeEach(func() {
+			options.Format = FORMAT_JSONL_GZIP
+		})
+
+		It("should append records to a compressed file", func() {
+			archiver, err := New(logger, options)
+			Expect(err).ToNot(HaveOccurred())
+
+			records := []*Record{newRecord(), newRecord(), newRecord()}
+			for _, r := range records {
+				Expect(archiver.Archive(r)).To(Succeed())
+			}
+			Expect(archiver.Close()).To(Succeed())
+
+			files := archivedFiles()
+			Expect(files).To(HaveLen(1))
+			Expect(files[0]).To(HaveSuffix(".jsonl.gz"))
+
+			file, err := os.Open(files[0])
+			Expect(err).ToNot(HaveOccurred())
+			defer file.Close()
+
+			gz, err := gzip.NewReader(file)
+			Expect(err).ToNot(HaveOccurred())
+
+			scanner := bufio.NewScanner(gz)
+			var bodies []string
+			for scanner.Scan() {
+				actual := &Record{}
+				Expect(json.Unmarshal(scanner.Bytes(), actual)).To(Succeed())
+				bodies = append(bodies, actual.Body)
+			}
+
+			Expect(bodies).To(Equal([]string{records[0].Body, records[1].Body, records[2].Body}))
+		})
+
+		It("should rotate files once they reach the maximum size", func() {
+			options.MaxFileBytes = 1
+			archiver, err := New(logger, options)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(archiver.Archive(newRecord())).To(Succeed())
+			time.Sleep(time.Millisecond)
+			Expect(archiver.Archive(newRecord())).To(Succeed())
+
+			Expect(archivedFiles()).To(HaveLen(2))
+		})
+
+		It("should enforce retention when a file rotates", func() {
+			options.MaxFileBytes = 1
+			options.MaxTotalBytes = 1
+			archiver, err := New(logger, options)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(archiver.Archive(newRecord())).To(Succeed())
+
+			Expect(archivedFiles()).To(BeEmpty())
+		})
+
+		It("should not remove the file that's being written to", func() {
+			options.MaxTotalBytes = 1
+			archiver, err := New(logger, options)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(archiver.Archive(newRecord())).To(Succeed())
+			pruned(archiver)
+
+			Expect(archivedFiles()).To(HaveLen(1))
+			Expect(archiver.Close()).To(Succeed())
+		})
+	})
+
+	Context("retention", func() {
+		It("should remove files older than the maximum age", func() {
+			stale := filepath.Join(dir, filePrefix+"stale.json")
+			Expect(ioutil.WriteFile(stale, []byte("{}"), 0644)).To(Succeed())
+			old := time.Now().Add(-2 * time.Hour)
+			Expect(os.Chtimes(stale, old, old)).To(Succeed())
+
+			options.MaxAge = time.Hour
+			archiver, err := New(logger, options)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(archiver.Archive(newRecord())).To(Succeed())
+			Expect(archivedFiles()).To(HaveLen(2))
+
+			pruned(archiver)
+
+			files := archivedFiles()
+			Expect(files).To(HaveLen(1))
+			Expect(files[0]).ToNot(Equal(stale))
+		})
+
+		It("should remove the oldest files when the archive is too large", func() {
+			options.MaxTotalBytes = 1
+			archiver, err := New(logger, options)
+			Expect(err).ToNot(HaveOccurred())
+
+			for i := 0; i < 3; i++ {
+				Expect(archiver.Archive(newRecord())).To(Succeed())
+			}
+			pruned(archiver)
+
+			Expect(archivedFiles()).To(BeEmpty())
+		})
+
+		It("should ignore files that weren't written by the archiver", func() {
+			other := filepath.Join(dir, "other.json")
+			Expect(ioutil.WriteFile(other, []byte("{}"), 0644)).To(Succeed())
+
+			options.MaxTotalBytes = 1
+			archiver, err := New(logger, options)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(archiver.Archive(newRecord())).To(Succeed())
+			pruned(archiver)
+
+			Expect(other).To(BeAnExistingFile())
+		})
+	})
+
+	Context("Handler", func() {
+		var (
+			body     string
+			received string
+			record   *Record
+		)
+
+		serve := func(maxBodyBytes int64) *httptest.ResponseRecorder {
+			archiver, err := New(logger, options)
+			Expect(err).ToNot(HaveOccurred())
+
+			handler := Handler(logger, archiver, maxBodyBytes, func(w http.ResponseWriter, r *http.Request) {
+				b, err := ioutil.ReadAll(r.Body)
+				Expect(err).ToNot(HaveOccurred())
+				received = string(b)
+				w.WriteHeader(http.StatusOK)
+			})
+
+			recorder := httptest.NewRecorder()
+			handler(recorder, httptest.NewRequest(http.MethodPost, "/webhook/event", strings.NewReader(body)))
+
+			files := archivedFiles()
+			Expect(files).To(HaveLen(1))
+			contents, err := ioutil.ReadFile(files[0])
+			Expect(err).ToNot(HaveOccurred())
+			record = &Record{}
+			Expect(json.Unmarshal(contents, record)).To(Succeed())
+
+			return recorder
+		}
+
+		BeforeEach(func() {
+			body = `{"taskId":"` + fake.LetterN(10) + `"}`
+		})
+
+		It("should archive the body and pass it to the next handler", func() {
+			recorder := serve(1024)
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(received).To(Equal(body))
+			Expect(record.Body).To(Equal(body))
+			Expect(record.Truncated).To(BeFalse())
+		})
+
+		It("should truncate large bodies, and still pass the whole body to the next handler", func() {
+			serve(5)
+
+			Expect(received).To(Equal(body))
+			Expect(record.Body).To(Equal(body[:5]))
+			Expect(record.Truncated).To(BeTrue())
+		})
+	})
+
+	It("should reject unknown formats", func() {
+		options.Format = "zip"
+
+		_, err := New(logger, options)
+		Expect(err).To(HaveOccurred())
+	})
+})
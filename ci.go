@@ -0,0 +1,101 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/rode/collector-sonarqube/ci"
+	"github.com/rode/collector-sonarqube/config"
+	"github.com/rode/collector-sonarqube/listener"
+	"github.com/rode/collector-sonarqube/sonar"
+	"go.uber.org/zap"
+)
+
+// ciCommand waits for the analysis submitted by the scanner, records it in Rode and prints a summary, so that a pipeline
+// can fail on the quality gate in a single step. It returns the exit code for the process.
+func ciCommand(name string, args []string) int {
+	conf, err := config.BuildCI(name, args)
+	if err != nil {
+		log.Printf("error parsing flags: %v", err)
+		return 2
+	}
+
+	logger, err := createLogger(conf.Debug)
+	if err != nil {
+		log.Printf("failed to create logger: %v", err)
+		return 1
+	}
+
+	file, err := os.Open(conf.ReportTaskFile)
+	if err != nil {
+		logger.Error("could not open report task", zap.Error(err))
+		return 1
+	}
+	defer file.Close()
+
+	reportTask, err := sonar.ParseReportTask(file)
+	if err != nil {
+		logger.Error("could not read report task", zap.Error(err))
+		return 1
+	}
+
+	// the scanner records the instance it submitted the analysis to
+	if conf.SonarConfig.Url == "" {
+		conf.SonarConfig.Url = reportTask.ServerUrl
+	}
+	if conf.SonarConfig.Url == "" {
+		logger.Error("the report task doesn't include the server url, please set --sonar-url")
+		return 1
+	}
+
+	// dry run requests are written to stderr so that the summary can still be read
+	rodeClient, err := createRodeClient(conf.ClientConfig, conf.DryRun, os.Stderr, logger)
+	if err != nil {
+		logger.Error("could not create rode client", zap.Error(err))
+		return 1
+	}
+
+	l, sonarClient, err := buildPipeline(conf.PipelineConfig, conf.SonarConfig, logger, rodeClient)
+	if err != nil {
+		logger.Error("could not create pipeline", zap.Error(err))
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.Timeout)
+	defer cancel()
+
+	report := ci.Run(ctx, l, sonarClient, reportTask, &ci.Options{
+		PollInterval: conf.PollInterval,
+		ProcessOptions: &listener.ProcessOptions{
+			Source:            listener.SOURCE_CI,
+			ResourceUri:       conf.ResourceUri,
+			ResourceUriPrefix: conf.ResourceUriPrefix,
+		},
+	})
+
+	if err := ci.WriteSummary(os.Stdout, report); err != nil {
+		logger.Error("error writing summary", zap.Error(err))
+		return 1
+	}
+
+	if len(report.Problems()) > 0 {
+		return 1
+	}
+
+	return 0
+}
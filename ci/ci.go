@@ -0,0 +1,145 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ci
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rode/collector-sonarqube/listener"
+	"github.com/rode/collector-sonarqube/sonar"
+)
+
+// Report is the outcome of waiting for an analysis and recording it.
+type Report struct {
+	ReportTask *sonar.ReportTask
+	Event      *sonar.Event
+	Result     *listener.Result
+	Error      string
+}
+
+// Problems lists the reasons that a pipeline should fail: the analysis failed, its quality gate failed, or it couldn't
+// be recorded. A report without problems passed. Events that couldn't be recorded always come with an error.
+func (r *Report) Problems() []string {
+	var problems []string
+	if r.Error != "" {
+		problems = append(problems, r.Error)
+	}
+
+	if r.Event != nil {
+		switch r.Event.Status {
+		case sonar.STATUS_SUCCESS:
+		case sonar.STATUS_CANCELED:
+			problems = append(problems, "the analysis was canceled")
+		default:
+			problems = append(problems, "the analysis failed")
+		}
+
+		if r.Event.HasQualityGate() && r.Event.QualityGate.Status == sonar.STATUS_ERROR {
+			problems = append(problems, "the quality gate failed")
+		}
+	}
+
+	return problems
+}
+
+// Options control how long the analysis is waited on, and how it's processed.
+type Options struct {
+	PollInterval   time.Duration
+	ProcessOptions *listener.ProcessOptions
+}
+
+// Run waits for the analysis submitted by the scanner, then records it.
+func Run(ctx context.Context, l listener.Listener, sonarClient sonar.Client, reportTask *sonar.ReportTask, options *Options) *Report {
+	report := &Report{ReportTask: reportTask}
+
+	event, result, err := listener.ProcessReportTask(ctx, l, sonarClient, reportTask, options.PollInterval, options.ProcessOptions)
+	report.Event = event
+	report.Result = result
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	return report
+}
+
+// WriteSummary writes a human-readable summary of the analysis, with the conditions that caused the quality gate to fail
+// or warn.
+func WriteSummary(out io.Writer, report *Report) error {
+	w := &summaryWriter{out: out}
+
+	w.printf("project:       %s\n", report.ReportTask.ProjectKey)
+	if report.Event == nil {
+		w.printf("task:          %s\n", report.ReportTask.CeTaskId)
+	} else {
+		event := report.Event
+		w.printf("task:          %s (%s)\n", event.TaskId, event.Status)
+
+		switch {
+		case event.HasQualityGate() && event.QualityGate.Name != "":
+			w.printf("quality gate:  %s (%s)\n", event.QualityGate.Name, event.QualityGate.Status)
+		case event.HasQualityGate():
+			w.printf("quality gate:  %s\n", event.QualityGate.Status)
+		default:
+			w.printf("quality gate:  none\n")
+		}
+
+		if event.HasQualityGate() {
+			for _, condition := range event.QualityGate.ConditionsWithStatus(sonar.CONDITION_STATUS_ERROR) {
+				w.printf("  failed:      %s\n", condition.Describe())
+			}
+			for _, condition := range event.QualityGate.ConditionsWithStatus(sonar.CONDITION_STATUS_WARN) {
+				w.printf("  warning:     %s\n", condition.Describe())
+			}
+		}
+
+		if dashboard := event.DashboardURL(); dashboard != "" {
+			w.printf("dashboard:     %s\n", dashboard)
+		}
+	}
+
+	if report.Result != nil {
+		if report.Result.ResourceUri != "" {
+			w.printf("resource:      %s\n", report.Result.ResourceUri)
+		}
+		w.printf("rode:          %s\n", report.Result.Outcome)
+	}
+
+	problems := report.Problems()
+	if len(problems) == 0 {
+		w.printf("\nPASSED\n")
+	} else {
+		w.printf("\nFAILED\n")
+		for _, problem := range problems {
+			w.printf("  - %s\n", problem)
+		}
+	}
+
+	return w.err
+}
+
+// summaryWriter keeps the first error, so that each line doesn't need to be checked.
+type summaryWriter struct {
+	out io.Writer
+	err error
+}
+
+func (w *summaryWriter) printf(format string, args ...interface{}) {
+	if w.err == nil {
+		_, w.err = fmt.Fprintf(w.out, format, args...)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ci
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/collector-sonarqube/listener"
+	"github.com/rode/collector-sonarqube/sonar"
+	"net/http"
+	"time"
+)
+
+type fakeSonarClient struct {
+	sonar.Client
+
+	task *sonar.Task
+	gate *sonar.QualityGate
+}
+
+func (f *fakeSonarClient) GetTask(context.Context, string) (*sonar.Task, error) {
+	return f.task, nil
+}
+
+func (f *fakeSonarClient) GetScannerContext(context.Context, string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (f *fakeSonarClient) GetAnalysis(context.Context, *sonar.Task) (*sonar.ProjectAnalysis, error) {
+	return &sonar.ProjectAnalysis{Revision: "abc123"}, nil
+}
+
+func (f *fakeSonarClient) GetQualityGate(context.Context, string, string) (*sonar.QualityGate, error) {
+	return f.gate, nil
+}
+
+type fakeListener struct {
+	listener.Listener
+
+	options *listener.ProcessOptions
+	err     error
+}
+
+func (f *fakeListener) ProcessEvent(http.ResponseWriter, *http.Request) {}
+
+func (f *fakeListener) Process(_ context.Context, event *sonar.Event, options *listener.ProcessOptions) (*listener.Result, error) {
+	f.options = options
+	if f.err != nil {
+		return &listener.Result{TaskId: event.TaskId, Outcome: listener.OUTCOME_FAILED, Reason: f.err.Error()}, f.err
+	}
+
+	return &listener.Result{TaskId: event.TaskId, Outcome: listener.OUTCOME_RECORDED, ResourceUri: "git://github.com/rode/collector-sonarqube@abc123"}, nil
+}
+
+var _ = Describe("CI", func() {
+	var (
+		client     *fakeSonarClient
+		l          *fakeListener
+		reportTask *sonar.ReportTask
+		options    *Options
+		report     *Report
+		summary    string
+	)
+
+	BeforeEach(func() {
+		client = &fakeSonarClient{
+			task: &sonar.Task{Id: "AXmu", ComponentKey: "my-project", Status: sonar.STATUS_SUCCESS, AnalysisId: "AXmv"},
+			gate: &sonar.QualityGate{Name: "Sonar way", Status: sonar.STATUS_OK},
+		}
+		l = &fakeListener{}
+		reportTask = &sonar.ReportTask{ProjectKey: "my-project", ServerUrl: "https://sonar.example.com", CeTaskId: "AXmu"}
+		options = &Options{
+			PollInterval:   time.Millisecond,
+			ProcessOptions: &listener.ProcessOptions{ResourceUriPrefix: "github.com/rode/collector-sonarqube"},
+		}
+	})
+
+	JustBeforeEach(func() {
+		report = Run(context.Background(), l, client, reportTask, options)
+
+		out := &bytes.Buffer{}
+		Expect(WriteSummary(out, report)).To(Succeed())
+		summary = out.String()
+	})
+
+	It("should pass when the analysis was recorded and the quality gate passed", func() {
+		Expect(report.Problems()).To(BeEmpty())
+		Expect(l.options).To(Equal(options.ProcessOptions))
+		Expect(summary).To(Equal(`project:       my-project
+task:          AXmu (SUCCESS)
+quality gate:  Sonar way (OK)
+dashboard:     https://sonar.example.com/dashboard?id=my-project
+resource:      git://github.com/rode/collector-sonarqube@abc123
+rode:          RECORDED
+
+PASSED
+`))
+	})
+
+	When("the quality gate fails", func() {
+		BeforeEach(func() {
+			client.gate.Status = sonar.STATUS_ERROR
+			client.gate.Conditions = []*sonar.Condition{
+				{Metric: "new_coverage", Operator: sonar.OPERATOR_LESS_THAN, ErrorThreshold: "80", Value: "72.5", Status: sonar.CONDITION_STATUS_ERROR},
+				{Metric: "bugs", Operator: sonar.OPERATOR_GREATER_THAN, ErrorThreshold: "0", Value: "0", Status: sonar.CONDITION_STATUS_OK},
+			}
+		})
+
+		It("should fail", func() {
+			Expect(report.Problems()).To(ConsistOf("the quality gate failed"))
+		})
+
+		It("should list the failed conditions", func() {
+			Expect(summary).To(ContainSubstring("  failed:      new_coverage is 72.5% (less than 80%)\n"))
+			Expect(summary).ToNot(ContainSubstring("bugs"))
+			Expect(summary).To(HaveSuffix("\nFAILED\n  - the quality gate failed\n"))
+		})
+	})
+
+	When("the analysis failed", func() {
+		BeforeEach(func() {
+			client.task.Status = sonar.STATUS_FAILED
+		})
+
+		It("should fail", func() {
+			Expect(report.Problems()).To(ConsistOf("the analysis failed"))
+		})
+	})
+
+	When("the analysis can't be recorded", func() {
+		BeforeEach(func() {
+			l.err = errors.New("rode is unavailable")
+		})
+
+		It("should fail", func() {
+			Expect(report.Problems()).To(ConsistOf("rode is unavailable"))
+			Expect(summary).To(ContainSubstring("rode:          FAILED\n"))
+		})
+	})
+
+	When("the task belongs to another project", func() {
+		BeforeEach(func() {
+			reportTask.ProjectKey = "other-project"
+		})
+
+		It("should fail without processing the analysis", func() {
+			Expect(report.Problems()).To(HaveLen(1))
+			Expect(l.options).To(BeNil())
+			Expect(summary).To(HavePrefix("project:       other-project\ntask:          AXmu\n"))
+		})
+	})
+})
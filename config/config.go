@@ -15,15 +15,72 @@
 package config
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/peterbourgon/ff/v3"
+	"github.com/rode/collector-sonarqube/sonar"
 	"github.com/rode/rode/common"
+	"strings"
+	"time"
 )
 
 type Config struct {
-	Port         int
-	Debug        bool
-	ClientConfig *common.ClientConfig
+	Port            int
+	Debug           bool
+	DryRun          bool
+	MaxRequestBytes int64
+	// ReportTaskTimeout limits how long a report task submitted by a CI pipeline is waited on
+	ReportTaskTimeout time.Duration
+	// ReportTaskMaxConcurrent limits how many report tasks are waited on at once
+	ReportTaskMaxConcurrent int
+	// ReportTaskToken must be sent by CI pipelines that submit report tasks, when it's set
+	ReportTaskToken string
+	ClientConfig    *common.ClientConfig
+	SonarConfig     *SonarConfig
+	SinkConfig      *SinkConfig
+	ArchiveConfig   *ArchiveConfig
+	PollConfig      *PollConfig
+	ReconcileConfig *ReconcileConfig
+	StateConfig     *StateConfig
+	AdminConfig     *AdminConfig
+	*PipelineConfig
+}
+
+// SonarConfig configures access to the SonarQube web API, which is used to fill in details missing from events, and
+// which of the scanner properties in each event are recorded.
+type SonarConfig struct {
+	Url               string
+	Token             string
+	Flavor            string
+	Organization      string
+	PropertyAllowlist []string
+}
+
+// SinkConfig configures the destinations that analyses are sent to in addition to Rode.
+type SinkConfig struct {
+	FilePath       string
+	HttpUrl        string
+	HttpTimeout    time.Duration
+	CloudEventsUrl string
+	// RequiredSinks are the sinks that an analysis must be sent to for it to be considered recorded
+	RequiredSinks []string
+	// RodeInstances are the hosts of additional Rode instances keyed by name, which are sinks named "rode-<name>"
+	RodeInstances map[string]string
+}
+
+// PipelineConfig configures how each analysis is processed before it's recorded, which is shared by the listener and
+// the subcommands.
+type PipelineConfig struct {
+	// LinkBuildProjects are the project keys whose analyses are also recorded against artifacts built from the same commit
+	LinkBuildProjects   []string
+	ResourceMappingFile string
+	// FilterRulesFile lists the rules that decide which projects and branches are recorded
+	FilterRulesFile string
+	// RoutingRulesFile lists the rules that drop, label and route analyses, and override their resource uri
+	RoutingRulesFile string
+	// NoteTemplatesFile customizes the text of the notes recorded in Rode
+	NoteTemplatesFile string
 }
 
 type RodeConfig struct {
@@ -35,16 +92,397 @@ func Build(name string, args []string) (*Config, error) {
 	flags := flag.NewFlagSet(name, flag.ContinueOnError)
 
 	c := &Config{
-		ClientConfig: common.SetupRodeClientFlags(flags),
+		ClientConfig:    common.SetupRodeClientFlags(flags),
+		SonarConfig:     setupSonarFlags(flags),
+		SinkConfig:      &SinkConfig{},
+		ArchiveConfig:   &ArchiveConfig{},
+		PollConfig:      &PollConfig{},
+		ReconcileConfig: &ReconcileConfig{},
+		StateConfig:     &StateConfig{},
+		AdminConfig:     &AdminConfig{},
+		PipelineConfig:  setupPipelineFlags(flags),
 	}
 
 	flags.IntVar(&c.Port, "port", 8080, "the port that the sonarqube collector should listen on")
 	flags.BoolVar(&c.Debug, "debug", false, "when set, debug mode will be enabled")
+	flags.BoolVar(&c.DryRun, "dry-run", false, "when set, requests to Rode will be printed as JSON instead of being sent")
+	flags.Int64Var(&c.MaxRequestBytes, "max-request-bytes", 1024*1024, "webhook requests with a larger body will be rejected")
+	flags.DurationVar(&c.ReportTaskTimeout, "report-task-timeout", 10*time.Minute, "how long to wait for the analysis of a report task submitted by a CI pipeline")
+	flags.IntVar(&c.ReportTaskMaxConcurrent, "report-task-max-concurrent", 10, "how many report tasks are waited on at once, before further submissions are rejected")
+	flags.StringVar(&c.ReportTaskToken, "report-task-token", "", "when set, report tasks must be submitted with this bearer token")
+
+	flags.StringVar(&c.SinkConfig.FilePath, "file-sink-path", "", "when set, analyses will also be appended to this file as JSON lines")
+	flags.StringVar(&c.SinkConfig.HttpUrl, "http-sink-url", "", "when set, analyses will also be POSTed to this URL as JSON")
+	flags.DurationVar(&c.SinkConfig.HttpTimeout, "http-sink-timeout", 10*time.Second, "the timeout for requests made by the HTTP and CloudEvents sinks")
+	flags.StringVar(&c.SinkConfig.CloudEventsUrl, "cloudevents-sink-url", "", "when set, analyses will also be POSTed to this URL as structured CloudEvents")
+	flags.Func("rode-instances", "a comma-separated list of name=host pairs of additional Rode instances, which routing rules can select as rode-<name>", func(value string) error {
+		return parseRodeInstances(c.SinkConfig, value)
+	})
+	listVar(flags, &c.SinkConfig.RequiredSinks, "required-sinks", "a comma-separated list of the sinks that must succeed for an event to be recorded; failures in other sinks are only logged (default rode)")
+
+	flags.StringVar(&c.ArchiveConfig.Directory, "archive-dir", "", "when set, raw webhook requests will be archived to this directory")
+	flags.StringVar(&c.ArchiveConfig.Format, "archive-format", "files", "how webhook requests are archived, either files (one JSON file per request) or jsonl.gz")
+	flags.DurationVar(&c.ArchiveConfig.MaxAge, "archive-max-age", 7*24*time.Hour, "archived requests older than this will be removed, 0 to keep forever")
+	flags.Int64Var(&c.ArchiveConfig.MaxSizeMB, "archive-max-size-mb", 1024, "the oldest archived requests will be removed when the archive exceeds this size, 0 for no limit")
+	flags.Int64Var(&c.ArchiveConfig.MaxFileSizeMB, "archive-max-file-size-mb", 64, "the size at which a jsonl.gz archive file is rotated")
+
+	flags.DurationVar(&c.PollConfig.Interval, "poll-interval", 0, "when set, the compute engine activity of the SonarQube instance is polled this often, for instances that can't send webhooks")
+	listVar(flags, &c.PollConfig.Projects, "poll-projects", "a comma-separated list of project keys to poll, with an optional trailing * to match a prefix")
+	flags.StringVar(&c.PollConfig.CheckpointFile, "poll-checkpoint-file", "", "when set, polling progress is saved to this file so that it can resume after a restart")
+
+	flags.DurationVar(&c.ReconcileConfig.Interval, "reconcile-interval", 0, "when set, recent analyses are checked against Rode this often, to find those whose events were lost")
+	flags.DurationVar(&c.ReconcileConfig.Window, "reconcile-window", 24*time.Hour, "how far back analyses are checked against Rode")
+	listVar(flags, &c.ReconcileConfig.Projects, "reconcile-projects", "a comma-separated list of project keys to reconcile, with an optional trailing * to match a prefix")
+	flags.BoolVar(&c.ReconcileConfig.Reingest, "reconcile-reingest", false, "when set, analyses missing from Rode are recorded, rather than only reported")
+
+	flags.StringVar(&c.StateConfig.File, "state-file", "", "when set, the outcome of processing each event is kept in this file")
+	flags.DurationVar(&c.StateConfig.MaxAge, "state-max-age", 30*24*time.Hour, "how long the outcome of processing an event is kept, or 0 to keep it indefinitely")
+	flags.IntVar(&c.StateConfig.MaxRecords, "state-max-records", 10000, "the maximum number of events kept, or 0 for no limit")
+
+	flags.IntVar(&c.AdminConfig.Port, "admin-port", 0, "when set, the admin api is served on this port")
+	flags.StringVar(&c.AdminConfig.Token, "admin-token", "", "the bearer token required by the admin api")
+
+	err := ff.Parse(flags, args, ff.WithEnvVarNoPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateSonarConfig(c.SonarConfig); err != nil {
+		return nil, err
+	}
+
+	if err := validateSinkConfig(c.SinkConfig); err != nil {
+		return nil, err
+	}
+
+	if c.ReconcileConfig.Interval < 0 || c.ReconcileConfig.Window <= 0 {
+		return nil, errors.New("the reconcile interval must not be negative, and the window must be positive")
+	}
+
+	if c.ReconcileConfig.Interval > 0 && c.SonarConfig.Url == "" {
+		return nil, errors.New("a sonar url is required for reconciliation")
+	}
+
+	if c.PollConfig.Interval < 0 {
+		return nil, errors.New("the poll interval must not be negative")
+	}
+
+	if c.PollConfig.Interval > 0 && c.SonarConfig.Url == "" {
+		return nil, errors.New("a sonar url is required for polling")
+	}
+
+	if c.ReportTaskMaxConcurrent <= 0 {
+		return nil, errors.New("the report task max concurrent must be positive")
+	}
+
+	if c.StateConfig.MaxAge < 0 || c.StateConfig.MaxRecords < 0 {
+		return nil, errors.New("the state max age and max records must not be negative")
+	}
+
+	if c.AdminConfig.Port != 0 {
+		if c.AdminConfig.Token == "" || c.StateConfig.File == "" {
+			return nil, errors.New("the admin api requires a token and a state file")
+		}
+
+		if c.AdminConfig.Port == c.Port {
+			return nil, errors.New("the admin api must use a different port to the webhook listener")
+		}
+	}
+
+	if c.ArchiveConfig.Format != "files" && c.ArchiveConfig.Format != "jsonl.gz" {
+		return nil, fmt.Errorf("unsupported archive format %q", c.ArchiveConfig.Format)
+	}
+
+	return c, nil
+}
+
+// ArchiveConfig configures archiving of raw webhook requests. Archiving is disabled unless a directory is set.
+type ArchiveConfig struct {
+	Directory     string
+	Format        string
+	MaxAge        time.Duration
+	MaxSizeMB     int64
+	MaxFileSizeMB int64
+}
+
+// PollConfig configures polling of compute engine activity, which is disabled unless an interval is set.
+type PollConfig struct {
+	Interval       time.Duration
+	Projects       []string
+	CheckpointFile string
+}
+
+// ReconcileConfig configures the periodic comparison of recent analyses with Rode, which is disabled unless an interval
+// is set.
+type ReconcileConfig struct {
+	Interval time.Duration
+	Window   time.Duration
+	Projects []string
+	Reingest bool
+}
+
+// StateConfig configures the store of event processing history, which is disabled unless a file is set.
+type StateConfig struct {
+	File       string
+	MaxAge     time.Duration
+	MaxRecords int
+}
+
+// AdminConfig configures the admin api, which is disabled unless a port is set.
+type AdminConfig struct {
+	Port  int
+	Token string
+}
+
+// ReconcileCommandConfig configures the reconcile subcommand, which compares recent analyses with Rode once.
+type ReconcileCommandConfig struct {
+	Debug        bool
+	DryRun       bool
+	Output       string
+	Window       time.Duration
+	Projects     []string
+	Reingest     bool
+	ClientConfig *common.ClientConfig
+	SonarConfig  *SonarConfig
+	*PipelineConfig
+}
+
+func BuildReconcile(name string, args []string) (*ReconcileCommandConfig, error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+
+	c := &ReconcileCommandConfig{
+		ClientConfig:   common.SetupRodeClientFlags(flags),
+		SonarConfig:    setupSonarFlags(flags),
+		PipelineConfig: setupPipelineFlags(flags),
+	}
+
+	flags.BoolVar(&c.Debug, "debug", false, "when set, debug mode will be enabled")
+	flags.BoolVar(&c.DryRun, "dry-run", false, "when set, requests to Rode will be printed as JSON instead of being sent")
+	flags.StringVar(&c.Output, "output", "table", "the format of the results, either table or json")
+	flags.DurationVar(&c.Window, "window", 24*time.Hour, "how far back analyses are checked against Rode")
+	listVar(flags, &c.Projects, "projects", "a comma-separated list of project keys to reconcile, with an optional trailing * to match a prefix")
+	flags.BoolVar(&c.Reingest, "reingest", false, "when set, analyses missing from Rode are recorded, rather than only reported")
 
 	err := ff.Parse(flags, args, ff.WithEnvVarNoPrefix())
 	if err != nil {
 		return nil, err
 	}
 
+	if err := validateSonarConfig(c.SonarConfig); err != nil {
+		return nil, err
+	}
+
+	if c.SonarConfig.Url == "" {
+		return nil, errors.New("a sonar url is required for reconciliation")
+	}
+
+	if c.Window <= 0 {
+		return nil, errors.New("the window must be positive")
+	}
+
+	if c.Output != "table" && c.Output != "json" {
+		return nil, fmt.Errorf("unsupported output format %q", c.Output)
+	}
+
 	return c, nil
 }
+
+// ReplayConfig configures the replay subcommand, which processes recorded webhook payloads.
+type ReplayConfig struct {
+	Debug             bool
+	DryRun            bool
+	ResourceUriPrefix string
+	Output            string
+	Files             []string
+	ClientConfig      *common.ClientConfig
+	SonarConfig       *SonarConfig
+	*PipelineConfig
+}
+
+func BuildReplay(name string, args []string) (*ReplayConfig, error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+
+	c := &ReplayConfig{
+		ClientConfig:   common.SetupRodeClientFlags(flags),
+		SonarConfig:    setupSonarFlags(flags),
+		PipelineConfig: setupPipelineFlags(flags),
+	}
+
+	flags.BoolVar(&c.Debug, "debug", false, "when set, debug mode will be enabled")
+	flags.BoolVar(&c.DryRun, "dry-run", false, "when set, requests to Rode will be printed as JSON instead of being sent")
+	flags.StringVar(&c.ResourceUriPrefix, "resource-uri-prefix", "", "when set, overrides the resource uri prefix property of each event")
+	flags.StringVar(&c.Output, "output", "table", "the format of the results, either table or json")
+
+	err := ff.Parse(flags, args, ff.WithEnvVarNoPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateSonarConfig(c.SonarConfig); err != nil {
+		return nil, err
+	}
+
+	if c.Output != "table" && c.Output != "json" {
+		return nil, fmt.Errorf("unsupported output format %q", c.Output)
+	}
+
+	c.Files = flags.Args()
+	if len(c.Files) == 0 {
+		return nil, errors.New("at least one file to replay must be specified")
+	}
+
+	return c, nil
+}
+
+// CIConfig configures the ci subcommand, which waits for an analysis submitted by the scanner and records it.
+type CIConfig struct {
+	Debug             bool
+	DryRun            bool
+	ReportTaskFile    string
+	ResourceUri       string
+	ResourceUriPrefix string
+	Timeout           time.Duration
+	PollInterval      time.Duration
+	ClientConfig      *common.ClientConfig
+	SonarConfig       *SonarConfig
+	*PipelineConfig
+}
+
+func BuildCI(name string, args []string) (*CIConfig, error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+
+	c := &CIConfig{
+		ClientConfig:   common.SetupRodeClientFlags(flags),
+		SonarConfig:    setupSonarFlags(flags),
+		PipelineConfig: setupPipelineFlags(flags),
+	}
+
+	flags.BoolVar(&c.Debug, "debug", false, "when set, debug mode will be enabled")
+	flags.BoolVar(&c.DryRun, "dry-run", false, "when set, requests to Rode will be printed as JSON instead of being sent")
+	flags.StringVar(&c.ReportTaskFile, "report-task-file", ".scannerwork/report-task.txt", "the report task file written by the scanner")
+	flags.StringVar(&c.ResourceUri, "resource-uri", "", "when set, the analysis is recorded against this resource uri")
+	flags.StringVar(&c.ResourceUriPrefix, "resource-uri-prefix", "", "when set, overrides the resource uri prefix property of the analysis")
+	flags.DurationVar(&c.Timeout, "timeout", 10*time.Minute, "how long to wait for the analysis to finish and be recorded")
+	flags.DurationVar(&c.PollInterval, "poll-interval", 5*time.Second, "how often to check whether the analysis has finished")
+
+	err := ff.Parse(flags, args, ff.WithEnvVarNoPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateSonarConfig(c.SonarConfig); err != nil {
+		return nil, err
+	}
+
+	if c.Timeout <= 0 || c.PollInterval <= 0 {
+		return nil, errors.New("the timeout and poll interval must be positive")
+	}
+
+	return c, nil
+}
+
+func setupSonarFlags(flags *flag.FlagSet) *SonarConfig {
+	c := &SonarConfig{}
+
+	flags.StringVar(&c.Url, "sonar-url", "", "the base URL of the SonarQube instance, used to look up details missing from events")
+	flags.StringVar(&c.Token, "sonar-token", "", "a token used to authenticate with the SonarQube web API")
+	flags.StringVar(&c.Flavor, "sonar-flavor", "sonarqube", "the kind of instance that sends events, either sonarqube or sonarcloud")
+	flags.StringVar(&c.Organization, "sonar-organization", "", "the SonarCloud organization that projects belong to")
+	listVar(flags, &c.PropertyAllowlist, "sonar-property-allowlist", "a comma-separated list of scanner properties to record, with an optional trailing * to match a prefix")
+
+	return c
+}
+
+func setupPipelineFlags(flags *flag.FlagSet) *PipelineConfig {
+	c := &PipelineConfig{}
+
+	listVar(flags, &c.LinkBuildProjects, "link-build-projects", "a comma-separated list of project keys whose analyses are also recorded against artifacts built from the same commit, with an optional trailing * to match a prefix")
+	flags.StringVar(&c.ResourceMappingFile, "resource-mapping-file", "", "a JSON file listing other resources that each project's analyses are recorded against")
+	flags.StringVar(&c.FilterRulesFile, "filter-rules-file", "", "a JSON file of include and exclude rules that decide which projects and branches are recorded")
+	flags.StringVar(&c.RoutingRulesFile, "routing-rules-file", "", "a JSON file of CEL rules that drop events, override the resource uri, add labels and select sinks")
+	flags.StringVar(&c.NoteTemplatesFile, "note-templates-file", "", "a JSON file of Go templates for the descriptions, related url labels and ids of the notes recorded in Rode, and the remediation and status messages of their occurrences")
+
+	return c
+}
+
+// listVar defines a flag that accepts a comma-separated list. Blank entries are ignored.
+func listVar(flags *flag.FlagSet, target *[]string, name, usage string) {
+	flags.Func(name, usage, func(value string) error {
+		for _, entry := range strings.Split(value, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				*target = append(*target, entry)
+			}
+		}
+
+		return nil
+	})
+}
+
+// parseRodeInstances adds each name=host pair to the additional Rode instances.
+func parseRodeInstances(c *SinkConfig, value string) error {
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("rode instance %q must be of the form name=host", entry)
+		}
+
+		if c.RodeInstances == nil {
+			c.RodeInstances = map[string]string{}
+		}
+		if _, ok := c.RodeInstances[parts[0]]; ok {
+			return fmt.Errorf("rode instance %q is listed more than once", parts[0])
+		}
+		c.RodeInstances[parts[0]] = parts[1]
+	}
+
+	return nil
+}
+
+// validateSinkConfig defaults the required sinks to Rode, and checks that each of them is configured.
+func validateSinkConfig(c *SinkConfig) error {
+	if len(c.RequiredSinks) == 0 {
+		c.RequiredSinks = []string{"rode"}
+	}
+
+	configured := map[string]bool{
+		"rode":        true,
+		"file":        c.FilePath != "",
+		"http":        c.HttpUrl != "",
+		"cloudevents": c.CloudEventsUrl != "",
+	}
+	for name := range c.RodeInstances {
+		configured["rode-"+name] = true
+	}
+	for _, name := range c.RequiredSinks {
+		if !configured[name] {
+			return fmt.Errorf("required sink %q isn't configured", name)
+		}
+	}
+
+	return nil
+}
+
+// validateSonarConfig checks the flavor, and defaults the url for SonarCloud, which always requires an organization.
+func validateSonarConfig(c *SonarConfig) error {
+	switch sonar.Flavor(c.Flavor) {
+	case sonar.FLAVOR_SONARQUBE:
+		return nil
+	case sonar.FLAVOR_SONARCLOUD:
+	default:
+		return fmt.Errorf("unsupported sonar flavor %q", c.Flavor)
+	}
+
+	if c.Organization == "" {
+		return errors.New("an organization is required when using sonarcloud")
+	}
+
+	if c.Url == "" {
+		c.Url = sonar.SonarCloudUrl
+	}
+
+	return nil
+}
@@ -18,6 +18,7 @@ import (
 	. "github.com/onsi/gomega"
 	"github.com/rode/rode/common"
 	"testing"
+	"time"
 )
 
 func TestConfig(t *testing.T) {
@@ -33,8 +34,11 @@ func TestConfig(t *testing.T) {
 			name:  "defaults",
 			flags: []string{},
 			expected: &Config{
-				Port:  8080,
-				Debug: false,
+				Port:                    8080,
+				MaxRequestBytes:         1024 * 1024,
+				ReportTaskTimeout:       10 * time.Minute,
+				ReportTaskMaxConcurrent: 10,
+				Debug:                   false,
 				ClientConfig: &common.ClientConfig{
 					Rode: &common.RodeClientConfig{
 						Host: "rode:50051",
@@ -42,6 +46,17 @@ func TestConfig(t *testing.T) {
 					OIDCAuth:  &common.OIDCAuthConfig{},
 					BasicAuth: &common.BasicAuthConfig{},
 				},
+				SonarConfig: defaultSonarConfig(),
+				SinkConfig: &SinkConfig{
+					HttpTimeout:   10 * time.Second,
+					RequiredSinks: []string{"rode"},
+				},
+				ArchiveConfig:   defaultArchiveConfig(),
+				PollConfig:      &PollConfig{},
+				ReconcileConfig: defaultReconcileConfig(),
+				StateConfig:     defaultStateConfig(),
+				AdminConfig:     &AdminConfig{},
+				PipelineConfig:  &PipelineConfig{},
 			},
 		},
 		{
@@ -54,12 +69,603 @@ func TestConfig(t *testing.T) {
 			flags:       []string{"--debug=bar"},
 			expectError: true,
 		},
+		{
+			name:  "dry run",
+			flags: []string{"--dry-run"},
+			expected: &Config{
+				Port:                    8080,
+				MaxRequestBytes:         1024 * 1024,
+				ReportTaskTimeout:       10 * time.Minute,
+				ReportTaskMaxConcurrent: 10,
+				DryRun:                  true,
+				ClientConfig: &common.ClientConfig{
+					Rode: &common.RodeClientConfig{
+						Host: "rode:50051",
+					},
+					OIDCAuth:  &common.OIDCAuthConfig{},
+					BasicAuth: &common.BasicAuthConfig{},
+				},
+				SonarConfig: defaultSonarConfig(),
+				SinkConfig: &SinkConfig{
+					HttpTimeout:   10 * time.Second,
+					RequiredSinks: []string{"rode"},
+				},
+				ArchiveConfig:   defaultArchiveConfig(),
+				PollConfig:      &PollConfig{},
+				ReconcileConfig: defaultReconcileConfig(),
+				StateConfig:     defaultStateConfig(),
+				AdminConfig:     &AdminConfig{},
+				PipelineConfig:  &PipelineConfig{},
+			},
+		},
+		{
+			name:  "sonar",
+			flags: []string{"--sonar-url=https://sonar.example.com", "--sonar-token=secret"},
+			expected: &Config{
+				Port:                    8080,
+				MaxRequestBytes:         1024 * 1024,
+				ReportTaskTimeout:       10 * time.Minute,
+				ReportTaskMaxConcurrent: 10,
+				ClientConfig: &common.ClientConfig{
+					Rode: &common.RodeClientConfig{
+						Host: "rode:50051",
+					},
+					OIDCAuth:  &common.OIDCAuthConfig{},
+					BasicAuth: &common.BasicAuthConfig{},
+				},
+				SonarConfig: &SonarConfig{
+					Url:    "https://sonar.example.com",
+					Token:  "secret",
+					Flavor: "sonarqube",
+				},
+				SinkConfig: &SinkConfig{
+					HttpTimeout:   10 * time.Second,
+					RequiredSinks: []string{"rode"},
+				},
+				ArchiveConfig:   defaultArchiveConfig(),
+				PollConfig:      &PollConfig{},
+				ReconcileConfig: defaultReconcileConfig(),
+				StateConfig:     defaultStateConfig(),
+				AdminConfig:     &AdminConfig{},
+				PipelineConfig:  &PipelineConfig{},
+			},
+		},
+		{
+			name:  "sonarcloud",
+			flags: []string{"--sonar-flavor=sonarcloud", "--sonar-organization=rode", "--sonar-token=secret"},
+			expected: &Config{
+				Port:                    8080,
+				MaxRequestBytes:         1024 * 1024,
+				ReportTaskTimeout:       10 * time.Minute,
+				ReportTaskMaxConcurrent: 10,
+				ClientConfig: &common.ClientConfig{
+					Rode: &common.RodeClientConfig{
+						Host: "rode:50051",
+					},
+					OIDCAuth:  &common.OIDCAuthConfig{},
+					BasicAuth: &common.BasicAuthConfig{},
+				},
+				SonarConfig: &SonarConfig{
+					Url:          "https://sonarcloud.io",
+					Token:        "secret",
+					Flavor:       "sonarcloud",
+					Organization: "rode",
+				},
+				SinkConfig: &SinkConfig{
+					HttpTimeout:   10 * time.Second,
+					RequiredSinks: []string{"rode"},
+				},
+				ArchiveConfig:   defaultArchiveConfig(),
+				PollConfig:      &PollConfig{},
+				ReconcileConfig: defaultReconcileConfig(),
+				StateConfig:     defaultStateConfig(),
+				AdminConfig:     &AdminConfig{},
+				PipelineConfig:  &PipelineConfig{},
+			},
+		},
+		{
+			name:  "sonar property allowlist",
+			flags: []string{"--sonar-property-allowlist=sonar.analysis.*, sonar.projectVersion,"},
+			expected: &Config{
+				Port:                    8080,
+				MaxRequestBytes:         1024 * 1024,
+				ReportTaskTimeout:       10 * time.Minute,
+				ReportTaskMaxConcurrent: 10,
+				ClientConfig: &common.ClientConfig{
+					Rode: &common.RodeClientConfig{
+						Host: "rode:50051",
+					},
+					OIDCAuth:  &common.OIDCAuthConfig{},
+					BasicAuth: &common.BasicAuthConfig{},
+				},
+				SonarConfig: &SonarConfig{
+					Flavor:            "sonarqube",
+					PropertyAllowlist: []string{"sonar.analysis.*", "sonar.projectVersion"},
+				},
+				SinkConfig: &SinkConfig{
+					HttpTimeout:   10 * time.Second,
+					RequiredSinks: []string{"rode"},
+				},
+				ArchiveConfig:   defaultArchiveConfig(),
+				PollConfig:      &PollConfig{},
+				ReconcileConfig: defaultReconcileConfig(),
+				StateConfig:     defaultStateConfig(),
+				AdminConfig:     &AdminConfig{},
+				PipelineConfig:  &PipelineConfig{},
+			},
+		},
+		{
+			name:  "link build projects",
+			flags: []string{"--link-build-projects=rode-*,collector"},
+			expected: &Config{
+				Port:                    8080,
+				MaxRequestBytes:         1024 * 1024,
+				ReportTaskTimeout:       10 * time.Minute,
+				ReportTaskMaxConcurrent: 10,
+				ClientConfig: &common.ClientConfig{
+					Rode: &common.RodeClientConfig{
+						Host: "rode:50051",
+					},
+					OIDCAuth:  &common.OIDCAuthConfig{},
+					BasicAuth: &common.BasicAuthConfig{},
+				},
+				SonarConfig: defaultSonarConfig(),
+				SinkConfig: &SinkConfig{
+					HttpTimeout:   10 * time.Second,
+					RequiredSinks: []string{"rode"},
+				},
+				ArchiveConfig:   defaultArchiveConfig(),
+				PollConfig:      &PollConfig{},
+				ReconcileConfig: defaultReconcileConfig(),
+				StateConfig:     defaultStateConfig(),
+				AdminConfig:     &AdminConfig{},
+				PipelineConfig: &PipelineConfig{
+					LinkBuildProjects: []string{"rode-*", "collector"},
+				},
+			},
+		},
+		{
+			name:  "resource mapping",
+			flags: []string{"--resource-mapping-file=mapping.json"},
+			expected: &Config{
+				Port:                    8080,
+				MaxRequestBytes:         1024 * 1024,
+				ReportTaskTimeout:       10 * time.Minute,
+				ReportTaskMaxConcurrent: 10,
+				ClientConfig: &common.ClientConfig{
+					Rode: &common.RodeClientConfig{
+						Host: "rode:50051",
+					},
+					OIDCAuth:  &common.OIDCAuthConfig{},
+					BasicAuth: &common.BasicAuthConfig{},
+				},
+				SonarConfig: defaultSonarConfig(),
+				SinkConfig: &SinkConfig{
+					HttpTimeout:   10 * time.Second,
+					RequiredSinks: []string{"rode"},
+				},
+				ArchiveConfig:   defaultArchiveConfig(),
+				PollConfig:      &PollConfig{},
+				ReconcileConfig: defaultReconcileConfig(),
+				StateConfig:     defaultStateConfig(),
+				AdminConfig:     &AdminConfig{},
+				PipelineConfig: &PipelineConfig{
+					ResourceMappingFile: "mapping.json",
+				},
+			},
+		},
+		{
+			name:  "filter rules",
+			flags: []string{"--filter-rules-file=filter.json"},
+			expected: &Config{
+				Port:                    8080,
+				MaxRequestBytes:         1024 * 1024,
+				ReportTaskTimeout:       10 * time.Minute,
+				ReportTaskMaxConcurrent: 10,
+				ClientConfig: &common.ClientConfig{
+					Rode: &common.RodeClientConfig{
+						Host: "rode:50051",
+					},
+					OIDCAuth:  &common.OIDCAuthConfig{},
+					BasicAuth: &common.BasicAuthConfig{},
+				},
+				SonarConfig: defaultSonarConfig(),
+				SinkConfig: &SinkConfig{
+					HttpTimeout:   10 * time.Second,
+					RequiredSinks: []string{"rode"},
+				},
+				ArchiveConfig:   defaultArchiveConfig(),
+				PollConfig:      &PollConfig{},
+				ReconcileConfig: defaultReconcileConfig(),
+				StateConfig:     defaultStateConfig(),
+				AdminConfig:     &AdminConfig{},
+				PipelineConfig: &PipelineConfig{
+					FilterRulesFile: "filter.json",
+				},
+			},
+		},
+		{
+			name:  "routing rules",
+			flags: []string{"--routing-rules-file=routing.json"},
+			expected: &Config{
+				Port:                    8080,
+				MaxRequestBytes:         1024 * 1024,
+				ReportTaskTimeout:       10 * time.Minute,
+				ReportTaskMaxConcurrent: 10,
+				ClientConfig: &common.ClientConfig{
+					Rode: &common.RodeClientConfig{
+						Host: "rode:50051",
+					},
+					OIDCAuth:  &common.OIDCAuthConfig{},
+					BasicAuth: &common.BasicAuthConfig{},
+				},
+				SonarConfig: defaultSonarConfig(),
+				SinkConfig: &SinkConfig{
+					HttpTimeout:   10 * time.Second,
+					RequiredSinks: []string{"rode"},
+				},
+				ArchiveConfig:   defaultArchiveConfig(),
+				PollConfig:      &PollConfig{},
+				ReconcileConfig: defaultReconcileConfig(),
+				StateConfig:     defaultStateConfig(),
+				AdminConfig:     &AdminConfig{},
+				PipelineConfig: &PipelineConfig{
+					RoutingRulesFile: "routing.json",
+				},
+			},
+		},
+		{
+			name:  "note templates",
+			flags: []string{"--note-templates-file=notes.json"},
+			expected: &Config{
+				Port:                    8080,
+				MaxRequestBytes:         1024 * 1024,
+				ReportTaskTimeout:       10 * time.Minute,
+				ReportTaskMaxConcurrent: 10,
+				ClientConfig: &common.ClientConfig{
+					Rode: &common.RodeClientConfig{
+						Host: "rode:50051",
+					},
+					OIDCAuth:  &common.OIDCAuthConfig{},
+					BasicAuth: &common.BasicAuthConfig{},
+				},
+				SonarConfig: defaultSonarConfig(),
+				SinkConfig: &SinkConfig{
+					HttpTimeout:   10 * time.Second,
+					RequiredSinks: []string{"rode"},
+				},
+				ArchiveConfig:   defaultArchiveConfig(),
+				PollConfig:      &PollConfig{},
+				ReconcileConfig: defaultReconcileConfig(),
+				StateConfig:     defaultStateConfig(),
+				AdminConfig:     &AdminConfig{},
+				PipelineConfig: &PipelineConfig{
+					NoteTemplatesFile: "notes.json",
+				},
+			},
+		},
+		{
+			name:        "sonarcloud without an organization",
+			flags:       []string{"--sonar-flavor=sonarcloud"},
+			expectError: true,
+		},
+		{
+			name:        "unknown sonar flavor",
+			flags:       []string{"--sonar-flavor=foo"},
+			expectError: true,
+		},
+		{
+			name:  "sinks",
+			flags: []string{"--file-sink-path=/tmp/analyses.jsonl", "--http-sink-url=http://example.com/analyses", "--http-sink-timeout=1m", "--cloudevents-sink-url=http://example.com/events", "--required-sinks=rode,file,rode-staging", "--rode-instances=staging=rode.staging:50051,eu=rode.eu:50051"},
+			expected: &Config{
+				Port:                    8080,
+				MaxRequestBytes:         1024 * 1024,
+				ReportTaskTimeout:       10 * time.Minute,
+				ReportTaskMaxConcurrent: 10,
+				Debug:                   false,
+				ClientConfig: &common.ClientConfig{
+					Rode: &common.RodeClientConfig{
+						Host: "rode:50051",
+					},
+					OIDCAuth:  &common.OIDCAuthConfig{},
+					BasicAuth: &common.BasicAuthConfig{},
+				},
+				SonarConfig: defaultSonarConfig(),
+				SinkConfig: &SinkConfig{
+					FilePath:       "/tmp/analyses.jsonl",
+					HttpUrl:        "http://example.com/analyses",
+					HttpTimeout:    time.Minute,
+					CloudEventsUrl: "http://example.com/events",
+					RequiredSinks:  []string{"rode", "file", "rode-staging"},
+					RodeInstances:  map[string]string{"staging": "rode.staging:50051", "eu": "rode.eu:50051"},
+				},
+				ArchiveConfig:   defaultArchiveConfig(),
+				PollConfig:      &PollConfig{},
+				ReconcileConfig: defaultReconcileConfig(),
+				StateConfig:     defaultStateConfig(),
+				AdminConfig:     &AdminConfig{},
+				PipelineConfig:  &PipelineConfig{},
+			},
+		},
+		{
+			name:        "bad max request bytes",
+			flags:       []string{"--max-request-bytes=foo"},
+			expectError: true,
+		},
+		{
+			name:        "bad http sink timeout",
+			flags:       []string{"--http-sink-timeout=baz"},
+			expectError: true,
+		},
+		{
+			name:  "archive",
+			flags: []string{"--archive-dir=/var/archive", "--archive-format=jsonl.gz", "--archive-max-age=24h", "--archive-max-size-mb=10", "--archive-max-file-size-mb=1"},
+			expected: &Config{
+				Port:                    8080,
+				MaxRequestBytes:         1024 * 1024,
+				ReportTaskTimeout:       10 * time.Minute,
+				ReportTaskMaxConcurrent: 10,
+				ClientConfig: &common.ClientConfig{
+					Rode: &common.RodeClientConfig{
+						Host: "rode:50051",
+					},
+					OIDCAuth:  &common.OIDCAuthConfig{},
+					BasicAuth: &common.BasicAuthConfig{},
+				},
+				SonarConfig: defaultSonarConfig(),
+				SinkConfig: &SinkConfig{
+					HttpTimeout:   10 * time.Second,
+					RequiredSinks: []string{"rode"},
+				},
+				ArchiveConfig: &ArchiveConfig{
+					Directory:     "/var/archive",
+					Format:        "jsonl.gz",
+					MaxAge:        24 * time.Hour,
+					MaxSizeMB:     10,
+					MaxFileSizeMB: 1,
+				},
+				PollConfig:      &PollConfig{},
+				ReconcileConfig: defaultReconcileConfig(),
+				StateConfig:     defaultStateConfig(),
+				AdminConfig:     &AdminConfig{},
+				PipelineConfig:  &PipelineConfig{},
+			},
+		},
+		{
+			name:  "polling",
+			flags: []string{"--sonar-url=https://sonar.example.com", "--poll-interval=5m", "--poll-projects=team-a-*,team-b", "--poll-checkpoint-file=/var/lib/collector/checkpoint.json"},
+			expected: &Config{
+				Port:                    8080,
+				MaxRequestBytes:         1024 * 1024,
+				ReportTaskTimeout:       10 * time.Minute,
+				ReportTaskMaxConcurrent: 10,
+				ClientConfig: &common.ClientConfig{
+					Rode: &common.RodeClientConfig{
+						Host: "rode:50051",
+					},
+					OIDCAuth:  &common.OIDCAuthConfig{},
+					BasicAuth: &common.BasicAuthConfig{},
+				},
+				SonarConfig: &SonarConfig{
+					Url:    "https://sonar.example.com",
+					Flavor: "sonarqube",
+				},
+				SinkConfig: &SinkConfig{
+					HttpTimeout:   10 * time.Second,
+					RequiredSinks: []string{"rode"},
+				},
+				ArchiveConfig: defaultArchiveConfig(),
+				PollConfig: &PollConfig{
+					Interval:       5 * time.Minute,
+					Projects:       []string{"team-a-*", "team-b"},
+					CheckpointFile: "/var/lib/collector/checkpoint.json",
+				},
+				ReconcileConfig: defaultReconcileConfig(),
+				StateConfig:     defaultStateConfig(),
+				AdminConfig:     &AdminConfig{},
+				PipelineConfig:  &PipelineConfig{},
+			},
+		},
+		{
+			name:        "polling without a sonar url",
+			flags:       []string{"--poll-interval=5m"},
+			expectError: true,
+		},
+		{
+			name:        "negative poll interval",
+			flags:       []string{"--sonar-url=https://sonar.example.com", "--poll-interval=-5m"},
+			expectError: true,
+		},
+		{
+			name:  "report tasks",
+			flags: []string{"--report-task-timeout=30m", "--report-task-max-concurrent=2", "--report-task-token=secret"},
+			expected: &Config{
+				Port:                    8080,
+				MaxRequestBytes:         1024 * 1024,
+				ReportTaskTimeout:       30 * time.Minute,
+				ReportTaskMaxConcurrent: 2,
+				ReportTaskToken:         "secret",
+				ClientConfig: &common.ClientConfig{
+					Rode: &common.RodeClientConfig{
+						Host: "rode:50051",
+					},
+					OIDCAuth:  &common.OIDCAuthConfig{},
+					BasicAuth: &common.BasicAuthConfig{},
+				},
+				SonarConfig: defaultSonarConfig(),
+				SinkConfig: &SinkConfig{
+					HttpTimeout:   10 * time.Second,
+					RequiredSinks: []string{"rode"},
+				},
+				ArchiveConfig:   defaultArchiveConfig(),
+				PollConfig:      &PollConfig{},
+				ReconcileConfig: defaultReconcileConfig(),
+				StateConfig:     defaultStateConfig(),
+				AdminConfig:     &AdminConfig{},
+				PipelineConfig:  &PipelineConfig{},
+			},
+		},
+		{
+			name:        "rode instance without a host",
+			flags:       []string{"--rode-instances=staging"},
+			expectError: true,
+		},
+		{
+			name:        "duplicate rode instance",
+			flags:       []string{"--rode-instances=staging=a:50051,staging=b:50051"},
+			expectError: true,
+		},
+		{
+			name:        "required sink that isn't configured",
+			flags:       []string{"--required-sinks=rode,http"},
+			expectError: true,
+		},
+		{
+			name:        "report task max concurrent",
+			flags:       []string{"--report-task-max-concurrent=0"},
+			expectError: true,
+		},
+		{
+			name:  "reconciliation",
+			flags: []string{"--sonar-url=https://sonar.example.com", "--reconcile-interval=1h", "--reconcile-window=72h", "--reconcile-projects=team-a-*", "--reconcile-reingest"},
+			expected: &Config{
+				Port:                    8080,
+				MaxRequestBytes:         1024 * 1024,
+				ReportTaskTimeout:       10 * time.Minute,
+				ReportTaskMaxConcurrent: 10,
+				ClientConfig: &common.ClientConfig{
+					Rode: &common.RodeClientConfig{
+						Host: "rode:50051",
+					},
+					OIDCAuth:  &common.OIDCAuthConfig{},
+					BasicAuth: &common.BasicAuthConfig{},
+				},
+				SonarConfig: &SonarConfig{
+					Url:    "https://sonar.example.com",
+					Flavor: "sonarqube",
+				},
+				SinkConfig: &SinkConfig{
+					HttpTimeout:   10 * time.Second,
+					RequiredSinks: []string{"rode"},
+				},
+				ArchiveConfig: defaultArchiveConfig(),
+				PollConfig:    &PollConfig{},
+				ReconcileConfig: &ReconcileConfig{
+					Interval: time.Hour,
+					Window:   72 * time.Hour,
+					Projects: []string{"team-a-*"},
+					Reingest: true,
+				},
+				StateConfig:    defaultStateConfig(),
+				AdminConfig:    &AdminConfig{},
+				PipelineConfig: &PipelineConfig{},
+			},
+		},
+		{
+			name:        "reconciliation without a sonar url",
+			flags:       []string{"--reconcile-interval=1h"},
+			expectError: true,
+		},
+		{
+			name:  "state",
+			flags: []string{"--state-file=/data/state.db", "--state-max-age=24h", "--state-max-records=0"},
+			expected: &Config{
+				Port:                    8080,
+				MaxRequestBytes:         1024 * 1024,
+				ReportTaskTimeout:       10 * time.Minute,
+				ReportTaskMaxConcurrent: 10,
+				ClientConfig: &common.ClientConfig{
+					Rode: &common.RodeClientConfig{
+						Host: "rode:50051",
+					},
+					OIDCAuth:  &common.OIDCAuthConfig{},
+					BasicAuth: &common.BasicAuthConfig{},
+				},
+				SonarConfig: defaultSonarConfig(),
+				SinkConfig: &SinkConfig{
+					HttpTimeout:   10 * time.Second,
+					RequiredSinks: []string{"rode"},
+				},
+				ArchiveConfig:   defaultArchiveConfig(),
+				PollConfig:      &PollConfig{},
+				ReconcileConfig: defaultReconcileConfig(),
+				StateConfig: &StateConfig{
+					File:   "/data/state.db",
+					MaxAge: 24 * time.Hour,
+				},
+				AdminConfig:    &AdminConfig{},
+				PipelineConfig: &PipelineConfig{},
+			},
+		},
+		{
+			name:  "admin api",
+			flags: []string{"--state-file=/data/state.db", "--admin-port=8081", "--admin-token=s3cret"},
+			expected: &Config{
+				Port:                    8080,
+				MaxRequestBytes:         1024 * 1024,
+				ReportTaskTimeout:       10 * time.Minute,
+				ReportTaskMaxConcurrent: 10,
+				ClientConfig: &common.ClientConfig{
+					Rode: &common.RodeClientConfig{
+						Host: "rode:50051",
+					},
+					OIDCAuth:  &common.OIDCAuthConfig{},
+					BasicAuth: &common.BasicAuthConfig{},
+				},
+				SonarConfig: defaultSonarConfig(),
+				SinkConfig: &SinkConfig{
+					HttpTimeout:   10 * time.Second,
+					RequiredSinks: []string{"rode"},
+				},
+				ArchiveConfig:   defaultArchiveConfig(),
+				PollConfig:      &PollConfig{},
+				ReconcileConfig: defaultReconcileConfig(),
+				StateConfig: &StateConfig{
+					File:       "/data/state.db",
+					MaxAge:     30 * 24 * time.Hour,
+					MaxRecords: 10000,
+				},
+				AdminConfig: &AdminConfig{
+					Port:  8081,
+					Token: "s3cret",
+				},
+				PipelineConfig: &PipelineConfig{},
+			},
+		},
+		{
+			name:        "admin api without a token",
+			flags:       []string{"--state-file=/data/state.db", "--admin-port=8081"},
+			expectError: true,
+		},
+		{
+			name:        "admin api without a state file",
+			flags:       []string{"--admin-port=8081", "--admin-token=s3cret"},
+			expectError: true,
+		},
+		{
+			name:        "admin api on the listener port",
+			flags:       []string{"--state-file=/data/state.db", "--admin-port=8080", "--admin-token=s3cret"},
+			expectError: true,
+		},
+		{
+			name:        "negative state max records",
+			flags:       []string{"--state-max-records=-1"},
+			expectError: true,
+		},
+		{
+			name:        "bad archive format",
+			flags:       []string{"--archive-format=zip"},
+			expectError: true,
+		},
 		{
 			name:  "Rode host",
 			flags: []string{"--rode-host=bar"},
 			expected: &Config{
-				Port:  8080,
-				Debug: false,
+				Port:                    8080,
+				MaxRequestBytes:         1024 * 1024,
+				ReportTaskTimeout:       10 * time.Minute,
+				ReportTaskMaxConcurrent: 10,
+				Debug:                   false,
 				ClientConfig: &common.ClientConfig{
 					Rode: &common.RodeClientConfig{
 						Host: "bar",
@@ -67,6 +673,17 @@ func TestConfig(t *testing.T) {
 					OIDCAuth:  &common.OIDCAuthConfig{},
 					BasicAuth: &common.BasicAuthConfig{},
 				},
+				SonarConfig: defaultSonarConfig(),
+				SinkConfig: &SinkConfig{
+					HttpTimeout:   10 * time.Second,
+					RequiredSinks: []string{"rode"},
+				},
+				ArchiveConfig:   defaultArchiveConfig(),
+				PollConfig:      &PollConfig{},
+				ReconcileConfig: defaultReconcileConfig(),
+				StateConfig:     defaultStateConfig(),
+				AdminConfig:     &AdminConfig{},
+				PipelineConfig:  &PipelineConfig{},
 			},
 		},
 	} {
@@ -86,3 +703,242 @@ func TestConfig(t *testing.T) {
 		})
 	}
 }
+
+func defaultSonarConfig() *SonarConfig {
+	return &SonarConfig{
+		Flavor: "sonarqube",
+	}
+}
+
+func defaultArchiveConfig() *ArchiveConfig {
+	return &ArchiveConfig{
+		Format:        "files",
+		MaxAge:        7 * 24 * time.Hour,
+		MaxSizeMB:     1024,
+		MaxFileSizeMB: 64,
+	}
+}
+
+func defaultReconcileConfig() *ReconcileConfig {
+	return &ReconcileConfig{
+		Window: 24 * time.Hour,
+	}
+}
+
+func defaultStateConfig() *StateConfig {
+	return &StateConfig{
+		MaxAge:     30 * 24 * time.Hour,
+		MaxRecords: 10000,
+	}
+}
+
+func TestReplayConfig(t *testing.T) {
+	Expect := NewGomegaWithT(t).Expect
+
+	for _, tc := range []struct {
+		name        string
+		flags       []string
+		expected    *ReplayConfig
+		expectError bool
+	}{
+		{
+			name:  "defaults",
+			flags: []string{"event.json"},
+			expected: &ReplayConfig{
+				Output: "table",
+				Files:  []string{"event.json"},
+				ClientConfig: &common.ClientConfig{
+					Rode: &common.RodeClientConfig{
+						Host: "rode:50051",
+					},
+					OIDCAuth:  &common.OIDCAuthConfig{},
+					BasicAuth: &common.BasicAuthConfig{},
+				},
+				SonarConfig:    defaultSonarConfig(),
+				PipelineConfig: &PipelineConfig{},
+			},
+		},
+		{
+			name:  "options",
+			flags: []string{"--dry-run", "--resource-uri-prefix=git://example.com/repo", "--output=json", "--filter-rules-file=filter.json", "--routing-rules-file=routing.json", "a.json", "b.jsonl"},
+			expected: &ReplayConfig{
+				DryRun:            true,
+				ResourceUriPrefix: "git://example.com/repo",
+				Output:            "json",
+				Files:             []string{"a.json", "b.jsonl"},
+				ClientConfig: &common.ClientConfig{
+					Rode: &common.RodeClientConfig{
+						Host: "rode:50051",
+					},
+					OIDCAuth:  &common.OIDCAuthConfig{},
+					BasicAuth: &common.BasicAuthConfig{},
+				},
+				SonarConfig: defaultSonarConfig(),
+				PipelineConfig: &PipelineConfig{
+					FilterRulesFile:  "filter.json",
+					RoutingRulesFile: "routing.json",
+				},
+			},
+		},
+		{
+			name:        "no files",
+			flags:       []string{},
+			expectError: true,
+		},
+		{
+			name:        "bad output",
+			flags:       []string{"--output=yaml", "event.json"},
+			expectError: true,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, err := BuildReplay("replay", tc.flags)
+
+			if tc.expectError {
+				Expect(err).To(HaveOccurred())
+			} else {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(c).To(BeEquivalentTo(tc.expected))
+			}
+		})
+	}
+}
+
+func TestCIConfig(t *testing.T) {
+	Expect := NewGomegaWithT(t).Expect
+
+	for _, tc := range []struct {
+		name        string
+		flags       []string
+		expected    *CIConfig
+		expectError bool
+	}{
+		{
+			name:  "defaults",
+			flags: []string{},
+			expected: &CIConfig{
+				ReportTaskFile: ".scannerwork/report-task.txt",
+				Timeout:        10 * time.Minute,
+				PollInterval:   5 * time.Second,
+				ClientConfig: &common.ClientConfig{
+					Rode: &common.RodeClientConfig{
+						Host: "rode:50051",
+					},
+					OIDCAuth:  &common.OIDCAuthConfig{},
+					BasicAuth: &common.BasicAuthConfig{},
+				},
+				SonarConfig:    defaultSonarConfig(),
+				PipelineConfig: &PipelineConfig{},
+			},
+		},
+		{
+			name:  "options",
+			flags: []string{"--dry-run", "--report-task-file=build/sonar/report-task.txt", "--resource-uri=git://example.com/repo@abc123", "--timeout=1m", "--poll-interval=1s", "--filter-rules-file=filter.json", "--routing-rules-file=routing.json"},
+			expected: &CIConfig{
+				DryRun:         true,
+				ReportTaskFile: "build/sonar/report-task.txt",
+				ResourceUri:    "git://example.com/repo@abc123",
+				Timeout:        time.Minute,
+				PollInterval:   time.Second,
+				ClientConfig: &common.ClientConfig{
+					Rode: &common.RodeClientConfig{
+						Host: "rode:50051",
+					},
+					OIDCAuth:  &common.OIDCAuthConfig{},
+					BasicAuth: &common.BasicAuthConfig{},
+				},
+				SonarConfig: defaultSonarConfig(),
+				PipelineConfig: &PipelineConfig{
+					FilterRulesFile:  "filter.json",
+					RoutingRulesFile: "routing.json",
+				},
+			},
+		},
+		{
+			name:        "bad timeout",
+			flags:       []string{"--timeout=0s"},
+			expectError: true,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, err := BuildCI("ci", tc.flags)
+
+			if tc.expectError {
+				Expect(err).To(HaveOccurred())
+			} else {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(c).To(BeEquivalentTo(tc.expected))
+			}
+		})
+	}
+}
+
+func TestReconcileConfig(t *testing.T) {
+	Expect := NewGomegaWithT(t).Expect
+
+	for _, tc := range []struct {
+		name        string
+		flags       []string
+		expected    *ReconcileCommandConfig
+		expectError bool
+	}{
+		{
+			name:  "options",
+			flags: []string{"--sonar-url=https://sonar.example.com", "--window=1h", "--projects=a,b", "--reingest", "--output=json", "--filter-rules-file=filter.json", "--routing-rules-file=routing.json"},
+			expected: &ReconcileCommandConfig{
+				Output:   "json",
+				Window:   time.Hour,
+				Projects: []string{"a", "b"},
+				Reingest: true,
+				ClientConfig: &common.ClientConfig{
+					Rode: &common.RodeClientConfig{
+						Host: "rode:50051",
+					},
+					OIDCAuth:  &common.OIDCAuthConfig{},
+					BasicAuth: &common.BasicAuthConfig{},
+				},
+				SonarConfig: &SonarConfig{
+					Url:    "https://sonar.example.com",
+					Flavor: "sonarqube",
+				},
+				PipelineConfig: &PipelineConfig{
+					FilterRulesFile:  "filter.json",
+					RoutingRulesFile: "routing.json",
+				},
+			},
+		},
+		{
+			name:        "no sonar url",
+			flags:       []string{},
+			expectError: true,
+		},
+		{
+			name:        "bad output",
+			flags:       []string{"--sonar-url=https://sonar.example.com", "--output=yaml"},
+			expectError: true,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, err := BuildReconcile("reconcile", tc.flags)
+
+			if tc.expectError {
+				Expect(err).To(HaveOccurred())
+			} else {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(c).To(BeEquivalentTo(tc.expected))
+			}
+		})
+	}
+}
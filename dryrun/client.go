@@ -0,0 +1,124 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dryrun
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/rode/rode/proto/v1alpha1"
+	"github.com/rode/rode/protodeps/grafeas/proto/v1beta1/grafeas_go_proto"
+)
+
+// rodeClient stands in for a real Rode client when the collector runs in dry-run mode. Requests that would write to
+// Rode are printed as JSON and answered with a synthetic response, so callers behave as though the write succeeded.
+// Reads are answered with empty responses, since there's no Rode instance to read from. Only the RPCs used by the
+// collector are implemented, calling any other RPC will panic.
+type rodeClient struct {
+	pb.RodeClient
+
+	logger *zap.Logger
+
+	mu          sync.Mutex
+	out         io.Writer
+	occurrences int
+}
+
+// record is a single line of dry-run output.
+type record struct {
+	Method  string          `json:"method"`
+	Request json.RawMessage `json:"request"`
+}
+
+func NewRodeClient(logger *zap.Logger, out io.Writer) pb.RodeClient {
+	return &rodeClient{
+		logger: logger,
+		out:    out,
+	}
+}
+
+func (r *rodeClient) CreateNote(_ context.Context, request *pb.CreateNoteRequest, _ ...grpc.CallOption) (*grafeas_go_proto.Note, error) {
+	if err := r.record("CreateNote", request); err != nil {
+		return nil, err
+	}
+
+	note := proto.Clone(request.Note).(*grafeas_go_proto.Note)
+	note.Name = fmt.Sprintf("projects/rode/notes/%s", request.NoteId)
+
+	return note, nil
+}
+
+func (r *rodeClient) BatchCreateOccurrences(_ context.Context, request *pb.BatchCreateOccurrencesRequest, _ ...grpc.CallOption) (*pb.BatchCreateOccurrencesResponse, error) {
+	if err := r.record("BatchCreateOccurrences", request); err != nil {
+		return nil, err
+	}
+
+	response := &pb.BatchCreateOccurrencesResponse{}
+	for _, o := range request.Occurrences {
+		occurrence := proto.Clone(o).(*grafeas_go_proto.Occurrence)
+		occurrence.Name = fmt.Sprintf("projects/rode/occurrences/dry-run-%d", r.nextOccurrence())
+
+		response.Occurrences = append(response.Occurrences, occurrence)
+	}
+
+	return response, nil
+}
+
+func (r *rodeClient) ListOccurrences(_ context.Context, request *pb.ListOccurrencesRequest, _ ...grpc.CallOption) (*pb.ListOccurrencesResponse, error) {
+	r.logger.Info("dry run, not reading occurrences from rode", zap.String("filter", request.Filter))
+
+	return &pb.ListOccurrencesResponse{}, nil
+}
+
+func (r *rodeClient) nextOccurrence() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.occurrences++
+
+	return r.occurrences
+}
+
+func (r *rodeClient) record(method string, request proto.Message) error {
+	body, err := protojson.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("error marshaling %s request: %v", method, err)
+	}
+
+	line, err := json.Marshal(&record{
+		Method:  method,
+		Request: body,
+	})
+	if err != nil {
+		return err
+	}
+
+	r.logger.Info("dry run, not sending request to rode", zap.String("method", method))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, err = r.out.Write(append(line, '\n'))
+
+	return err
+}
@@ -0,0 +1,107 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dryrun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	pb "github.com/rode/rode/proto/v1alpha1"
+	"github.com/rode/rode/protodeps/grafeas/proto/v1beta1/grafeas_go_proto"
+	"strings"
+)
+
+var _ = Describe("dry run client", func() {
+	var (
+		out    *bytes.Buffer
+		client pb.RodeClient
+	)
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		client = NewRodeClient(logger, out)
+	})
+
+	lines := func() []map[string]interface{} {
+		var records []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			r := map[string]interface{}{}
+			Expect(json.Unmarshal([]byte(line), &r)).To(Succeed())
+			records = append(records, r)
+		}
+
+		return records
+	}
+
+	Context("CreateNote", func() {
+		It("should print the request and return a note", func() {
+			noteId := fake.LetterN(10)
+			description := fake.LetterN(10)
+
+			note, err := client.CreateNote(context.Background(), &pb.CreateNoteRequest{
+				NoteId: noteId,
+				Note: &grafeas_go_proto.Note{
+					ShortDescription: description,
+				},
+			})
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(note.Name).To(Equal("projects/rode/notes/" + noteId))
+			Expect(note.ShortDescription).To(Equal(description))
+
+			records := lines()
+			Expect(records).To(HaveLen(1))
+			Expect(records[0]["method"]).To(Equal("CreateNote"))
+			Expect(records[0]["request"]).To(HaveKeyWithValue("noteId", noteId))
+		})
+	})
+
+	Context("BatchCreateOccurrences", func() {
+		It("should print the request and return the occurrences with names", func() {
+			uri := fake.URL()
+
+			response, err := client.BatchCreateOccurrences(context.Background(), &pb.BatchCreateOccurrencesRequest{
+				Occurrences: []*grafeas_go_proto.Occurrence{
+					{Resource: &grafeas_go_proto.Resource{Uri: uri}},
+					{Resource: &grafeas_go_proto.Resource{Uri: uri}},
+				},
+			})
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(response.Occurrences).To(HaveLen(2))
+			Expect(response.Occurrences[0].Name).ToNot(Equal(response.Occurrences[1].Name))
+			Expect(response.Occurrences[0].Resource.Uri).To(Equal(uri))
+
+			records := lines()
+			Expect(records).To(HaveLen(1))
+			Expect(records[0]["method"]).To(Equal("BatchCreateOccurrences"))
+			Expect(records[0]["request"]).To(HaveKey("occurrences"))
+		})
+	})
+
+	Context("ListOccurrences", func() {
+		It("should return no occurrences without printing the request", func() {
+			response, err := client.ListOccurrences(context.Background(), &pb.ListOccurrencesRequest{
+				Filter: fake.LetterN(10),
+			})
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(response.Occurrences).To(BeEmpty())
+			Expect(out.Len()).To(BeZero())
+		})
+	})
+})
@@ -0,0 +1,325 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rode/collector-sonarqube/internal/match"
+	"github.com/rode/collector-sonarqube/sonar"
+	"go.uber.org/zap"
+)
+
+const (
+	// tagsTtl is how long a project's tags are cached, so that every event doesn't need a request to SonarQube
+	tagsTtl = 5 * time.Minute
+	// tagsErrorTtl is how long a failure to look up a project's tags is cached, so that an outage doesn't turn every
+	// event into another request
+	tagsErrorTtl = 30 * time.Second
+)
+
+// Rules decide which analyses are recorded. When there are include rules, an event must match at least one of them,
+// and an event that matches any exclude rule is skipped.
+//
+//	{
+//	  "include": [
+//	    {"name": "team projects", "projects": ["team-a-*", "team-b-*"]}
+//	  ],
+//	  "exclude": [
+//	    {"name": "sandboxes", "tags": ["sandbox"]},
+//	    {"name": "feature branches", "branches": ["feature/*"], "pullRequest": false}
+//	  ]
+//	}
+type Rules struct {
+	Include []*Rule `json:"include"`
+	Exclude []*Rule `json:"exclude"`
+}
+
+// Rule matches an event when every criterion that's set matches. A criterion with several values matches when any one
+// of them does. Project keys and branch names may end in "*" to match a prefix.
+type Rule struct {
+	Name     string   `json:"name"`
+	Projects []string `json:"projects,omitempty"`
+	// Tags are the tags applied to the project in SonarQube, which are looked up with the web API
+	Tags     []string `json:"tags,omitempty"`
+	Branches []string `json:"branches,omitempty"`
+	// BranchTypes are compared to the type in the event, e.g. BRANCH or PULL_REQUEST
+	BranchTypes []string `json:"branchTypes,omitempty"`
+	// PullRequest matches only pull requests when true, and only branches when false
+	PullRequest *bool `json:"pullRequest,omitempty"`
+}
+
+// Load reads rules from a JSON file.
+func Load(path string) (*Rules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules := &Rules{}
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(rules); err != nil {
+		return nil, fmt.Errorf("error reading filter rules %s: %v", path, err)
+	}
+
+	if err := rules.validate(); err != nil {
+		return nil, fmt.Errorf("invalid filter rules %s: %v", path, err)
+	}
+
+	return rules, nil
+}
+
+// validate names unnamed rules after their position, so that the rule responsible for skipping an event can always be
+// reported, and rejects rules that would match every event.
+func (r *Rules) validate() error {
+	kinds := []struct {
+		name  string
+		rules []*Rule
+	}{
+		{"include", r.Include},
+		{"exclude", r.Exclude},
+	}
+
+	for _, kind := range kinds {
+		for i, rule := range kind.rules {
+			if rule.Name == "" {
+				rule.Name = fmt.Sprintf("%s[%d]", kind.name, i)
+			}
+
+			if len(rule.Projects) == 0 && len(rule.Tags) == 0 && len(rule.Branches) == 0 && len(rule.BranchTypes) == 0 && rule.PullRequest == nil {
+				return fmt.Errorf("rule %s has no criteria", rule.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *Rules) usesTags() bool {
+	for _, rules := range [][]*Rule{r.Include, r.Exclude} {
+		for _, rule := range rules {
+			if len(rule.Tags) > 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Decision is the result of evaluating the rules against an event.
+type Decision struct {
+	Skip bool
+	// Rule is the name of the exclude rule that matched the event. It's empty when the event was skipped because it
+	// didn't match any include rule.
+	Rule   string
+	Reason string
+}
+
+// Stats count the events that have been evaluated, and those that were skipped by each rule.
+type Stats struct {
+	Evaluated int64 `json:"evaluated"`
+	Skipped   int64 `json:"skipped"`
+	// SkippedByRule is keyed by rule name, with events that didn't match any include rule counted under an empty name
+	SkippedByRule map[string]int64 `json:"skippedByRule"`
+}
+
+type cachedTags struct {
+	tags      []string
+	err       error
+	expiresAt time.Time
+}
+
+// Filter evaluates rules against events. It's safe for concurrent use.
+type Filter struct {
+	logger      *zap.Logger
+	rules       *Rules
+	usesTags    bool
+	sonarClient sonar.Client
+
+	mu    sync.Mutex
+	stats Stats
+	tags  map[string]*cachedTags
+	now   func() time.Time
+}
+
+// New returns a filter for the rules. The sonar client is only needed when a rule matches project tags; without one,
+// projects are treated as having no tags. When it's set but the tags can't be looked up, events are neither recorded
+// nor skipped, so that an exclude rule isn't bypassed while SonarQube is unavailable.
+func New(logger *zap.Logger, rules *Rules, sonarClient sonar.Client) *Filter {
+	return &Filter{
+		logger:      logger,
+		rules:       rules,
+		usesTags:    rules.usesTags(),
+		sonarClient: sonarClient,
+		stats:       Stats{SkippedByRule: map[string]int64{}},
+		tags:        map[string]*cachedTags{},
+		now:         time.Now,
+	}
+}
+
+// Evaluate decides whether the event should be skipped, and counts the decision in the stats. Events that can't be
+// evaluated aren't counted.
+func (f *Filter) Evaluate(ctx context.Context, event *sonar.Event) (*Decision, error) {
+	decision, err := f.Check(ctx, event)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.stats.Evaluated++
+	if decision.Skip {
+		f.stats.Skipped++
+		f.stats.SkippedByRule[decision.Rule]++
+	}
+
+	return decision, nil
+}
+
+// Check decides whether the event should be skipped, without counting it. Exclude rules take precedence over include
+// rules. An error is returned when the project's tags are needed but can't be looked up.
+func (f *Filter) Check(ctx context.Context, event *sonar.Event) (*Decision, error) {
+	var tags []string
+	if f.usesTags {
+		var err error
+		if tags, err = f.projectTags(ctx, event); err != nil {
+			return nil, err
+		}
+	}
+
+	decision := &Decision{}
+	if len(f.rules.Include) > 0 && firstMatch(f.rules.Include, event, tags) == nil {
+		decision.Skip = true
+		decision.Reason = "event did not match any include rule"
+	}
+
+	if rule := firstMatch(f.rules.Exclude, event, tags); rule != nil {
+		decision.Skip = true
+		decision.Rule = rule.Name
+		decision.Reason = fmt.Sprintf("event matched exclude rule %q", rule.Name)
+	}
+
+	return decision, nil
+}
+
+// Stats returns a snapshot of the filter's counts.
+func (f *Filter) Stats() Stats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stats := f.stats
+	stats.SkippedByRule = map[string]int64{}
+	for rule, count := range f.stats.SkippedByRule {
+		stats.SkippedByRule[rule] = count
+	}
+
+	return stats
+}
+
+func (f *Filter) projectTags(ctx context.Context, event *sonar.Event) ([]string, error) {
+	if event.Project == nil || f.sonarClient == nil {
+		return nil, nil
+	}
+
+	key := event.Project.Key
+	f.mu.Lock()
+	cached, ok := f.tags[key]
+	f.mu.Unlock()
+	if ok && f.now().Before(cached.expiresAt) {
+		return cached.tags, cached.err
+	}
+
+	cached = &cachedTags{expiresAt: f.now().Add(tagsTtl)}
+	tags, err := f.sonarClient.GetProjectTags(ctx, key)
+	if err != nil {
+		f.logger.Warn("error getting project tags", zap.String("projectKey", key), zap.Error(err))
+		cached.err = fmt.Errorf("error getting tags of project %s: %v", key, err)
+		cached.expiresAt = f.now().Add(tagsErrorTtl)
+	}
+	cached.tags = tags
+
+	f.mu.Lock()
+	f.tags[key] = cached
+	f.mu.Unlock()
+
+	return cached.tags, cached.err
+}
+
+func firstMatch(rules []*Rule, event *sonar.Event, tags []string) *Rule {
+	for _, rule := range rules {
+		if rule.matches(event, tags) {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+func (r *Rule) matches(event *sonar.Event, tags []string) bool {
+	projectKey := ""
+	if event.Project != nil {
+		projectKey = event.Project.Key
+	}
+
+	// events from editions of SonarQube without branch support are for the main branch
+	branch := event.Branch
+	if branch == nil {
+		branch = &sonar.Branch{Type: sonar.BRANCH_TYPE_BRANCH, IsMain: true}
+	}
+
+	if len(r.Projects) > 0 && !match.Any(r.Projects, projectKey) {
+		return false
+	}
+
+	if len(r.Tags) > 0 && !containsAny(r.Tags, tags) {
+		return false
+	}
+
+	if len(r.Branches) > 0 && (branch.Name == "" || !match.Any(r.Branches, branch.Name)) {
+		return false
+	}
+
+	if len(r.BranchTypes) > 0 && !containsAny(r.BranchTypes, []string{strings.ToUpper(branch.Type)}) {
+		return false
+	}
+
+	if r.PullRequest != nil && *r.PullRequest != branch.IsPullRequest() {
+		return false
+	}
+
+	return true
+}
+
+func containsAny(wanted, values []string) bool {
+	for _, w := range wanted {
+		for _, v := range values {
+			if strings.EqualFold(w, v) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
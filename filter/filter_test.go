@@ -0,0 +1,296 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"context"
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/collector-sonarqube/sonar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fakeSonarClient only implements GetProjectTags, the rest panic
+type fakeSonarClient struct {
+	sonar.Client
+
+	tags  []string
+	err   error
+	calls int
+}
+
+func (f *fakeSonarClient) GetProjectTags(context.Context, string) ([]string, error) {
+	f.calls++
+
+	return f.tags, f.err
+}
+
+var _ = Describe("Filter", func() {
+	var (
+		sonarClient *fakeSonarClient
+		event       *sonar.Event
+	)
+
+	yes, no := true, false
+
+	BeforeEach(func() {
+		sonarClient = &fakeSonarClient{tags: []string{"team-a"}}
+		event = &sonar.Event{
+			TaskId:  fake.LetterN(10),
+			Project: &sonar.Project{Key: "team-a-api"},
+			Branch:  &sonar.Branch{Name: "feature/login", Type: sonar.BRANCH_TYPE_BRANCH},
+		}
+	})
+
+	evaluate := func(rules *Rules) *Decision {
+		Expect(rules.validate()).To(Succeed())
+
+		decision, err := New(logger, rules, sonarClient).Evaluate(context.Background(), event)
+		Expect(err).ToNot(HaveOccurred())
+
+		return decision
+	}
+
+	It("should include every event when there are no rules", func() {
+		decision := evaluate(&Rules{})
+
+		Expect(decision.Skip).To(BeFalse())
+	})
+
+	It("should include events that match an include rule", func() {
+		decision := evaluate(&Rules{Include: []*Rule{{Projects: []string{"team-a-*"}}}})
+
+		Expect(decision.Skip).To(BeFalse())
+	})
+
+	It("should skip events that don't match any include rule", func() {
+		decision := evaluate(&Rules{Include: []*Rule{{Projects: []string{"team-b-*"}}}})
+
+		Expect(decision.Skip).To(BeTrue())
+	})
+
+	It("should skip events that match an exclude rule", func() {
+		decision := evaluate(&Rules{Exclude: []*Rule{{Name: "team a", Projects: []string{"team-a-api"}}}})
+
+		Expect(decision.Skip).To(BeTrue())
+		Expect(decision.Rule).To(Equal("team a"))
+	})
+
+	It("should give exclude rules precedence", func() {
+		decision := evaluate(&Rules{
+			Include: []*Rule{{Projects: []string{"team-a-*"}}},
+			Exclude: []*Rule{{Name: "features", Branches: []string{"feature/*"}}},
+		})
+
+		Expect(decision.Skip).To(BeTrue())
+		Expect(decision.Rule).To(Equal("features"))
+	})
+
+	It("should name unnamed rules after their position", func() {
+		decision := evaluate(&Rules{Exclude: []*Rule{{Projects: []string{"other"}}, {Tags: []string{"TEAM-A"}}}})
+
+		Expect(decision.Skip).To(BeTrue())
+		Expect(decision.Rule).To(Equal("exclude[1]"))
+	})
+
+	It("should not skip events whose project doesn't have the tag", func() {
+		decision := evaluate(&Rules{Exclude: []*Rule{{Tags: []string{"sandbox"}}}})
+
+		Expect(decision.Skip).To(BeFalse())
+	})
+
+	It("should match the branch type", func() {
+		decision := evaluate(&Rules{Exclude: []*Rule{{Name: "branches", BranchTypes: []string{"branch"}}}})
+
+		Expect(decision.Skip).To(BeTrue())
+		Expect(decision.Rule).To(Equal("branches"))
+	})
+
+	It("should match only pull requests", func() {
+		decision := evaluate(&Rules{Exclude: []*Rule{{Name: "prs", PullRequest: &yes}}})
+
+		Expect(decision.Skip).To(BeFalse())
+	})
+
+	It("should match only branches", func() {
+		decision := evaluate(&Rules{Exclude: []*Rule{{Name: "branches", PullRequest: &no}}})
+
+		Expect(decision.Skip).To(BeTrue())
+		Expect(decision.Rule).To(Equal("branches"))
+	})
+
+	It("should require every criterion to match", func() {
+		decision := evaluate(&Rules{Exclude: []*Rule{{Projects: []string{"team-a-*"}, PullRequest: &yes}}})
+
+		Expect(decision.Skip).To(BeFalse())
+	})
+
+	When("the event has no branch", func() {
+		BeforeEach(func() {
+			event.Branch = nil
+		})
+
+		It("should be treated as the main branch", func() {
+			f := New(logger, &Rules{Exclude: []*Rule{
+				{Name: "features", Branches: []string{"*"}},
+				{Name: "prs", PullRequest: &yes},
+			}}, sonarClient)
+
+			decision, err := f.Evaluate(context.Background(), event)
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decision.Skip).To(BeFalse())
+		})
+	})
+
+	Context("project tags", func() {
+		var f *Filter
+
+		BeforeEach(func() {
+			f = New(logger, &Rules{Exclude: []*Rule{{Name: "team a", Tags: []string{"team-a"}}}}, sonarClient)
+		})
+
+		It("should cache the tags of each project", func() {
+			f.Evaluate(context.Background(), event)
+			f.Evaluate(context.Background(), event)
+
+			Expect(sonarClient.calls).To(Equal(1))
+		})
+
+		It("should look the tags up again once they expire", func() {
+			f.Evaluate(context.Background(), event)
+			f.now = func() time.Time { return time.Now().Add(tagsTtl) }
+			f.Evaluate(context.Background(), event)
+
+			Expect(sonarClient.calls).To(Equal(2))
+		})
+
+		It("should return an error when the tags can't be looked up", func() {
+			sonarClient.err = errors.New("unauthorized")
+
+			decision, err := f.Evaluate(context.Background(), event)
+
+			Expect(err).To(MatchError(ContainSubstring("unauthorized")))
+			Expect(decision).To(BeNil())
+			Expect(f.Stats().Evaluated).To(BeZero())
+		})
+
+		It("should briefly cache a failure to look up the tags", func() {
+			sonarClient.err = errors.New("unauthorized")
+
+			_, err := f.Evaluate(context.Background(), event)
+			Expect(err).To(HaveOccurred())
+			_, err = f.Evaluate(context.Background(), event)
+			Expect(err).To(HaveOccurred())
+			Expect(sonarClient.calls).To(Equal(1))
+
+			sonarClient.err = nil
+			f.now = func() time.Time { return time.Now().Add(tagsErrorTtl) }
+
+			decision, err := f.Evaluate(context.Background(), event)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decision.Skip).To(BeTrue())
+			Expect(sonarClient.calls).To(Equal(2))
+		})
+
+		It("should not look up tags when no rule uses them", func() {
+			New(logger, &Rules{Exclude: []*Rule{{Projects: []string{"other"}}}}, sonarClient).Evaluate(context.Background(), event)
+
+			Expect(sonarClient.calls).To(BeZero())
+		})
+	})
+
+	It("should count the events skipped by each rule", func() {
+		f := New(logger, &Rules{
+			Include: []*Rule{{Name: "team a", Projects: []string{"team-a-*"}}},
+			Exclude: []*Rule{{Name: "features", Branches: []string{"feature/*"}}},
+		}, sonarClient)
+
+		f.Evaluate(context.Background(), event)
+		event.Branch.Name = "main"
+		f.Evaluate(context.Background(), event)
+		event.Project.Key = "team-b-api"
+		f.Evaluate(context.Background(), event)
+
+		Expect(f.Stats()).To(Equal(Stats{
+			Evaluated:     3,
+			Skipped:       2,
+			SkippedByRule: map[string]int64{"features": 1, "": 1},
+		}))
+	})
+
+	It("should not count events that are only checked", func() {
+		f := New(logger, &Rules{Exclude: []*Rule{{Name: "features", Branches: []string{"feature/*"}}}}, sonarClient)
+
+		decision, err := f.Check(context.Background(), event)
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(decision.Skip).To(BeTrue())
+		Expect(f.Stats()).To(Equal(Stats{SkippedByRule: map[string]int64{}}))
+	})
+
+	Context("Load", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "filter")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		write := func(contents string) string {
+			path := filepath.Join(dir, "filter.json")
+			Expect(ioutil.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+
+			return path
+		}
+
+		It("should read rules from a file", func() {
+			rules, err := Load(write(`{"include": [{"projects": ["team-*"]}], "exclude": [{"name": "sandboxes", "tags": ["sandbox"], "pullRequest": false}]}`))
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rules.Include).To(Equal([]*Rule{{Name: "include[0]", Projects: []string{"team-*"}}}))
+			Expect(rules.Exclude).To(Equal([]*Rule{{Name: "sandboxes", Tags: []string{"sandbox"}, PullRequest: &no}}))
+		})
+
+		It("should reject unknown fields", func() {
+			_, err := Load(write(`{"exclude": [{"project": ["team-*"]}]}`))
+
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should reject rules without criteria", func() {
+			_, err := Load(write(`{"exclude": [{"name": "everything"}]}`))
+
+			Expect(err).To(MatchError(ContainSubstring("rule everything has no criteria")))
+		})
+
+		It("should report the first rule without criteria, checking include rules before exclude rules", func() {
+			for i := 0; i < 10; i++ {
+				_, err := Load(write(`{"include": [{"projects": ["team-*"]}, {}], "exclude": [{}]}`))
+
+				Expect(err).To(MatchError(ContainSubstring("rule include[1] has no criteria")))
+			}
+		})
+	})
+})
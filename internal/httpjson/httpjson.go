@@ -0,0 +1,40 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package httpjson writes the JSON responses of the webhook listener and the admin api, so that both send errors in the
+// same shape.
+package httpjson
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ErrorResponse is the body sent with any error response.
+type ErrorResponse struct {
+	Errors []string `json:"errors"`
+}
+
+// Write sends the body as JSON with the given status.
+func Write(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// WriteErrors sends an ErrorResponse listing the problems with the given status.
+func WriteErrors(w http.ResponseWriter, status int, problems ...string) {
+	Write(w, status, &ErrorResponse{Errors: problems})
+}
@@ -0,0 +1,56 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package match compares names, such as project keys and branches, with patterns that are either the exact name or a
+// prefix followed by "*".
+package match
+
+import "strings"
+
+// Pattern returns true if the value is the pattern, or starts with the prefix of a pattern that ends in "*".
+func Pattern(pattern, value string) bool {
+	if IsPrefix(pattern) {
+		return strings.HasPrefix(value, strings.TrimSuffix(pattern, "*"))
+	}
+
+	return pattern == value
+}
+
+// Any returns true if the value matches any of the patterns.
+func Any(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if Pattern(pattern, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsPrefix returns true if the pattern matches a prefix, rather than an exact name.
+func IsPrefix(pattern string) bool {
+	return strings.HasSuffix(pattern, "*")
+}
+
+// AnyPrefix returns true if any of the patterns matches a prefix. Exact names can be looked up individually, so this
+// is used to decide whether everything needs to be listed and matched instead.
+func AnyPrefix(patterns []string) bool {
+	for _, pattern := range patterns {
+		if IsPrefix(pattern) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,50 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package match
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("match", func() {
+	It("should match exact names", func() {
+		Expect(Pattern("rode-api", "rode-api")).To(BeTrue())
+		Expect(Pattern("rode-api", "rode-api-v2")).To(BeFalse())
+		Expect(Pattern("rode", "rode-api")).To(BeFalse())
+	})
+
+	It("should match prefixes", func() {
+		Expect(Pattern("rode-*", "rode-api")).To(BeTrue())
+		Expect(Pattern("rode-*", "rode-")).To(BeTrue())
+		Expect(Pattern("rode-*", "collector")).To(BeFalse())
+		Expect(Pattern("*", "collector")).To(BeTrue())
+	})
+
+	It("should match any of the patterns", func() {
+		patterns := []string{"collector", "rode-*"}
+
+		Expect(Any(patterns, "collector")).To(BeTrue())
+		Expect(Any(patterns, "rode-ui")).To(BeTrue())
+		Expect(Any(patterns, "sandbox")).To(BeFalse())
+		Expect(Any(nil, "sandbox")).To(BeFalse())
+	})
+
+	It("should find prefix patterns", func() {
+		Expect(AnyPrefix([]string{"collector", "rode-*"})).To(BeTrue())
+		Expect(AnyPrefix([]string{"collector", "rode"})).To(BeFalse())
+		Expect(AnyPrefix(nil)).To(BeFalse())
+	})
+})
@@ -19,37 +19,126 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/rode/rode/protodeps/grafeas/proto/v1beta1/discovery_go_proto"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/rode/collector-sonarqube/filter"
+	"github.com/rode/collector-sonarqube/internal/httpjson"
+	"github.com/rode/collector-sonarqube/routing"
+	"github.com/rode/collector-sonarqube/sink"
 	"github.com/rode/collector-sonarqube/sonar"
 	"go.uber.org/zap"
-
-	pb "github.com/rode/rode/proto/v1alpha1"
-	"github.com/rode/rode/protodeps/grafeas/proto/v1beta1/common_go_proto"
-	"github.com/rode/rode/protodeps/grafeas/proto/v1beta1/grafeas_go_proto"
-	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 const (
 	resourceUriPrefixPropertyName = "sonar.analysis.resourceUriPrefix"
+	// additionalResourceUrisPropertyName is a comma-separated list of other resources that the analysis applies to, such
+	// as the artifacts built from a monorepo commit
+	additionalResourceUrisPropertyName = "sonar.analysis.additionalResourceUris"
+	// componentPropertyName is the subdirectory of a monorepo that the project analyzes
+	componentPropertyName = "sonar.analysis.component"
 )
 
 type listener struct {
-	rodeClient pb.RodeClient
-	logger     *zap.Logger
+	sink        sink.Sink
+	sonarClient sonar.Client
+	properties  *sonar.PropertyFilter
+	filter      *filter.Filter
+	routing     *routing.Rules
+	history     History
+	logger      *zap.Logger
 }
 
 type Listener interface {
 	ProcessEvent(http.ResponseWriter, *http.Request)
+	Process(context.Context, *sonar.Event, *ProcessOptions) (*Result, error)
+	Plan(context.Context, *sonar.Event, *ProcessOptions) (*Plan, error)
+}
+
+// History keeps a record of every event that's processed, and what happened to it.
+type History interface {
+	Record(ctx context.Context, event *sonar.Event, options *ProcessOptions, result *Result) error
+}
+
+// Source is how an event was received.
+type Source string
+
+const (
+	SOURCE_WEBHOOK     Source = "WEBHOOK"
+	SOURCE_POLL        Source = "POLL"
+	SOURCE_REPORT_TASK Source = "REPORT_TASK"
+	SOURCE_RECONCILE   Source = "RECONCILE"
+	SOURCE_REPLAY      Source = "REPLAY"
+	SOURCE_CI          Source = "CI"
+	SOURCE_ADMIN       Source = "ADMIN"
+)
+
+// ProcessOptions allow callers other than the webhook handler to adjust how an event is processed.
+type ProcessOptions struct {
+	// Source defaults to the webhook
+	Source Source
+	// ResourceUriPrefix is used in place of the resource uri prefix scanner property
+	ResourceUriPrefix string
+	// ResourceUri is used as is, rather than being derived from the prefix and the revision
+	ResourceUri string
+}
+
+// Outcome describes what happened to an event once it was processed.
+type Outcome string
+
+const (
+	OUTCOME_RECORDED Outcome = "RECORDED"
+	OUTCOME_SKIPPED  Outcome = "SKIPPED"
+	OUTCOME_REJECTED Outcome = "REJECTED"
+	OUTCOME_FAILED   Outcome = "FAILED"
+)
+
+// Result is the outcome of processing a single event. Reason explains why an event was skipped, rejected or failed.
+type Result struct {
+	TaskId       string   `json:"taskId"`
+	Outcome      Outcome  `json:"outcome"`
+	ResourceUri  string   `json:"resourceUri,omitempty"`
+	ArtifactUris []string `json:"artifactUris,omitempty"`
+	Reason       string   `json:"reason,omitempty"`
+	// FailedResourceUris are the resources that the analysis couldn't be recorded against, when it was recorded against
+	// others
+	FailedResourceUris []string `json:"failedResourceUris,omitempty"`
+	// NoteName and OccurrenceNames are the records created in Rode
+	NoteName        string   `json:"noteName,omitempty"`
+	OccurrenceNames []string `json:"occurrenceNames,omitempty"`
 }
 
-func NewListener(logger *zap.Logger, client pb.RodeClient) Listener {
+// Plan describes how an event would be processed.
+type Plan struct {
+	// Skip is set when the event would be skipped on purpose, such as by the filter or routing rules, and Reason
+	// explains why
+	Skip   bool   `json:"skip,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// ResourceUri is the resource that the analysis would be recorded against, including any routing override
+	ResourceUri string `json:"resourceUri,omitempty"`
+}
+
+// resolution is how an event that isn't skipped will be recorded.
+type resolution struct {
+	route       *routing.Route
+	resourceUri string
+}
+
+// NewListener returns a listener that sends analyses to the given sink. The sonar client is optional, and is only used
+// to fill in details that are missing from an event. Scanner properties allowed by the property filter are copied into
+// each analysis; a nil filter allows none. Events that the ingestion filter skips are never sent to the sink; a nil
+// ingestion filter skips nothing. Routing rules can drop events, or change where and how they're recorded. The outcome
+// of each event is recorded in the history, when there is one.
+func NewListener(logger *zap.Logger, sink sink.Sink, sonarClient sonar.Client, properties *sonar.PropertyFilter, ingestFilter *filter.Filter, routingRules *routing.Rules, history History) Listener {
 	return &listener{
-		rodeClient: client,
-		logger:     logger,
+		sink:        sink,
+		sonarClient: sonarClient,
+		properties:  properties,
+		filter:      ingestFilter,
+		routing:     routingRules,
+		history:     history,
+		logger:      logger,
 	}
 }
 
@@ -60,52 +149,306 @@ func (l *listener) ProcessEvent(w http.ResponseWriter, request *http.Request) {
 	event := &sonar.Event{}
 	if err := json.NewDecoder(request.Body).Decode(event); err != nil {
 		log.Error("error reading webhook event", zap.Error(err))
+		httpjson.WriteErrors(w, http.StatusBadRequest, fmt.Sprintf("error decoding event: %v", err))
+		return
+	}
+
+	// allow for one minute to process this event
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	// skipped events are still a success from sonar's perspective, there's nothing it could do differently
+	_, err := l.Process(ctx, event, nil)
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		httpjson.WriteErrors(w, http.StatusBadRequest, validationErr.Problems...)
+		return
+	}
+
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	log = log.With(zap.Any("event", event))
+	w.WriteHeader(http.StatusOK)
+}
+
+// Process records a single sonar event, regardless of how it was received. An error is returned when the event is
+// invalid, or when it should have been recorded but couldn't be; events that are skipped are described by the result.
+func (l *listener) Process(ctx context.Context, event *sonar.Event, options *ProcessOptions) (*Result, error) {
+	if options == nil {
+		options = &ProcessOptions{}
+	}
+	if options.Source == "" {
+		sourceOptions := *options
+		sourceOptions.Source = SOURCE_WEBHOOK
+		options = &sourceOptions
+	}
+
+	result, err := l.process(ctx, event, options)
+
+	if l.history != nil {
+		if historyErr := l.history.Record(ctx, event, options, result); historyErr != nil {
+			l.logger.Error("error recording event history", zap.String("taskId", event.TaskId), zap.Error(historyErr))
+		}
+	}
+
+	return result, err
+}
+
+// Plan decides how the event would be processed, without sending it anywhere, recording it in the history or counting it
+// in the filter's stats. An error is returned when the event is invalid.
+func (l *listener) Plan(ctx context.Context, event *sonar.Event, options *ProcessOptions) (*Plan, error) {
+	if options == nil {
+		options = &ProcessOptions{}
+	}
+
+	log := l.logger.Named("Plan").With(zap.String("taskId", event.TaskId))
+	resolved, result, err := l.resolve(ctx, log, event, options, false)
+	if result != nil {
+		return &Plan{Skip: result.Outcome == OUTCOME_SKIPPED, Reason: result.Reason}, err
+	}
+
+	return &Plan{ResourceUri: resolved.resourceUri}, nil
+}
+
+func (l *listener) process(ctx context.Context, event *sonar.Event, options *ProcessOptions) (*Result, error) {
+	log := l.logger.Named("Process").With(zap.Any("event", event))
 	log.Debug("received sonarqube event")
 
-	resourceUri, err := getResourceUriFromEvent(event)
+	resolved, result, err := l.resolve(ctx, log, event, options, true)
+	if result != nil {
+		return result, err
+	}
+
+	route := resolved.route
+	resourceUri := resolved.resourceUri
+	result = &Result{
+		TaskId:      event.TaskId,
+		ResourceUri: resourceUri,
+	}
+
+	analysis := &sink.Analysis{
+		Event:       event,
+		ResourceUri: resourceUri,
+		ReceivedAt:  time.Now(),
+		Component:   strings.Trim(strings.TrimSpace(event.Properties[componentPropertyName]), "/"),
+		Metadata:    l.properties.Filter(event.Properties),
+		Pipeline:    sonar.DetectCIRun(event.Properties),
+	}
+	analysis.AnalysedAt, analysis.AnalysedAtSource = l.analysisTime(ctx, log, event, analysis.ReceivedAt)
+	analysis.AddArtifactUris(additionalResourceUris(event)...)
+	analysis.Sinks = route.Sinks
+	for label, value := range route.Labels {
+		if analysis.Metadata == nil {
+			analysis.Metadata = map[string]string{}
+		}
+		analysis.Metadata[label] = value
+	}
+
+	err = l.sink.Send(ctx, analysis)
+	result.ArtifactUris = analysis.ArtifactUris
+	result.NoteName = analysis.RodeNoteName
+	result.OccurrenceNames = analysis.RodeOccurrenceNames
+	if err != nil {
+		log.Error("error sending analysis to sinks", zap.Error(err))
+		result.Outcome = OUTCOME_FAILED
+		result.Reason = err.Error()
+
+		var resourceErr *sink.ResourceError
+		if errors.As(err, &resourceErr) {
+			result.FailedResourceUris = resourceErr.FailedResourceUris()
+		}
+
+		return result, err
+	}
+
+	result.Outcome = OUTCOME_RECORDED
+
+	return result, nil
+}
+
+// resolve applies the filter and routing rules, validates the event and derives its resource uri. When the event won't
+// be recorded, the result describes why, along with an error if the event is invalid or the filter rules couldn't be
+// evaluated. Filter decisions are only counted
+// when the event is being processed.
+func (l *listener) resolve(ctx context.Context, log *zap.Logger, event *sonar.Event, options *ProcessOptions, count bool) (*resolution, *Result, error) {
+	result := &Result{
+		TaskId:  event.TaskId,
+		Outcome: OUTCOME_SKIPPED,
+	}
+
+	// filtered events are skipped before they're validated, since what's missing from them doesn't matter
+	if l.filter != nil {
+		decide := l.filter.Check
+		if count {
+			decide = l.filter.Evaluate
+		}
+
+		decision, err := decide(ctx, event)
+		if err != nil {
+			log.Error("error evaluating filter rules", zap.Error(err))
+			result.Outcome = OUTCOME_FAILED
+			result.Reason = err.Error()
+			return nil, result, err
+		}
+
+		if decision.Skip {
+			log.Info("skipping filtered event", zap.String("rule", decision.Rule), zap.String("reason", decision.Reason))
+			result.Reason = decision.Reason
+			return nil, result, nil
+		}
+	}
+
+	route := &routing.Route{}
+	if l.routing != nil {
+		route = l.routing.Evaluate(event)
+		for _, routeErr := range route.Errors {
+			log.Warn("ignoring routing rule expression that couldn't be evaluated", zap.String("error", routeErr))
+		}
+
+		if route.Drop != "" {
+			log.Info("dropping event", zap.String("rule", route.Drop))
+			result.Reason = fmt.Sprintf("dropped by routing rule %q", route.Drop)
+			return nil, result, nil
+		}
+
+		// a resource uri chosen by the caller takes precedence over one from the rules
+		if route.ResourceUri != "" && options.ResourceUri == "" {
+			routedOptions := *options
+			routedOptions.ResourceUri = route.ResourceUri
+			options = &routedOptions
+		}
+	}
+
+	if prefix := l.boundResourceUriPrefix(ctx, log, event, options); prefix != "" {
+		boundOptions := *options
+		boundOptions.ResourceUriPrefix = prefix
+		options = &boundOptions
+	}
+
+	if problems := validateEvent(event, options); len(problems) > 0 {
+		err := &ValidationError{Problems: problems}
+		log.Warn("rejecting invalid event", zap.Strings("problems", problems))
+		result.Outcome = OUTCOME_REJECTED
+		result.Reason = err.Error()
+		return nil, result, err
+	}
+
+	switch {
+	case event.Status == sonar.STATUS_SUCCESS, event.Status == sonar.STATUS_FAILED:
+	case event.Status == sonar.STATUS_CANCELED:
+		log.Info("analysis was canceled, nothing to record")
+		result.Reason = "analysis was canceled"
+		return nil, result, nil
+	case !event.Status.IsTaskStatus():
+		log.Warn("received event with an unknown analysis status, ignoring", zap.String("status", string(event.Status)))
+		result.Reason = fmt.Sprintf("unknown analysis status %q", event.Status)
+		return nil, result, nil
+	default:
+		log.Warn("received event for an analysis that has not finished, ignoring", zap.String("status", string(event.Status)))
+		result.Reason = fmt.Sprintf("analysis has not finished (%s)", event.Status)
+		return nil, result, nil
+	}
+
+	resourceUri := options.ResourceUri
+	var err error
+	if resourceUri == "" {
+		resourceUri, err = ResourceUriFromEvent(event, options.ResourceUriPrefix)
+	}
 	if err != nil {
 		log.Error("error getting resource uri from event", zap.Error(err))
-		// there's no point in responding with an error to sonar, as this is a user error
-		w.WriteHeader(http.StatusOK)
-		return
+		result.Outcome = OUTCOME_REJECTED
+		result.Reason = err.Error()
+		return nil, result, &ValidationError{Problems: []string{err.Error()}}
 	}
 
-	// allow for one minute to process this event
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
+	return &resolution{route: route, resourceUri: resourceUri}, nil, nil
+}
+
+// analysisTime determines when the analysis happened. Events with a missing or unrecognized timestamp are still
+// recorded, using the time the compute engine task finished when it's available, and the time the event was received
+// otherwise.
+func (l *listener) analysisTime(ctx context.Context, log *zap.Logger, event *sonar.Event, receivedAt time.Time) (time.Time, sink.TimestampSource) {
+	timestamp, err := event.AnalysisTime()
+	if err == nil {
+		return timestamp, sink.TIMESTAMP_SOURCE_EVENT
+	}
+
+	log.Warn("unable to parse analysis timestamp", zap.Error(err))
+
+	if l.sonarClient != nil {
+		task, err := l.sonarClient.GetTask(ctx, event.TaskId)
+		if err == nil {
+			var executedAt time.Time
+			if executedAt, err = sonar.ParseTimestamp(task.ExecutedAt); err == nil {
+				return executedAt, sink.TIMESTAMP_SOURCE_TASK
+			}
+		}
+
+		log.Warn("unable to determine analysis time from compute engine task", zap.Error(err))
+	}
 
-	// create a note to represent the sonar analysis
-	noteName, err := l.createNoteForEvent(ctx, event)
+	return receivedAt, sink.TIMESTAMP_SOURCE_RECEIVED
+}
+
+// boundResourceUriPrefix looks up the repository that the project is bound to when the event doesn't include a
+// resource uri prefix. This is only possible with SonarCloud, where projects are usually imported from an ALM.
+func (l *listener) boundResourceUriPrefix(ctx context.Context, log *zap.Logger, event *sonar.Event, options *ProcessOptions) string {
+	if l.sonarClient == nil || options.ResourceUriPrefix != "" || options.ResourceUri != "" || event.Project == nil || event.Project.Key == "" {
+		return ""
+	}
+
+	if _, ok := event.Properties[resourceUriPrefixPropertyName]; ok {
+		return ""
+	}
+
+	if event.Status != sonar.STATUS_SUCCESS && event.Status != sonar.STATUS_FAILED {
+		return ""
+	}
+
+	binding, err := l.sonarClient.GetProjectBinding(ctx, event.Project.Key)
 	if err != nil {
-		log.Error("error creating note for analysis", zap.Error(err))
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		log.Warn("unable to look up project binding", zap.Error(err))
+		return ""
+	}
+	// self-hosted instances don't expose bindings
+	if binding == nil {
+		return ""
 	}
 
-	// create occurrences for sonar analysis
-	response, err := l.createOccurrencesForEvent(ctx, event, resourceUri, noteName)
+	prefix, err := binding.ResourceUriPrefix()
 	if err != nil {
-		log.Error("error creating occurrences for event", zap.Error(err))
-		w.WriteHeader(500)
-		return
+		log.Warn("unable to derive resource uri prefix from project binding", zap.Error(err))
+		return ""
 	}
 
-	log.Debug("response payload", zap.Any("response", response.GetOccurrences()))
-	w.WriteHeader(200)
+	return prefix
 }
 
-// getResourceUriFromEvent parses the received event and returns a resource URI that can be referenced in occurrences.
+// additionalResourceUris returns the resources listed in the additional resource uris property.
+func additionalResourceUris(event *sonar.Event) []string {
+	var uris []string
+	for _, uri := range strings.Split(event.Properties[additionalResourceUrisPropertyName], ",") {
+		if uri = strings.TrimSpace(uri); uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+
+	return uris
+}
+
+// ResourceUriFromEvent parses the received event and returns a resource URI that can be referenced in occurrences.
 // Eventually, this needs to check if the community edition or the developer edition of sonar is being used. The events
 // sent from the developer edition should contain information about the repository URL that can be used to construct the
 // resource URI. Unfortunately, the community edition requires that an extra property "resourceUriPrefix" is sent with the
 // scan. We'll throw an error here if this property isn't present.
-func getResourceUriFromEvent(event *sonar.Event) (string, error) {
+func ResourceUriFromEvent(event *sonar.Event, prefixOverride string) (string, error) {
 	prefix, ok := event.Properties[resourceUriPrefixPropertyName]
+	if prefixOverride != "" {
+		prefix, ok = prefixOverride, true
+	}
+
 	if !ok {
 		return "", fmt.Errorf("expected event to contain the resource uri prefix. please run the scanner with the \"-D%s\" option", resourceUriPrefixPropertyName)
 	}
@@ -117,103 +460,3 @@ func getResourceUriFromEvent(event *sonar.Event) (string, error) {
 
 	return fmt.Sprintf("%s@%s", prefix, event.Revision), nil
 }
-
-// createNoteForEvent creates a note that represents the sonar analysis.
-func (l *listener) createNoteForEvent(ctx context.Context, event *sonar.Event) (string, error) {
-	var longDescription string
-	if event.Status == sonar.STATUS_FAILED {
-		longDescription = "Failed SonarQube Analysis"
-	} else if event.Status == sonar.STATUS_SUCCESS && event.QualityGate != nil {
-		longDescription = fmt.Sprintf("SonarQube Analysis using %s Quality Gate", event.QualityGate.Name)
-	} else {
-		return "", errors.New("unexpected event payload, unable to compute note for event")
-	}
-
-	note, err := l.rodeClient.CreateNote(ctx, &pb.CreateNoteRequest{
-		Note: &grafeas_go_proto.Note{
-			ShortDescription: "SonarQube Analysis",
-			LongDescription:  longDescription,
-			Kind:             common_go_proto.NoteKind_DISCOVERY,
-			RelatedUrl: []*common_go_proto.RelatedUrl{
-				{
-					Label: "Project URL",
-					Url:   event.Project.URL,
-				},
-			},
-			Type: &grafeas_go_proto.Note_Discovery{
-				Discovery: &discovery_go_proto.Discovery{
-					// in the future, this should reference the new static analysis note kind
-					AnalysisKind: common_go_proto.NoteKind_VULNERABILITY,
-				},
-			},
-		},
-		NoteId: fmt.Sprintf("sonar-scan-%s", event.TaskId),
-	})
-	if err != nil {
-		return "", err
-	}
-
-	return note.Name, nil
-}
-
-// createOccurrencesForEvent creates occurrences based on the received sonar event. We use discovery occurrences here
-// due to the lack of a better occurrence type. We also misuse the discovery analysis status, such that "FAILED" is
-// equivalent to a failing quality gate, rather than the analysis as a whole failing. This will be revisited with the
-// addition of a new static analysis occurrence type.
-func (l *listener) createOccurrencesForEvent(ctx context.Context, event *sonar.Event, resourceUri, noteName string) (*pb.BatchCreateOccurrencesResponse, error) {
-	timestamp, err := eventTimestamp(event)
-	if err != nil {
-		return nil, err
-	}
-
-	status := discovery_go_proto.Discovered_FINISHED_FAILED
-	if event.Status == sonar.STATUS_SUCCESS && event.QualityGate != nil && event.QualityGate.Status == sonar.STATUS_OK {
-		status = discovery_go_proto.Discovered_FINISHED_SUCCESS
-	}
-
-	return l.rodeClient.BatchCreateOccurrences(ctx, &pb.BatchCreateOccurrencesRequest{
-		Occurrences: []*grafeas_go_proto.Occurrence{
-			{
-				Resource: &grafeas_go_proto.Resource{
-					Uri: resourceUri,
-				},
-				NoteName:   noteName,
-				Kind:       common_go_proto.NoteKind_DISCOVERY,
-				CreateTime: timestamp,
-				Details: &grafeas_go_proto.Occurrence_Discovered{
-					Discovered: &discovery_go_proto.Details{
-						Discovered: &discovery_go_proto.Discovered{
-							ContinuousAnalysis: discovery_go_proto.Discovered_CONTINUOUS_ANALYSIS_UNSPECIFIED,
-							AnalysisStatus:     discovery_go_proto.Discovered_SCANNING,
-						},
-					},
-				},
-			},
-			{
-				Resource: &grafeas_go_proto.Resource{
-					Uri: resourceUri,
-				},
-				NoteName:   noteName,
-				Kind:       common_go_proto.NoteKind_DISCOVERY,
-				CreateTime: timestamp,
-				Details: &grafeas_go_proto.Occurrence_Discovered{
-					Discovered: &discovery_go_proto.Details{
-						Discovered: &discovery_go_proto.Discovered{
-							ContinuousAnalysis: discovery_go_proto.Discovered_CONTINUOUS_ANALYSIS_UNSPECIFIED,
-							AnalysisStatus:     status,
-						},
-					},
-				},
-			},
-		},
-	})
-}
-
-func eventTimestamp(event *sonar.Event) (*timestamppb.Timestamp, error) {
-	timestamp, err := time.Parse("2006-01-02T15:04:05+0000", event.AnalysedAt)
-	if err != nil {
-		return nil, err
-	}
-
-	return timestamppb.New(timestamp), nil
-}
@@ -15,22 +15,31 @@
 package listener
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/rode/collector-sonarqube/filter"
+	"github.com/rode/collector-sonarqube/internal/httpjson"
+	"github.com/rode/collector-sonarqube/routing"
+	"github.com/rode/collector-sonarqube/sink"
 	"github.com/rode/collector-sonarqube/sonar"
 	pb "github.com/rode/rode/proto/v1alpha1"
 	"github.com/rode/rode/proto/v1alpha1fakes"
 	"github.com/rode/rode/protodeps/grafeas/proto/v1beta1/common_go_proto"
 	"github.com/rode/rode/protodeps/grafeas/proto/v1beta1/discovery_go_proto"
 	"github.com/rode/rode/protodeps/grafeas/proto/v1beta1/grafeas_go_proto"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
+	"time"
 )
 
 var _ = Describe("listener", func() {
@@ -44,7 +53,7 @@ var _ = Describe("listener", func() {
 	})
 
 	JustBeforeEach(func() {
-		listener = NewListener(logger, rodeClient)
+		listener = NewListener(logger, sink.NewRodeSink(logger, rodeClient, nil), nil, nil, nil, nil, nil)
 	})
 
 	Context("ProcessEvent", func() {
@@ -106,8 +115,9 @@ var _ = Describe("listener", func() {
 				expectedPayload = strings.NewReader("invalid json")
 			})
 
-			It("should respond with an error", func() {
-				Expect(recorder.Code).To(Equal(http.StatusInternalServerError))
+			It("should respond with a 400", func() {
+				Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+				Expect(responseErrors(recorder)).To(HaveLen(1))
 			})
 
 			It("should not make any request to rode", func() {
@@ -172,6 +182,7 @@ var _ = Describe("listener", func() {
 				Expect(scanEndOccurrence.Kind).To(Equal(common_go_proto.NoteKind_DISCOVERY))
 				Expect(scanEndOccurrence.NoteName).To(Equal(expectedNoteName))
 				Expect(scanEndOccurrence.Details.(*grafeas_go_proto.Occurrence_Discovered).Discovered.Discovered.AnalysisStatus).To(Equal(discovery_go_proto.Discovered_FINISHED_SUCCESS))
+				Expect(scanEndOccurrence.Details.(*grafeas_go_proto.Occurrence_Discovered).Discovered.Discovered.AnalysisStatusError).To(BeNil())
 				Expect(scanEndOccurrence.Resource.Uri).To(Equal(fmt.Sprintf("%s@%s", expectedResourceUriPrefix, expectedRevision)))
 			})
 
@@ -207,20 +218,183 @@ var _ = Describe("listener", func() {
 				})
 			})
 
-			When("an unexpected payload is received from sonar", func() {
+			When("the event includes branch and server details", func() {
+				BeforeEach(func() {
+					expectedSonarEvent.ServerUrl = "https://sonar.example.com"
+					expectedSonarEvent.Project.Key = "my-project"
+					expectedSonarEvent.Project.URL = "https://sonar.example.com/dashboard?id=my-project"
+					expectedSonarEvent.Branch = &sonar.Branch{
+						Name: "42",
+						Type: sonar.BRANCH_TYPE_PULL_REQUEST,
+						URL:  "https://sonar.example.com/dashboard?id=my-project&pullRequest=42",
+					}
+					expectedSonarEvent.QualityGate.Name = "Sonar way"
+					expectedSonarEvent.QualityGate.Status = sonar.STATUS_ERROR
+				})
+
+				It("should link the note to the relevant SonarQube pages", func() {
+					_, createNoteRequest, _ := rodeClient.CreateNoteArgsForCall(0)
+
+					var labels, urls []string
+					for _, relatedUrl := range createNoteRequest.Note.RelatedUrl {
+						labels = append(labels, relatedUrl.Label)
+						urls = append(urls, relatedUrl.Url)
+					}
+
+					Expect(labels).To(Equal([]string{"Project URL", "Analysis Dashboard", "Quality Gate", "Issues", "Compute Engine Task"}))
+					Expect(urls).To(Equal([]string{
+						"https://sonar.example.com/dashboard?id=my-project",
+						"https://sonar.example.com/dashboard?id=my-project&pullRequest=42",
+						"https://sonar.example.com/quality_gates/show/Sonar%20way",
+						"https://sonar.example.com/project/issues?id=my-project&pullRequest=42&resolved=false",
+						"https://sonar.example.com/api/ce/task?id=" + expectedTaskId,
+					}))
+				})
+
+				It("should link the failing occurrence to the analysis dashboard", func() {
+					_, batchCreateOccurrencesRequest, _ := rodeClient.BatchCreateOccurrencesArgsForCall(0)
+
+					Expect(batchCreateOccurrencesRequest.Occurrences[0].Remediation).To(BeEmpty())
+					Expect(batchCreateOccurrencesRequest.Occurrences[1].Remediation).To(ContainSubstring("https://sonar.example.com/dashboard?id=my-project&pullRequest=42"))
+				})
+			})
+
+			When("the quality gate fails", func() {
+				BeforeEach(func() {
+					expectedSonarEvent.QualityGate.Status = sonar.STATUS_ERROR
+					expectedSonarEvent.QualityGate.Conditions = []*sonar.Condition{
+						{
+							Metric:         "new_coverage",
+							Operator:       sonar.OPERATOR_LESS_THAN,
+							ErrorThreshold: "80",
+							Value:          "72.5",
+							Status:         sonar.CONDITION_STATUS_ERROR,
+						},
+						{
+							Metric:         "new_reliability_rating",
+							Operator:       sonar.OPERATOR_GREATER_THAN,
+							ErrorThreshold: "1",
+							Value:          "1",
+							Status:         sonar.CONDITION_STATUS_OK,
+						},
+					}
+				})
+
+				It("should indicate the failure in the discovery occurrence", func() {
+					_, batchCreateOccurrencesRequest, _ := rodeClient.BatchCreateOccurrencesArgsForCall(0)
+
+					discovered := batchCreateOccurrencesRequest.Occurrences[1].Details.(*grafeas_go_proto.Occurrence_Discovered).Discovered.Discovered
+					Expect(discovered.AnalysisStatus).To(Equal(discovery_go_proto.Discovered_FINISHED_FAILED))
+					Expect(discovered.AnalysisStatusError.Message).To(Equal("quality gate failed: new_coverage is 72.5% (less than 80%)"))
+				})
+			})
+
+			When("the quality gate passes with warnings", func() {
+				BeforeEach(func() {
+					expectedSonarEvent.QualityGate.Status = sonar.STATUS_WARN
+					expectedSonarEvent.QualityGate.Conditions = []*sonar.Condition{
+						{
+							Metric:           "reliability_rating",
+							Operator:         sonar.OPERATOR_GREATER_THAN,
+							ErrorThreshold:   "3",
+							WarningThreshold: "1",
+							Value:            "2",
+							Status:           sonar.CONDITION_STATUS_WARN,
+						},
+					}
+				})
+
+				It("should record the analysis as successful with a warning", func() {
+					_, batchCreateOccurrencesRequest, _ := rodeClient.BatchCreateOccurrencesArgsForCall(0)
+
+					discovered := batchCreateOccurrencesRequest.Occurrences[1].Details.(*grafeas_go_proto.Occurrence_Discovered).Discovered.Discovered
+					Expect(discovered.AnalysisStatus).To(Equal(discovery_go_proto.Discovered_FINISHED_SUCCESS))
+					Expect(discovered.AnalysisStatusError.Message).To(Equal("quality gate passed with warnings: reliability_rating is B (greater than A)"))
+				})
+			})
+
+			When("the project does not have a quality gate", func() {
 				BeforeEach(func() {
 					expectedSonarEvent.QualityGate = nil
 				})
 
-				It("should respond with a 500", func() {
-					Expect(recorder.Code).To(Equal(http.StatusInternalServerError))
+				It("should create a note indicating that there was no quality gate", func() {
+					Expect(rodeClient.CreateNoteCallCount()).To(Equal(1))
+
+					_, createNoteRequest, _ := rodeClient.CreateNoteArgsForCall(0)
+
+					Expect(createNoteRequest.Note.LongDescription).To(Equal("SonarQube Analysis without a Quality Gate"))
 				})
 
-				It("should not create a note", func() {
+				It("should record the analysis as successful", func() {
+					Expect(rodeClient.BatchCreateOccurrencesCallCount()).To(Equal(1))
+
+					_, batchCreateOccurrencesRequest, _ := rodeClient.BatchCreateOccurrencesArgsForCall(0)
+
+					scanEndOccurrence := batchCreateOccurrencesRequest.Occurrences[1]
+					Expect(scanEndOccurrence.Details.(*grafeas_go_proto.Occurrence_Discovered).Discovered.Discovered.AnalysisStatus).To(Equal(discovery_go_proto.Discovered_FINISHED_SUCCESS))
+				})
+
+				It("should respond with a 200", func() {
+					Expect(recorder.Code).To(Equal(http.StatusOK))
+				})
+			})
+
+			When("the quality gate status is NONE", func() {
+				BeforeEach(func() {
+					expectedSonarEvent.QualityGate.Status = sonar.STATUS_NONE
+				})
+
+				It("should be treated as an analysis without a quality gate", func() {
+					_, createNoteRequest, _ := rodeClient.CreateNoteArgsForCall(0)
+
+					Expect(createNoteRequest.Note.LongDescription).To(Equal("SonarQube Analysis without a Quality Gate"))
+				})
+			})
+
+			When("the analysis was canceled", func() {
+				BeforeEach(func() {
+					expectedSonarEvent.Status = sonar.STATUS_CANCELED
+				})
+
+				It("should respond with a 200", func() {
+					Expect(recorder.Code).To(Equal(http.StatusOK))
+				})
+
+				It("should not make any request to rode", func() {
 					Expect(rodeClient.CreateNoteCallCount()).To(Equal(0))
+					Expect(rodeClient.BatchCreateOccurrencesCallCount()).To(Equal(0))
 				})
+			})
 
-				It("should not create occurrences", func() {
+			When("the analysis has not finished", func() {
+				BeforeEach(func() {
+					expectedSonarEvent.Status = sonar.STATUS_IN_PROGRESS
+				})
+
+				It("should respond with a 200", func() {
+					Expect(recorder.Code).To(Equal(http.StatusOK))
+				})
+
+				It("should not make any request to rode", func() {
+					Expect(rodeClient.CreateNoteCallCount()).To(Equal(0))
+					Expect(rodeClient.BatchCreateOccurrencesCallCount()).To(Equal(0))
+				})
+			})
+
+			When("the analysis status is unknown", func() {
+				BeforeEach(func() {
+					expectedSonarEvent.Status = sonar.EventStatus(fake.LetterN(10))
+				})
+
+				// a newer version of SonarQube may add statuses, and a 400 would show up as a failed delivery, so
+				// unknown statuses are acknowledged rather than rejected
+				It("should respond with a 200 rather than rejecting the event", func() {
+					Expect(recorder.Code).To(Equal(http.StatusOK))
+				})
+
+				It("should not make any request to rode", func() {
+					Expect(rodeClient.CreateNoteCallCount()).To(Equal(0))
 					Expect(rodeClient.BatchCreateOccurrencesCallCount()).To(Equal(0))
 				})
 			})
@@ -230,12 +404,17 @@ var _ = Describe("listener", func() {
 					expectedSonarEvent.AnalysedAt = fake.LetterN(10)
 				})
 
-				It("should respond with a 500", func() {
-					Expect(recorder.Code).To(Equal(http.StatusInternalServerError))
+				It("should respond with a 200", func() {
+					Expect(recorder.Code).To(Equal(http.StatusOK))
 				})
 
-				It("should not create occurrences", func() {
-					Expect(rodeClient.BatchCreateOccurrencesCallCount()).To(Equal(0))
+				It("should use the time the event was received", func() {
+					Expect(rodeClient.BatchCreateOccurrencesCallCount()).To(Equal(1))
+
+					_, batchCreateOccurrencesRequest, _ := rodeClient.BatchCreateOccurrencesArgsForCall(0)
+					createTime := batchCreateOccurrencesRequest.Occurrences[0].CreateTime.AsTime()
+
+					Expect(createTime).To(BeTemporally("~", time.Now(), time.Minute))
 				})
 			})
 
@@ -244,8 +423,9 @@ var _ = Describe("listener", func() {
 					delete(expectedSonarEvent.Properties, resourceUriPrefixPropertyName)
 				})
 
-				It("should respond with a 200 (user error)", func() {
-					Expect(recorder.Code).To(Equal(http.StatusOK))
+				It("should respond with a 400 explaining how to set the property", func() {
+					Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+					Expect(responseErrors(recorder)).To(ConsistOf(ContainSubstring("-D" + resourceUriPrefixPropertyName)))
 				})
 
 				It("should not create a note", func() {
@@ -257,6 +437,54 @@ var _ = Describe("listener", func() {
 				})
 			})
 
+			When("the project is missing", func() {
+				BeforeEach(func() {
+					expectedSonarEvent.Project = nil
+				})
+
+				It("should respond with a 400", func() {
+					Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+					Expect(responseErrors(recorder)).To(ConsistOf("project is required"))
+				})
+
+				It("should not make any request to rode", func() {
+					Expect(rodeClient.CreateNoteCallCount()).To(Equal(0))
+					Expect(rodeClient.BatchCreateOccurrencesCallCount()).To(Equal(0))
+				})
+			})
+
+			When("the event has several problems", func() {
+				BeforeEach(func() {
+					expectedSonarEvent.TaskId = ""
+					expectedSonarEvent.Revision = ""
+					expectedSonarEvent.Project.Key = ""
+					expectedSonarEvent.QualityGate.Conditions = []*sonar.Condition{{}}
+				})
+
+				It("should list every problem", func() {
+					Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+					Expect(recorder.Header().Get("Content-Type")).To(Equal("application/json"))
+					Expect(responseErrors(recorder)).To(ConsistOf(
+						"taskId is required",
+						"revision is required",
+						"project.key is required",
+						"qualityGate.conditions[0].metric is required",
+					))
+				})
+			})
+
+			When("a canceled analysis is missing details", func() {
+				BeforeEach(func() {
+					expectedSonarEvent.Status = sonar.STATUS_CANCELED
+					expectedSonarEvent.Project = nil
+					expectedSonarEvent.AnalysedAt = ""
+				})
+
+				It("should still respond with a 200", func() {
+					Expect(recorder.Code).To(Equal(http.StatusOK))
+				})
+			})
+
 			When("the git:// prefix is not specified", func() {
 				BeforeEach(func() {
 					expectedSonarEvent.Properties[resourceUriPrefixPropertyName] = strings.TrimPrefix(expectedResourceUriPrefix, "git://")
@@ -290,6 +518,896 @@ var _ = Describe("listener", func() {
 	})
 })
 
+var _ = Describe("Process", func() {
+	var (
+		rodeClient    *v1alpha1fakes.FakeRodeClient
+		listener      Listener
+		event         *sonar.Event
+		sonarClient   *fakeSonarClient
+		properties    *sonar.PropertyFilter
+		ingestFilter  *filter.Filter
+		routingRules  *routing.Rules
+		noteTemplates *sink.NoteTemplates
+		recorder      *recordingSink
+		history       *fakeHistory
+		options       *ProcessOptions
+		result        *Result
+		err           error
+	)
+
+	BeforeEach(func() {
+		sonarClient = &fakeSonarClient{}
+		properties = nil
+		ingestFilter = nil
+		routingRules = nil
+		noteTemplates = nil
+		history = &fakeHistory{}
+		rodeClient = &v1alpha1fakes.FakeRodeClient{}
+		rodeClient.CreateNoteReturns(&grafeas_go_proto.Note{Name: fake.LetterN(10)}, nil)
+		rodeClient.BatchCreateOccurrencesReturns(&pb.BatchCreateOccurrencesResponse{}, nil)
+
+		options = nil
+		event = &sonar.Event{
+			TaskId:     fake.LetterN(10),
+			Status:     sonar.STATUS_SUCCESS,
+			AnalysedAt: "2021-05-27T19:08:23+0000",
+			Revision:   fake.LetterN(10),
+			Project: &sonar.Project{
+				Key: fake.LetterN(10),
+				URL: fake.URL(),
+			},
+			Properties: map[string]string{
+				resourceUriPrefixPropertyName: "git://" + fake.DomainName(),
+			},
+		}
+	})
+
+	JustBeforeEach(func() {
+		var client sonar.Client
+		if sonarClient != nil {
+			client = sonarClient
+		}
+
+		recorder = &recordingSink{}
+		listener = NewListener(logger, sink.NewFanout(logger, []string{"rode", recorder.Name()}, sink.NewRodeSink(logger, rodeClient, noteTemplates), recorder), client, properties, ingestFilter, routingRules, history)
+		result, err = listener.Process(context.Background(), event, options)
+	})
+
+	It("should report that the analysis was recorded", func() {
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.TaskId).To(Equal(event.TaskId))
+		Expect(result.Outcome).To(Equal(OUTCOME_RECORDED))
+		Expect(result.ResourceUri).To(Equal(fmt.Sprintf("%s@%s", event.Properties[resourceUriPrefixPropertyName], event.Revision)))
+	})
+
+	When("rode returns the records it created", func() {
+		var noteName string
+
+		BeforeEach(func() {
+			noteName = "projects/rode/notes/" + fake.LetterN(10)
+			rodeClient.CreateNoteReturns(&grafeas_go_proto.Note{Name: noteName}, nil)
+			rodeClient.BatchCreateOccurrencesReturns(&pb.BatchCreateOccurrencesResponse{
+				Occurrences: []*grafeas_go_proto.Occurrence{{Name: "projects/rode/occurrences/1"}, {Name: "projects/rode/occurrences/2"}},
+			}, nil)
+		})
+
+		It("should include them in the result", func() {
+			Expect(result.NoteName).To(Equal(noteName))
+			Expect(result.OccurrenceNames).To(Equal([]string{"projects/rode/occurrences/1", "projects/rode/occurrences/2"}))
+		})
+	})
+
+	It("should record the outcome in the history", func() {
+		Expect(history.events).To(ConsistOf(event))
+		Expect(history.options[0].Source).To(Equal(SOURCE_WEBHOOK))
+		Expect(history.results).To(ConsistOf(result))
+	})
+
+	When("the source is set", func() {
+		BeforeEach(func() {
+			options = &ProcessOptions{Source: SOURCE_POLL}
+		})
+
+		It("should be recorded in the history", func() {
+			Expect(history.options[0].Source).To(Equal(SOURCE_POLL))
+		})
+	})
+
+	When("recording the history fails", func() {
+		BeforeEach(func() {
+			history.err = errors.New("disk full")
+		})
+
+		It("should still record the analysis", func() {
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Outcome).To(Equal(OUTCOME_RECORDED))
+		})
+	})
+
+	When("the event is excluded by a filter rule", func() {
+		BeforeEach(func() {
+			ingestFilter = filter.New(logger, &filter.Rules{
+				Exclude: []*filter.Rule{{Name: "sandboxes", Projects: []string{event.Project.Key}}},
+			}, nil)
+		})
+
+		It("should skip the event without calling rode", func() {
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Outcome).To(Equal(OUTCOME_SKIPPED))
+			Expect(result.Reason).To(ContainSubstring("sandboxes"))
+			Expect(rodeClient.CreateNoteCallCount()).To(BeZero())
+			Expect(recorder.count()).To(BeZero())
+		})
+
+		It("should count the skipped event", func() {
+			Expect(ingestFilter.Stats().SkippedByRule).To(Equal(map[string]int64{"sandboxes": 1}))
+		})
+
+		It("should record the outcome in the history", func() {
+			Expect(history.results).To(ConsistOf(result))
+		})
+
+		When("the event is also invalid", func() {
+			BeforeEach(func() {
+				event.Properties = nil
+			})
+
+			It("should skip it rather than reject it", func() {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result.Outcome).To(Equal(OUTCOME_SKIPPED))
+			})
+		})
+	})
+
+	When("the project's tags can't be looked up for a filter rule", func() {
+		BeforeEach(func() {
+			sonarClient.tagsErr = errors.New("service unavailable")
+			ingestFilter = filter.New(logger, &filter.Rules{
+				Exclude: []*filter.Rule{{Name: "sandboxes", Tags: []string{"sandbox"}}},
+			}, sonarClient)
+		})
+
+		It("should fail rather than record the analysis", func() {
+			Expect(err).To(MatchError(ContainSubstring("service unavailable")))
+			Expect(result.Outcome).To(Equal(OUTCOME_FAILED))
+			Expect(recorder.count()).To(BeZero())
+			Expect(history.results).To(ConsistOf(result))
+		})
+	})
+
+	When("the event matches an include rule", func() {
+		BeforeEach(func() {
+			ingestFilter = filter.New(logger, &filter.Rules{
+				Include: []*filter.Rule{{Name: "team projects", Projects: []string{event.Project.Key[:3] + "*"}}},
+			}, nil)
+		})
+
+		It("should record the analysis", func() {
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Outcome).To(Equal(OUTCOME_RECORDED))
+		})
+	})
+
+	Context("routing rules", func() {
+		compile := func(rules ...*routing.RuleConfig) {
+			var compileErr error
+			routingRules, compileErr = routing.Compile(&routing.Config{Rules: rules}, []string{"rode", "recording"})
+			Expect(compileErr).ToNot(HaveOccurred())
+		}
+
+		When("a rule drops the event", func() {
+			BeforeEach(func() {
+				compile(&routing.RuleConfig{Name: "everything", When: "true", Drop: true})
+			})
+
+			It("should skip it without calling rode", func() {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result.Outcome).To(Equal(OUTCOME_SKIPPED))
+				Expect(result.Reason).To(ContainSubstring("everything"))
+				Expect(rodeClient.CreateNoteCallCount()).To(BeZero())
+				Expect(recorder.count()).To(BeZero())
+			})
+		})
+
+		When("a rule overrides the resource uri", func() {
+			BeforeEach(func() {
+				compile(&routing.RuleConfig{When: "true", ResourceUri: "'harbor.example.com/rode/api:' + event.revision"})
+				event.Properties = nil
+			})
+
+			It("should record the analysis against it", func() {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result.ResourceUri).To(Equal("harbor.example.com/rode/api:" + event.Revision))
+			})
+
+			When("the caller also chose a resource uri", func() {
+				BeforeEach(func() {
+					options = &ProcessOptions{ResourceUri: "git://example.com/repo@abc123"}
+				})
+
+				It("should use the caller's", func() {
+					Expect(result.ResourceUri).To(Equal("git://example.com/repo@abc123"))
+				})
+			})
+		})
+
+		When("a rule adds labels and selects sinks", func() {
+			BeforeEach(func() {
+				compile(&routing.RuleConfig{When: "true", Labels: map[string]string{"team": "'a'"}, Sinks: []string{"recording"}})
+			})
+
+			It("should only send the labelled analysis to the selected sinks", func() {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(rodeClient.CreateNoteCallCount()).To(BeZero())
+				Expect(recorder.analyses).To(HaveLen(1))
+				Expect(recorder.analyses[0].Metadata).To(Equal(map[string]string{"team": "a"}))
+			})
+		})
+
+		When("a rule can't be evaluated", func() {
+			BeforeEach(func() {
+				compile(&routing.RuleConfig{Name: "team", When: "event.properties['sonar.analysis.team'] == 'a'", Drop: true})
+			})
+
+			It("should treat the rule as not matching", func() {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result.Outcome).To(Equal(OUTCOME_RECORDED))
+				Expect(rodeClient.CreateNoteCallCount()).To(Equal(1))
+			})
+		})
+	})
+
+	When("the resource uri prefix is overridden", func() {
+		var expectedPrefix string
+
+		BeforeEach(func() {
+			expectedPrefix = "git://" + fake.DomainName()
+			options = &ProcessOptions{ResourceUriPrefix: expectedPrefix}
+		})
+
+		It("should use the override", func() {
+			Expect(result.ResourceUri).To(Equal(fmt.Sprintf("%s@%s", expectedPrefix, event.Revision)))
+		})
+
+		It("should not modify the event", func() {
+			Expect(event.Properties[resourceUriPrefixPropertyName]).ToNot(Equal(expectedPrefix))
+		})
+	})
+
+	When("the event is skipped", func() {
+		BeforeEach(func() {
+			event.Status = sonar.STATUS_CANCELED
+		})
+
+		It("should explain why", func() {
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Outcome).To(Equal(OUTCOME_SKIPPED))
+			Expect(result.Reason).To(Equal("analysis was canceled"))
+		})
+	})
+
+	When("the event is invalid", func() {
+		BeforeEach(func() {
+			event.Project = nil
+		})
+
+		It("should return a validation error", func() {
+			var validationErr *ValidationError
+
+			Expect(errors.As(err, &validationErr)).To(BeTrue())
+			Expect(validationErr.Problems).To(ConsistOf("project is required"))
+			Expect(result.Outcome).To(Equal(OUTCOME_REJECTED))
+		})
+	})
+
+	When("the resource uri prefix is overridden and the property is missing", func() {
+		BeforeEach(func() {
+			delete(event.Properties, resourceUriPrefixPropertyName)
+			options = &ProcessOptions{ResourceUriPrefix: "git://" + fake.DomainName()}
+		})
+
+		It("should record the analysis", func() {
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Outcome).To(Equal(OUTCOME_RECORDED))
+		})
+	})
+
+	When("the resource uri is overridden and the property is missing", func() {
+		var expectedResourceUri string
+
+		BeforeEach(func() {
+			delete(event.Properties, resourceUriPrefixPropertyName)
+			expectedResourceUri = fmt.Sprintf("git://%s@%s", fake.DomainName(), fake.LetterN(10))
+			options = &ProcessOptions{ResourceUri: expectedResourceUri}
+		})
+
+		It("should record the analysis against the override", func() {
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Outcome).To(Equal(OUTCOME_RECORDED))
+			Expect(result.ResourceUri).To(Equal(expectedResourceUri))
+		})
+
+		It("should not look up the project binding", func() {
+			Expect(sonarClient.bindingCalls).To(BeEmpty())
+		})
+	})
+
+	Context("analysis time", func() {
+		var (
+			occurrenceTime time.Time
+			statusError    *status.Status
+		)
+
+		JustBeforeEach(func() {
+			_, batchCreateOccurrencesRequest, _ := rodeClient.BatchCreateOccurrencesArgsForCall(0)
+			occurrenceTime = batchCreateOccurrencesRequest.Occurrences[0].CreateTime.AsTime()
+			statusError = batchCreateOccurrencesRequest.Occurrences[1].Details.(*grafeas_go_proto.Occurrence_Discovered).Discovered.Discovered.AnalysisStatusError
+		})
+
+		timeSource := func() interface{} {
+			Expect(statusError).ToNot(BeNil())
+			Expect(statusError.Details).To(HaveLen(1))
+
+			details := &structpb.Struct{}
+			Expect(statusError.Details[0].UnmarshalTo(details)).To(Succeed())
+
+			return details.AsMap()["analysedAtSource"]
+		}
+
+		It("should use the event timestamp", func() {
+			Expect(occurrenceTime).To(Equal(time.Date(2021, 5, 27, 19, 8, 23, 0, time.UTC)))
+			Expect(sonarClient.calls).To(BeEmpty())
+		})
+
+		It("should not flag the time in the end occurrence", func() {
+			Expect(statusError).To(BeNil())
+		})
+
+		When("the timestamp includes milliseconds and an offset", func() {
+			BeforeEach(func() {
+				event.AnalysedAt = "2021-05-27T21:08:23.512+0200"
+			})
+
+			It("should convert the timestamp correctly", func() {
+				Expect(occurrenceTime).To(Equal(time.Date(2021, 5, 27, 19, 8, 23, 512000000, time.UTC)))
+			})
+		})
+
+		When("the timestamp can't be parsed", func() {
+			BeforeEach(func() {
+				event.AnalysedAt = fake.LetterN(10)
+				sonarClient.task = &sonar.Task{ExecutedAt: "2021-05-27T19:10:00+0000"}
+			})
+
+			It("should record the analysis", func() {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result.Outcome).To(Equal(OUTCOME_RECORDED))
+			})
+
+			It("should look up the compute engine task", func() {
+				Expect(sonarClient.calls).To(ConsistOf(event.TaskId))
+			})
+
+			It("should use the time the task finished", func() {
+				Expect(occurrenceTime).To(Equal(time.Date(2021, 5, 27, 19, 10, 0, 0, time.UTC)))
+			})
+
+			It("should flag the time in the end occurrence", func() {
+				Expect(timeSource()).To(Equal(string(sink.TIMESTAMP_SOURCE_TASK)))
+			})
+
+			When("the task can't be retrieved", func() {
+				BeforeEach(func() {
+					sonarClient.err = errors.New(fake.LetterN(10))
+				})
+
+				It("should use the time the event was received", func() {
+					Expect(occurrenceTime).To(BeTemporally("~", time.Now(), time.Minute))
+				})
+
+				It("should flag the time in the end occurrence", func() {
+					Expect(timeSource()).To(Equal(string(sink.TIMESTAMP_SOURCE_RECEIVED)))
+				})
+			})
+		})
+
+		When("the timestamp is missing and there is no sonar client", func() {
+			BeforeEach(func() {
+				event.AnalysedAt = ""
+				sonarClient = nil
+			})
+
+			It("should use the time the event was received", func() {
+				Expect(occurrenceTime).To(BeTemporally("~", time.Now(), time.Minute))
+			})
+		})
+	})
+
+	Context("scanner properties", func() {
+		BeforeEach(func() {
+			event.Properties["sonar.analysis.buildUrl"] = "https://jenkins.example.com/job/foo/12/"
+			event.Properties["sonar.analysis.buildNumber"] = "12"
+			event.Properties["sonar.analysis.team"] = "platform"
+			event.Properties["sonar.projectVersion"] = "1.0.0"
+		})
+
+		It("should not copy any properties by default", func() {
+			Expect(recorder.analyses).To(HaveLen(1))
+			Expect(recorder.analyses[0].Metadata).To(BeNil())
+		})
+
+		It("should recognize the pipeline run", func() {
+			Expect(recorder.analyses[0].Pipeline).To(Equal(&sonar.CIRun{
+				Provider: sonar.CI_PROVIDER_JENKINS,
+				Id:       "12",
+				Url:      "https://jenkins.example.com/job/foo/12/",
+			}))
+		})
+
+		It("should link the note to the pipeline run", func() {
+			_, createNoteRequest, _ := rodeClient.CreateNoteArgsForCall(0)
+
+			Expect(createNoteRequest.Note.RelatedUrl).To(ContainElement(WithTransform(func(u *common_go_proto.RelatedUrl) string {
+				return u.Label + " " + u.Url
+			}, Equal("Pipeline Run https://jenkins.example.com/job/foo/12/"))))
+		})
+
+		When("properties are allowed", func() {
+			BeforeEach(func() {
+				properties = sonar.NewPropertyFilter([]string{"sonar.analysis.team", "sonar.project*"})
+			})
+
+			It("should copy the allowed properties into the analysis", func() {
+				Expect(recorder.analyses[0].Metadata).To(Equal(map[string]string{
+					"sonar.analysis.team":  "platform",
+					"sonar.projectVersion": "1.0.0",
+				}))
+			})
+
+			It("should record the properties and the pipeline run in the status of the end occurrence", func() {
+				_, request, _ := rodeClient.BatchCreateOccurrencesArgsForCall(0)
+				statusError := request.Occurrences[1].Details.(*grafeas_go_proto.Occurrence_Discovered).Discovered.Discovered.AnalysisStatusError
+
+				Expect(statusError.Code).To(BeZero())
+				Expect(statusError.Details).To(HaveLen(1))
+
+				details := &structpb.Struct{}
+				Expect(statusError.Details[0].UnmarshalTo(details)).To(Succeed())
+				Expect(details.AsMap()).To(Equal(map[string]interface{}{
+					"metadata": map[string]interface{}{
+						"sonar.analysis.team":  "platform",
+						"sonar.projectVersion": "1.0.0",
+					},
+					"pipeline": map[string]interface{}{
+						"provider": string(sonar.CI_PROVIDER_JENKINS),
+						"id":       "12",
+						"url":      "https://jenkins.example.com/job/foo/12/",
+					},
+				}))
+			})
+
+			When("the quality gate failed", func() {
+				BeforeEach(func() {
+					event.QualityGate = &sonar.QualityGate{Name: "Sonar way", Status: sonar.STATUS_ERROR}
+				})
+
+				It("should keep the failure in the status", func() {
+					_, request, _ := rodeClient.BatchCreateOccurrencesArgsForCall(0)
+					statusError := request.Occurrences[1].Details.(*grafeas_go_proto.Occurrence_Discovered).Discovered.Discovered.AnalysisStatusError
+
+					Expect(statusError.Message).To(Equal("quality gate failed"))
+					Expect(statusError.Details).To(HaveLen(1))
+				})
+			})
+		})
+	})
+
+	When("the resource uri prefix property is missing", func() {
+		BeforeEach(func() {
+			delete(event.Properties, resourceUriPrefixPropertyName)
+		})
+
+		When("the project is bound to a repository", func() {
+			BeforeEach(func() {
+				sonarClient.binding = &sonar.ProjectBinding{
+					Alm: "github",
+					Url: "https://github.com/rode/collector-sonarqube",
+				}
+			})
+
+			It("should derive the resource uri from the binding", func() {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(sonarClient.bindingCalls).To(ConsistOf(event.Project.Key))
+				Expect(result.ResourceUri).To(Equal("git://github.com/rode/collector-sonarqube@" + event.Revision))
+			})
+		})
+
+		When("the instance doesn't expose bindings", func() {
+			It("should reject the event", func() {
+				var validationErr *ValidationError
+
+				Expect(errors.As(err, &validationErr)).To(BeTrue())
+				Expect(sonarClient.bindingCalls).To(ConsistOf(event.Project.Key))
+				Expect(result.Outcome).To(Equal(OUTCOME_REJECTED))
+			})
+		})
+
+		When("the binding can't be retrieved", func() {
+			BeforeEach(func() {
+				sonarClient.bindingErr = errors.New(fake.LetterN(10))
+			})
+
+			It("should reject the event", func() {
+				var validationErr *ValidationError
+
+				Expect(errors.As(err, &validationErr)).To(BeTrue())
+				Expect(result.Outcome).To(Equal(OUTCOME_REJECTED))
+			})
+		})
+	})
+
+	When("the event includes the resource uri prefix property", func() {
+		It("should not look up the project binding", func() {
+			Expect(sonarClient.bindingCalls).To(BeEmpty())
+		})
+	})
+
+	When("the analysis applies to additional resources", func() {
+		var (
+			apiUri string
+			webUri string
+		)
+
+		BeforeEach(func() {
+			apiUri = "harbor.example.com/rode/api@sha256:" + fake.LetterN(64)
+			webUri = "harbor.example.com/rode/web@sha256:" + fake.LetterN(64)
+			event.Properties[additionalResourceUrisPropertyName] = fmt.Sprintf("%s, %s,", apiUri, webUri)
+		})
+
+		It("should record the analysis against every resource in one batch", func() {
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.ArtifactUris).To(Equal([]string{apiUri, webUri}))
+			Expect(rodeClient.BatchCreateOccurrencesCallCount()).To(Equal(1))
+
+			_, request, _ := rodeClient.BatchCreateOccurrencesArgsForCall(0)
+			var uris []string
+			for _, occurrence := range request.Occurrences {
+				uris = append(uris, occurrence.Resource.Uri)
+			}
+
+			Expect(uris).To(Equal([]string{result.ResourceUri, result.ResourceUri, apiUri, apiUri, webUri, webUri}))
+		})
+
+		When("the analysis can't be recorded against some of the resources", func() {
+			BeforeEach(func() {
+				rodeClient.BatchCreateOccurrencesReturnsOnCall(0, nil, errors.New(fake.LetterN(10)))
+				rodeClient.BatchCreateOccurrencesReturnsOnCall(1, &pb.BatchCreateOccurrencesResponse{}, nil)
+				rodeClient.BatchCreateOccurrencesReturnsOnCall(2, nil, errors.New(fake.LetterN(10)))
+				rodeClient.BatchCreateOccurrencesReturnsOnCall(3, &pb.BatchCreateOccurrencesResponse{}, nil)
+			})
+
+			It("should retry each resource separately", func() {
+				Expect(rodeClient.BatchCreateOccurrencesCallCount()).To(Equal(4))
+
+				for i, uri := range []string{result.ResourceUri, apiUri, webUri} {
+					_, request, _ := rodeClient.BatchCreateOccurrencesArgsForCall(i + 1)
+					Expect(request.Occurrences).To(HaveLen(2))
+					Expect(request.Occurrences[0].Resource.Uri).To(Equal(uri))
+				}
+			})
+
+			It("should report the resources that failed", func() {
+				Expect(err).To(HaveOccurred())
+				Expect(result.Outcome).To(Equal(OUTCOME_FAILED))
+				Expect(result.FailedResourceUris).To(ConsistOf(apiUri))
+				Expect(result.Reason).To(ContainSubstring("1 of 3 resources"))
+			})
+		})
+	})
+
+	When("the project analyzes a component of the repository", func() {
+		BeforeEach(func() {
+			event.Properties[componentPropertyName] = "/services/Payment_API/"
+		})
+
+		It("should include the component in the note", func() {
+			_, createNoteRequest, _ := rodeClient.CreateNoteArgsForCall(0)
+
+			Expect(createNoteRequest.NoteId).To(Equal(fmt.Sprintf("sonar-scan-services-payment-api-%s", event.TaskId)))
+			Expect(createNoteRequest.Note.ShortDescription).To(Equal("SonarQube Analysis of services/Payment_API"))
+		})
+
+		It("should include the component in the analysis", func() {
+			Expect(recorder.analyses[0].Component).To(Equal("services/Payment_API"))
+		})
+	})
+
+	When("note templates are configured", func() {
+		var config *sink.NoteTemplatesConfig
+
+		parse := func() {
+			var parseErr error
+			noteTemplates, parseErr = sink.ParseNoteTemplates(config)
+			Expect(parseErr).ToNot(HaveOccurred())
+		}
+
+		BeforeEach(func() {
+			event.Project.Name = "Payment API"
+			event.Properties[componentPropertyName] = "services/api"
+			config = &sink.NoteTemplatesConfig{
+				ShortDescription: "{{ .Event.Project.Name }} ({{ .Component }})",
+				LongDescription:  "[team-a] {{ .Default }}",
+				NoteId:           "team-a-{{ .Component | slug }}-{{ .Event.TaskId }}",
+				RelatedUrlLabels: map[string]string{"project": "{{ .Event.Project.Name | upper }} in SonarQube"},
+			}
+			parse()
+		})
+
+		It("should render the note from the templates", func() {
+			Expect(err).ToNot(HaveOccurred())
+			_, createNoteRequest, _ := rodeClient.CreateNoteArgsForCall(0)
+
+			Expect(createNoteRequest.NoteId).To(Equal(fmt.Sprintf("team-a-services-api-%s", event.TaskId)))
+			Expect(createNoteRequest.Note.ShortDescription).To(Equal("Payment API (services/api)"))
+			Expect(createNoteRequest.Note.LongDescription).To(Equal("[team-a] SonarQube Analysis without a Quality Gate"))
+			Expect(createNoteRequest.Note.RelatedUrl[0].Label).To(Equal("PAYMENT API in SonarQube"))
+		})
+
+		When("the quality gate failed", func() {
+			BeforeEach(func() {
+				event.QualityGate = &sonar.QualityGate{Name: "Sonar way", Status: sonar.STATUS_ERROR}
+				event.Branch = &sonar.Branch{
+					Name: "main",
+					Type: sonar.BRANCH_TYPE_BRANCH,
+					URL:  "https://sonar.example.com/dashboard?id=payment-api",
+				}
+				config.StatusMessage = "[team-a] {{ .Default }}"
+				config.Remediation = "Ask #team-a about {{ .Event.Project.Name }}. {{ .Default }}"
+				parse()
+			})
+
+			It("should render the status message and remediation from the templates", func() {
+				Expect(err).ToNot(HaveOccurred())
+				_, request, _ := rodeClient.BatchCreateOccurrencesArgsForCall(0)
+				discovered := request.Occurrences[1].Details.(*grafeas_go_proto.Occurrence_Discovered).Discovered.Discovered
+
+				Expect(discovered.AnalysisStatusError.Message).To(Equal("[team-a] quality gate failed"))
+				Expect(request.Occurrences[1].Remediation).To(Equal("Ask #team-a about Payment API. Review the analysis in SonarQube: https://sonar.example.com/dashboard?id=payment-api"))
+				Expect(request.Occurrences[0].Remediation).To(BeEmpty())
+			})
+		})
+
+		When("the quality gate passed", func() {
+			BeforeEach(func() {
+				event.QualityGate = &sonar.QualityGate{Name: "Sonar way", Status: sonar.STATUS_OK}
+				config.StatusMessage = "[team-a] {{ .Default }}"
+				config.Remediation = "Ask #team-a about {{ .Event.Project.Name }}"
+				parse()
+			})
+
+			It("should not render the status message or remediation", func() {
+				Expect(err).ToNot(HaveOccurred())
+				_, request, _ := rodeClient.BatchCreateOccurrencesArgsForCall(0)
+				discovered := request.Occurrences[1].Details.(*grafeas_go_proto.Occurrence_Discovered).Discovered.Discovered
+
+				Expect(discovered.AnalysisStatusError).To(BeNil())
+				Expect(request.Occurrences[1].Remediation).To(BeEmpty())
+			})
+		})
+
+		When("the note id doesn't end with the task id", func() {
+			BeforeEach(func() {
+				config.NoteId = "team-a-{{ .Event.TaskId }}-{{ .Component | slug }}"
+				parse()
+			})
+
+			It("should fail", func() {
+				Expect(err).To(MatchError(ContainSubstring("must end with -" + event.TaskId)))
+				Expect(result.Outcome).To(Equal(OUTCOME_FAILED))
+			})
+		})
+
+		When("a template can't be rendered", func() {
+			BeforeEach(func() {
+				config.ShortDescription = "{{ .Event.QualityGate.Name }}"
+				parse()
+			})
+
+			It("should fail", func() {
+				Expect(err).To(MatchError(ContainSubstring("error rendering shortDescription template")))
+				Expect(result.Outcome).To(Equal(OUTCOME_FAILED))
+			})
+		})
+	})
+
+	When("sending the analysis fails", func() {
+		BeforeEach(func() {
+			rodeClient.CreateNoteReturns(nil, errors.New(fake.LetterN(10)))
+		})
+
+		It("should return an error", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(result.Outcome).To(Equal(OUTCOME_FAILED))
+		})
+	})
+})
+
+var _ = Describe("Plan", func() {
+	var (
+		event        *sonar.Event
+		ingestFilter *filter.Filter
+		routingRules *routing.Rules
+		recorder     *recordingSink
+		history      *fakeHistory
+		plan         *Plan
+		err          error
+	)
+
+	BeforeEach(func() {
+		ingestFilter = nil
+		routingRules = nil
+		history = &fakeHistory{}
+		event = &sonar.Event{
+			TaskId:   fake.LetterN(10),
+			Status:   sonar.STATUS_SUCCESS,
+			Revision: "abc123",
+			Project:  &sonar.Project{Key: "sandbox-api"},
+			Properties: map[string]string{
+				resourceUriPrefixPropertyName: "git://github.com/rode/collector-sonarqube",
+				"sonar.analysis.image":        "harbor.example.com/rode/api",
+			},
+		}
+	})
+
+	JustBeforeEach(func() {
+		recorder = &recordingSink{}
+		plan, err = NewListener(logger, recorder, nil, nil, ingestFilter, routingRules, history).Plan(context.Background(), event, nil)
+	})
+
+	It("should derive the resource uri without recording the analysis", func() {
+		Expect(err).ToNot(HaveOccurred())
+		Expect(plan).To(Equal(&Plan{ResourceUri: "git://github.com/rode/collector-sonarqube@abc123"}))
+		Expect(recorder.count()).To(BeZero())
+		Expect(history.events).To(BeEmpty())
+	})
+
+	When("the filter skips the event", func() {
+		BeforeEach(func() {
+			ingestFilter = filter.New(logger, &filter.Rules{Exclude: []*filter.Rule{{Name: "sandboxes", Projects: []string{"sandbox-*"}}}}, nil)
+		})
+
+		It("should be skipped without counting it", func() {
+			Expect(err).ToNot(HaveOccurred())
+			Expect(plan.Skip).To(BeTrue())
+			Expect(plan.Reason).To(ContainSubstring("sandboxes"))
+			Expect(ingestFilter.Stats().Evaluated).To(BeZero())
+		})
+	})
+
+	When("routing rules are configured", func() {
+		BeforeEach(func() {
+			var compileErr error
+			routingRules, compileErr = routing.Compile(&routing.Config{Rules: []*routing.RuleConfig{
+				{Name: "images", When: "'sonar.analysis.image' in event.properties", ResourceUri: "event.properties['sonar.analysis.image'] + ':' + event.revision"},
+			}}, nil)
+			Expect(compileErr).ToNot(HaveOccurred())
+		})
+
+		It("should use the routed resource uri", func() {
+			Expect(plan.ResourceUri).To(Equal("harbor.example.com/rode/api:abc123"))
+		})
+	})
+
+	When("the event is invalid", func() {
+		BeforeEach(func() {
+			event.Properties = nil
+		})
+
+		It("should return the problems", func() {
+			var validationErr *ValidationError
+
+			Expect(errors.As(err, &validationErr)).To(BeTrue())
+			Expect(plan.Skip).To(BeFalse())
+		})
+	})
+})
+
+type recordingSink struct {
+	mu       sync.Mutex
+	analyses []*sink.Analysis
+	err      error
+}
+
+func (r *recordingSink) Name() string {
+	return "recording"
+}
+
+func (r *recordingSink) Send(_ context.Context, analysis *sink.Analysis) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.analyses = append(r.analyses, analysis)
+
+	return r.err
+}
+
+// count is safe to call while analyses are sent in the background
+func (r *recordingSink) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.analyses)
+}
+
+type fakeHistory struct {
+	events  []*sonar.Event
+	options []*ProcessOptions
+	results []*Result
+	err     error
+}
+
+func (f *fakeHistory) Record(_ context.Context, event *sonar.Event, options *ProcessOptions, result *Result) error {
+	f.events = append(f.events, event)
+	f.options = append(f.options, options)
+	f.results = append(f.results, result)
+
+	return f.err
+}
+
+// fakeSonarClient only implements the methods used by the listener and report task handler, the rest panic
+type fakeSonarClient struct {
+	sonar.Client
+
+	task  *sonar.Task
+	err   error
+	calls []string
+
+	properties map[string]string
+	analysis   *sonar.ProjectAnalysis
+	gate       *sonar.QualityGate
+
+	binding      *sonar.ProjectBinding
+	bindingErr   error
+	bindingCalls []string
+
+	tagsErr error
+}
+
+func (f *fakeSonarClient) GetTask(_ context.Context, id string) (*sonar.Task, error) {
+	f.calls = append(f.calls, id)
+
+	return f.task, f.err
+}
+
+func (f *fakeSonarClient) GetProjectBinding(_ context.Context, projectKey string) (*sonar.ProjectBinding, error) {
+	f.bindingCalls = append(f.bindingCalls, projectKey)
+
+	return f.binding, f.bindingErr
+}
+
+func (f *fakeSonarClient) GetScannerContext(context.Context, string) (map[string]string, error) {
+	return f.properties, nil
+}
+
+func (f *fakeSonarClient) GetProjectTags(context.Context, string) ([]string, error) {
+	return nil, f.tagsErr
+}
+
+func (f *fakeSonarClient) GetAnalysis(context.Context, *sonar.Task) (*sonar.ProjectAnalysis, error) {
+	return f.analysis, nil
+}
+
+func (f *fakeSonarClient) GetQualityGate(context.Context, string, string) (*sonar.QualityGate, error) {
+	return f.gate, nil
+}
+
+func responseErrors(recorder *httptest.ResponseRecorder) []string {
+	response := &httpjson.ErrorResponse{}
+	Expect(json.Unmarshal(recorder.Body.Bytes(), response)).To(Succeed())
+
+	return response.Errors
+}
+
 func structToJsonBody(i interface{}) io.ReadCloser {
 	b, err := json.Marshal(i)
 	Expect(err).ToNot(HaveOccurred())
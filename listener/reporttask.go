@@ -0,0 +1,188 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rode/collector-sonarqube/internal/httpjson"
+	"github.com/rode/collector-sonarqube/sonar"
+	"go.uber.org/zap"
+)
+
+// ReportTaskRequest is submitted by CI pipelines after running the scanner, as an alternative to webhooks.
+type ReportTaskRequest struct {
+	// ReportTask is the contents of the report-task.txt file written by the scanner
+	ReportTask string `json:"reportTask"`
+	// ResourceUri and ResourceUriPrefix are optional, and take precedence over the resource uri prefix scanner property
+	ResourceUri       string `json:"resourceUri,omitempty"`
+	ResourceUriPrefix string `json:"resourceUriPrefix,omitempty"`
+}
+
+// ReportTaskOptions control how long and how many submitted report tasks are waited on.
+type ReportTaskOptions struct {
+	// PollInterval is how often the compute engine task is checked
+	PollInterval time.Duration
+	// Timeout limits how long the task is waited on and the analysis takes to record
+	Timeout time.Duration
+	// MaxConcurrent limits how many report tasks are waited on at once; further submissions are rejected until one finishes
+	MaxConcurrent int
+	// ServerUrl is the SonarQube instance that report tasks must come from, and is used in place of the submitted one
+	ServerUrl string
+	// AllowResourceOverrides accepts the resource uri and prefix from the request. It should only be set when requests
+	// are authenticated, otherwise anyone who can reach the listener could record an analysis against any resource.
+	AllowResourceOverrides bool
+}
+
+type reportTaskHandler struct {
+	logger      *zap.Logger
+	listener    Listener
+	sonarClient sonar.Client
+	options     *ReportTaskOptions
+	slots       chan struct{}
+}
+
+// ReportTaskHandler accepts report tasks from CI pipelines. Once the compute engine task finishes, the analysis is
+// looked up and processed like a webhook event. By default the request is accepted immediately and processed in the
+// background; with the "wait" query parameter, the response is sent once the analysis has been processed.
+func ReportTaskHandler(logger *zap.Logger, l Listener, sonarClient sonar.Client, options *ReportTaskOptions) http.HandlerFunc {
+	h := &reportTaskHandler{
+		logger:      logger,
+		listener:    l,
+		sonarClient: sonarClient,
+		options:     options,
+		slots:       make(chan struct{}, options.MaxConcurrent),
+	}
+
+	return h.ServeHTTP
+}
+
+func (h *reportTaskHandler) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	log := h.logger.Named("ReportTask")
+
+	body := &ReportTaskRequest{}
+	if err := json.NewDecoder(request.Body).Decode(body); err != nil {
+		httpjson.WriteErrors(w, http.StatusBadRequest, fmt.Sprintf("error decoding request: %v", err))
+		return
+	}
+
+	if (body.ResourceUri != "" || body.ResourceUriPrefix != "") && !h.options.AllowResourceOverrides {
+		httpjson.WriteErrors(w, http.StatusBadRequest, "resourceUri and resourceUriPrefix are only accepted when report tasks are authenticated")
+		return
+	}
+
+	reportTask, err := sonar.ParseReportTask(strings.NewReader(body.ReportTask))
+	if err != nil {
+		httpjson.WriteErrors(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// the server url ends up in the links recorded with the analysis, so it isn't taken from the request
+	serverUrl := strings.TrimSuffix(h.options.ServerUrl, "/")
+	if submitted := strings.TrimSuffix(reportTask.ServerUrl, "/"); submitted != "" && submitted != serverUrl {
+		httpjson.WriteErrors(w, http.StatusBadRequest, fmt.Sprintf("report task is from %s, not %s", submitted, serverUrl))
+		return
+	}
+	reportTask.ServerUrl = serverUrl
+
+	select {
+	case h.slots <- struct{}{}:
+	default:
+		log.Warn("rejecting report task, too many are already being processed", zap.Int("maxConcurrent", cap(h.slots)))
+		w.Header().Set("Retry-After", "30")
+		httpjson.WriteErrors(w, http.StatusTooManyRequests, "too many report tasks are already being processed")
+		return
+	}
+
+	log = log.With(zap.String("taskId", reportTask.CeTaskId), zap.String("project", reportTask.ProjectKey))
+	options := &ProcessOptions{
+		Source:            SOURCE_REPORT_TASK,
+		ResourceUri:       body.ResourceUri,
+		ResourceUriPrefix: body.ResourceUriPrefix,
+	}
+
+	if request.URL.Query().Get("wait") != "true" {
+		go func() {
+			defer h.release()
+			ctx, cancel := context.WithTimeout(context.Background(), h.options.Timeout)
+			defer cancel()
+
+			if _, result, err := ProcessReportTask(ctx, h.listener, h.sonarClient, reportTask, h.options.PollInterval, options); err != nil {
+				log.Error("error processing report task", zap.Error(err))
+			} else {
+				log.Info("processed report task", zap.String("outcome", string(result.Outcome)), zap.String("reason", result.Reason))
+			}
+		}()
+
+		httpjson.Write(w, http.StatusAccepted, &struct {
+			TaskId string `json:"taskId"`
+		}{reportTask.CeTaskId})
+		return
+	}
+
+	defer h.release()
+	ctx, cancel := context.WithTimeout(request.Context(), h.options.Timeout)
+	defer cancel()
+
+	_, result, err := ProcessReportTask(ctx, h.listener, h.sonarClient, reportTask, h.options.PollInterval, options)
+	var validationErr *ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		httpjson.WriteErrors(w, http.StatusBadRequest, validationErr.Problems...)
+	case errors.Is(err, context.DeadlineExceeded):
+		log.Error("timed out processing report task", zap.Error(err))
+		httpjson.WriteErrors(w, http.StatusGatewayTimeout, err.Error())
+	case result == nil:
+		log.Error("error looking up report task", zap.Error(err))
+		httpjson.WriteErrors(w, http.StatusBadGateway, err.Error())
+	case err != nil:
+		httpjson.Write(w, http.StatusInternalServerError, result)
+	default:
+		httpjson.Write(w, http.StatusOK, result)
+	}
+}
+
+func (h *reportTaskHandler) release() {
+	<-h.slots
+}
+
+// ProcessReportTask waits for the compute engine task of a report task, then processes the equivalent webhook event.
+// The event is nil when it couldn't be built, and the result is also nil when it wasn't processed.
+func ProcessReportTask(ctx context.Context, l Listener, sonarClient sonar.Client, reportTask *sonar.ReportTask, pollInterval time.Duration, options *ProcessOptions) (*sonar.Event, *Result, error) {
+	task, err := sonar.WaitForTask(ctx, sonarClient, reportTask.CeTaskId, pollInterval)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the task id identifies the analysis, so a mismatched project most likely means the wrong report was submitted
+	if task.ComponentKey != reportTask.ProjectKey {
+		return nil, nil, &ValidationError{Problems: []string{fmt.Sprintf("task %s belongs to project %s, not %s", task.Id, task.ComponentKey, reportTask.ProjectKey)}}
+	}
+
+	event, err := sonar.EventForTask(ctx, sonarClient, reportTask.ServerUrl, task)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result, err := l.Process(ctx, event, options)
+
+	return event, result, err
+}
@@ -0,0 +1,252 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/collector-sonarqube/sonar"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("ReportTaskHandler", func() {
+	var (
+		sonarClient *fakeSonarClient
+		recorder    *recordingSink
+		body        *ReportTaskRequest
+		query       string
+		options     *ReportTaskOptions
+		handler     http.HandlerFunc
+		response    *httptest.ResponseRecorder
+		taskId      string
+		projectKey  string
+		revision    string
+	)
+
+	BeforeEach(func() {
+		taskId = fake.LetterN(10)
+		projectKey = fake.LetterN(10)
+		revision = fake.LetterN(10)
+
+		recorder = &recordingSink{}
+		sonarClient = &fakeSonarClient{
+			task: &sonar.Task{
+				Id:           taskId,
+				ComponentKey: projectKey,
+				Status:       sonar.STATUS_SUCCESS,
+				ExecutedAt:   "2021-05-27T19:08:23+0000",
+				AnalysisId:   fake.LetterN(10),
+			},
+			properties: map[string]string{},
+			analysis:   &sonar.ProjectAnalysis{Revision: revision},
+			gate:       &sonar.QualityGate{Name: "Sonar way", Status: sonar.STATUS_OK},
+		}
+		body = &ReportTaskRequest{
+			ReportTask:        fmt.Sprintf("projectKey=%s\nserverUrl=https\\://sonar.example.com\nceTaskId=%s\n", projectKey, taskId),
+			ResourceUriPrefix: "github.com/rode/collector-sonarqube",
+		}
+		query = "?wait=true"
+		options = &ReportTaskOptions{
+			PollInterval:           time.Millisecond,
+			Timeout:                time.Second,
+			MaxConcurrent:          1,
+			ServerUrl:              "https://sonar.example.com/",
+			AllowResourceOverrides: true,
+		}
+	})
+
+	submit := func() *httptest.ResponseRecorder {
+		b, err := json.Marshal(body)
+		Expect(err).ToNot(HaveOccurred())
+
+		response := httptest.NewRecorder()
+		handler(response, httptest.NewRequest(http.MethodPost, "/report-task"+query, bytes.NewReader(b)))
+
+		return response
+	}
+
+	JustBeforeEach(func() {
+		handler = ReportTaskHandler(logger, NewListener(logger, recorder, sonarClient, nil, nil, nil, nil), sonarClient, options)
+		response = submit()
+	})
+
+	It("should record the analysis once the task finishes", func() {
+		Expect(response.Code).To(Equal(http.StatusOK))
+		Expect(recorder.analyses).To(HaveLen(1))
+
+		analysis := recorder.analyses[0]
+		Expect(analysis.ResourceUri).To(Equal("git://github.com/rode/collector-sonarqube@" + revision))
+		Expect(analysis.Event.ServerUrl).To(Equal("https://sonar.example.com"))
+		Expect(analysis.Event.QualityGate.Name).To(Equal("Sonar way"))
+
+		result := &Result{}
+		Expect(json.Unmarshal(response.Body.Bytes(), result)).To(Succeed())
+		Expect(result.Outcome).To(Equal(OUTCOME_RECORDED))
+		Expect(result.TaskId).To(Equal(taskId))
+	})
+
+	When("a resource uri is submitted", func() {
+		BeforeEach(func() {
+			body.ResourceUri = "git://github.com/rode/rode@" + revision
+		})
+
+		It("should record the analysis against it", func() {
+			Expect(recorder.analyses[0].ResourceUri).To(Equal(body.ResourceUri))
+		})
+	})
+
+	When("resource overrides aren't allowed", func() {
+		BeforeEach(func() {
+			options.AllowResourceOverrides = false
+		})
+
+		It("should reject the resource uri prefix", func() {
+			Expect(response.Code).To(Equal(http.StatusBadRequest))
+			Expect(responseErrors(response)).To(ConsistOf("resourceUri and resourceUriPrefix are only accepted when report tasks are authenticated"))
+			Expect(recorder.analyses).To(BeEmpty())
+		})
+
+		When("the request doesn't override the resource", func() {
+			BeforeEach(func() {
+				body.ResourceUriPrefix = ""
+				sonarClient.properties[resourceUriPrefixPropertyName] = "github.com/rode/rode"
+			})
+
+			It("should use the scanner property", func() {
+				Expect(response.Code).To(Equal(http.StatusOK))
+				Expect(recorder.analyses[0].ResourceUri).To(Equal("git://github.com/rode/rode@" + revision))
+			})
+		})
+	})
+
+	When("the report task is missing the task id", func() {
+		BeforeEach(func() {
+			body.ReportTask = "projectKey=" + projectKey
+		})
+
+		It("should respond with a 400", func() {
+			Expect(response.Code).To(Equal(http.StatusBadRequest))
+			Expect(responseErrors(response)).To(ConsistOf("report task is missing ceTaskId"))
+		})
+	})
+
+	When("the report task is from a different server", func() {
+		BeforeEach(func() {
+			body.ReportTask = fmt.Sprintf("projectKey=%s\nserverUrl=https\\://evil.example.com\nceTaskId=%s\n", projectKey, taskId)
+		})
+
+		It("should respond with a 400", func() {
+			Expect(response.Code).To(Equal(http.StatusBadRequest))
+			Expect(responseErrors(response)).To(ConsistOf("report task is from https://evil.example.com, not https://sonar.example.com"))
+			Expect(recorder.analyses).To(BeEmpty())
+		})
+	})
+
+	When("the report task doesn't include the server url", func() {
+		BeforeEach(func() {
+			body.ReportTask = fmt.Sprintf("projectKey=%s\nceTaskId=%s\n", projectKey, taskId)
+		})
+
+		It("should use the configured one", func() {
+			Expect(response.Code).To(Equal(http.StatusOK))
+			Expect(recorder.analyses[0].Event.ServerUrl).To(Equal("https://sonar.example.com"))
+		})
+	})
+
+	When("the task belongs to a different project", func() {
+		BeforeEach(func() {
+			sonarClient.task.ComponentKey = fake.LetterN(11)
+		})
+
+		It("should respond with a 400", func() {
+			Expect(response.Code).To(Equal(http.StatusBadRequest))
+			Expect(recorder.analyses).To(BeEmpty())
+		})
+	})
+
+	When("the task can't be retrieved", func() {
+		BeforeEach(func() {
+			sonarClient.err = errors.New("unauthorized")
+		})
+
+		It("should respond with a 502", func() {
+			Expect(response.Code).To(Equal(http.StatusBadGateway))
+		})
+	})
+
+	When("the task doesn't finish in time", func() {
+		BeforeEach(func() {
+			sonarClient.task.Status = sonar.STATUS_IN_PROGRESS
+		})
+
+		It("should respond with a 504", func() {
+			Expect(response.Code).To(Equal(http.StatusGatewayTimeout))
+		})
+	})
+
+	When("the analysis can't be recorded", func() {
+		BeforeEach(func() {
+			recorder.err = errors.New("rode is unavailable")
+		})
+
+		It("should respond with a 500 and the result", func() {
+			Expect(response.Code).To(Equal(http.StatusInternalServerError))
+
+			result := &Result{}
+			Expect(json.Unmarshal(response.Body.Bytes(), result)).To(Succeed())
+			Expect(result.Outcome).To(Equal(OUTCOME_FAILED))
+		})
+	})
+
+	When("the caller doesn't wait", func() {
+		BeforeEach(func() {
+			query = ""
+		})
+
+		It("should accept the report task", func() {
+			Expect(response.Code).To(Equal(http.StatusAccepted))
+			Expect(response.Body.String()).To(MatchJSON(fmt.Sprintf(`{"taskId":%q}`, taskId)))
+		})
+
+		It("should record the analysis in the background", func() {
+			Eventually(recorder.count).Should(Equal(1))
+		})
+
+		When("as many report tasks as allowed are already being processed", func() {
+			BeforeEach(func() {
+				sonarClient.task.Status = sonar.STATUS_IN_PROGRESS
+			})
+
+			It("should reject further report tasks with a 429", func() {
+				next := submit()
+
+				Expect(next.Code).To(Equal(http.StatusTooManyRequests))
+				Expect(next.Header().Get("Retry-After")).ToNot(BeEmpty())
+			})
+
+			It("should accept report tasks once a slot is free", func() {
+				Eventually(func() int {
+					return submit().Code
+				}, 2*time.Second, 50*time.Millisecond).Should(Equal(http.StatusAccepted))
+			})
+		})
+	})
+})
@@ -0,0 +1,110 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/rode/collector-sonarqube/internal/httpjson"
+	"github.com/rode/collector-sonarqube/sonar"
+)
+
+// ValidationError lists every problem found with an event that prevents it from being recorded.
+type ValidationError struct {
+	Problems []string
+}
+
+func (v *ValidationError) Error() string {
+	return fmt.Sprintf("invalid event: %s", strings.Join(v.Problems, "; "))
+}
+
+// validateEvent checks that the event contains everything needed to record it. Events that won't be recorded, such as
+// canceled analyses, only need a task id and status.
+func validateEvent(event *sonar.Event, options *ProcessOptions) []string {
+	var problems []string
+	if event.TaskId == "" {
+		problems = append(problems, "taskId is required")
+	}
+
+	// unknown statuses aren't a problem with the event, they may come from a newer version of SonarQube
+	if event.Status == "" {
+		problems = append(problems, "status is required")
+	}
+
+	if event.Status != sonar.STATUS_SUCCESS && event.Status != sonar.STATUS_FAILED {
+		return problems
+	}
+
+	if event.Revision == "" {
+		problems = append(problems, "revision is required")
+	}
+
+	if event.Project == nil {
+		problems = append(problems, "project is required")
+	} else if event.Project.Key == "" {
+		problems = append(problems, "project.key is required")
+	}
+
+	if event.QualityGate != nil {
+		for i, condition := range event.QualityGate.Conditions {
+			if condition == nil || condition.Metric == "" {
+				problems = append(problems, fmt.Sprintf("qualityGate.conditions[%d].metric is required", i))
+			}
+		}
+	}
+
+	if _, ok := event.Properties[resourceUriPrefixPropertyName]; !ok && options.ResourceUriPrefix == "" && options.ResourceUri == "" {
+		problems = append(problems, fmt.Sprintf("properties.%s is required, please run the scanner with the \"-D%[1]s\" option", resourceUriPrefixPropertyName))
+	}
+
+	return problems
+}
+
+// WithRequestLimits rejects webhook requests that aren't JSON or are larger than maxBytes, before the body is read by
+// the next handler.
+func WithRequestLimits(maxBytes int64, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, request *http.Request) {
+		mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+		if err != nil || mediaType != "application/json" {
+			httpjson.WriteErrors(w, http.StatusUnsupportedMediaType, fmt.Sprintf("expected content type application/json, got %q", request.Header.Get("Content-Type")))
+			return
+		}
+
+		if request.ContentLength > maxBytes {
+			httpjson.WriteErrors(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body must not exceed %d bytes", maxBytes))
+			return
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(request.Body, maxBytes+1))
+		if err != nil {
+			httpjson.WriteErrors(w, http.StatusBadRequest, fmt.Sprintf("error reading request body: %v", err))
+			return
+		}
+
+		if int64(len(body)) > maxBytes {
+			httpjson.WriteErrors(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body must not exceed %d bytes", maxBytes))
+			return
+		}
+
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next(w, request)
+	}
+}
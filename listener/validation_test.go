@@ -0,0 +1,106 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+var _ = Describe("WithRequestLimits", func() {
+	var (
+		recorder     *httptest.ResponseRecorder
+		request      *http.Request
+		body         string
+		called       bool
+		receivedBody string
+	)
+
+	BeforeEach(func() {
+		called = false
+		receivedBody = ""
+		recorder = httptest.NewRecorder()
+		body = `{"taskId":"` + fake.LetterN(10) + `"}`
+		request = httptest.NewRequest(http.MethodPost, "/webhook/event", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json; charset=utf-8")
+	})
+
+	JustBeforeEach(func() {
+		handler := WithRequestLimits(int64(len(body)), func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			b, err := ioutil.ReadAll(r.Body)
+			Expect(err).ToNot(HaveOccurred())
+			receivedBody = string(b)
+		})
+
+		handler(recorder, request)
+	})
+
+	It("should pass the request to the next handler", func() {
+		Expect(called).To(BeTrue())
+		Expect(receivedBody).To(Equal(body))
+	})
+
+	When("the content type isn't JSON", func() {
+		BeforeEach(func() {
+			request.Header.Set("Content-Type", "text/plain")
+		})
+
+		It("should respond with a 415", func() {
+			Expect(recorder.Code).To(Equal(http.StatusUnsupportedMediaType))
+			Expect(responseErrors(recorder)).To(HaveLen(1))
+			Expect(called).To(BeFalse())
+		})
+	})
+
+	When("the content type is missing", func() {
+		BeforeEach(func() {
+			request.Header.Del("Content-Type")
+		})
+
+		It("should respond with a 415", func() {
+			Expect(recorder.Code).To(Equal(http.StatusUnsupportedMediaType))
+		})
+	})
+
+	When("the body is too large", func() {
+		BeforeEach(func() {
+			request = httptest.NewRequest(http.MethodPost, "/webhook/event", strings.NewReader(body+" "))
+			request.Header.Set("Content-Type", "application/json")
+		})
+
+		It("should respond with a 413", func() {
+			Expect(recorder.Code).To(Equal(http.StatusRequestEntityTooLarge))
+			Expect(called).To(BeFalse())
+		})
+	})
+
+	When("the content length isn't known up front", func() {
+		BeforeEach(func() {
+			request = httptest.NewRequest(http.MethodPost, "/webhook/event", ioutil.NopCloser(strings.NewReader(body+" ")))
+			request.ContentLength = -1
+			request.Header.Set("Content-Type", "application/json")
+		})
+
+		It("should still enforce the limit", func() {
+			Expect(recorder.Code).To(Equal(http.StatusRequestEntityTooLarge))
+			Expect(called).To(BeFalse())
+		})
+	})
+})
@@ -18,18 +18,48 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/rode/collector-sonarqube/admin"
+	"github.com/rode/collector-sonarqube/archive"
 	"github.com/rode/collector-sonarqube/config"
+	"github.com/rode/collector-sonarqube/dryrun"
+	"github.com/rode/collector-sonarqube/filter"
 	"github.com/rode/collector-sonarqube/listener"
+	"github.com/rode/collector-sonarqube/mapping"
+	"github.com/rode/collector-sonarqube/poller"
+	"github.com/rode/collector-sonarqube/provenance"
+	"github.com/rode/collector-sonarqube/reconcile"
+	"github.com/rode/collector-sonarqube/routing"
+	"github.com/rode/collector-sonarqube/sink"
+	"github.com/rode/collector-sonarqube/sonar"
+	"github.com/rode/collector-sonarqube/status"
+	"github.com/rode/collector-sonarqube/store"
 	"github.com/rode/rode/common"
+	pb "github.com/rode/rode/proto/v1alpha1"
 	"go.uber.org/zap"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"syscall"
+	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			os.Exit(replayCommand(os.Args[0]+" replay", os.Args[2:]))
+		case "ci":
+			os.Exit(ciCommand(os.Args[0]+" ci", os.Args[2:]))
+		case "reconcile":
+			os.Exit(reconcileCommand(os.Args[0]+" reconcile", os.Args[2:]))
+		}
+	}
+
+	startedAt := time.Now()
+
 	conf, err := config.Build(os.Args[0], os.Args[1:])
 	if err != nil {
 		log.Fatalf("error parsing flags: %v", err)
@@ -40,15 +70,98 @@ func main() {
 		log.Fatalf("failed to create logger: %v", err)
 	}
 
-	rodeClient, err := common.NewRodeClient(conf.ClientConfig)
+	rodeClient, err := createRodeClient(conf.ClientConfig, conf.DryRun, os.Stdout, logger)
 	if err != nil {
 		logger.Fatal("could not create rode client", zap.Error(err))
 	}
 
-	l := listener.NewListener(logger.Named("listener"), rodeClient)
+	noteTemplates, err := loadNoteTemplates(conf.NoteTemplatesFile)
+	if err != nil {
+		logger.Fatal("could not load note templates", zap.Error(err))
+	}
+
+	rodeInstances, err := createRodeInstances(conf, logger)
+	if err != nil {
+		logger.Fatal("could not create rode instance clients", zap.Error(err))
+	}
+
+	sinks, err := createSinks(conf.SinkConfig, logger, rodeClient, rodeInstances, noteTemplates)
+	if err != nil {
+		logger.Fatal("could not create sinks", zap.Error(err))
+	}
+
+	fanout := sink.NewFanout(logger.Named("sink"), conf.SinkConfig.RequiredSinks, sinks...)
+	defer fanout.Close()
+
+	s, err := mapResources(conf.ResourceMappingFile, linkBuilds(conf.LinkBuildProjects, logger, rodeClient, fanout))
+	if err != nil {
+		logger.Fatal("could not load resource mapping", zap.Error(err))
+	}
+
+	var (
+		history listener.History
+		st      *store.Store
+	)
+	if conf.StateConfig.File != "" {
+		st, err = store.Open(logger.Named("store"), conf.StateConfig.File, &store.Options{
+			MaxAge:     conf.StateConfig.MaxAge,
+			MaxRecords: conf.StateConfig.MaxRecords,
+		})
+		if err != nil {
+			logger.Fatal("could not open state store", zap.Error(err))
+		}
+		defer st.Close()
+
+		history = st
+	}
+
+	sonarClient := createSonarClient(conf.SonarConfig)
+	ingestFilter, err := createFilter(conf.FilterRulesFile, logger, sonarClient)
+	if err != nil {
+		logger.Fatal("could not load filter rules", zap.Error(err))
+	}
+
+	routingRules, err := loadRoutingRules(conf.RoutingRulesFile, sinks)
+	if err != nil {
+		logger.Fatal("could not load routing rules", zap.Error(err))
+	}
+
+	l := listener.NewListener(logger.Named("listener"), s, sonarClient, sonar.NewPropertyFilter(conf.SonarConfig.PropertyAllowlist), ingestFilter, routingRules, history)
+
+	// the archiver is outside the request limits, so that the requests they reject can be debugged
+	handler := listener.WithRequestLimits(conf.MaxRequestBytes, l.ProcessEvent)
+	var archiver archive.Archiver
+	if conf.ArchiveConfig.Directory != "" {
+		archiver, err = archive.New(logger.Named("archive"), &archive.Options{
+			Directory:     conf.ArchiveConfig.Directory,
+			Format:        conf.ArchiveConfig.Format,
+			MaxAge:        conf.ArchiveConfig.MaxAge,
+			MaxTotalBytes: conf.ArchiveConfig.MaxSizeMB * 1024 * 1024,
+			MaxFileBytes:  conf.ArchiveConfig.MaxFileSizeMB * 1024 * 1024,
+		})
+		if err != nil {
+			logger.Fatal("could not create webhook archive", zap.Error(err))
+		}
+		defer archiver.Close()
+
+		handler = archive.Handler(logger.Named("archive"), archiver, conf.MaxRequestBytes, handler)
+	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/webhook/event", l.ProcessEvent)
+	mux.HandleFunc("/webhook/event", handler)
+	if sonarClient != nil {
+		var reportTaskHandler http.Handler = listener.WithRequestLimits(conf.MaxRequestBytes, listener.ReportTaskHandler(logger.Named("listener"), l, sonarClient, &listener.ReportTaskOptions{
+			PollInterval:           5 * time.Second,
+			Timeout:                conf.ReportTaskTimeout,
+			MaxConcurrent:          conf.ReportTaskMaxConcurrent,
+			ServerUrl:              conf.SonarConfig.Url,
+			AllowResourceOverrides: conf.ReportTaskToken != "",
+		}))
+		if conf.ReportTaskToken != "" {
+			reportTaskHandler = admin.Authenticate(conf.ReportTaskToken, reportTaskHandler)
+		}
+		mux.Handle("/report-task", reportTaskHandler)
+	}
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) { fmt.Fprintf(w, "I'm healthy") })
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%d", conf.Port),
@@ -64,10 +177,91 @@ func main() {
 
 	logger.Info("listening for SonarQube events", zap.String("host", server.Addr))
 
+	var reconciler *reconcile.Reconciler
+	if conf.ReconcileConfig.Interval > 0 {
+		reconciler = reconcile.New(logger.Named("reconcile"), sonarClient, rodeClient, l, &reconcile.Options{
+			ServerUrl: conf.SonarConfig.Url,
+			Window:    conf.ReconcileConfig.Window,
+			Projects:  conf.ReconcileConfig.Projects,
+			Reingest:  conf.ReconcileConfig.Reingest,
+			History:   recordedResourceUri(st),
+			DryRun:    conf.DryRun,
+		})
+	}
+
+	var p *poller.Poller
+	if conf.PollConfig.Interval > 0 {
+		p = poller.New(logger.Named("poller"), sonarClient, l, &poller.Options{
+			ServerUrl:      conf.SonarConfig.Url,
+			Interval:       conf.PollConfig.Interval,
+			Projects:       conf.PollConfig.Projects,
+			CheckpointFile: conf.PollConfig.CheckpointFile,
+		})
+	}
+
+	var adminServer *http.Server
+	if conf.AdminConfig.Port != 0 {
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/", admin.NewHandler(logger.Named("admin"), st, l, &admin.Options{Token: conf.AdminConfig.Token}))
+		adminMux.Handle("/status", admin.Authenticate(conf.AdminConfig.Token, status.NewHandler(logger.Named("status"), st, rodeClient, &status.Options{
+			StartedAt: startedAt,
+			Instances: sonarInstances(conf),
+			DryRun:    conf.DryRun,
+			Sinks:     fanout.Stats,
+			Filter:    filterStats(ingestFilter),
+			Reconcile: reconcileStats(reconciler),
+			Poller:    pollerStats(p),
+		})))
+
+		adminServer = &http.Server{
+			Addr:    fmt.Sprintf(":%d", conf.AdminConfig.Port),
+			Handler: adminMux,
+		}
+
+		go func() {
+			err := adminServer.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Fatal("could not start admin http server...", zap.NamedError("error", err))
+			}
+		}()
+
+		logger.Info("serving the admin api", zap.String("host", adminServer.Addr))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if st != nil {
+		go st.RunRetention(ctx, time.Hour)
+	}
+
+	if archiver != nil {
+		go archiver.RunRetention(ctx, time.Minute)
+	}
+
+	if p != nil {
+		go p.Run(ctx)
+
+		logger.Info("polling SonarQube compute engine activity", zap.Duration("interval", conf.PollConfig.Interval))
+	}
+
+	if reconciler != nil {
+		go reconciler.Run(ctx, conf.ReconcileConfig.Interval)
+
+		logger.Info("reconciling analyses with Rode", zap.Duration("interval", conf.ReconcileConfig.Interval))
+	}
+
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	terminationSignal := <-sig
 	logger.Info("shutting down...", zap.String("termination signal", terminationSignal.String()))
+	cancel()
+
+	if adminServer != nil {
+		if err := adminServer.Shutdown(context.Background()); err != nil {
+			logger.Error("could not shutdown admin http server", zap.Error(err))
+		}
+	}
 
 	err = server.Shutdown(context.Background())
 	if err != nil {
@@ -75,6 +269,234 @@ func main() {
 	}
 }
 
+// createRodeClient returns a client for Rode, or when dryRun is set, a client that writes requests to out instead.
+func createRodeClient(conf *common.ClientConfig, dryRun bool, out io.Writer, logger *zap.Logger) (pb.RodeClient, error) {
+	if dryRun {
+		logger.Info("dry run mode enabled, no data will be written to rode")
+		return dryrun.NewRodeClient(logger.Named("dryrun"), out), nil
+	}
+
+	return common.NewRodeClient(conf)
+}
+
+// createFilter loads the rules that decide which events are recorded, or returns nil if there aren't any.
+func createFilter(path string, logger *zap.Logger, sonarClient sonar.Client) (*filter.Filter, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	rules, err := filter.Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return filter.New(logger.Named("filter"), rules, sonarClient), nil
+}
+
+// filterStats returns the stats of the filter for the status page, or nil if there isn't one.
+func filterStats(f *filter.Filter) func() filter.Stats {
+	if f == nil {
+		return nil
+	}
+
+	return f.Stats
+}
+
+// reconcileStats returns the stats of the reconciler for the status page, or nil if reconciliation isn't scheduled.
+func reconcileStats(r *reconcile.Reconciler) func() reconcile.Stats {
+	if r == nil {
+		return nil
+	}
+
+	return r.Stats
+}
+
+// pollerStats returns the tasks waiting to be retried by the poller for the status page, or nil if polling isn't enabled.
+func pollerStats(p *poller.Poller) func() poller.Stats {
+	if p == nil {
+		return nil
+	}
+
+	return p.Stats
+}
+
+// recordedResourceUri returns the resource uri the store has recorded each task against, so the reconciler can check
+// Rode before looking the analysis up in SonarQube, or nil if there's no store.
+func recordedResourceUri(st *store.Store) reconcile.History {
+	if st == nil {
+		return nil
+	}
+
+	return func(taskId string) string {
+		record, err := st.Get(taskId)
+		if err != nil || record.Outcome != listener.OUTCOME_RECORDED {
+			return ""
+		}
+
+		return record.ResourceUri
+	}
+}
+
+// loadRoutingRules compiles the routing rules, checking that every sink they select has been configured, or returns
+// nil if there aren't any.
+func loadRoutingRules(path string, sinks []sink.Sink) (*routing.Rules, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	var names []string
+	for _, s := range sinks {
+		names = append(names, s.Name())
+	}
+
+	return routing.Load(path, names)
+}
+
+// sonarInstances describes the configured SonarQube instance for the status page.
+func sonarInstances(conf *config.Config) []*status.Instance {
+	if conf.SonarConfig.Url == "" {
+		return nil
+	}
+
+	return []*status.Instance{{
+		Url:          conf.SonarConfig.Url,
+		Flavor:       conf.SonarConfig.Flavor,
+		PollInterval: conf.PollConfig.Interval,
+	}}
+}
+
+// createSonarClient returns a client for the SonarQube web API, or nil if one isn't configured.
+func createSonarClient(conf *config.SonarConfig) sonar.Client {
+	if conf.Url == "" {
+		return nil
+	}
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	if sonar.Flavor(conf.Flavor) == sonar.FLAVOR_SONARCLOUD {
+		return sonar.NewCloudClient(httpClient, conf.Url, conf.Token, conf.Organization)
+	}
+
+	return sonar.NewClient(httpClient, conf.Url, conf.Token)
+}
+
+// linkBuilds wraps the sink so that analyses of the given projects are also recorded against build artifacts.
+func linkBuilds(projects []string, logger *zap.Logger, rodeClient pb.RodeClient, next sink.Sink) sink.Sink {
+	if len(projects) == 0 {
+		return next
+	}
+
+	return provenance.NewLinker(logger.Named("provenance"), rodeClient, projects, next)
+}
+
+// mapResources wraps the sink so that analyses are also recorded against the resources listed in the mapping file.
+func mapResources(path string, next sink.Sink) (sink.Sink, error) {
+	if path == "" {
+		return next, nil
+	}
+
+	m, err := mapping.Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return mapping.NewMapper(m, next), nil
+}
+
+// loadNoteTemplates reads the templates that customize the notes recorded in Rode, or returns nil to keep the default
+// text.
+func loadNoteTemplates(path string) (*sink.NoteTemplates, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	return sink.LoadNoteTemplates(path)
+}
+
+// createRodeInstances returns a client for each additional Rode instance, which share the credentials of the primary one.
+func createRodeInstances(conf *config.Config, logger *zap.Logger) (map[string]pb.RodeClient, error) {
+	clients := map[string]pb.RodeClient{}
+	for name, host := range conf.SinkConfig.RodeInstances {
+		clientConfig := *conf.ClientConfig
+		clientConfig.Rode = &common.RodeClientConfig{
+			Host:                     host,
+			DisableTransportSecurity: conf.ClientConfig.Rode.DisableTransportSecurity,
+		}
+
+		client, err := createRodeClient(&clientConfig, conf.DryRun, os.Stdout, logger.Named(name))
+		if err != nil {
+			return nil, fmt.Errorf("rode instance %s: %v", name, err)
+		}
+		clients[name] = client
+	}
+
+	return clients, nil
+}
+
+func createSinks(conf *config.SinkConfig, logger *zap.Logger, rodeClient pb.RodeClient, rodeInstances map[string]pb.RodeClient, noteTemplates *sink.NoteTemplates) ([]sink.Sink, error) {
+	sinks := []sink.Sink{sink.NewRodeSink(logger.Named("rode"), rodeClient, noteTemplates)}
+
+	var names []string
+	for name := range rodeInstances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sinks = append(sinks, sink.NewRodeInstanceSink(name, logger.Named("rode-"+name), rodeInstances[name], noteTemplates))
+	}
+
+	if conf.FilePath != "" {
+		fileSink, err := sink.NewFileSink(conf.FilePath)
+		if err != nil {
+			return nil, err
+		}
+
+		sinks = append(sinks, fileSink)
+	}
+
+	if conf.HttpUrl != "" {
+		sinks = append(sinks, sink.NewHttpSink(conf.HttpUrl, &http.Client{Timeout: conf.HttpTimeout}))
+	}
+
+	if conf.CloudEventsUrl != "" {
+		sinks = append(sinks, sink.NewCloudEventsSink(conf.CloudEventsUrl, &http.Client{Timeout: conf.HttpTimeout}))
+	}
+
+	return sinks, nil
+}
+
+// buildPipeline creates the listener used by the subcommands, along with the SonarQube client it uses. Analyses are only
+// recorded in Rode, but still through a fanout, so that an analysis that routing rules send to other sinks isn't recorded
+// in Rode either.
+func buildPipeline(conf *config.PipelineConfig, sonarConfig *config.SonarConfig, logger *zap.Logger, rodeClient pb.RodeClient) (listener.Listener, sonar.Client, error) {
+	noteTemplates, err := loadNoteTemplates(conf.NoteTemplatesFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load note templates: %w", err)
+	}
+
+	rodeSink := sink.NewFanout(logger.Named("sink"), []string{"rode"}, sink.NewRodeSink(logger.Named("rode"), rodeClient, noteTemplates))
+	s, err := mapResources(conf.ResourceMappingFile, linkBuilds(conf.LinkBuildProjects, logger, rodeClient, rodeSink))
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load resource mapping: %w", err)
+	}
+
+	sonarClient := createSonarClient(sonarConfig)
+	ingestFilter, err := createFilter(conf.FilterRulesFile, logger, sonarClient)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load filter rules: %w", err)
+	}
+
+	// only the rode sink is configured, so the sinks that rules select aren't checked here. An analysis that rules only
+	// send to other sinks fails, rather than being reported as recorded.
+	routingRules, err := loadRoutingRules(conf.RoutingRulesFile, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load routing rules: %w", err)
+	}
+
+	l := listener.NewListener(logger.Named("listener"), s, sonarClient, sonar.NewPropertyFilter(sonarConfig.PropertyAllowlist), ingestFilter, routingRules, nil)
+
+	return l, sonarClient, nil
+}
+
 func createLogger(debug bool) (*zap.Logger, error) {
 	if debug {
 		return zap.NewDevelopment()
@@ -0,0 +1,158 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapping
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/rode/collector-sonarqube/internal/match"
+	"github.com/rode/collector-sonarqube/sink"
+	"github.com/rode/collector-sonarqube/sonar"
+)
+
+// Mapping lists the resources that each project's analyses apply to, in addition to the analyzed commit, and the
+// component of the repository that each project analyzes. Project keys may end in "*" to match a prefix. Resource uris
+// and components can include the placeholders {projectKey}, {revision} and {branch}, which are replaced with details
+// from the event.
+//
+//	{
+//	  "projects": {
+//	    "my-monorepo-api": ["harbor.example.com/my-org/api:{revision}"]
+//	  },
+//	  "components": {
+//	    "my-monorepo-api": "services/api"
+//	  }
+//	}
+type Mapping struct {
+	Projects   map[string][]string `json:"projects"`
+	Components map[string]string   `json:"components"`
+}
+
+// Load reads a mapping from a JSON file.
+func Load(path string) (*Mapping, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mapping := &Mapping{}
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(mapping); err != nil {
+		return nil, fmt.Errorf("error reading resource mapping %s: %v", path, err)
+	}
+
+	return mapping, nil
+}
+
+// ResourceUris returns the resources mapped to the event's project.
+func (m *Mapping) ResourceUris(event *sonar.Event) []string {
+	if event.Project == nil {
+		return nil
+	}
+
+	replacer := placeholders(event)
+
+	var uris []string
+	// patterns are sorted so that the resources are always listed in the same order
+	var patterns []string
+	for pattern := range m.Projects {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	for _, pattern := range patterns {
+		if !match.Pattern(pattern, event.Project.Key) {
+			continue
+		}
+
+		for _, template := range m.Projects[pattern] {
+			uris = append(uris, replacer.Replace(template))
+		}
+	}
+
+	return uris
+}
+
+// Component returns the component mapped to the event's project, or an empty string if there isn't one. An exact
+// project key takes precedence over a prefix.
+func (m *Mapping) Component(event *sonar.Event) string {
+	if event.Project == nil {
+		return ""
+	}
+
+	component, ok := m.Components[event.Project.Key]
+	if !ok {
+		// the longest matching prefix is the most specific
+		longest := ""
+		for pattern, value := range m.Components {
+			if match.IsPrefix(pattern) && match.Pattern(pattern, event.Project.Key) && len(pattern) > len(longest) {
+				longest, component, ok = pattern, value, true
+			}
+		}
+	}
+
+	if !ok {
+		return ""
+	}
+
+	return strings.Trim(placeholders(event).Replace(component), "/")
+}
+
+func placeholders(event *sonar.Event) *strings.Replacer {
+	branch := ""
+	if event.Branch != nil {
+		branch = event.Branch.Name
+	}
+
+	return strings.NewReplacer(
+		"{projectKey}", event.Project.Key,
+		"{revision}", event.Revision,
+		"{branch}", branch,
+	)
+}
+
+type mapper struct {
+	mapping *Mapping
+	next    sink.Sink
+}
+
+// NewMapper returns a sink that adds the mapped resources to each analysis before passing it to the next sink.
+func NewMapper(mapping *Mapping, next sink.Sink) sink.Sink {
+	return &mapper{
+		mapping: mapping,
+		next:    next,
+	}
+}
+
+func (m *mapper) Name() string {
+	return m.next.Name()
+}
+
+// Send adds the mapped resources to the analysis, and the mapped component unless the scanner already set one.
+func (m *mapper) Send(ctx context.Context, analysis *sink.Analysis) error {
+	analysis.AddArtifactUris(m.mapping.ResourceUris(analysis.Event)...)
+	if analysis.Component == "" {
+		analysis.Component = m.mapping.Component(analysis.Event)
+	}
+
+	return m.next.Send(ctx, analysis)
+}
@@ -0,0 +1,180 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapping
+
+import (
+	"context"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/collector-sonarqube/sink"
+	"github.com/rode/collector-sonarqube/sonar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("Mapping", func() {
+	var (
+		mapping *Mapping
+		event   *sonar.Event
+	)
+
+	BeforeEach(func() {
+		mapping = &Mapping{
+			Projects: map[string][]string{
+				"monorepo":   {"harbor.example.com/rode/api:{revision}", "harbor.example.com/rode/web:{branch}-{revision}"},
+				"mono*":      {"harbor.example.com/rode/{projectKey}:latest"},
+				"standalone": {"harbor.example.com/rode/standalone:{revision}"},
+			},
+		}
+
+		event = &sonar.Event{
+			Revision: "abc123",
+			Project:  &sonar.Project{Key: "monorepo"},
+			Branch:   &sonar.Branch{Name: "main"},
+		}
+	})
+
+	Context("ResourceUris", func() {
+		It("should return the resources for every matching project", func() {
+			Expect(mapping.ResourceUris(event)).To(Equal([]string{
+				"harbor.example.com/rode/monorepo:latest",
+				"harbor.example.com/rode/api:abc123",
+				"harbor.example.com/rode/web:main-abc123",
+			}))
+		})
+
+		It("should return nothing for projects that aren't mapped", func() {
+			event.Project.Key = fake.LetterN(10)
+
+			Expect(mapping.ResourceUris(event)).To(BeEmpty())
+		})
+
+		It("should return nothing for events without a project", func() {
+			event.Project = nil
+
+			Expect(mapping.ResourceUris(event)).To(BeEmpty())
+		})
+	})
+
+	Context("Component", func() {
+		BeforeEach(func() {
+			mapping.Components = map[string]string{
+				"monorepo":       "services/main",
+				"monorepo-*":     "services/{projectKey}",
+				"monorepo-web-*": "web/{branch}/",
+			}
+		})
+
+		It("should prefer an exact project key", func() {
+			Expect(mapping.Component(event)).To(Equal("services/main"))
+		})
+
+		It("should use the longest matching prefix", func() {
+			event.Project.Key = "monorepo-web-admin"
+
+			Expect(mapping.Component(event)).To(Equal("web/main"))
+		})
+
+		It("should replace placeholders", func() {
+			event.Project.Key = "monorepo-api"
+
+			Expect(mapping.Component(event)).To(Equal("services/monorepo-api"))
+		})
+
+		It("should return nothing for projects that aren't mapped", func() {
+			event.Project.Key = "standalone"
+
+			Expect(mapping.Component(event)).To(BeEmpty())
+		})
+	})
+
+	Context("Load", func() {
+		var (
+			dir  string
+			path string
+		)
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "mapping")
+			Expect(err).ToNot(HaveOccurred())
+
+			path = filepath.Join(dir, "mapping.json")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should read the projects", func() {
+			Expect(ioutil.WriteFile(path, []byte(`{"projects": {"monorepo": ["harbor.example.com/rode/api:{revision}"]}}`), 0600)).To(Succeed())
+
+			actual, err := Load(path)
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(actual.Projects).To(HaveKeyWithValue("monorepo", []string{"harbor.example.com/rode/api:{revision}"}))
+		})
+
+		It("should reject unknown fields", func() {
+			Expect(ioutil.WriteFile(path, []byte(`{"project": {}}`), 0600)).To(Succeed())
+
+			_, err := Load(path)
+
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should return an error when the file doesn't exist", func() {
+			_, err := Load(path)
+
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("NewMapper", func() {
+		It("should add the mapped resources before sending the analysis", func() {
+			next := &recordingSink{}
+			analysis := &sink.Analysis{Event: event, ResourceUri: "git://github.com/rode/monorepo@abc123"}
+
+			Expect(NewMapper(mapping, next).Send(context.Background(), analysis)).To(Succeed())
+
+			Expect(next.analyses).To(ConsistOf(analysis))
+			Expect(analysis.ArtifactUris).To(HaveLen(3))
+		})
+
+		It("should not replace a component set by the scanner", func() {
+			mapping.Components = map[string]string{"monorepo": "services/main"}
+			analysis := &sink.Analysis{Event: event, Component: "services/api"}
+
+			Expect(NewMapper(mapping, &recordingSink{}).Send(context.Background(), analysis)).To(Succeed())
+
+			Expect(analysis.Component).To(Equal("services/api"))
+		})
+	})
+})
+
+type recordingSink struct {
+	analyses []*sink.Analysis
+}
+
+func (r *recordingSink) Name() string {
+	return "recording"
+}
+
+func (r *recordingSink) Send(_ context.Context, analysis *sink.Analysis) error {
+	r.analyses = append(r.analyses, analysis)
+
+	return nil
+}
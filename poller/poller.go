@@ -0,0 +1,344 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package poller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rode/collector-sonarqube/internal/match"
+	"github.com/rode/collector-sonarqube/listener"
+	"github.com/rode/collector-sonarqube/sonar"
+	"go.uber.org/zap"
+)
+
+const (
+	// lookback is how far before the checkpoint tasks are requested. Activity can only be filtered by submission time,
+	// and a task may wait in the compute engine queue for a while before it's executed.
+	lookback = time.Hour
+	// maxAttempts is how many polls a task is retried for before it's skipped, so that a task that can never be
+	// processed, such as one whose analysis was purged, doesn't hold back every task after it
+	maxAttempts = 5
+)
+
+// Options configure which projects are polled, how often, and where progress is saved.
+type Options struct {
+	// ServerUrl is the base URL of the instance, which is included in each event
+	ServerUrl string
+	Interval  time.Duration
+	// Projects are the project keys to poll, with an optional trailing * to match a prefix. All projects are polled when
+	// it's empty.
+	Projects []string
+	// CheckpointFile is where the last processed task is saved, so that tasks aren't processed again after a restart.
+	// Progress is only kept in memory when it's empty.
+	CheckpointFile string
+}
+
+// Checkpoint is the most recent execution time that has been processed, along with the tasks executed at that exact
+// time, since several tasks can finish within the same second.
+type Checkpoint struct {
+	ExecutedAt time.Time `json:"executedAt"`
+	TaskIds    []string  `json:"taskIds"`
+	// Attempts counts the failed attempts at the task that's holding back the checkpoint
+	Attempts map[string]int `json:"attempts,omitempty"`
+}
+
+func (c *Checkpoint) processed(task *sonar.Task, executedAt time.Time) bool {
+	if executedAt.Before(c.ExecutedAt) {
+		return true
+	}
+
+	if !executedAt.Equal(c.ExecutedAt) {
+		return false
+	}
+
+	for _, id := range c.TaskIds {
+		if id == task.Id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Checkpoint) advance(task *sonar.Task, executedAt time.Time) {
+	if !executedAt.Equal(c.ExecutedAt) {
+		c.ExecutedAt = executedAt
+		c.TaskIds = nil
+	}
+
+	c.TaskIds = append(c.TaskIds, task.Id)
+	delete(c.Attempts, task.Id)
+}
+
+// failed counts a failed attempt at the task, and returns true if it should be retried on the next poll.
+func (c *Checkpoint) failed(task *sonar.Task) bool {
+	if c.Attempts == nil {
+		c.Attempts = map[string]int{}
+	}
+	c.Attempts[task.Id]++
+
+	return c.Attempts[task.Id] < maxAttempts
+}
+
+// Stats describe the tasks the poller is waiting to retry.
+type Stats struct {
+	// PendingRetries is the number of tasks that failed to record and will be retried on the next poll
+	PendingRetries int `json:"pendingRetries"`
+}
+
+// Poller reads finished tasks from the compute engine activity of a SonarQube instance, and processes the equivalent
+// webhook events. It's used when the instance can't make requests to the collector.
+type Poller struct {
+	logger     *zap.Logger
+	client     sonar.Client
+	listener   listener.Listener
+	options    *Options
+	checkpoint *Checkpoint
+
+	mu    sync.Mutex
+	stats Stats
+}
+
+func New(logger *zap.Logger, client sonar.Client, l listener.Listener, options *Options) *Poller {
+	return &Poller{
+		logger:   logger,
+		client:   client,
+		listener: l,
+		options:  options,
+	}
+}
+
+// Run polls once per interval until the context is canceled.
+func (p *Poller) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.options.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.Poll(ctx); err != nil {
+			p.logger.Error("error polling compute engine activity", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll processes the tasks that finished since the checkpoint, oldest first. The checkpoint is saved after each task,
+// and isn't advanced past a task that couldn't be recorded, so that it's retried on the next poll. A task that still
+// can't be recorded after maxAttempts polls is skipped; when the listener keeps a history, the last failure is left in
+// it as a dead letter that can be reprocessed. Invalid events are not retried, as processing them again won't change
+// the outcome, and a task interrupted by shutdown doesn't count as an attempt.
+func (p *Poller) Poll(ctx context.Context) error {
+	if err := p.loadCheckpoint(); err != nil {
+		return err
+	}
+	defer p.updateStats()
+
+	tasks, err := p.listTasks(ctx)
+	if err != nil {
+		return err
+	}
+
+	log := p.logger.Named("Poll")
+	log.Debug("found compute engine tasks", zap.Int("count", len(tasks)))
+
+	for _, task := range tasks {
+		log := log.With(zap.String("taskId", task.Id), zap.String("project", task.ComponentKey))
+
+		if err := p.process(ctx, log, task.Task); err != nil {
+			if interrupted(ctx, err) {
+				return err
+			}
+
+			if p.checkpoint.failed(task.Task) {
+				if saveErr := p.saveCheckpoint(); saveErr != nil {
+					return saveErr
+				}
+
+				return err
+			}
+
+			log.Error("skipping compute engine task after repeated failures", zap.Int("attempts", maxAttempts), zap.Error(err))
+		}
+
+		p.checkpoint.advance(task.Task, task.executedAt)
+		if err := p.saveCheckpoint(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Stats returns a snapshot of the tasks waiting to be retried, as of the end of the last poll.
+func (p *Poller) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.stats
+}
+
+// updateStats copies the retry counts out of the checkpoint, which is only used by Poll.
+func (p *Poller) updateStats() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.stats.PendingRetries = len(p.checkpoint.Attempts)
+}
+
+func (p *Poller) process(ctx context.Context, log *zap.Logger, task *sonar.Task) error {
+	event, err := sonar.EventForTask(ctx, p.client, p.options.ServerUrl, task)
+	if err != nil {
+		return fmt.Errorf("error building event for task %s: %w", task.Id, err)
+	}
+
+	result, err := p.listener.Process(ctx, event, &listener.ProcessOptions{Source: listener.SOURCE_POLL})
+	var validationErr *listener.ValidationError
+	if err != nil && !errors.As(err, &validationErr) {
+		return fmt.Errorf("error processing task %s: %w", task.Id, err)
+	}
+
+	log.Info("processed compute engine task", zap.String("outcome", string(result.Outcome)), zap.String("reason", result.Reason))
+
+	return nil
+}
+
+// interrupted reports whether processing failed because the context was canceled or timed out, rather than because of
+// the task itself.
+func interrupted(ctx context.Context, err error) bool {
+	return ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+type activityTask struct {
+	*sonar.Task
+	executedAt time.Time
+}
+
+// listTasks returns the finished tasks for the polled projects that haven't been processed, ordered by execution time.
+// Exact project keys are requested individually, which doesn't require permission to see the activity of every project.
+func (p *Poller) listTasks(ctx context.Context) ([]*activityTask, error) {
+	components := []string{""}
+	if len(p.options.Projects) > 0 && !match.AnyPrefix(p.options.Projects) {
+		components = p.options.Projects
+	}
+
+	var tasks []*activityTask
+	for _, component := range components {
+		activity, err := p.client.ListActivity(ctx, &sonar.ActivityQuery{
+			Component:      component,
+			MinSubmittedAt: p.checkpoint.ExecutedAt.Add(-lookback),
+			Statuses:       []sonar.EventStatus{sonar.STATUS_SUCCESS, sonar.STATUS_FAILED, sonar.STATUS_CANCELED},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error listing compute engine activity: %v", err)
+		}
+
+		for _, task := range activity {
+			executedAt, err := sonar.ParseTimestamp(task.ExecutedAt)
+			if err != nil {
+				p.logger.Warn("ignoring task with an unrecognized execution time", zap.String("taskId", task.Id), zap.Error(err))
+				continue
+			}
+
+			if !p.polled(task.ComponentKey) || p.checkpoint.processed(task, executedAt) {
+				continue
+			}
+
+			tasks = append(tasks, &activityTask{Task: task, executedAt: executedAt})
+		}
+	}
+
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return tasks[i].executedAt.Before(tasks[j].executedAt)
+	})
+
+	return tasks, nil
+}
+
+// polled returns true if the project is one of those polled, which is every project when none are listed.
+func (p *Poller) polled(projectKey string) bool {
+	return len(p.options.Projects) == 0 || match.Any(p.options.Projects, projectKey)
+}
+
+// loadCheckpoint reads the checkpoint the first time it's needed. Without a saved checkpoint, polling starts one
+// interval in the past, rather than processing the entire history of the instance.
+func (p *Poller) loadCheckpoint() error {
+	if p.checkpoint != nil {
+		return nil
+	}
+
+	checkpoint := &Checkpoint{ExecutedAt: time.Now().Add(-p.options.Interval)}
+	if p.options.CheckpointFile != "" {
+		b, err := ioutil.ReadFile(p.options.CheckpointFile)
+		switch {
+		case err == nil:
+			checkpoint = &Checkpoint{}
+			if err := json.Unmarshal(b, checkpoint); err != nil {
+				return fmt.Errorf("error reading checkpoint: %v", err)
+			}
+		case !errors.Is(err, os.ErrNotExist):
+			return fmt.Errorf("error reading checkpoint: %v", err)
+		}
+	}
+
+	p.checkpoint = checkpoint
+
+	return nil
+}
+
+// saveCheckpoint replaces the checkpoint file, so that a partially written checkpoint is never read.
+func (p *Poller) saveCheckpoint() error {
+	if p.options.CheckpointFile == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(p.checkpoint)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p.options.CheckpointFile), filepath.Base(p.options.CheckpointFile)+".*")
+	if err != nil {
+		return fmt.Errorf("error saving checkpoint: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error saving checkpoint: %v", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error saving checkpoint: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), p.options.CheckpointFile); err != nil {
+		return fmt.Errorf("error saving checkpoint: %v", err)
+	}
+
+	return nil
+}
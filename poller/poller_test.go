@@ -0,0 +1,312 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package poller
+
+import (
+	"context"
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/collector-sonarqube/listener"
+	"github.com/rode/collector-sonarqube/sonar"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type fakeSonarClient struct {
+	sonar.Client
+
+	tasks   []*sonar.Task
+	queries []*sonar.ActivityQuery
+	err     error
+	// analysisErrs are keyed by task id
+	analysisErrs map[string]error
+}
+
+func (f *fakeSonarClient) ListActivity(_ context.Context, query *sonar.ActivityQuery) ([]*sonar.Task, error) {
+	f.queries = append(f.queries, query)
+
+	var tasks []*sonar.Task
+	for _, task := range f.tasks {
+		if query.Component == "" || query.Component == task.ComponentKey {
+			tasks = append(tasks, task)
+		}
+	}
+
+	return tasks, f.err
+}
+
+func (f *fakeSonarClient) GetScannerContext(context.Context, string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (f *fakeSonarClient) GetAnalysis(_ context.Context, task *sonar.Task) (*sonar.ProjectAnalysis, error) {
+	if err := f.analysisErrs[task.Id]; err != nil {
+		return nil, err
+	}
+
+	return &sonar.ProjectAnalysis{Key: task.AnalysisId, Revision: "abc123"}, nil
+}
+
+func (f *fakeSonarClient) GetQualityGate(context.Context, string, string) (*sonar.QualityGate, error) {
+	return &sonar.QualityGate{Status: sonar.STATUS_OK}, nil
+}
+
+type fakeListener struct {
+	listener.Listener
+
+	events []*sonar.Event
+	errs   map[string]error
+}
+
+func (f *fakeListener) ProcessEvent(http.ResponseWriter, *http.Request) {}
+
+func (f *fakeListener) Process(_ context.Context, event *sonar.Event, _ *listener.ProcessOptions) (*listener.Result, error) {
+	f.events = append(f.events, event)
+
+	if err := f.errs[event.TaskId]; err != nil {
+		return &listener.Result{TaskId: event.TaskId, Outcome: listener.OUTCOME_FAILED, Reason: err.Error()}, err
+	}
+
+	return &listener.Result{TaskId: event.TaskId, Outcome: listener.OUTCOME_RECORDED}, nil
+}
+
+var _ = Describe("Poller", func() {
+	var (
+		client  *fakeSonarClient
+		l       *fakeListener
+		options *Options
+		poller  *Poller
+		now     time.Time
+	)
+
+	task := func(id, projectKey string, executedAt time.Time) *sonar.Task {
+		return &sonar.Task{
+			Id:           id,
+			ComponentKey: projectKey,
+			Status:       sonar.STATUS_SUCCESS,
+			AnalysisId:   fake.LetterN(10),
+			ExecutedAt:   executedAt.Format("2006-01-02T15:04:05-0700"),
+		}
+	}
+
+	taskIds := func() []string {
+		var ids []string
+		for _, event := range l.events {
+			ids = append(ids, event.TaskId)
+		}
+
+		return ids
+	}
+
+	BeforeEach(func() {
+		now = time.Now().Truncate(time.Second)
+		client = &fakeSonarClient{analysisErrs: map[string]error{}}
+		l = &fakeListener{errs: map[string]error{}}
+		options = &Options{
+			ServerUrl: "https://sonar.example.com",
+			Interval:  time.Minute,
+		}
+	})
+
+	JustBeforeEach(func() {
+		poller = New(logger, client, l, options)
+	})
+
+	It("should process tasks that finished since the last interval, oldest first", func() {
+		client.tasks = []*sonar.Task{
+			task("second", "project", now.Add(-10*time.Second)),
+			task("first", "project", now.Add(-20*time.Second)),
+			task("old", "project", now.Add(-time.Hour)),
+		}
+
+		Expect(poller.Poll(context.Background())).To(Succeed())
+
+		Expect(taskIds()).To(Equal([]string{"first", "second"}))
+		Expect(l.events[0].ServerUrl).To(Equal(options.ServerUrl))
+		Expect(l.events[0].Revision).To(Equal("abc123"))
+		Expect(client.queries[0].Statuses).To(ConsistOf(sonar.STATUS_SUCCESS, sonar.STATUS_FAILED, sonar.STATUS_CANCELED))
+		Expect(client.queries[0].MinSubmittedAt).To(BeTemporally("<", now.Add(-time.Minute)))
+	})
+
+	It("should not process a task twice", func() {
+		client.tasks = []*sonar.Task{task("first", "project", now.Add(-10*time.Second))}
+		Expect(poller.Poll(context.Background())).To(Succeed())
+
+		client.tasks = append(client.tasks, task("second", "project", now.Add(-10*time.Second)))
+		Expect(poller.Poll(context.Background())).To(Succeed())
+
+		Expect(taskIds()).To(Equal([]string{"first", "second"}))
+	})
+
+	It("should retry tasks that could not be recorded", func() {
+		client.tasks = []*sonar.Task{
+			task("first", "project", now.Add(-20*time.Second)),
+			task("second", "project", now.Add(-10*time.Second)),
+		}
+		l.errs["first"] = errors.New("rode is unavailable")
+
+		Expect(poller.Poll(context.Background())).To(MatchError(ContainSubstring("rode is unavailable")))
+		Expect(taskIds()).To(Equal([]string{"first"}))
+
+		Expect(poller.Stats().PendingRetries).To(Equal(1))
+
+		delete(l.errs, "first")
+		Expect(poller.Poll(context.Background())).To(Succeed())
+		Expect(taskIds()).To(Equal([]string{"first", "first", "second"}))
+		Expect(poller.Stats().PendingRetries).To(BeZero())
+	})
+
+	It("should skip a task that can't be processed after repeated attempts", func() {
+		client.tasks = []*sonar.Task{
+			task("purged", "project", now.Add(-20*time.Second)),
+			task("second", "project", now.Add(-10*time.Second)),
+		}
+		client.analysisErrs["purged"] = errors.New("analysis not found")
+
+		for i := 1; i < maxAttempts; i++ {
+			Expect(poller.Poll(context.Background())).To(MatchError(ContainSubstring("analysis not found")))
+			Expect(taskIds()).To(BeEmpty())
+		}
+
+		Expect(poller.Poll(context.Background())).To(Succeed())
+		Expect(taskIds()).To(Equal([]string{"second"}))
+
+		Expect(poller.Poll(context.Background())).To(Succeed())
+		Expect(taskIds()).To(Equal([]string{"second"}))
+	})
+
+	It("should not count attempts interrupted by shutdown", func() {
+		client.tasks = []*sonar.Task{task("first", "project", now.Add(-10*time.Second))}
+		l.errs["first"] = context.Canceled
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		for i := 0; i <= maxAttempts; i++ {
+			Expect(poller.Poll(ctx)).To(MatchError(context.Canceled))
+		}
+
+		delete(l.errs, "first")
+		Expect(poller.Poll(context.Background())).To(Succeed())
+		Expect(taskIds()).To(HaveLen(maxAttempts + 2))
+	})
+
+	It("should not retry invalid events", func() {
+		client.tasks = []*sonar.Task{task("first", "project", now.Add(-10*time.Second))}
+		l.errs["first"] = &listener.ValidationError{Problems: []string{"missing revision"}}
+
+		Expect(poller.Poll(context.Background())).To(Succeed())
+		Expect(poller.Poll(context.Background())).To(Succeed())
+
+		Expect(taskIds()).To(Equal([]string{"first"}))
+	})
+
+	It("should return an error when activity can't be listed", func() {
+		client.err = errors.New("unauthorized")
+
+		Expect(poller.Poll(context.Background())).To(MatchError(ContainSubstring("unauthorized")))
+	})
+
+	When("projects are configured", func() {
+		BeforeEach(func() {
+			client.tasks = []*sonar.Task{
+				task("first", "team-a", now.Add(-20*time.Second)),
+				task("second", "team-b", now.Add(-10*time.Second)),
+				task("third", "other", now.Add(-5*time.Second)),
+			}
+		})
+
+		It("should request the activity of each project", func() {
+			options.Projects = []string{"team-a", "other"}
+
+			Expect(poller.Poll(context.Background())).To(Succeed())
+
+			Expect(taskIds()).To(Equal([]string{"first", "third"}))
+			Expect(client.queries).To(HaveLen(2))
+			Expect(client.queries[0].Component).To(Equal("team-a"))
+			Expect(client.queries[1].Component).To(Equal("other"))
+		})
+
+		It("should filter the activity of every project by prefix", func() {
+			options.Projects = []string{"team-*"}
+
+			Expect(poller.Poll(context.Background())).To(Succeed())
+
+			Expect(taskIds()).To(Equal([]string{"first", "second"}))
+			Expect(client.queries).To(HaveLen(1))
+			Expect(client.queries[0].Component).To(BeEmpty())
+		})
+	})
+
+	When("a checkpoint file is configured", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "poller")
+			Expect(err).ToNot(HaveOccurred())
+
+			options.CheckpointFile = filepath.Join(dir, "checkpoint.json")
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("should resume from the saved checkpoint", func() {
+			client.tasks = []*sonar.Task{task("first", "project", now.Add(-10*time.Second))}
+			Expect(poller.Poll(context.Background())).To(Succeed())
+
+			client.tasks = append(client.tasks, task("second", "project", now.Add(-5*time.Second)))
+			Expect(New(logger, client, l, options).Poll(context.Background())).To(Succeed())
+
+			Expect(taskIds()).To(Equal([]string{"first", "second"}))
+		})
+
+		It("should process tasks older than the interval when the checkpoint is older", func() {
+			Expect(ioutil.WriteFile(options.CheckpointFile, []byte(`{"executedAt":"`+now.Add(-2*time.Hour).Format(time.RFC3339)+`"}`), 0600)).To(Succeed())
+			client.tasks = []*sonar.Task{task("old", "project", now.Add(-time.Hour))}
+
+			Expect(poller.Poll(context.Background())).To(Succeed())
+
+			Expect(taskIds()).To(Equal([]string{"old"}))
+		})
+
+		It("should keep counting attempts after a restart", func() {
+			client.tasks = []*sonar.Task{task("purged", "project", now.Add(-10*time.Second))}
+			client.analysisErrs["purged"] = errors.New("analysis not found")
+
+			for i := 1; i < maxAttempts; i++ {
+				Expect(New(logger, client, l, options).Poll(context.Background())).ToNot(Succeed())
+			}
+			Expect(New(logger, client, l, options).Poll(context.Background())).To(Succeed())
+
+			checkpoint, err := ioutil.ReadFile(options.CheckpointFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(checkpoint)).To(ContainSubstring(`"taskIds":["purged"]`))
+			Expect(string(checkpoint)).ToNot(ContainSubstring("attempts"))
+		})
+
+		It("should return an error for an unreadable checkpoint", func() {
+			Expect(ioutil.WriteFile(options.CheckpointFile, []byte("{"), 0600)).To(Succeed())
+
+			Expect(poller.Poll(context.Background())).To(MatchError(ContainSubstring("error reading checkpoint")))
+		})
+	})
+})
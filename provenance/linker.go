@@ -0,0 +1,140 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provenance
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/rode/collector-sonarqube/internal/match"
+	"github.com/rode/collector-sonarqube/sink"
+	"github.com/rode/collector-sonarqube/sonar"
+	pb "github.com/rode/rode/proto/v1alpha1"
+	"github.com/rode/rode/protodeps/grafeas/proto/v1beta1/grafeas_go_proto"
+	"github.com/rode/rode/protodeps/grafeas/proto/v1beta1/provenance_go_proto"
+	"go.uber.org/zap"
+)
+
+// Linker looks up the build occurrences that Rode has for the analyzed commit, and adds the artifacts they produced to
+// the analysis before passing it to the next sink. This allows policies evaluated against an artifact, such as an image,
+// to require a Sonar analysis of the commit it was built from.
+type Linker struct {
+	next     sink.Sink
+	client   pb.RodeClient
+	projects []string
+	logger   *zap.Logger
+}
+
+// NewLinker returns a sink that links analyses of the given projects to build artifacts. Each project pattern is either
+// an exact project key, or a prefix followed by "*".
+func NewLinker(logger *zap.Logger, client pb.RodeClient, projects []string, next sink.Sink) *Linker {
+	return &Linker{
+		next:     next,
+		client:   client,
+		projects: projects,
+		logger:   logger,
+	}
+}
+
+func (l *Linker) Name() string {
+	return l.next.Name()
+}
+
+// Send links the analysis to build artifacts when its project is enabled. Failing to find builds isn't fatal: the
+// analysis is still recorded against the commit.
+func (l *Linker) Send(ctx context.Context, analysis *sink.Analysis) error {
+	if analysis.Event.Project != nil && match.Any(l.projects, analysis.Event.Project.Key) {
+		log := l.logger.With(zap.String("resourceUri", analysis.ResourceUri))
+
+		artifacts, err := l.builtArtifacts(ctx, analysis.ResourceUri, analysis.Pipeline)
+		if err != nil {
+			log.Warn("unable to look up build occurrences", zap.Error(err))
+		} else {
+			log.Debug("linking analysis to build artifacts", zap.Strings("artifacts", artifacts))
+			analysis.AddArtifactUris(artifacts...)
+		}
+	}
+
+	return l.next.Send(ctx, analysis)
+}
+
+// builtArtifacts returns the artifacts built from the commit. When the analysis came from a recognized pipeline run and
+// any of the builds were produced by that same run, only those builds are used, so that an analysis of one pipeline
+// run isn't attached to artifacts from an unrelated rebuild of the same commit.
+func (l *Linker) builtArtifacts(ctx context.Context, resourceUri string, pipeline *sonar.CIRun) ([]string, error) {
+	builds, err := l.listBuilds(ctx, resourceUri)
+	if err != nil {
+		return nil, err
+	}
+
+	if pipeline != nil {
+		var sameRun []*provenance_go_proto.BuildProvenance
+		for _, build := range builds {
+			if (pipeline.Id != "" && build.Id == pipeline.Id) || (pipeline.Url != "" && build.LogsUri == pipeline.Url) {
+				sameRun = append(sameRun, build)
+			}
+		}
+
+		if len(sameRun) > 0 {
+			builds = sameRun
+		}
+	}
+
+	var artifacts []string
+	seen := map[string]bool{resourceUri: true}
+	for _, build := range builds {
+		for _, artifact := range build.BuiltArtifacts {
+			if artifact.Id == "" || seen[artifact.Id] {
+				continue
+			}
+
+			seen[artifact.Id] = true
+			artifacts = append(artifacts, artifact.Id)
+		}
+	}
+
+	return artifacts, nil
+}
+
+func (l *Linker) listBuilds(ctx context.Context, resourceUri string) ([]*provenance_go_proto.BuildProvenance, error) {
+	request := &pb.ListOccurrencesRequest{
+		// the uri comes from scanner properties, so it's quoted rather than trusted not to contain a quote
+		Filter:   fmt.Sprintf(`kind == "BUILD" && resource.uri == %s`, strconv.Quote(resourceUri)),
+		PageSize: 100,
+	}
+
+	var builds []*provenance_go_proto.BuildProvenance
+	for {
+		response, err := l.client.ListOccurrences(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, occurrence := range response.Occurrences {
+			details, ok := occurrence.Details.(*grafeas_go_proto.Occurrence_Build)
+			if !ok || details.Build == nil || details.Build.Provenance == nil || occurrence.GetResource().GetUri() != resourceUri {
+				continue
+			}
+
+			builds = append(builds, details.Build.Provenance)
+		}
+
+		if response.NextPageToken == "" {
+			return builds, nil
+		}
+		request.PageToken = response.NextPageToken
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provenance
+
+import (
+	"context"
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/collector-sonarqube/sink"
+	"github.com/rode/collector-sonarqube/sonar"
+	pb "github.com/rode/rode/proto/v1alpha1"
+	"github.com/rode/rode/proto/v1alpha1fakes"
+	"github.com/rode/rode/protodeps/grafeas/proto/v1beta1/build_go_proto"
+	"github.com/rode/rode/protodeps/grafeas/proto/v1beta1/grafeas_go_proto"
+	"github.com/rode/rode/protodeps/grafeas/proto/v1beta1/provenance_go_proto"
+	"time"
+)
+
+var _ = Describe("Linker", func() {
+	var (
+		rodeClient *v1alpha1fakes.FakeRodeClient
+		projects   []string
+		analysis   *sink.Analysis
+		err        error
+
+		commitUri string
+		imageUri  string
+	)
+
+	buildOccurrence := func(id, logsUri string, artifacts ...string) *grafeas_go_proto.Occurrence {
+		provenance := &provenance_go_proto.BuildProvenance{
+			Id:      id,
+			LogsUri: logsUri,
+		}
+		for _, artifact := range artifacts {
+			provenance.BuiltArtifacts = append(provenance.BuiltArtifacts, &provenance_go_proto.Artifact{Id: artifact})
+		}
+
+		return &grafeas_go_proto.Occurrence{
+			Resource: &grafeas_go_proto.Resource{Uri: commitUri},
+			Details: &grafeas_go_proto.Occurrence_Build{
+				Build: &build_go_proto.Details{Provenance: provenance},
+			},
+		}
+	}
+
+	BeforeEach(func() {
+		rodeClient = &v1alpha1fakes.FakeRodeClient{}
+		rodeClient.CreateNoteReturns(&grafeas_go_proto.Note{Name: fake.LetterN(10)}, nil)
+		rodeClient.BatchCreateOccurrencesReturns(&pb.BatchCreateOccurrencesResponse{}, nil)
+
+		commitUri = "git://github.com/rode/collector-sonarqube@" + fake.LetterN(10)
+		imageUri = "harbor.example.com/rode/collector-sonarqube@sha256:" + fake.LetterN(64)
+		projects = []string{"rode-*"}
+
+		rodeClient.ListOccurrencesReturns(&pb.ListOccurrencesResponse{
+			Occurrences: []*grafeas_go_proto.Occurrence{
+				buildOccurrence("12", "", imageUri),
+			},
+		}, nil)
+
+		analysis = &sink.Analysis{
+			Event: &sonar.Event{
+				TaskId:  fake.LetterN(10),
+				Status:  sonar.STATUS_SUCCESS,
+				Project: &sonar.Project{Key: "rode-collector-sonarqube"},
+			},
+			ResourceUri: commitUri,
+			AnalysedAt:  time.Now(),
+		}
+	})
+
+	JustBeforeEach(func() {
+		linker := NewLinker(logger, rodeClient, projects, sink.NewRodeSink(logger, rodeClient, nil))
+		err = linker.Send(context.Background(), analysis)
+	})
+
+	It("should look up build occurrences for the analyzed commit", func() {
+		Expect(rodeClient.ListOccurrencesCallCount()).To(Equal(1))
+
+		_, request, _ := rodeClient.ListOccurrencesArgsForCall(0)
+		Expect(request.Filter).To(Equal(`kind == "BUILD" && resource.uri == "` + commitUri + `"`))
+	})
+
+	It("should record the analysis against the commit and the built artifacts", func() {
+		Expect(err).ToNot(HaveOccurred())
+		Expect(analysis.ArtifactUris).To(ConsistOf(imageUri))
+
+		_, request, _ := rodeClient.BatchCreateOccurrencesArgsForCall(0)
+		Expect(request.Occurrences).To(HaveLen(4))
+
+		var uris []string
+		for _, occurrence := range request.Occurrences {
+			uris = append(uris, occurrence.Resource.Uri)
+		}
+		Expect(uris).To(Equal([]string{commitUri, commitUri, imageUri, imageUri}))
+	})
+
+	When("the resource uri contains a quote", func() {
+		BeforeEach(func() {
+			commitUri = `git://github.com/rode/collector-sonarqube" || resource.uri != "@abc123`
+			analysis.ResourceUri = commitUri
+			rodeClient.ListOccurrencesReturns(&pb.ListOccurrencesResponse{
+				Occurrences: []*grafeas_go_proto.Occurrence{
+					buildOccurrence("12", "", imageUri),
+					{
+						Resource: &grafeas_go_proto.Resource{Uri: "git://github.com/rode/other@" + fake.LetterN(10)},
+						Details: &grafeas_go_proto.Occurrence_Build{
+							Build: &build_go_proto.Details{Provenance: &provenance_go_proto.BuildProvenance{
+								Id:             "13",
+								BuiltArtifacts: []*provenance_go_proto.Artifact{{Id: "harbor.example.com/rode/other"}},
+							}},
+						},
+					},
+				},
+			}, nil)
+		})
+
+		It("should escape it in the filter", func() {
+			_, request, _ := rodeClient.ListOccurrencesArgsForCall(0)
+
+			Expect(request.Filter).To(Equal(`kind == "BUILD" && resource.uri == "git://github.com/rode/collector-sonarqube\" || resource.uri != \"@abc123"`))
+		})
+
+		It("should only link artifacts built from the analyzed commit", func() {
+			Expect(analysis.ArtifactUris).To(ConsistOf(imageUri))
+		})
+	})
+
+	When("the project isn't enabled", func() {
+		BeforeEach(func() {
+			analysis.Event.Project.Key = "other"
+		})
+
+		It("should not look up builds", func() {
+			Expect(rodeClient.ListOccurrencesCallCount()).To(Equal(0))
+			Expect(analysis.ArtifactUris).To(BeEmpty())
+		})
+
+		It("should still send the analysis", func() {
+			Expect(rodeClient.BatchCreateOccurrencesCallCount()).To(Equal(1))
+		})
+	})
+
+	When("there are several pages of builds", func() {
+		var otherImageUri string
+
+		BeforeEach(func() {
+			otherImageUri = "harbor.example.com/rode/other@sha256:" + fake.LetterN(64)
+			rodeClient.ListOccurrencesReturnsOnCall(0, &pb.ListOccurrencesResponse{
+				Occurrences:   []*grafeas_go_proto.Occurrence{buildOccurrence("12", "", imageUri)},
+				NextPageToken: "next",
+			}, nil)
+			rodeClient.ListOccurrencesReturnsOnCall(1, &pb.ListOccurrencesResponse{
+				Occurrences: []*grafeas_go_proto.Occurrence{
+					buildOccurrence("13", "", otherImageUri, imageUri),
+					{Resource: &grafeas_go_proto.Resource{Uri: commitUri}},
+				},
+			}, nil)
+		})
+
+		It("should link every distinct artifact", func() {
+			Expect(rodeClient.ListOccurrencesCallCount()).To(Equal(2))
+
+			_, request, _ := rodeClient.ListOccurrencesArgsForCall(1)
+			Expect(request.PageToken).To(Equal("next"))
+			Expect(analysis.ArtifactUris).To(Equal([]string{imageUri, otherImageUri}))
+		})
+	})
+
+	When("the analysis came from a recognized pipeline run", func() {
+		var rebuiltImageUri string
+
+		BeforeEach(func() {
+			rebuiltImageUri = "harbor.example.com/rode/collector-sonarqube@sha256:" + fake.LetterN(64)
+			rodeClient.ListOccurrencesReturns(&pb.ListOccurrencesResponse{
+				Occurrences: []*grafeas_go_proto.Occurrence{
+					buildOccurrence("12", "https://jenkins.example.com/job/foo/12/", imageUri),
+					buildOccurrence("13", "https://jenkins.example.com/job/foo/13/", rebuiltImageUri),
+				},
+			}, nil)
+			analysis.Pipeline = &sonar.CIRun{
+				Provider: sonar.CI_PROVIDER_JENKINS,
+				Url:      "https://jenkins.example.com/job/foo/13/",
+			}
+		})
+
+		It("should only link artifacts from the same run", func() {
+			Expect(analysis.ArtifactUris).To(ConsistOf(rebuiltImageUri))
+		})
+
+		When("none of the builds came from the run", func() {
+			BeforeEach(func() {
+				analysis.Pipeline.Url = "https://jenkins.example.com/job/foo/14/"
+			})
+
+			It("should link artifacts from every build", func() {
+				Expect(analysis.ArtifactUris).To(ConsistOf(imageUri, rebuiltImageUri))
+			})
+		})
+	})
+
+	When("looking up builds fails", func() {
+		BeforeEach(func() {
+			rodeClient.ListOccurrencesReturns(nil, errors.New(fake.LetterN(10)))
+		})
+
+		It("should still record the analysis against the commit", func() {
+			Expect(err).ToNot(HaveOccurred())
+
+			_, request, _ := rodeClient.BatchCreateOccurrencesArgsForCall(0)
+			Expect(request.Occurrences).To(HaveLen(2))
+		})
+	})
+})
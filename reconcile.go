@@ -0,0 +1,84 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/rode/collector-sonarqube/config"
+	"github.com/rode/collector-sonarqube/reconcile"
+	"go.uber.org/zap"
+)
+
+// reconcileCommand compares recent analyses with Rode once, and returns the exit code for the process. Analyses that are
+// missing from Rode and weren't re-ingested are a failure.
+func reconcileCommand(name string, args []string) int {
+	conf, err := config.BuildReconcile(name, args)
+	if err != nil {
+		log.Printf("error parsing flags: %v", err)
+		return 2
+	}
+
+	logger, err := createLogger(conf.Debug)
+	if err != nil {
+		log.Printf("failed to create logger: %v", err)
+		return 1
+	}
+
+	// dry run requests are written to stderr so that the results can still be parsed
+	rodeClient, err := createRodeClient(conf.ClientConfig, conf.DryRun, os.Stderr, logger)
+	if err != nil {
+		logger.Error("could not create rode client", zap.Error(err))
+		return 1
+	}
+
+	l, sonarClient, err := buildPipeline(conf.PipelineConfig, conf.SonarConfig, logger, rodeClient)
+	if err != nil {
+		logger.Error("could not create pipeline", zap.Error(err))
+		return 1
+	}
+
+	reconciler := reconcile.New(logger.Named("reconcile"), sonarClient, rodeClient, l, &reconcile.Options{
+		ServerUrl: conf.SonarConfig.Url,
+		Window:    conf.Window,
+		Projects:  conf.Projects,
+		Reingest:  conf.Reingest,
+		DryRun:    conf.DryRun,
+	})
+
+	report, err := reconciler.Reconcile(context.Background())
+	if err != nil {
+		logger.Error("error reconciling analyses", zap.Error(err))
+		return 1
+	}
+
+	if conf.Output == "json" {
+		err = reconcile.WriteJSON(os.Stdout, report)
+	} else {
+		err = reconcile.WriteTable(os.Stdout, report)
+	}
+	if err != nil {
+		logger.Error("error writing results", zap.Error(err))
+		return 1
+	}
+
+	if report.Unresolved() > 0 {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,411 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reconcile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rode/collector-sonarqube/internal/match"
+	"github.com/rode/collector-sonarqube/listener"
+	"github.com/rode/collector-sonarqube/sonar"
+	pb "github.com/rode/rode/proto/v1alpha1"
+	"go.uber.org/zap"
+)
+
+// Options configure which analyses are checked, and what happens to the ones missing from Rode.
+type Options struct {
+	// ServerUrl is the base URL of the instance, which is included in re-ingested events
+	ServerUrl string
+	// Window is how far back analyses are checked
+	Window time.Duration
+	// Projects are the project keys to check, with an optional trailing * to match a prefix. All projects are checked
+	// when it's empty.
+	Projects []string
+	// Reingest processes missing analyses, rather than only reporting them
+	Reingest bool
+	// History is optional, and is checked before an analysis is looked up in SonarQube
+	History History
+	// DryRun is set when the Rode client doesn't read occurrences, so every analysis is reported as missing
+	DryRun bool
+}
+
+// History returns the resource uri that the listener recorded the analysis of a task against, or an empty string if it
+// hasn't recorded it.
+type History func(taskId string) string
+
+// Gap is an analysis that SonarQube holds and Rode doesn't.
+type Gap struct {
+	TaskId      string `json:"taskId"`
+	ProjectKey  string `json:"projectKey"`
+	ResourceUri string `json:"resourceUri,omitempty"`
+	AnalysedAt  string `json:"analysedAt,omitempty"`
+	// Result is set when the analysis was re-ingested
+	Result *listener.Result `json:"result,omitempty"`
+	// Reason explains why the analysis couldn't be checked or re-ingested
+	Reason string `json:"reason,omitempty"`
+}
+
+// Resolved returns true if the analysis was re-ingested.
+func (g *Gap) Resolved() bool {
+	return g.Result != nil && g.Result.Outcome == listener.OUTCOME_RECORDED
+}
+
+// Report is the outcome of a single reconciliation.
+type Report struct {
+	// DryRun is set when Rode wasn't checked, so every analysis is reported as missing
+	DryRun  bool `json:"dryRun,omitempty"`
+	Checked int  `json:"checked"`
+	// Skipped are the analyses that the filter or routing rules skip on purpose, which aren't expected in Rode
+	Skipped int    `json:"skipped"`
+	Gaps    []*Gap `json:"gaps"`
+}
+
+// Unresolved returns the number of gaps that weren't re-ingested.
+func (r *Report) Unresolved() int {
+	unresolved := 0
+	for _, gap := range r.Gaps {
+		if !gap.Resolved() {
+			unresolved++
+		}
+	}
+
+	return unresolved
+}
+
+// Stats are the totals across every reconciliation since the collector started.
+type Stats struct {
+	Runs            int64      `json:"runs"`
+	Failed          int64      `json:"failed"`
+	Checked         int64      `json:"checked"`
+	Skipped         int64      `json:"skipped"`
+	Missing         int64      `json:"missing"`
+	Reingested      int64      `json:"reingested"`
+	LastRunTime     *time.Time `json:"lastRunTime,omitempty"`
+	LastMissing     int        `json:"lastMissing"`
+	LastError       string     `json:"lastError,omitempty"`
+	LastFailureTime *time.Time `json:"lastFailureTime,omitempty"`
+}
+
+// Reconciler compares recent analyses in SonarQube with the occurrences in Rode, to find analyses whose webhook events
+// were lost.
+type Reconciler struct {
+	logger      *zap.Logger
+	sonarClient sonar.Client
+	rodeClient  pb.RodeClient
+	listener    listener.Listener
+	options     *Options
+
+	mu    sync.Mutex
+	stats Stats
+	// recorded are the tasks within the window that have been found in Rode, which aren't looked up again. It's only
+	// used by reconcile, which doesn't run concurrently.
+	recorded map[string]bool
+}
+
+func New(logger *zap.Logger, sonarClient sonar.Client, rodeClient pb.RodeClient, l listener.Listener, options *Options) *Reconciler {
+	return &Reconciler{
+		logger:      logger,
+		sonarClient: sonarClient,
+		rodeClient:  rodeClient,
+		listener:    l,
+		options:     options,
+		recorded:    map[string]bool{},
+	}
+}
+
+// Run reconciles once per interval until the context is canceled.
+func (r *Reconciler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := r.Reconcile(ctx); err != nil {
+			r.logger.Error("error reconciling analyses", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stats returns a snapshot of the reconciliation totals.
+func (r *Reconciler) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.stats
+}
+
+// Reconcile checks each analysis finished within the window, and reports those without occurrences in Rode. Canceled
+// analyses are never recorded, so they aren't checked, and neither are analyses that the filter or routing rules skip.
+// Each analysis is looked for under the resource uri that the listener would record it against. Rode is checked before
+// SonarQube when possible: analyses that have already been found, or that the history says were recorded, aren't
+// looked up in SonarQube again unless they're missing.
+func (r *Reconciler) Reconcile(ctx context.Context) (*Report, error) {
+	report, err := r.reconcile(ctx)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.stats.Runs++
+	r.stats.LastRunTime = &now
+	if err != nil {
+		r.stats.Failed++
+		r.stats.LastError = err.Error()
+		r.stats.LastFailureTime = r.stats.LastRunTime
+		return nil, err
+	}
+
+	r.stats.Checked += int64(report.Checked)
+	r.stats.Skipped += int64(report.Skipped)
+	r.stats.Missing += int64(len(report.Gaps))
+	r.stats.LastMissing = len(report.Gaps)
+	for _, gap := range report.Gaps {
+		if gap.Resolved() {
+			r.stats.Reingested++
+		}
+	}
+
+	return report, nil
+}
+
+func (r *Reconciler) reconcile(ctx context.Context) (*Report, error) {
+	tasks, err := r.listTasks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	log := r.logger.Named("Reconcile")
+	report := &Report{DryRun: r.options.DryRun, Gaps: []*Gap{}}
+	noteNames := map[string][]string{}
+	listNoteNames := func(resourceUri string) ([]string, error) {
+		if names, ok := noteNames[resourceUri]; ok {
+			return names, nil
+		}
+
+		names, err := r.listNoteNames(ctx, resourceUri)
+		if err != nil {
+			return nil, fmt.Errorf("error listing occurrences for %s: %v", resourceUri, err)
+		}
+		noteNames[resourceUri] = names
+
+		return names, nil
+	}
+
+	// tasks that have left the window are forgotten
+	recordedTasks := r.recorded
+	r.recorded = map[string]bool{}
+
+	for _, task := range tasks {
+		log := log.With(zap.String("taskId", task.Id), zap.String("project", task.ComponentKey))
+		report.Checked++
+
+		if recordedTasks[task.Id] {
+			r.recorded[task.Id] = true
+			continue
+		}
+
+		if resourceUri := r.recordedResourceUri(task.Id); resourceUri != "" {
+			names, err := listNoteNames(resourceUri)
+			if err != nil {
+				return nil, err
+			}
+
+			if recorded(names, task.Id) {
+				r.recorded[task.Id] = true
+				continue
+			}
+		}
+
+		gap := &Gap{
+			TaskId:     task.Id,
+			ProjectKey: task.ComponentKey,
+			AnalysedAt: task.ExecutedAt,
+		}
+
+		event, err := sonar.EventForTask(ctx, r.sonarClient, r.options.ServerUrl, task)
+		if err != nil {
+			gap.Reason = fmt.Sprintf("unable to look up analysis: %v", err)
+			log.Warn("unable to check analysis", zap.Error(err))
+			report.Gaps = append(report.Gaps, gap)
+			continue
+		}
+		gap.AnalysedAt = event.AnalysedAt
+
+		plan, err := r.listener.Plan(ctx, event, &listener.ProcessOptions{Source: listener.SOURCE_RECONCILE})
+		if err != nil {
+			gap.Reason = err.Error()
+			log.Warn("unable to determine how the analysis would be recorded", zap.Error(err))
+			report.Gaps = append(report.Gaps, gap)
+			continue
+		}
+		if plan.Skip {
+			log.Debug("analysis is skipped on purpose", zap.String("reason", plan.Reason))
+			report.Skipped++
+			continue
+		}
+		gap.ResourceUri = plan.ResourceUri
+
+		names, err := listNoteNames(gap.ResourceUri)
+		if err != nil {
+			return nil, err
+		}
+
+		if recorded(names, task.Id) {
+			r.recorded[task.Id] = true
+			continue
+		}
+
+		log.Warn("analysis is missing from rode", zap.String("resourceUri", gap.ResourceUri))
+		report.Gaps = append(report.Gaps, gap)
+
+		if !r.options.Reingest {
+			continue
+		}
+
+		gap.Result, err = r.listener.Process(ctx, event, &listener.ProcessOptions{Source: listener.SOURCE_RECONCILE, ResourceUri: gap.ResourceUri})
+		if err != nil {
+			log.Error("error re-ingesting analysis", zap.Error(err))
+		}
+	}
+
+	return report, nil
+}
+
+func (r *Reconciler) recordedResourceUri(taskId string) string {
+	if r.options.History == nil {
+		return ""
+	}
+
+	return r.options.History(taskId)
+}
+
+func (r *Reconciler) listTasks(ctx context.Context) ([]*sonar.Task, error) {
+	components := []string{""}
+	if len(r.options.Projects) > 0 && !match.AnyPrefix(r.options.Projects) {
+		components = r.options.Projects
+	}
+
+	var tasks []*sonar.Task
+	for _, component := range components {
+		activity, err := r.sonarClient.ListActivity(ctx, &sonar.ActivityQuery{
+			Component:      component,
+			MinSubmittedAt: time.Now().Add(-r.options.Window),
+			Statuses:       []sonar.EventStatus{sonar.STATUS_SUCCESS, sonar.STATUS_FAILED},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error listing compute engine activity: %v", err)
+		}
+
+		for _, task := range activity {
+			if len(r.options.Projects) == 0 || match.Any(r.options.Projects, task.ComponentKey) {
+				tasks = append(tasks, task)
+			}
+		}
+	}
+
+	sort.SliceStable(tasks, func(i, j int) bool {
+		a, _ := sonar.ParseTimestamp(tasks[i].ExecutedAt)
+		b, _ := sonar.ParseTimestamp(tasks[j].ExecutedAt)
+
+		return a.Before(b)
+	})
+
+	return tasks, nil
+}
+
+// listNoteNames returns the notes of the discovery occurrences recorded against the resource.
+func (r *Reconciler) listNoteNames(ctx context.Context, resourceUri string) ([]string, error) {
+	request := &pb.ListOccurrencesRequest{
+		// the uri comes from scanner properties, so it's quoted rather than trusted to be a valid string literal
+		Filter:   fmt.Sprintf(`kind == "DISCOVERY" && resource.uri == %s`, strconv.Quote(resourceUri)),
+		PageSize: 100,
+	}
+
+	var names []string
+	for {
+		response, err := r.rodeClient.ListOccurrences(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, occurrence := range response.Occurrences {
+			names = append(names, occurrence.NoteName)
+		}
+
+		if response.NextPageToken == "" {
+			return names, nil
+		}
+		request.PageToken = response.NextPageToken
+	}
+}
+
+// recorded returns true if any of the notes is for the task. Note ids end with the task id, and may include the
+// monorepo component before it.
+func recorded(noteNames []string, taskId string) bool {
+	for _, name := range noteNames {
+		if strings.HasSuffix(name, "-"+taskId) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WriteTable writes a human-readable list of the analyses missing from Rode.
+func WriteTable(out io.Writer, report *Report) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TASK ID\tPROJECT\tANALYSED AT\tRESOURCE URI\tOUTCOME\tREASON")
+
+	for _, gap := range report.Gaps {
+		outcome, reason := "MISSING", gap.Reason
+		if gap.Result != nil {
+			outcome = string(gap.Result.Outcome)
+			if reason == "" {
+				reason = gap.Result.Reason
+			}
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", gap.TaskId, gap.ProjectKey, gap.AnalysedAt, gap.ResourceUri, outcome, reason)
+	}
+
+	fmt.Fprintf(w, "\n%d analyses checked, %d skipped, %d missing, %d unresolved\n", report.Checked, report.Skipped, len(report.Gaps), report.Unresolved())
+	if report.DryRun {
+		fmt.Fprintln(w, "dry run: occurrences aren't read from Rode, so every analysis is reported as missing")
+	}
+
+	return w.Flush()
+}
+
+// WriteJSON writes the report as JSON.
+func WriteJSON(out io.Writer, report *Report) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(report)
+}
@@ -0,0 +1,353 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reconcile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/collector-sonarqube/listener"
+	"github.com/rode/collector-sonarqube/sonar"
+	pb "github.com/rode/rode/proto/v1alpha1"
+	"github.com/rode/rode/proto/v1alpha1fakes"
+	"github.com/rode/rode/protodeps/grafeas/proto/v1beta1/grafeas_go_proto"
+	"net/http"
+	"time"
+)
+
+type fakeSonarClient struct {
+	sonar.Client
+
+	tasks      []*sonar.Task
+	properties map[string]map[string]string
+	queries    []*sonar.ActivityQuery
+	lookups    []string
+}
+
+func (f *fakeSonarClient) ListActivity(_ context.Context, query *sonar.ActivityQuery) ([]*sonar.Task, error) {
+	f.queries = append(f.queries, query)
+
+	return f.tasks, nil
+}
+
+func (f *fakeSonarClient) GetScannerContext(_ context.Context, taskId string) (map[string]string, error) {
+	f.lookups = append(f.lookups, taskId)
+
+	return f.properties[taskId], nil
+}
+
+func (f *fakeSonarClient) GetAnalysis(_ context.Context, task *sonar.Task) (*sonar.ProjectAnalysis, error) {
+	return &sonar.ProjectAnalysis{Key: task.AnalysisId, Revision: "rev-" + task.Id}, nil
+}
+
+func (f *fakeSonarClient) GetQualityGate(context.Context, string, string) (*sonar.QualityGate, error) {
+	return &sonar.QualityGate{Status: sonar.STATUS_OK}, nil
+}
+
+func (f *fakeSonarClient) GetProjectBinding(context.Context, string) (*sonar.ProjectBinding, error) {
+	return nil, errors.New("bindings are only available in sonarcloud")
+}
+
+type fakeListener struct {
+	events  []*sonar.Event
+	options []*listener.ProcessOptions
+	// skips and resourceUris are keyed by task id, and stand in for the filter and routing rules
+	skips        map[string]string
+	resourceUris map[string]string
+}
+
+func (f *fakeListener) ProcessEvent(http.ResponseWriter, *http.Request) {}
+
+func (f *fakeListener) Process(_ context.Context, event *sonar.Event, options *listener.ProcessOptions) (*listener.Result, error) {
+	f.events = append(f.events, event)
+	f.options = append(f.options, options)
+
+	return &listener.Result{TaskId: event.TaskId, Outcome: listener.OUTCOME_RECORDED, ResourceUri: options.ResourceUri}, nil
+}
+
+func (f *fakeListener) Plan(_ context.Context, event *sonar.Event, _ *listener.ProcessOptions) (*listener.Plan, error) {
+	if reason, ok := f.skips[event.TaskId]; ok {
+		return &listener.Plan{Skip: true, Reason: reason}, nil
+	}
+
+	if uri, ok := f.resourceUris[event.TaskId]; ok {
+		return &listener.Plan{ResourceUri: uri}, nil
+	}
+
+	uri, err := listener.ResourceUriFromEvent(event, "")
+	if err != nil {
+		return &listener.Plan{}, &listener.ValidationError{Problems: []string{err.Error()}}
+	}
+
+	return &listener.Plan{ResourceUri: uri}, nil
+}
+
+var _ = Describe("Reconciler", func() {
+	var (
+		sonarClient *fakeSonarClient
+		rodeClient  *v1alpha1fakes.FakeRodeClient
+		l           *fakeListener
+		options     *Options
+		reconciler  *Reconciler
+		report      *Report
+		err         error
+	)
+
+	task := func(id, projectKey string) *sonar.Task {
+		return &sonar.Task{
+			Id:           id,
+			ComponentKey: projectKey,
+			Status:       sonar.STATUS_SUCCESS,
+			AnalysisId:   "analysis-" + id,
+			ExecutedAt:   "2021-05-27T19:08:23+0000",
+		}
+	}
+
+	BeforeEach(func() {
+		sonarClient = &fakeSonarClient{
+			tasks: []*sonar.Task{task("recorded", "project"), task("missing", "project")},
+			properties: map[string]map[string]string{
+				"recorded": {"sonar.analysis.resourceUriPrefix": "github.com/rode/collector-sonarqube"},
+				"missing":  {"sonar.analysis.resourceUriPrefix": "github.com/rode/collector-sonarqube"},
+			},
+		}
+		rodeClient = &v1alpha1fakes.FakeRodeClient{}
+		rodeClient.ListOccurrencesReturns(&pb.ListOccurrencesResponse{
+			Occurrences: []*grafeas_go_proto.Occurrence{
+				{NoteName: "projects/rode/notes/sonar-scan-recorded"},
+			},
+		}, nil)
+		l = &fakeListener{}
+		options = &Options{
+			ServerUrl: "https://sonar.example.com",
+			Window:    24 * time.Hour,
+		}
+	})
+
+	JustBeforeEach(func() {
+		reconciler = New(logger, sonarClient, rodeClient, l, options)
+		report, err = reconciler.Reconcile(context.Background())
+	})
+
+	It("should report analyses that are missing from rode", func() {
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.Checked).To(Equal(2))
+		Expect(report.Gaps).To(HaveLen(1))
+		Expect(report.Gaps[0].TaskId).To(Equal("missing"))
+		Expect(report.Gaps[0].ResourceUri).To(Equal("git://github.com/rode/collector-sonarqube@rev-missing"))
+		Expect(report.Unresolved()).To(Equal(1))
+		Expect(l.events).To(BeEmpty())
+	})
+
+	It("should look up the occurrences of each resource", func() {
+		Expect(rodeClient.ListOccurrencesCallCount()).To(Equal(2))
+
+		_, request, _ := rodeClient.ListOccurrencesArgsForCall(0)
+		Expect(request.Filter).To(Equal(`kind == "DISCOVERY" && resource.uri == "git://github.com/rode/collector-sonarqube@rev-recorded"`))
+	})
+
+	It("should only check finished analyses within the window", func() {
+		Expect(sonarClient.queries).To(HaveLen(1))
+		Expect(sonarClient.queries[0].Statuses).To(ConsistOf(sonar.STATUS_SUCCESS, sonar.STATUS_FAILED))
+		Expect(sonarClient.queries[0].MinSubmittedAt).To(BeTemporally("~", time.Now().Add(-24*time.Hour), time.Minute))
+	})
+
+	It("should update the stats", func() {
+		stats := reconciler.Stats()
+		Expect(stats.Runs).To(BeEquivalentTo(1))
+		Expect(stats.Checked).To(BeEquivalentTo(2))
+		Expect(stats.Missing).To(BeEquivalentTo(1))
+		Expect(stats.LastMissing).To(Equal(1))
+	})
+
+	It("should write a table", func() {
+		out := &bytes.Buffer{}
+		Expect(WriteTable(out, report)).To(Succeed())
+
+		Expect(out.String()).To(ContainSubstring("missing  project  2021-05-27T19:08:23+0000  git://github.com/rode/collector-sonarqube@rev-missing  MISSING"))
+		Expect(out.String()).To(ContainSubstring("2 analyses checked, 0 skipped, 1 missing, 1 unresolved"))
+	})
+
+	When("reconciling again", func() {
+		var second *Report
+
+		JustBeforeEach(func() {
+			sonarClient.lookups = nil
+			second, err = reconciler.Reconcile(context.Background())
+		})
+
+		It("should not look up analyses that were already found in rode", func() {
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sonarClient.lookups).To(ConsistOf("missing"))
+			Expect(second.Checked).To(Equal(2))
+			Expect(second.Gaps).To(HaveLen(1))
+		})
+	})
+
+	When("the history says where the analysis was recorded", func() {
+		BeforeEach(func() {
+			options.History = func(taskId string) string {
+				if taskId == "recorded" {
+					return "git://github.com/rode/collector-sonarqube@rev-recorded"
+				}
+
+				return ""
+			}
+		})
+
+		It("should check rode before looking up the analysis in sonarqube", func() {
+			Expect(sonarClient.lookups).To(ConsistOf("missing"))
+			Expect(report.Checked).To(Equal(2))
+			Expect(report.Gaps).To(HaveLen(1))
+			Expect(report.Gaps[0].TaskId).To(Equal("missing"))
+		})
+
+		When("the analysis isn't in rode", func() {
+			BeforeEach(func() {
+				rodeClient.ListOccurrencesReturns(&pb.ListOccurrencesResponse{}, nil)
+			})
+
+			It("should look up the analysis in sonarqube", func() {
+				Expect(sonarClient.lookups).To(ConsistOf("recorded", "missing"))
+				Expect(report.Gaps).To(HaveLen(2))
+			})
+		})
+	})
+
+	When("it's a dry run", func() {
+		BeforeEach(func() {
+			options.DryRun = true
+		})
+
+		It("should say that every analysis is reported as missing", func() {
+			out := &bytes.Buffer{}
+			Expect(WriteTable(out, report)).To(Succeed())
+
+			Expect(report.DryRun).To(BeTrue())
+			Expect(out.String()).To(ContainSubstring("dry run: occurrences aren't read from Rode"))
+		})
+	})
+
+	When("re-ingesting is enabled", func() {
+		BeforeEach(func() {
+			options.Reingest = true
+		})
+
+		It("should process the missing analysis against the same resource", func() {
+			Expect(l.events).To(HaveLen(1))
+			Expect(l.events[0].TaskId).To(Equal("missing"))
+			Expect(l.options[0].ResourceUri).To(Equal("git://github.com/rode/collector-sonarqube@rev-missing"))
+			Expect(report.Gaps[0].Resolved()).To(BeTrue())
+			Expect(report.Unresolved()).To(BeZero())
+			Expect(reconciler.Stats().Reingested).To(BeEquivalentTo(1))
+		})
+	})
+
+	When("the resource uri can't be determined", func() {
+		BeforeEach(func() {
+			delete(sonarClient.properties["missing"], "sonar.analysis.resourceUriPrefix")
+			options.Reingest = true
+		})
+
+		It("should report the analysis without re-ingesting it", func() {
+			Expect(report.Gaps).To(HaveLen(1))
+			Expect(report.Gaps[0].Reason).To(ContainSubstring("resource uri prefix"))
+			Expect(l.events).To(BeEmpty())
+		})
+	})
+
+	When("the filter or routing rules skip the analysis", func() {
+		BeforeEach(func() {
+			l.skips = map[string]string{"missing": `dropped by routing rule "sandboxes"`}
+			options.Reingest = true
+		})
+
+		It("should not report it as missing", func() {
+			Expect(report.Checked).To(Equal(2))
+			Expect(report.Skipped).To(Equal(1))
+			Expect(report.Gaps).To(BeEmpty())
+			Expect(l.events).To(BeEmpty())
+			Expect(reconciler.Stats().Skipped).To(BeEquivalentTo(1))
+		})
+	})
+
+	When("routing rules override the resource uri", func() {
+		BeforeEach(func() {
+			l.resourceUris = map[string]string{"missing": "harbor.example.com/rode/api:rev-missing"}
+			options.Reingest = true
+		})
+
+		It("should look for the analysis under the routed resource uri", func() {
+			_, request, _ := rodeClient.ListOccurrencesArgsForCall(1)
+			Expect(request.Filter).To(Equal(`kind == "DISCOVERY" && resource.uri == "harbor.example.com/rode/api:rev-missing"`))
+		})
+
+		It("should re-ingest the analysis against the routed resource uri", func() {
+			Expect(report.Gaps[0].ResourceUri).To(Equal("harbor.example.com/rode/api:rev-missing"))
+			Expect(l.options[0].ResourceUri).To(Equal("harbor.example.com/rode/api:rev-missing"))
+		})
+	})
+
+	When("the resource uri contains a quote", func() {
+		BeforeEach(func() {
+			l.resourceUris = map[string]string{"missing": `git://github.com/rode/collector-sonarqube" || resource.uri != "@abc123`}
+		})
+
+		It("should escape it in the occurrence filter", func() {
+			_, request, _ := rodeClient.ListOccurrencesArgsForCall(1)
+			Expect(request.Filter).To(Equal(`kind == "DISCOVERY" && resource.uri == "git://github.com/rode/collector-sonarqube\" || resource.uri != \"@abc123"`))
+		})
+	})
+
+	When("the analysis belongs to a monorepo component", func() {
+		BeforeEach(func() {
+			rodeClient.ListOccurrencesReturns(&pb.ListOccurrencesResponse{
+				Occurrences: []*grafeas_go_proto.Occurrence{
+					{NoteName: "projects/rode/notes/sonar-scan-recorded"},
+					{NoteName: "projects/rode/notes/sonar-scan-services-api-missing"},
+				},
+			}, nil)
+		})
+
+		It("should recognize the note", func() {
+			Expect(report.Gaps).To(BeEmpty())
+		})
+	})
+
+	When("projects are configured", func() {
+		BeforeEach(func() {
+			sonarClient.tasks = append(sonarClient.tasks, task("other", "other-project"))
+			options.Projects = []string{"project"}
+		})
+
+		It("should only check those projects", func() {
+			Expect(report.Checked).To(Equal(2))
+			Expect(sonarClient.queries[0].Component).To(Equal("project"))
+		})
+	})
+
+	When("occurrences can't be listed", func() {
+		BeforeEach(func() {
+			rodeClient.ListOccurrencesReturns(nil, errors.New("unavailable"))
+		})
+
+		It("should return an error", func() {
+			Expect(err).To(MatchError(ContainSubstring("unavailable")))
+			Expect(reconciler.Stats().Failed).To(BeEquivalentTo(1))
+		})
+	})
+})
@@ -0,0 +1,80 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/rode/collector-sonarqube/config"
+	"github.com/rode/collector-sonarqube/listener"
+	"github.com/rode/collector-sonarqube/replay"
+	"go.uber.org/zap"
+)
+
+// replayCommand pushes recorded webhook payloads through the same processing path as the webhook listener, and returns the
+// exit code for the process.
+func replayCommand(name string, args []string) int {
+	conf, err := config.BuildReplay(name, args)
+	if err != nil {
+		log.Printf("error parsing flags: %v", err)
+		return 2
+	}
+
+	logger, err := createLogger(conf.Debug)
+	if err != nil {
+		log.Printf("failed to create logger: %v", err)
+		return 1
+	}
+
+	// dry run requests are written to stderr so that the results can still be parsed
+	rodeClient, err := createRodeClient(conf.ClientConfig, conf.DryRun, os.Stderr, logger)
+	if err != nil {
+		logger.Error("could not create rode client", zap.Error(err))
+		return 1
+	}
+
+	l, _, err := buildPipeline(conf.PipelineConfig, conf.SonarConfig, logger, rodeClient)
+	if err != nil {
+		logger.Error("could not create pipeline", zap.Error(err))
+		return 1
+	}
+
+	replayer := replay.NewReplayer(logger.Named("replay"), l, &listener.ProcessOptions{
+		Source:            listener.SOURCE_REPLAY,
+		ResourceUriPrefix: conf.ResourceUriPrefix,
+	})
+
+	entries := replayer.ReplayFiles(context.Background(), conf.Files)
+
+	if conf.Output == "json" {
+		err = replay.WriteJSON(os.Stdout, entries)
+	} else {
+		err = replay.WriteTable(os.Stdout, entries)
+	}
+	if err != nil {
+		logger.Error("error writing results", zap.Error(err))
+		return 1
+	}
+
+	for _, entry := range entries {
+		if entry.Failed() {
+			return 1
+		}
+	}
+
+	return 0
+}
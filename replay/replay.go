@@ -0,0 +1,188 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replay
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rode/collector-sonarqube/listener"
+	"github.com/rode/collector-sonarqube/sonar"
+	"go.uber.org/zap"
+)
+
+// Entry is the result of replaying a single recorded event. Line is the position of the event within its file, which
+// is the line number for JSON-lines archives.
+type Entry struct {
+	File  string `json:"file"`
+	Line  int    `json:"line"`
+	Error string `json:"error,omitempty"`
+	*listener.Result
+}
+
+// Failed returns true if the event couldn't be read, was invalid, or couldn't be recorded.
+func (e *Entry) Failed() bool {
+	if e.Error != "" {
+		return true
+	}
+
+	return e.Result != nil && (e.Result.Outcome == listener.OUTCOME_FAILED || e.Result.Outcome == listener.OUTCOME_REJECTED)
+}
+
+type Replayer struct {
+	logger   *zap.Logger
+	listener listener.Listener
+	options  *listener.ProcessOptions
+}
+
+func NewReplayer(logger *zap.Logger, l listener.Listener, options *listener.ProcessOptions) *Replayer {
+	return &Replayer{
+		logger:   logger,
+		listener: l,
+		options:  options,
+	}
+}
+
+// ReplayFiles replays every event found in the given files. Each file may contain a single event, or a JSON-lines
+// archive of events, optionally gzip compressed.
+func (r *Replayer) ReplayFiles(ctx context.Context, paths []string) []*Entry {
+	var entries []*Entry
+	for _, path := range paths {
+		entries = append(entries, r.replayFile(ctx, path)...)
+	}
+
+	return entries
+}
+
+func (r *Replayer) replayFile(ctx context.Context, path string) []*Entry {
+	file, err := os.Open(path)
+	if err != nil {
+		return []*Entry{{File: path, Error: err.Error()}}
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return []*Entry{{File: path, Error: err.Error()}}
+		}
+		defer gz.Close()
+
+		reader = gz
+	}
+
+	return r.Replay(ctx, path, reader)
+}
+
+// Replay processes each event read from the reader, in order.
+func (r *Replayer) Replay(ctx context.Context, name string, reader io.Reader) []*Entry {
+	var entries []*Entry
+	decoder := json.NewDecoder(bufio.NewReader(reader))
+	for i := 1; ; i++ {
+		entry := &Entry{File: name, Line: i}
+
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			// the rest of the input can't be trusted once the decoder fails
+			entry.Error = fmt.Sprintf("error reading event: %v", err)
+			entries = append(entries, entry)
+			break
+		}
+
+		event, err := decodeEvent(raw)
+		if err != nil {
+			entry.Error = err.Error()
+			entries = append(entries, entry)
+			continue
+		}
+
+		r.logger.Debug("replaying event", zap.String("file", name), zap.String("taskId", event.TaskId))
+		entry.Result, err = r.listener.Process(ctx, event, r.options)
+		if err != nil {
+			r.logger.Error("error replaying event", zap.String("file", name), zap.Error(err))
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// decodeEvent accepts either a webhook payload, a record written by the file sink that wraps the payload, or a raw
+// request from the webhook archive.
+func decodeEvent(raw json.RawMessage) (*sonar.Event, error) {
+	envelope := struct {
+		Event *sonar.Event `json:"event"`
+		Body  *string      `json:"body"`
+	}{}
+	if err := json.Unmarshal(raw, &envelope); err == nil {
+		if envelope.Event != nil {
+			return envelope.Event, nil
+		}
+
+		if envelope.Body != nil {
+			raw = json.RawMessage(*envelope.Body)
+		}
+	}
+
+	event := &sonar.Event{}
+	if err := json.Unmarshal(raw, event); err != nil {
+		return nil, fmt.Errorf("error decoding event: %v", err)
+	}
+
+	return event, nil
+}
+
+// WriteTable writes a human-readable summary of the replayed events.
+func WriteTable(out io.Writer, entries []*Entry) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tLINE\tTASK ID\tOUTCOME\tRESOURCE URI\tREASON")
+
+	for _, e := range entries {
+		if e.Result == nil {
+			fmt.Fprintf(w, "%s\t%d\t\t%s\t\t%s\n", e.File, e.Line, listener.OUTCOME_FAILED, e.Error)
+			continue
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", e.File, e.Line, e.TaskId, e.Outcome, e.ResourceUri, e.Reason)
+	}
+
+	return w.Flush()
+}
+
+// WriteJSON writes the replayed events as a JSON array.
+func WriteJSON(out io.Writer, entries []*Entry) error {
+	if entries == nil {
+		entries = []*Entry{}
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(entries)
+}
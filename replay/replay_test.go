@@ -0,0 +1,214 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/collector-sonarqube/listener"
+	"github.com/rode/collector-sonarqube/sonar"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type fakeListener struct {
+	listener.Listener
+
+	events  []*sonar.Event
+	options []*listener.ProcessOptions
+	err     error
+}
+
+func (f *fakeListener) ProcessEvent(http.ResponseWriter, *http.Request) {}
+
+func (f *fakeListener) Process(_ context.Context, event *sonar.Event, options *listener.ProcessOptions) (*listener.Result, error) {
+	f.events = append(f.events, event)
+	f.options = append(f.options, options)
+
+	if f.err != nil {
+		return &listener.Result{TaskId: event.TaskId, Outcome: listener.OUTCOME_FAILED, Reason: f.err.Error()}, f.err
+	}
+
+	return &listener.Result{TaskId: event.TaskId, Outcome: listener.OUTCOME_RECORDED}, nil
+}
+
+var _ = Describe("Replayer", func() {
+	var (
+		l        *fakeListener
+		options  *listener.ProcessOptions
+		replayer *Replayer
+	)
+
+	BeforeEach(func() {
+		l = &fakeListener{}
+		options = &listener.ProcessOptions{ResourceUriPrefix: fake.URL()}
+	})
+
+	JustBeforeEach(func() {
+		replayer = NewReplayer(logger, l, options)
+	})
+
+	event := func(taskId string) string {
+		b, err := json.Marshal(&sonar.Event{TaskId: taskId, Status: sonar.STATUS_SUCCESS})
+		Expect(err).ToNot(HaveOccurred())
+
+		return string(b)
+	}
+
+	It("should replay a single event", func() {
+		taskId := fake.LetterN(10)
+
+		entries := replayer.Replay(context.Background(), "event.json", strings.NewReader(event(taskId)))
+
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].TaskId).To(Equal(taskId))
+		Expect(entries[0].Outcome).To(Equal(listener.OUTCOME_RECORDED))
+		Expect(entries[0].Failed()).To(BeFalse())
+		Expect(l.options[0]).To(Equal(options))
+	})
+
+	It("should replay each event in a JSON-lines archive", func() {
+		taskIds := []string{fake.LetterN(10), fake.LetterN(10), fake.LetterN(10)}
+		var lines []string
+		for _, taskId := range taskIds {
+			lines = append(lines, event(taskId))
+		}
+
+		entries := replayer.Replay(context.Background(), "events.jsonl", strings.NewReader(strings.Join(lines, "\n")))
+
+		Expect(entries).To(HaveLen(3))
+		for i, entry := range entries {
+			Expect(entry.Line).To(Equal(i + 1))
+			Expect(entry.TaskId).To(Equal(taskIds[i]))
+		}
+	})
+
+	It("should unwrap records written by the file sink", func() {
+		taskId := fake.LetterN(10)
+		record := fmt.Sprintf(`{"event":%s,"resourceUri":"%s"}`, event(taskId), fake.URL())
+
+		entries := replayer.Replay(context.Background(), "analyses.jsonl", strings.NewReader(record))
+
+		Expect(entries).To(HaveLen(1))
+		Expect(l.events[0].TaskId).To(Equal(taskId))
+	})
+
+	It("should decode the body of archived webhook requests", func() {
+		taskId := fake.LetterN(10)
+		body, err := json.Marshal(event(taskId))
+		Expect(err).ToNot(HaveOccurred())
+		record := fmt.Sprintf(`{"headers":{},"body":%s}`, body)
+
+		entries := replayer.Replay(context.Background(), "webhook.json", strings.NewReader(record))
+
+		Expect(entries).To(HaveLen(1))
+		Expect(l.events[0].TaskId).To(Equal(taskId))
+	})
+
+	It("should report invalid JSON", func() {
+		entries := replayer.Replay(context.Background(), "event.json", strings.NewReader("invalid json"))
+
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Failed()).To(BeTrue())
+		Expect(l.events).To(BeEmpty())
+	})
+
+	It("should read gzip compressed archives", func() {
+		dir, err := ioutil.TempDir("", "replay")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "events.jsonl.gz")
+		file, err := os.Create(path)
+		Expect(err).ToNot(HaveOccurred())
+
+		taskId := fake.LetterN(10)
+		gz := gzip.NewWriter(file)
+		_, err = gz.Write([]byte(event(taskId) + "\n"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(gz.Close()).To(Succeed())
+		Expect(file.Close()).To(Succeed())
+
+		entries := replayer.ReplayFiles(context.Background(), []string{path})
+
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].TaskId).To(Equal(taskId))
+	})
+
+	It("should report missing files", func() {
+		entries := replayer.ReplayFiles(context.Background(), []string{fake.LetterN(10)})
+
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Failed()).To(BeTrue())
+	})
+
+	When("processing fails", func() {
+		BeforeEach(func() {
+			l.err = errors.New(fake.LetterN(10))
+		})
+
+		It("should report the failure", func() {
+			entries := replayer.Replay(context.Background(), "event.json", strings.NewReader(event(fake.LetterN(10))))
+
+			Expect(entries[0].Failed()).To(BeTrue())
+			Expect(entries[0].Reason).To(Equal(l.err.Error()))
+		})
+	})
+
+	Context("output", func() {
+		var entries []*Entry
+
+		BeforeEach(func() {
+			entries = []*Entry{
+				{File: "a.json", Line: 1, Result: &listener.Result{TaskId: "task-1", Outcome: listener.OUTCOME_RECORDED, ResourceUri: "git://a@b"}},
+				{File: "b.json", Line: 1, Error: "error reading event"},
+			}
+		})
+
+		It("should write a table", func() {
+			out := &bytes.Buffer{}
+
+			Expect(WriteTable(out, entries)).To(Succeed())
+
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			Expect(lines).To(HaveLen(3))
+			Expect(lines[0]).To(HavePrefix("FILE"))
+			Expect(lines[1]).To(ContainSubstring("task-1"))
+			Expect(lines[2]).To(ContainSubstring("error reading event"))
+		})
+
+		It("should write JSON", func() {
+			out := &bytes.Buffer{}
+
+			Expect(WriteJSON(out, entries)).To(Succeed())
+
+			var actual []map[string]interface{}
+			Expect(json.Unmarshal(out.Bytes(), &actual)).To(Succeed())
+			Expect(actual).To(HaveLen(2))
+			Expect(actual[0]["taskId"]).To(Equal("task-1"))
+			Expect(actual[0]["outcome"]).To(Equal("RECORDED"))
+			Expect(actual[1]["error"]).To(Equal("error reading event"))
+		})
+	})
+})
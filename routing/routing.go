@@ -0,0 +1,336 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/rode/collector-sonarqube/sonar"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	"google.golang.org/protobuf/proto"
+)
+
+// Config lists the routing rules, which are evaluated against each event in order. Every expression is written in CEL
+// (https://github.com/google/cel-spec), with the event available as the variable "event".
+//
+//	{
+//	  "rules": [
+//	    {"name": "drop sandboxes", "when": "event.project.key.startsWith('sandbox-')", "drop": true},
+//	    {
+//	      "name": "container images",
+//	      "when": "'sonar.analysis.image' in event.properties",
+//	      "resourceUri": "event.properties['sonar.analysis.image']",
+//	      "labels": {"gate": "event.qualityGate.status"},
+//	      "sinks": ["rode", "file"]
+//	    }
+//	  ]
+//	}
+type Config struct {
+	Rules []*RuleConfig `json:"rules"`
+}
+
+// RuleConfig is a single rule. When is a boolean expression, and ResourceUri and each label are string expressions.
+type RuleConfig struct {
+	Name        string            `json:"name"`
+	When        string            `json:"when"`
+	Drop        bool              `json:"drop,omitempty"`
+	ResourceUri string            `json:"resourceUri,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	// Sinks are the names of the sinks that receive the event, e.g. "rode" or "file"
+	Sinks []string `json:"sinks,omitempty"`
+}
+
+// Route is what the matching rules decided should happen to an event. When several rules match, the resource uri and
+// sinks of the last one that sets them are used, and their labels are merged.
+type Route struct {
+	// Drop is the name of the rule that dropped the event, if one did
+	Drop        string
+	ResourceUri string
+	Labels      map[string]string
+	// Sinks is nil unless a rule selected sinks
+	Sinks []string
+	// Rules are the names of the rules that matched
+	Rules []string
+	// Errors describe the expressions that couldn't be evaluated. A condition that fails doesn't match, and an action
+	// that fails isn't applied.
+	Errors []string
+}
+
+type rule struct {
+	name        string
+	when        cel.Program
+	drop        bool
+	resourceUri cel.Program
+	labels      map[string]cel.Program
+	sinks       []string
+}
+
+// Rules are compiled routing rules.
+type Rules struct {
+	rules []*rule
+}
+
+// Load reads the routing rules from a JSON file and compiles them. Every sink that a rule selects must be one of the
+// given sink names, unless they're nil.
+func Load(path string, sinkNames []string) (*Rules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config := &Config{}
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("error reading routing rules %s: %v", path, err)
+	}
+
+	rules, err := Compile(config, sinkNames)
+	if err != nil {
+		return nil, fmt.Errorf("invalid routing rules %s: %v", path, err)
+	}
+
+	return rules, nil
+}
+
+// Compile type checks every expression in the config, so that mistakes are found at startup rather than when an event
+// is received. The selected sinks aren't checked when sinkNames is nil, for callers that don't configure every sink.
+func Compile(config *Config, sinkNames []string) (*Rules, error) {
+	env, err := cel.NewEnv(cel.Declarations(decls.NewVar("event", decls.NewMapType(decls.String, decls.Dyn))))
+	if err != nil {
+		return nil, err
+	}
+
+	knownSinks := map[string]bool{}
+	for _, name := range sinkNames {
+		knownSinks[name] = true
+	}
+
+	rules := &Rules{}
+	for i, c := range config.Rules {
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("rules[%d]", i)
+		}
+
+		r := &rule{name: name, drop: c.Drop, sinks: c.Sinks, labels: map[string]cel.Program{}}
+
+		if c.When == "" {
+			return nil, fmt.Errorf("rule %s has no condition", name)
+		}
+		if !c.Drop && c.ResourceUri == "" && len(c.Labels) == 0 && c.Sinks == nil {
+			return nil, fmt.Errorf("rule %s has no action", name)
+		}
+		if c.Drop && (c.ResourceUri != "" || len(c.Labels) > 0 || c.Sinks != nil) {
+			return nil, fmt.Errorf("rule %s drops events, so it can't have other actions", name)
+		}
+		if c.Sinks != nil && len(c.Sinks) == 0 {
+			return nil, fmt.Errorf("rule %s must select at least one sink, or drop the event", name)
+		}
+		for _, sink := range c.Sinks {
+			if sinkNames != nil && !knownSinks[sink] {
+				return nil, fmt.Errorf("rule %s selects unknown sink %q", name, sink)
+			}
+		}
+
+		if r.when, err = compile(env, c.When, decls.Bool); err != nil {
+			return nil, fmt.Errorf("rule %s condition: %v", name, err)
+		}
+
+		if c.ResourceUri != "" {
+			if r.resourceUri, err = compile(env, c.ResourceUri, decls.String); err != nil {
+				return nil, fmt.Errorf("rule %s resource uri: %v", name, err)
+			}
+		}
+
+		for label, expression := range c.Labels {
+			if r.labels[label], err = compile(env, expression, decls.String); err != nil {
+				return nil, fmt.Errorf("rule %s label %s: %v", name, label, err)
+			}
+		}
+
+		rules.rules = append(rules.rules, r)
+	}
+
+	return rules, nil
+}
+
+func compile(env *cel.Env, expression string, expectedType *exprpb.Type) (cel.Program, error) {
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+
+	// expressions that access the event's fields are dynamically typed, and are checked again when they're evaluated
+	if resultType := ast.ResultType(); !proto.Equal(resultType, expectedType) && !proto.Equal(resultType, decls.Dyn) {
+		return nil, fmt.Errorf("expression must evaluate to a %s", typeName(expectedType))
+	}
+
+	return env.Program(ast)
+}
+
+// Evaluate applies every rule that matches the event. Evaluation stops at the first rule that drops the event. An
+// expression that fails, such as one that refers to a property the event doesn't have, is treated as though its rule
+// didn't match, or for an action, as though it wasn't set; the failures are returned in the route's errors.
+func (r *Rules) Evaluate(event *sonar.Event) *Route {
+	input := map[string]interface{}{"event": activation(event)}
+	route := &Route{}
+
+	for _, rule := range r.rules {
+		matched, err := evaluate(rule.when, input, decls.Bool)
+		if err != nil {
+			route.Errors = append(route.Errors, fmt.Sprintf("error evaluating rule %s: %v", rule.name, err))
+			continue
+		}
+		if !matched.(bool) {
+			continue
+		}
+
+		route.Rules = append(route.Rules, rule.name)
+		if rule.drop {
+			route.Drop = rule.name
+			return route
+		}
+
+		if rule.resourceUri != nil {
+			uri, err := evaluate(rule.resourceUri, input, decls.String)
+			if err != nil {
+				route.Errors = append(route.Errors, fmt.Sprintf("error evaluating the resource uri of rule %s: %v", rule.name, err))
+			} else {
+				route.ResourceUri = uri.(string)
+			}
+		}
+
+		// labels are evaluated in order, so that errors are reported consistently
+		var labels []string
+		for label := range rule.labels {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+
+		for _, label := range labels {
+			value, err := evaluate(rule.labels[label], input, decls.String)
+			if err != nil {
+				route.Errors = append(route.Errors, fmt.Sprintf("error evaluating label %s of rule %s: %v", label, rule.name, err))
+				continue
+			}
+
+			if route.Labels == nil {
+				route.Labels = map[string]string{}
+			}
+			route.Labels[label] = value.(string)
+		}
+
+		if rule.sinks != nil {
+			route.Sinks = rule.sinks
+		}
+	}
+
+	return route
+}
+
+func evaluate(program cel.Program, input map[string]interface{}, expectedType *exprpb.Type) (interface{}, error) {
+	value, _, err := program.Eval(input)
+	if err != nil {
+		return nil, err
+	}
+
+	result := value.Value()
+	switch result.(type) {
+	case bool:
+		if proto.Equal(expectedType, decls.Bool) {
+			return result, nil
+		}
+	case string:
+		if proto.Equal(expectedType, decls.String) {
+			return result, nil
+		}
+	}
+
+	return nil, fmt.Errorf("expression must evaluate to a %s, not %T", typeName(expectedType), result)
+}
+
+func typeName(t *exprpb.Type) string {
+	if proto.Equal(t, decls.Bool) {
+		return "bool"
+	}
+
+	return "string"
+}
+
+// activation describes the event with every field present, so that expressions don't need to check whether optional
+// parts of the event, such as the branch, were sent.
+func activation(event *sonar.Event) map[string]interface{} {
+	project := map[string]interface{}{"key": "", "name": "", "url": ""}
+	if event.Project != nil {
+		project = map[string]interface{}{"key": event.Project.Key, "name": event.Project.Name, "url": event.Project.URL}
+	}
+
+	branch := map[string]interface{}{"name": "", "type": sonar.BRANCH_TYPE_BRANCH, "isMain": true, "isPullRequest": false, "url": ""}
+	if event.Branch != nil {
+		branch = map[string]interface{}{
+			"name":          event.Branch.Name,
+			"type":          event.Branch.Type,
+			"isMain":        event.Branch.IsMain,
+			"isPullRequest": event.Branch.IsPullRequest(),
+			"url":           event.Branch.URL,
+		}
+	}
+
+	qualityGate := map[string]interface{}{"name": "", "status": "", "conditions": []interface{}{}}
+	if event.QualityGate != nil {
+		conditions := []interface{}{}
+		for _, c := range event.QualityGate.Conditions {
+			conditions = append(conditions, map[string]interface{}{
+				"metric":           c.Metric,
+				"operator":         string(c.Operator),
+				"status":           string(c.Status),
+				"value":            c.Value,
+				"errorThreshold":   c.ErrorThreshold,
+				"warningThreshold": c.WarningThreshold,
+				"onLeakPeriod":     c.OnLeakPeriod,
+			})
+		}
+
+		qualityGate = map[string]interface{}{
+			"name":       event.QualityGate.Name,
+			"status":     string(event.QualityGate.Status),
+			"conditions": conditions,
+		}
+	}
+
+	properties := map[string]string{}
+	for key, value := range event.Properties {
+		properties[key] = value
+	}
+
+	return map[string]interface{}{
+		"taskId":      event.TaskId,
+		"status":      string(event.Status),
+		"analysedAt":  event.AnalysedAt,
+		"revision":    event.Revision,
+		"serverUrl":   event.ServerUrl,
+		"project":     project,
+		"branch":      branch,
+		"qualityGate": qualityGate,
+		"properties":  properties,
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/collector-sonarqube/sonar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("Routing", func() {
+	var (
+		event     *sonar.Event
+		sinkNames []string
+	)
+
+	BeforeEach(func() {
+		sinkNames = []string{"rode", "file"}
+		event = &sonar.Event{
+			TaskId:   fake.LetterN(10),
+			Status:   sonar.STATUS_SUCCESS,
+			Revision: "abc123",
+			Project:  &sonar.Project{Key: "team-a-api"},
+			Branch:   &sonar.Branch{Name: "main", Type: sonar.BRANCH_TYPE_BRANCH, IsMain: true},
+			QualityGate: &sonar.QualityGate{
+				Status: sonar.STATUS_ERROR,
+				Conditions: []*sonar.Condition{
+					{Metric: "coverage", Status: sonar.CONDITION_STATUS_ERROR, Value: "42.1"},
+				},
+			},
+			Properties: map[string]string{
+				"sonar.analysis.image": "harbor.example.com/team-a/api",
+			},
+		}
+	})
+
+	evaluate := func(rules ...*RuleConfig) *Route {
+		compiled, err := Compile(&Config{Rules: rules}, sinkNames)
+		Expect(err).ToNot(HaveOccurred())
+
+		route := compiled.Evaluate(event)
+		Expect(route.Errors).To(BeEmpty())
+
+		return route
+	}
+
+	It("should do nothing when no rule matches", func() {
+		route := evaluate(&RuleConfig{Name: "sandboxes", When: "event.project.key.startsWith('sandbox-')", Drop: true})
+
+		Expect(route).To(Equal(&Route{}))
+	})
+
+	It("should drop events", func() {
+		route := evaluate(
+			&RuleConfig{Name: "failed gates", When: "event.qualityGate.status == 'ERROR'", Drop: true},
+			&RuleConfig{Name: "labels", When: "true", Labels: map[string]string{"team": "'a'"}},
+		)
+
+		Expect(route.Drop).To(Equal("failed gates"))
+		Expect(route.Labels).To(BeNil())
+	})
+
+	It("should override the resource uri", func() {
+		route := evaluate(&RuleConfig{
+			When:        "'sonar.analysis.image' in event.properties",
+			ResourceUri: "event.properties['sonar.analysis.image'] + ':' + event.revision",
+		})
+
+		Expect(route.ResourceUri).To(Equal("harbor.example.com/team-a/api:abc123"))
+		Expect(route.Rules).To(Equal([]string{"rules[0]"}))
+	})
+
+	It("should merge the labels of every matching rule", func() {
+		route := evaluate(
+			&RuleConfig{Name: "team", When: "true", Labels: map[string]string{"team": "event.project.key.startsWith('team-a-') ? 'a' : 'other'", "gate": "'unknown'"}},
+			&RuleConfig{Name: "gate", When: "event.qualityGate.conditions.exists(c, c.status == 'ERROR')", Labels: map[string]string{"gate": "event.qualityGate.status"}},
+		)
+
+		Expect(route.Labels).To(Equal(map[string]string{"team": "a", "gate": "ERROR"}))
+		Expect(route.Rules).To(Equal([]string{"team", "gate"}))
+	})
+
+	It("should select sinks", func() {
+		route := evaluate(
+			&RuleConfig{When: "event.branch.isMain", Sinks: []string{"rode", "file"}},
+			&RuleConfig{When: "event.branch.isPullRequest", Sinks: []string{"file"}},
+		)
+
+		Expect(route.Sinks).To(Equal([]string{"rode", "file"}))
+	})
+
+	When("the event has no branch or quality gate", func() {
+		BeforeEach(func() {
+			event.Branch = nil
+			event.QualityGate = nil
+			event.Properties = nil
+		})
+
+		It("should describe the main branch", func() {
+			route := evaluate(&RuleConfig{
+				When:   "event.branch.isMain && event.qualityGate.status == '' && size(event.properties) == 0",
+				Labels: map[string]string{"branch": "event.branch.type"},
+			})
+
+			Expect(route.Labels).To(Equal(map[string]string{"branch": "BRANCH"}))
+		})
+	})
+
+	It("should treat a condition that fails as not matching", func() {
+		compiled, err := Compile(&Config{Rules: []*RuleConfig{
+			{Name: "missing", When: "event.properties['sonar.analysis.team'] == 'a'", Drop: true},
+			{Name: "team", When: "true", Labels: map[string]string{"team": "'a'"}},
+		}}, sinkNames)
+		Expect(err).ToNot(HaveOccurred())
+
+		route := compiled.Evaluate(event)
+
+		Expect(route.Drop).To(BeEmpty())
+		Expect(route.Rules).To(Equal([]string{"team"}))
+		Expect(route.Errors).To(ConsistOf(ContainSubstring("error evaluating rule missing")))
+	})
+
+	It("should skip actions that fail", func() {
+		compiled, err := Compile(&Config{Rules: []*RuleConfig{
+			{Name: "team", When: "true", ResourceUri: "event.properties['sonar.analysis.uri']", Labels: map[string]string{"team": "event.properties['sonar.analysis.team']", "gate": "event.qualityGate.status"}},
+		}}, sinkNames)
+		Expect(err).ToNot(HaveOccurred())
+
+		route := compiled.Evaluate(event)
+
+		Expect(route.ResourceUri).To(BeEmpty())
+		Expect(route.Labels).To(Equal(map[string]string{"gate": "ERROR"}))
+		Expect(route.Errors).To(ConsistOf(
+			ContainSubstring("error evaluating the resource uri of rule team"),
+			ContainSubstring("error evaluating label team of rule team"),
+		))
+	})
+
+	It("should report a dynamic expression with the wrong type", func() {
+		compiled, err := Compile(&Config{Rules: []*RuleConfig{
+			{Name: "not a bool", When: "event.project.key", Drop: true},
+		}}, sinkNames)
+		Expect(err).ToNot(HaveOccurred())
+
+		route := compiled.Evaluate(event)
+
+		Expect(route.Drop).To(BeEmpty())
+		Expect(route.Errors).To(ConsistOf(ContainSubstring("must evaluate to a bool")))
+	})
+
+	Context("compiling", func() {
+		invalid := map[string]*RuleConfig{
+			"syntax error":        {When: "event.project.key ==", Drop: true},
+			"condition type":      {When: "'yes'", Drop: true},
+			"resource uri type":   {When: "true", ResourceUri: "1 + 1"},
+			"label type":          {When: "true", Labels: map[string]string{"x": "false"}},
+			"no condition":        {Drop: true},
+			"no action":           {When: "true"},
+			"drop with actions":   {When: "true", Drop: true, ResourceUri: "'x'"},
+			"no sinks":            {When: "true", Sinks: []string{}},
+			"unknown sink":        {When: "true", Sinks: []string{"kafka"}},
+			"undeclared variable": {When: "project.key == 'a'", Drop: true},
+		}
+
+		for name, rule := range invalid {
+			rule := rule
+
+			It("should reject a rule with "+name, func() {
+				_, err := Compile(&Config{Rules: []*RuleConfig{rule}}, sinkNames)
+
+				Expect(err).To(HaveOccurred())
+			})
+		}
+
+		It("should not check the selected sinks when there aren't any sink names", func() {
+			_, err := Compile(&Config{Rules: []*RuleConfig{{When: "true", Sinks: []string{"kafka"}}}}, nil)
+
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Context("Load", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "routing")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		write := func(contents string) string {
+			path := filepath.Join(dir, "routing.json")
+			Expect(ioutil.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+
+			return path
+		}
+
+		It("should read and compile rules from a file", func() {
+			rules, err := Load(write(`{"rules": [{"name": "sandboxes", "when": "event.project.key.startsWith('team-')", "drop": true}]}`), sinkNames)
+			Expect(err).ToNot(HaveOccurred())
+
+			route := rules.Evaluate(event)
+			Expect(route.Drop).To(Equal("sandboxes"))
+		})
+
+		It("should reject unknown fields", func() {
+			_, err := Load(write(`{"rules": [{"if": "true", "drop": true}]}`), sinkNames)
+
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should name the file in compilation errors", func() {
+			path := write(`{"rules": [{"name": "broken", "when": "event ==", "drop": true}]}`)
+
+			_, err := Load(path, sinkNames)
+
+			Expect(err).To(MatchError(ContainSubstring(path)))
+			Expect(err).To(MatchError(ContainSubstring("rule broken condition")))
+		})
+	})
+})
@@ -0,0 +1,151 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rode/collector-sonarqube/sonar"
+)
+
+const (
+	cloudEventsSpecVersion = "1.0"
+	cloudEventsContentType = "application/cloudevents+json"
+
+	analysisCompletedEventType = "io.rode.sonarqube.analysis.completed"
+	analysisFailedEventType    = "io.rode.sonarqube.analysis.failed"
+)
+
+// cloudEvent is the structured content mode representation of a CloudEvent. The sonar* fields are extension attributes
+// that allow consumers to route events without inspecting the data.
+type cloudEvent struct {
+	SpecVersion      string          `json:"specversion"`
+	Id               string          `json:"id"`
+	Source           string          `json:"source"`
+	Type             string          `json:"type"`
+	Subject          string          `json:"subject,omitempty"`
+	Time             string          `json:"time,omitempty"`
+	DataContentType  string          `json:"datacontenttype"`
+	SonarInstance    string          `json:"sonarinstance,omitempty"`
+	SonarProject     string          `json:"sonarproject,omitempty"`
+	SonarQualityGate string          `json:"sonarqualitygate,omitempty"`
+	SonarTimeSource  string          `json:"sonartimesource,omitempty"`
+	SonarComponent   string          `json:"sonarcomponent,omitempty"`
+	Data             *cloudEventData `json:"data"`
+}
+
+type cloudEventData struct {
+	ResourceUri string             `json:"resourceUri"`
+	Event       *sonar.Event       `json:"event"`
+	QualityGate *qualityGateResult `json:"qualityGateResult,omitempty"`
+	Metadata    map[string]string  `json:"metadata,omitempty"`
+	Pipeline    *sonar.CIRun       `json:"pipeline,omitempty"`
+	// ArtifactUris are the artifacts built from the analyzed commit
+	ArtifactUris []string `json:"artifactUris,omitempty"`
+}
+
+type qualityGateResult struct {
+	Name     string            `json:"name"`
+	Status   sonar.EventStatus `json:"status"`
+	Passed   bool              `json:"passed"`
+	Errors   []string          `json:"errors,omitempty"`
+	Warnings []string          `json:"warnings,omitempty"`
+}
+
+type cloudEventsSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewCloudEventsSink returns a sink that POSTs each analysis to the given URL as a CloudEvent in structured mode.
+func NewCloudEventsSink(url string, client *http.Client) Sink {
+	return &cloudEventsSink{
+		url:    url,
+		client: client,
+	}
+}
+
+func (c *cloudEventsSink) Name() string {
+	return "cloudevents"
+}
+
+func (c *cloudEventsSink) Send(ctx context.Context, analysis *Analysis) error {
+	body, err := json.Marshal(newCloudEvent(analysis))
+	if err != nil {
+		return err
+	}
+
+	return post(ctx, c.client, c.url, cloudEventsContentType, body)
+}
+
+func newCloudEvent(analysis *Analysis) *cloudEvent {
+	event := analysis.Event
+
+	eventType := analysisCompletedEventType
+	if event.Status != sonar.STATUS_SUCCESS {
+		eventType = analysisFailedEventType
+	}
+
+	ce := &cloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		Id:              event.TaskId,
+		Type:            eventType,
+		Subject:         analysis.ResourceUri,
+		Time:            analysis.AnalysedAt.Format(time.RFC3339Nano),
+		DataContentType: "application/json",
+		SonarTimeSource: string(analysis.AnalysedAtSource),
+		SonarComponent:  analysis.Component,
+		Data: &cloudEventData{
+			ResourceUri:  analysis.ResourceUri,
+			Event:        event,
+			Metadata:     analysis.Metadata,
+			Pipeline:     analysis.Pipeline,
+			ArtifactUris: analysis.ArtifactUris,
+		},
+	}
+
+	// the source identifies the project within a specific sonar instance, so that consumers can route on either
+	ce.Source = "sonarqube"
+	if event.Project != nil {
+		if serverUrl := event.ServerURL(); serverUrl != "" {
+			ce.Source = serverUrl
+			if u, err := url.Parse(serverUrl); err == nil {
+				ce.SonarInstance = u.Host
+			}
+		}
+
+		ce.SonarProject = event.Project.Key
+		ce.Source = fmt.Sprintf("%s/projects/%s", ce.Source, url.PathEscape(event.Project.Key))
+	}
+
+	if event.HasQualityGate() {
+		gate := event.QualityGate
+		ce.SonarQualityGate = string(gate.Status)
+		ce.Data.QualityGate = &qualityGateResult{
+			Name:     gate.Name,
+			Status:   gate.Status,
+			Passed:   gate.Status == sonar.STATUS_OK || gate.Status == sonar.STATUS_WARN,
+			Errors:   describeConditions(gate.ConditionsWithStatus(sonar.CONDITION_STATUS_ERROR)),
+			Warnings: describeConditions(gate.ConditionsWithStatus(sonar.CONDITION_STATUS_WARN)),
+		}
+	}
+
+	return ce
+}
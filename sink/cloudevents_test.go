@@ -0,0 +1,141 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/collector-sonarqube/sonar"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("cloudevents sink", func() {
+	var (
+		server      *httptest.Server
+		received    map[string]interface{}
+		contentType string
+		analysis    *Analysis
+		projectKey  string
+		err         error
+	)
+
+	BeforeEach(func() {
+		projectKey = fake.LetterN(10)
+		analysis = &Analysis{
+			Event: &sonar.Event{
+				TaskId:     fake.LetterN(10),
+				Status:     sonar.STATUS_SUCCESS,
+				AnalysedAt: "2021-05-27T19:08:23+0000",
+				Project: &sonar.Project{
+					Key: projectKey,
+					URL: "https://sonar.example.com/dashboard?id=" + projectKey,
+				},
+				QualityGate: &sonar.QualityGate{
+					Name:   fake.LetterN(10),
+					Status: sonar.STATUS_ERROR,
+					Conditions: []*sonar.Condition{
+						{
+							Metric:         "coverage",
+							Operator:       sonar.OPERATOR_LESS_THAN,
+							ErrorThreshold: "80",
+							Value:          "50",
+							Status:         sonar.CONDITION_STATUS_ERROR,
+						},
+					},
+				},
+			},
+			ResourceUri:      "git://" + fake.DomainName() + "@" + fake.LetterN(10),
+			AnalysedAt:       time.Date(2021, 5, 27, 21, 8, 23, 0, time.FixedZone("", 2*60*60)),
+			AnalysedAtSource: TIMESTAMP_SOURCE_EVENT,
+		}
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			contentType = r.Header.Get("Content-Type")
+			received = map[string]interface{}{}
+			Expect(json.NewDecoder(r.Body).Decode(&received)).To(Succeed())
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	JustBeforeEach(func() {
+		err = NewCloudEventsSink(server.URL, server.Client()).Send(context.Background(), analysis)
+	})
+
+	It("should send a structured mode CloudEvent", func() {
+		Expect(err).ToNot(HaveOccurred())
+		Expect(contentType).To(Equal("application/cloudevents+json"))
+
+		Expect(received["specversion"]).To(Equal("1.0"))
+		Expect(received["id"]).To(Equal(analysis.Event.TaskId))
+		Expect(received["type"]).To(Equal("io.rode.sonarqube.analysis.completed"))
+		Expect(received["subject"]).To(Equal(analysis.ResourceUri))
+		Expect(received["time"]).To(Equal("2021-05-27T21:08:23+02:00"))
+		Expect(received["datacontenttype"]).To(Equal("application/json"))
+	})
+
+	It("should identify the sonar instance and project", func() {
+		Expect(received["source"]).To(Equal("https://sonar.example.com/projects/" + projectKey))
+		Expect(received["sonarinstance"]).To(Equal("sonar.example.com"))
+		Expect(received["sonarproject"]).To(Equal(projectKey))
+		Expect(received["sonarqualitygate"]).To(Equal("ERROR"))
+	})
+
+	It("should indicate where the time came from", func() {
+		Expect(received["sonartimesource"]).To(Equal("analysedAt"))
+	})
+
+	It("should not set a component", func() {
+		Expect(received).ToNot(HaveKey("sonarcomponent"))
+	})
+
+	When("the analysis is of a component", func() {
+		BeforeEach(func() {
+			analysis.Component = "services/api"
+		})
+
+		It("should set the component extension attribute", func() {
+			Expect(received["sonarcomponent"]).To(Equal("services/api"))
+		})
+	})
+
+	It("should include the resource uri and quality gate results in the data", func() {
+		data := received["data"].(map[string]interface{})
+		gate := data["qualityGateResult"].(map[string]interface{})
+
+		Expect(data["resourceUri"]).To(Equal(analysis.ResourceUri))
+		Expect(data["event"]).ToNot(BeNil())
+		Expect(gate["passed"]).To(BeFalse())
+		Expect(gate["errors"]).To(ConsistOf("coverage is 50% (less than 80%)"))
+	})
+
+	When("the analysis failed", func() {
+		BeforeEach(func() {
+			analysis.Event.Status = sonar.STATUS_FAILED
+			analysis.Event.QualityGate = nil
+		})
+
+		It("should use the failed event type", func() {
+			Expect(received["type"]).To(Equal("io.rode.sonarqube.analysis.failed"))
+			Expect(received["data"]).ToNot(HaveKey("qualityGateResult"))
+		})
+	})
+})
@@ -0,0 +1,100 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/collector-sonarqube/sonar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var _ = Describe("file sink", func() {
+	var (
+		dir  string
+		path string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "file-sink")
+		Expect(err).ToNot(HaveOccurred())
+
+		path = filepath.Join(dir, "analyses.jsonl")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should append each analysis as a line of JSON", func() {
+		fileSink, err := NewFileSink(path)
+		Expect(err).ToNot(HaveOccurred())
+
+		taskIds := []string{fake.LetterN(10), fake.LetterN(10)}
+		for _, taskId := range taskIds {
+			err = fileSink.Send(context.Background(), &Analysis{
+				Event:       &sonar.Event{TaskId: taskId},
+				ResourceUri: fake.URL(),
+			})
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		contents, err := ioutil.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+
+		lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+		Expect(lines).To(HaveLen(2))
+
+		for i, line := range lines {
+			actual := &Analysis{}
+			Expect(json.Unmarshal([]byte(line), actual)).To(Succeed())
+			Expect(actual.Event.TaskId).To(Equal(taskIds[i]))
+		}
+	})
+
+	It("should not truncate an existing file", func() {
+		Expect(ioutil.WriteFile(path, []byte("{}\n"), 0644)).To(Succeed())
+
+		fileSink, err := NewFileSink(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fileSink.Send(context.Background(), &Analysis{Event: &sonar.Event{}})).To(Succeed())
+
+		contents, err := ioutil.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(strings.Split(strings.TrimSpace(string(contents)), "\n")).To(HaveLen(2))
+	})
+
+	It("should close the file with the fanout", func() {
+		fileSink, err := NewFileSink(path)
+		Expect(err).ToNot(HaveOccurred())
+
+		fanout := NewFanout(logger, []string{"file"}, fileSink)
+		Expect(fanout.Close()).To(Succeed())
+
+		Expect(fileSink.Send(context.Background(), &Analysis{Event: &sonar.Event{}})).To(MatchError(os.ErrClosed))
+	})
+
+	It("should return an error if the file can't be opened", func() {
+		_, err := NewFileSink(filepath.Join(dir, "missing", "analyses.jsonl"))
+
+		Expect(err).To(HaveOccurred())
+	})
+})
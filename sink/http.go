@@ -0,0 +1,70 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewHttpSink returns a sink that POSTs each analysis as JSON to the given URL. Any non-2xx response is treated as a
+// failure.
+func NewHttpSink(url string, client *http.Client) Sink {
+	return &httpSink{
+		url:    url,
+		client: client,
+	}
+}
+
+func (h *httpSink) Name() string {
+	return "http"
+}
+
+func (h *httpSink) Send(ctx context.Context, analysis *Analysis) error {
+	body, err := json.Marshal(analysis)
+	if err != nil {
+		return err
+	}
+
+	return post(ctx, h.client, h.url, "application/json", body)
+}
+
+func post(ctx context.Context, client *http.Client, url, contentType string, body []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", contentType)
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected response from %s: %s", url, response.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/collector-sonarqube/sonar"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("http sink", func() {
+	var (
+		server         *httptest.Server
+		responseStatus int
+		received       *Analysis
+		contentType    string
+		analysis       *Analysis
+		err            error
+	)
+
+	BeforeEach(func() {
+		responseStatus = http.StatusAccepted
+		received = nil
+		analysis = &Analysis{
+			Event:       &sonar.Event{TaskId: fake.LetterN(10)},
+			ResourceUri: fake.URL(),
+		}
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			contentType = r.Header.Get("Content-Type")
+			received = &Analysis{}
+			Expect(json.NewDecoder(r.Body).Decode(received)).To(Succeed())
+
+			w.WriteHeader(responseStatus)
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	JustBeforeEach(func() {
+		err = NewHttpSink(server.URL, server.Client()).Send(context.Background(), analysis)
+	})
+
+	It("should POST the analysis as JSON", func() {
+		Expect(err).ToNot(HaveOccurred())
+		Expect(contentType).To(Equal("application/json"))
+		Expect(received.Event.TaskId).To(Equal(analysis.Event.TaskId))
+		Expect(received.ResourceUri).To(Equal(analysis.ResourceUri))
+	})
+
+	When("the endpoint responds with an error", func() {
+		BeforeEach(func() {
+			responseStatus = http.StatusBadGateway
+		})
+
+		It("should return an error", func() {
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
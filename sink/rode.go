@@ -0,0 +1,487 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rode/collector-sonarqube/sonar"
+	"go.uber.org/zap"
+
+	pb "github.com/rode/rode/proto/v1alpha1"
+	"github.com/rode/rode/protodeps/grafeas/proto/v1beta1/common_go_proto"
+	"github.com/rode/rode/protodeps/grafeas/proto/v1beta1/discovery_go_proto"
+	"github.com/rode/rode/protodeps/grafeas/proto/v1beta1/grafeas_go_proto"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type rodeSink struct {
+	name      string
+	client    pb.RodeClient
+	logger    *zap.Logger
+	templates *NoteTemplates
+}
+
+// NewRodeSink returns a sink that records each analysis in Rode as a note and a pair of discovery occurrences. The
+// templates customize the text of each note, and may be nil.
+func NewRodeSink(logger *zap.Logger, client pb.RodeClient, templates *NoteTemplates) Sink {
+	return &rodeSink{
+		name:      "rode",
+		client:    client,
+		logger:    logger,
+		templates: templates,
+	}
+}
+
+// NewRodeInstanceSink returns a sink that records each analysis in an additional Rode instance, like NewRodeSink. It's
+// named "rode-<name>", so that routing rules can select it.
+func NewRodeInstanceSink(name string, logger *zap.Logger, client pb.RodeClient, templates *NoteTemplates) Sink {
+	return &rodeSink{
+		name:      "rode-" + name,
+		client:    client,
+		logger:    logger,
+		templates: templates,
+	}
+}
+
+func (r *rodeSink) Name() string {
+	return r.name
+}
+
+func (r *rodeSink) Send(ctx context.Context, analysis *Analysis) error {
+	// create a note to represent the sonar analysis
+	noteName, err := r.createNoteForEvent(ctx, analysis)
+	if err != nil {
+		return fmt.Errorf("error creating note for analysis: %w", err)
+	}
+	// the names recorded with the analysis are those of the primary instance, which the reconciler checks
+	primary := r.name == "rode"
+	if primary {
+		analysis.RodeNoteName = noteName
+	}
+
+	// create occurrences for sonar analysis
+	response, err := r.createOccurrencesForEvent(ctx, analysis, noteName)
+	if err != nil {
+		return fmt.Errorf("error creating occurrences for event: %w", err)
+	}
+
+	if primary {
+		for _, occurrence := range response.GetOccurrences() {
+			analysis.RodeOccurrenceNames = append(analysis.RodeOccurrenceNames, occurrence.Name)
+		}
+	}
+
+	r.logger.Debug("response payload", zap.Any("response", response.GetOccurrences()))
+
+	return nil
+}
+
+// createNoteForEvent creates a note that represents the sonar analysis.
+func (r *rodeSink) createNoteForEvent(ctx context.Context, analysis *Analysis) (string, error) {
+	event := analysis.Event
+	var longDescription string
+	switch {
+	case event.Status == sonar.STATUS_FAILED:
+		longDescription = "Failed SonarQube Analysis"
+	case event.Status == sonar.STATUS_SUCCESS && event.HasQualityGate():
+		longDescription = fmt.Sprintf("SonarQube Analysis using %s Quality Gate", event.QualityGate.Name)
+	case event.Status == sonar.STATUS_SUCCESS:
+		longDescription = "SonarQube Analysis without a Quality Gate"
+	default:
+		return "", errors.New("unexpected event payload, unable to compute note for event")
+	}
+
+	shortDescription := "SonarQube Analysis"
+	if analysis.Component != "" {
+		shortDescription = fmt.Sprintf("SonarQube Analysis of %s", analysis.Component)
+	}
+
+	shortDescription, err := r.templates.render("shortDescription", analysis, shortDescription)
+	if err != nil {
+		return "", err
+	}
+
+	longDescription, err = r.templates.render("longDescription", analysis, longDescription)
+	if err != nil {
+		return "", err
+	}
+
+	noteId, err := r.templates.render("noteId", analysis, noteIdForAnalysis(analysis))
+	if err != nil {
+		return "", err
+	}
+	// the reconciler recognizes the analyses that have been recorded by the end of their note names
+	if !strings.HasSuffix(noteId, "-"+event.TaskId) {
+		return "", fmt.Errorf("note id %q must end with -%s", noteId, event.TaskId)
+	}
+
+	relatedUrls, err := r.relatedUrlsForAnalysis(analysis)
+	if err != nil {
+		return "", err
+	}
+
+	note, err := r.client.CreateNote(ctx, &pb.CreateNoteRequest{
+		Note: &grafeas_go_proto.Note{
+			ShortDescription: shortDescription,
+			LongDescription:  longDescription,
+			Kind:             common_go_proto.NoteKind_DISCOVERY,
+			RelatedUrl:       relatedUrls,
+			Type: &grafeas_go_proto.Note_Discovery{
+				Discovery: &discovery_go_proto.Discovery{
+					// in the future, this should reference the new static analysis note kind
+					AnalysisKind: common_go_proto.NoteKind_VULNERABILITY,
+				},
+			},
+		},
+		NoteId: noteId,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return note.Name, nil
+}
+
+// createOccurrencesForEvent creates occurrences based on the received sonar event. We use discovery occurrences here
+// due to the lack of a better occurrence type. We also misuse the discovery analysis status, such that "FAILED" is
+// equivalent to a failing quality gate, rather than the analysis as a whole failing. This will be revisited with the
+// addition of a new static analysis occurrence type. The same pair of occurrences is created for the analyzed commit and
+// for each artifact, in a single batch.
+func (r *rodeSink) createOccurrencesForEvent(ctx context.Context, analysis *Analysis, noteName string) (*pb.BatchCreateOccurrencesResponse, error) {
+	end, err := r.endOfAnalysis(analysis)
+	if err != nil {
+		return nil, err
+	}
+
+	resourceUris := analysis.ResourceUris()
+	occurrencesByResource := map[string][]*grafeas_go_proto.Occurrence{}
+
+	var occurrences []*grafeas_go_proto.Occurrence
+	for _, resourceUri := range resourceUris {
+		occurrencesByResource[resourceUri] = occurrencesForResource(analysis, noteName, resourceUri, end)
+		occurrences = append(occurrences, occurrencesByResource[resourceUri]...)
+	}
+
+	response, err := r.client.BatchCreateOccurrences(ctx, &pb.BatchCreateOccurrencesRequest{
+		Occurrences: occurrences,
+	})
+	if err == nil || len(resourceUris) == 1 {
+		return response, err
+	}
+
+	// the batch is rejected as a whole, so each resource is retried on its own to find out which can't be recorded
+	r.logger.Warn("error creating occurrences, retrying each resource separately", zap.Error(err))
+
+	response = &pb.BatchCreateOccurrencesResponse{}
+	resourceErr := &ResourceError{Total: len(resourceUris), Errors: map[string]error{}}
+	for _, resourceUri := range resourceUris {
+		resourceResponse, err := r.client.BatchCreateOccurrences(ctx, &pb.BatchCreateOccurrencesRequest{
+			Occurrences: occurrencesByResource[resourceUri],
+		})
+		if err != nil {
+			resourceErr.Errors[resourceUri] = err
+			continue
+		}
+
+		response.Occurrences = append(response.Occurrences, resourceResponse.Occurrences...)
+	}
+
+	if len(resourceErr.Errors) == 0 {
+		return response, nil
+	}
+
+	return response, resourceErr
+}
+
+// analysisEnd is what's recorded on the occurrence that marks the end of the analysis, which is the same for every
+// resource.
+type analysisEnd struct {
+	status      discovery_go_proto.Discovered_AnalysisStatus
+	statusError *status.Status
+	remediation string
+}
+
+// endOfAnalysis determines the status and remediation of the occurrence that marks the end of the analysis, rendering
+// the statusMessage and remediation templates.
+func (r *rodeSink) endOfAnalysis(analysis *Analysis) (*analysisEnd, error) {
+	analysisStatus, statusError := analysisStatusForEvent(analysis.Event)
+	if statusError != nil && statusError.Message != "" {
+		message, err := r.templates.render("statusMessage", analysis, statusError.Message)
+		if err != nil {
+			return nil, err
+		}
+		statusError.Message = message
+	}
+
+	if details := detailsForAnalysis(analysis); details != nil {
+		if statusError == nil {
+			statusError = &status.Status{Code: int32(codes.OK)}
+		}
+		statusError.Details = append(statusError.Details, details)
+	}
+
+	end := &analysisEnd{status: analysisStatus, statusError: statusError}
+	if analysisStatus == discovery_go_proto.Discovered_FINISHED_FAILED {
+		remediation, err := r.templates.render("remediation", analysis, remediationForEvent(analysis.Event))
+		if err != nil {
+			return nil, err
+		}
+		end.remediation = remediation
+	}
+
+	return end, nil
+}
+
+// occurrencesForResource returns the pair of occurrences that mark the start and end of the analysis.
+func occurrencesForResource(analysis *Analysis, noteName, resourceUri string, end *analysisEnd) []*grafeas_go_proto.Occurrence {
+	timestamp := timestamppb.New(analysis.AnalysedAt)
+
+	return []*grafeas_go_proto.Occurrence{
+		{
+			Resource: &grafeas_go_proto.Resource{
+				Uri: resourceUri,
+			},
+			NoteName:   noteName,
+			Kind:       common_go_proto.NoteKind_DISCOVERY,
+			CreateTime: timestamp,
+			Details: &grafeas_go_proto.Occurrence_Discovered{
+				Discovered: &discovery_go_proto.Details{
+					Discovered: &discovery_go_proto.Discovered{
+						ContinuousAnalysis: discovery_go_proto.Discovered_CONTINUOUS_ANALYSIS_UNSPECIFIED,
+						AnalysisStatus:     discovery_go_proto.Discovered_SCANNING,
+					},
+				},
+			},
+		},
+		{
+			Resource: &grafeas_go_proto.Resource{
+				Uri: resourceUri,
+			},
+			NoteName:   noteName,
+			Kind:       common_go_proto.NoteKind_DISCOVERY,
+			CreateTime: timestamp,
+			Details: &grafeas_go_proto.Occurrence_Discovered{
+				Discovered: &discovery_go_proto.Details{
+					Discovered: &discovery_go_proto.Discovered{
+						ContinuousAnalysis:  discovery_go_proto.Discovered_CONTINUOUS_ANALYSIS_UNSPECIFIED,
+						AnalysisStatus:      end.status,
+						AnalysisStatusError: end.statusError,
+					},
+				},
+			},
+			Remediation: end.remediation,
+		},
+	}
+}
+
+// detailsForAnalysis describes the allowlisted scanner properties and the pipeline run of the analysis as a struct, along
+// with where its time came from when that wasn't the event. It's attached to the status of the occurrence that marks
+// the end of the analysis. Discovery occurrences don't have a field for arbitrary metadata, so this is how policies in
+// Rode can correlate an analysis with the run that produced it. Nil is returned when there's nothing to describe.
+func detailsForAnalysis(analysis *Analysis) *anypb.Any {
+	fields := map[string]interface{}{}
+	if len(analysis.Metadata) > 0 {
+		metadata := map[string]interface{}{}
+		for name, value := range analysis.Metadata {
+			metadata[validUtf8(name)] = validUtf8(value)
+		}
+		fields["metadata"] = metadata
+	}
+
+	if pipeline := analysis.Pipeline; pipeline != nil {
+		fields["pipeline"] = map[string]interface{}{
+			"provider": validUtf8(string(pipeline.Provider)),
+			"id":       validUtf8(pipeline.Id),
+			"url":      validUtf8(pipeline.Url),
+		}
+	}
+
+	// a time that didn't come from the event is flagged, so that it isn't mistaken for the time of the analysis
+	if source := analysis.AnalysedAtSource; source != "" && source != TIMESTAMP_SOURCE_EVENT {
+		fields["analysedAtSource"] = string(source)
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+
+	// every value is a valid string, so neither of these can fail
+	details, err := structpb.NewStruct(fields)
+	if err != nil {
+		return nil
+	}
+	detailsAny, err := anypb.New(details)
+	if err != nil {
+		return nil
+	}
+
+	return detailsAny
+}
+
+// validUtf8 replaces invalid characters in scanner properties, which protobuf strings can't contain.
+func validUtf8(value string) string {
+	return strings.ToValidUTF8(value, "\uFFFD")
+}
+
+// noteIdForAnalysis includes the component in the note id, so that policies can distinguish the occurrences for each
+// part of a monorepo by their note name, since they share the same resource uri.
+func noteIdForAnalysis(analysis *Analysis) string {
+	if analysis.Component == "" {
+		return fmt.Sprintf("sonar-scan-%s", analysis.Event.TaskId)
+	}
+
+	return fmt.Sprintf("sonar-scan-%s-%s", componentSlug(analysis.Component), analysis.Event.TaskId)
+}
+
+// componentSlug converts a component path into a form that's safe to use in a note id, e.g. "services/api" becomes
+// "services-api".
+func componentSlug(component string) string {
+	var slug strings.Builder
+	separator := false
+	for _, r := range strings.ToLower(component) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if separator && slug.Len() > 0 {
+				slug.WriteRune('-')
+			}
+			slug.WriteRune(r)
+			separator = false
+			continue
+		}
+
+		separator = true
+	}
+
+	return slug.String()
+}
+
+// relatedUrlsForAnalysis links the note to the SonarQube pages that are relevant to the analysis, so that a failing
+// policy can be traced back to its cause, and to the pipeline run that produced it. Links that can't be derived from
+// the analysis are omitted.
+func (r *rodeSink) relatedUrlsForAnalysis(analysis *Analysis) ([]*common_go_proto.RelatedUrl, error) {
+	event := analysis.Event
+	pipelineUrl := ""
+	if analysis.Pipeline != nil {
+		pipelineUrl = analysis.Pipeline.Url
+	}
+
+	links := []struct {
+		key   string
+		label string
+		url   string
+	}{
+		{"project", "Project URL", event.Project.URL},
+		{"dashboard", "Analysis Dashboard", event.DashboardURL()},
+		{"qualityGate", "Quality Gate", event.QualityGateURL()},
+		{"issues", "Issues", event.IssuesURL()},
+		{"task", "Compute Engine Task", event.TaskURL()},
+		{"pipeline", "Pipeline Run", pipelineUrl},
+	}
+
+	var relatedUrls []*common_go_proto.RelatedUrl
+	seen := map[string]bool{}
+	for _, link := range links {
+		// without branch support, the analysis dashboard is the project dashboard
+		if link.url == "" || seen[link.url] {
+			continue
+		}
+		seen[link.url] = true
+
+		label, err := r.templates.render(relatedUrlTemplateName(link.key), analysis, link.label)
+		if err != nil {
+			return nil, err
+		}
+
+		relatedUrls = append(relatedUrls, &common_go_proto.RelatedUrl{
+			Label: label,
+			Url:   link.url,
+		})
+	}
+
+	return relatedUrls, nil
+}
+
+// remediationForEvent points to the analysis dashboard when it failed. Occurrences don't have related urls of their own,
+// so this is the only way to link a failing occurrence to SonarQube without going through the note.
+func remediationForEvent(event *sonar.Event) string {
+	dashboardUrl := event.DashboardURL()
+	if dashboardUrl == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("Review the analysis in SonarQube: %s", dashboardUrl)
+}
+
+// analysisStatusForEvent determines the status of the occurrence that marks the end of the analysis. A quality gate
+// that passed with warnings is still a success, but the warnings are surfaced in the status error so that they can be
+// distinguished from a clean pass. Likewise, a failing gate lists the conditions that caused it to fail.
+func analysisStatusForEvent(event *sonar.Event) (discovery_go_proto.Discovered_AnalysisStatus, *status.Status) {
+	if event.Status != sonar.STATUS_SUCCESS {
+		return discovery_go_proto.Discovered_FINISHED_FAILED, nil
+	}
+
+	// an analysis of a project without a quality gate has nothing that can fail, so it's recorded as a success
+	if !event.HasQualityGate() {
+		return discovery_go_proto.Discovered_FINISHED_SUCCESS, nil
+	}
+
+	gate := event.QualityGate
+	switch gate.Status {
+	case sonar.STATUS_OK, sonar.STATUS_WARN:
+		warnings := gate.ConditionsWithStatus(sonar.CONDITION_STATUS_WARN)
+		if gate.Status == sonar.STATUS_OK && len(warnings) == 0 {
+			return discovery_go_proto.Discovered_FINISHED_SUCCESS, nil
+		}
+
+		return discovery_go_proto.Discovered_FINISHED_SUCCESS, &status.Status{
+			Code:    int32(codes.OK),
+			Message: conditionsMessage("quality gate passed with warnings", warnings),
+		}
+	case sonar.STATUS_ERROR:
+		return discovery_go_proto.Discovered_FINISHED_FAILED, &status.Status{
+			Code:    int32(codes.FailedPrecondition),
+			Message: conditionsMessage("quality gate failed", gate.ConditionsWithStatus(sonar.CONDITION_STATUS_ERROR)),
+		}
+	}
+
+	return discovery_go_proto.Discovered_FINISHED_FAILED, &status.Status{
+		Code:    int32(codes.Unknown),
+		Message: fmt.Sprintf("unknown quality gate status %s", gate.Status),
+	}
+}
+
+func conditionsMessage(summary string, conditions []*sonar.Condition) string {
+	if len(conditions) == 0 {
+		return summary
+	}
+
+	return fmt.Sprintf("%s: %s", summary, strings.Join(describeConditions(conditions), "; "))
+}
+
+func describeConditions(conditions []*sonar.Condition) []string {
+	var descriptions []string
+	for _, condition := range conditions {
+		descriptions = append(descriptions, condition.Describe())
+	}
+
+	return descriptions
+}
@@ -0,0 +1,69 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"context"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/collector-sonarqube/sonar"
+	pb "github.com/rode/rode/proto/v1alpha1"
+	"github.com/rode/rode/proto/v1alpha1fakes"
+	"github.com/rode/rode/protodeps/grafeas/proto/v1beta1/grafeas_go_proto"
+)
+
+var _ = Describe("rode instance sink", func() {
+	var (
+		rodeClient *v1alpha1fakes.FakeRodeClient
+		analysis   *Analysis
+		instance   Sink
+	)
+
+	BeforeEach(func() {
+		rodeClient = &v1alpha1fakes.FakeRodeClient{}
+		rodeClient.CreateNoteReturns(&grafeas_go_proto.Note{Name: fake.LetterN(10)}, nil)
+		rodeClient.BatchCreateOccurrencesReturns(&pb.BatchCreateOccurrencesResponse{
+			Occurrences: []*grafeas_go_proto.Occurrence{{Name: fake.LetterN(10)}},
+		}, nil)
+
+		analysis = &Analysis{
+			Event: &sonar.Event{
+				TaskId:  fake.LetterN(10),
+				Status:  sonar.STATUS_SUCCESS,
+				Project: &sonar.Project{Key: fake.LetterN(10), URL: fake.URL()},
+			},
+			ResourceUri: "git://github.com/rode/collector-sonarqube@abc123",
+		}
+		instance = NewRodeInstanceSink("staging", logger, rodeClient, nil)
+	})
+
+	It("should be named after the instance", func() {
+		Expect(instance.Name()).To(Equal("rode-staging"))
+	})
+
+	It("should record the analysis in the instance", func() {
+		Expect(instance.Send(context.Background(), analysis)).To(Succeed())
+
+		Expect(rodeClient.CreateNoteCallCount()).To(Equal(1))
+		Expect(rodeClient.BatchCreateOccurrencesCallCount()).To(Equal(1))
+	})
+
+	It("should leave the note and occurrence names of the primary instance", func() {
+		Expect(instance.Send(context.Background(), analysis)).To(Succeed())
+
+		Expect(analysis.RodeNoteName).To(BeEmpty())
+		Expect(analysis.RodeOccurrenceNames).To(BeEmpty())
+	})
+})
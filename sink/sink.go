@@ -0,0 +1,265 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rode/collector-sonarqube/sonar"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+// TimestampSource records where the time of an analysis came from, since it isn't always present in the event.
+type TimestampSource string
+
+const (
+	TIMESTAMP_SOURCE_EVENT    TimestampSource = "analysedAt"
+	TIMESTAMP_SOURCE_TASK     TimestampSource = "executedAt"
+	TIMESTAMP_SOURCE_RECEIVED TimestampSource = "receivedAt"
+)
+
+// Analysis is a sonar event that has been normalized by the listener, and is ready to be sent to each sink.
+type Analysis struct {
+	Event       *sonar.Event `json:"event"`
+	ResourceUri string       `json:"resourceUri"`
+	ReceivedAt  time.Time    `json:"receivedAt"`
+	// AnalysedAt is the time of the analysis in its original offset. When the event's timestamp can't be used, it's
+	// the time that the compute engine task finished, or failing that, the time the event was received.
+	AnalysedAt       time.Time       `json:"analysedAt"`
+	AnalysedAtSource TimestampSource `json:"analysedAtSource"`
+	// Metadata are the scanner properties selected by the property allowlist
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Pipeline is the CI run that produced the analysis, when it can be recognized from the scanner properties
+	Pipeline *sonar.CIRun `json:"pipeline,omitempty"`
+	// ArtifactUris are the resource uris of artifacts built from the analyzed commit, which the analysis is also
+	// recorded against
+	ArtifactUris []string `json:"artifactUris,omitempty"`
+	// Component is the part of the repository that was analyzed, such as a service directory in a monorepo. It
+	// distinguishes analyses of different projects that share the same commit.
+	Component string `json:"component,omitempty"`
+	// Sinks are the names of the sinks that receive the analysis, when routing rules have selected them. Every sink
+	// receives the analysis when it's nil.
+	Sinks []string `json:"-"`
+	// RodeNoteName and RodeOccurrenceNames are set by the Rode sink, once the analysis has been recorded
+	RodeNoteName        string   `json:"-"`
+	RodeOccurrenceNames []string `json:"-"`
+}
+
+// AddArtifactUris records the analysis against additional resources, ignoring any that it's already recorded against.
+func (a *Analysis) AddArtifactUris(uris ...string) {
+	for _, uri := range uris {
+		if uri == "" || uri == a.ResourceUri || a.hasArtifactUri(uri) {
+			continue
+		}
+
+		a.ArtifactUris = append(a.ArtifactUris, uri)
+	}
+}
+
+func (a *Analysis) hasArtifactUri(uri string) bool {
+	for _, existing := range a.ArtifactUris {
+		if existing == uri {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *Analysis) selects(sink string) bool {
+	if a.Sinks == nil {
+		return true
+	}
+
+	for _, name := range a.Sinks {
+		if name == sink {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ResourceUris returns every resource that the analysis is recorded against, starting with the analyzed commit.
+func (a *Analysis) ResourceUris() []string {
+	return append([]string{a.ResourceUri}, a.ArtifactUris...)
+}
+
+// ResourceError is returned when an analysis was recorded against some of its resources, but not all of them.
+type ResourceError struct {
+	// Total is the number of resources the analysis should have been recorded against
+	Total int
+	// Errors are keyed by the uri of each resource that the analysis couldn't be recorded against
+	Errors map[string]error
+}
+
+func (r *ResourceError) Error() string {
+	var failures []string
+	for _, uri := range r.FailedResourceUris() {
+		failures = append(failures, fmt.Sprintf("%s: %v", uri, r.Errors[uri]))
+	}
+
+	return fmt.Sprintf("unable to record analysis for %d of %d resources: %s", len(r.Errors), r.Total, strings.Join(failures, "; "))
+}
+
+// FailedResourceUris returns the resources that the analysis couldn't be recorded against, in sorted order.
+func (r *ResourceError) FailedResourceUris() []string {
+	var uris []string
+	for uri := range r.Errors {
+		uris = append(uris, uri)
+	}
+	sort.Strings(uris)
+
+	return uris
+}
+
+// Sink is a destination for processed analyses.
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, analysis *Analysis) error
+}
+
+// Stats tracks the outcome of sending analyses to a single sink.
+type Stats struct {
+	Name            string     `json:"name"`
+	Required        bool       `json:"required"`
+	Succeeded       int64      `json:"succeeded"`
+	Failed          int64      `json:"failed"`
+	LastError       string     `json:"lastError,omitempty"`
+	LastSuccessTime *time.Time `json:"lastSuccessTime,omitempty"`
+	LastFailureTime *time.Time `json:"lastFailureTime,omitempty"`
+}
+
+// Fanout sends each analysis to every configured sink. A failure in one sink doesn't prevent the analysis from being
+// sent to the others.
+type Fanout struct {
+	logger   *zap.Logger
+	sinks    []Sink
+	required map[string]bool
+
+	mu    sync.Mutex
+	stats map[string]*Stats
+}
+
+// NewFanout returns a sink that sends each analysis to the given sinks. Only failures in the required sinks are
+// returned, so that an analysis that was recorded isn't retried because of an optional sink; the others are logged and
+// counted in the stats.
+func NewFanout(logger *zap.Logger, required []string, sinks ...Sink) *Fanout {
+	f := &Fanout{
+		logger:   logger,
+		sinks:    sinks,
+		required: map[string]bool{},
+		stats:    map[string]*Stats{},
+	}
+
+	for _, name := range required {
+		f.required[name] = true
+	}
+	for _, s := range sinks {
+		f.stats[s.Name()] = &Stats{Name: s.Name(), Required: f.required[s.Name()]}
+	}
+
+	return f
+}
+
+func (f *Fanout) Name() string {
+	return "fanout"
+}
+
+// Send delivers the analysis to each sink in order, returning the combined errors of any required sinks that failed. An
+// error is also returned when routing rules only selected sinks that aren't configured, since the analysis wouldn't be
+// recorded anywhere.
+func (f *Fanout) Send(ctx context.Context, analysis *Analysis) error {
+	var (
+		errs     error
+		selected int
+	)
+	for _, s := range f.sinks {
+		log := f.logger.With(zap.String("sink", s.Name()))
+		if !analysis.selects(s.Name()) {
+			log.Debug("sink was not selected for analysis")
+			continue
+		}
+		selected++
+
+		err := s.Send(ctx, analysis)
+		f.record(s.Name(), err)
+
+		if err != nil {
+			log.Error("error sending analysis to sink", zap.Error(err), zap.Bool("required", f.required[s.Name()]))
+			if f.required[s.Name()] {
+				errs = multierr.Append(errs, fmt.Errorf("%s: %w", s.Name(), err))
+			}
+			continue
+		}
+
+		log.Debug("sent analysis to sink")
+	}
+
+	if analysis.Sinks != nil && selected == 0 {
+		return fmt.Errorf("none of the selected sinks are configured: %s", strings.Join(analysis.Sinks, ", "))
+	}
+
+	return errs
+}
+
+// Stats returns a snapshot of the outcomes for each sink, in the order the sinks were configured.
+func (f *Fanout) Stats() []Stats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var stats []Stats
+	for _, s := range f.sinks {
+		stats = append(stats, *f.stats[s.Name()])
+	}
+
+	return stats
+}
+
+// Close closes any of the sinks that hold resources, such as an open file.
+func (f *Fanout) Close() error {
+	var errs error
+	for _, s := range f.sinks {
+		if closer, ok := s.(io.Closer); ok {
+			errs = multierr.Append(errs, closer.Close())
+		}
+	}
+
+	return errs
+}
+
+func (f *Fanout) record(name string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	stats := f.stats[name]
+	if err != nil {
+		stats.Failed++
+		stats.LastError = err.Error()
+		stats.LastFailureTime = &now
+		return
+	}
+
+	stats.Succeeded++
+	stats.LastSuccessTime = &now
+}
@@ -0,0 +1,191 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"context"
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/collector-sonarqube/sonar"
+)
+
+type fakeSink struct {
+	name     string
+	err      error
+	received []*Analysis
+}
+
+func (f *fakeSink) Name() string {
+	return f.name
+}
+
+func (f *fakeSink) Send(_ context.Context, analysis *Analysis) error {
+	f.received = append(f.received, analysis)
+
+	return f.err
+}
+
+var _ = Describe("Fanout", func() {
+	var (
+		first    *fakeSink
+		second   *fakeSink
+		fanout   *Fanout
+		analysis *Analysis
+		err      error
+	)
+
+	BeforeEach(func() {
+		first = &fakeSink{name: fake.LetterN(10)}
+		second = &fakeSink{name: fake.LetterN(10)}
+		analysis = &Analysis{
+			Event:       &sonar.Event{TaskId: fake.LetterN(10)},
+			ResourceUri: fake.URL(),
+		}
+	})
+
+	JustBeforeEach(func() {
+		fanout = NewFanout(logger, []string{first.name}, first, second)
+		err = fanout.Send(context.Background(), analysis)
+	})
+
+	It("should send the analysis to every sink", func() {
+		Expect(err).ToNot(HaveOccurred())
+		Expect(first.received).To(ConsistOf(analysis))
+		Expect(second.received).To(ConsistOf(analysis))
+	})
+
+	It("should track successes for each sink", func() {
+		stats := fanout.Stats()
+
+		Expect(stats).To(HaveLen(2))
+		Expect(stats[0].Name).To(Equal(first.name))
+		Expect(stats[0].Required).To(BeTrue())
+		Expect(stats[0].Succeeded).To(BeEquivalentTo(1))
+		Expect(stats[0].Failed).To(BeEquivalentTo(0))
+		Expect(stats[0].LastSuccessTime).ToNot(BeNil())
+		Expect(stats[0].LastFailureTime).To(BeNil())
+		Expect(stats[1].Name).To(Equal(second.name))
+		Expect(stats[1].Required).To(BeFalse())
+		Expect(stats[1].Succeeded).To(BeEquivalentTo(1))
+	})
+
+	When("routing rules have selected sinks", func() {
+		BeforeEach(func() {
+			analysis.Sinks = []string{second.name}
+		})
+
+		It("should only send the analysis to those sinks", func() {
+			Expect(err).ToNot(HaveOccurred())
+			Expect(first.received).To(BeEmpty())
+			Expect(second.received).To(ConsistOf(analysis))
+		})
+
+		It("should not count the sinks that were skipped", func() {
+			stats := fanout.Stats()
+
+			Expect(stats[0].Succeeded).To(BeZero())
+			Expect(stats[1].Succeeded).To(BeEquivalentTo(1))
+		})
+	})
+
+	When("routing rules only selected sinks that aren't configured", func() {
+		BeforeEach(func() {
+			analysis.Sinks = []string{"file"}
+		})
+
+		It("should return an error", func() {
+			Expect(err).To(MatchError("none of the selected sinks are configured: file"))
+			Expect(first.received).To(BeEmpty())
+			Expect(second.received).To(BeEmpty())
+		})
+	})
+
+	When("a sink that isn't required fails", func() {
+		BeforeEach(func() {
+			second.err = errors.New(fake.LetterN(10))
+		})
+
+		It("should not return the error", func() {
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should count the failure", func() {
+			stats := fanout.Stats()
+
+			Expect(stats[1].Failed).To(BeEquivalentTo(1))
+			Expect(stats[1].LastError).To(Equal(second.err.Error()))
+			Expect(stats[1].LastFailureTime).ToNot(BeNil())
+		})
+	})
+
+	When("a required sink fails", func() {
+		var expectedError error
+
+		BeforeEach(func() {
+			expectedError = errors.New(fake.LetterN(10))
+			first.err = expectedError
+		})
+
+		It("should return the error", func() {
+			Expect(err).To(MatchError(ContainSubstring(expectedError.Error())))
+		})
+
+		It("should still send the analysis to the remaining sinks", func() {
+			Expect(second.received).To(ConsistOf(analysis))
+		})
+
+		It("should track the failure independently", func() {
+			stats := fanout.Stats()
+
+			Expect(stats[0].Failed).To(BeEquivalentTo(1))
+			Expect(stats[0].Succeeded).To(BeEquivalentTo(0))
+			Expect(stats[0].LastError).To(Equal(expectedError.Error()))
+			Expect(stats[1].Succeeded).To(BeEquivalentTo(1))
+			Expect(stats[1].Failed).To(BeEquivalentTo(0))
+		})
+	})
+})
+
+var _ = Describe("Analysis", func() {
+	It("should add artifact uris that aren't already recorded", func() {
+		analysis := &Analysis{ResourceUri: "git://github.com/rode/collector-sonarqube@abc"}
+
+		analysis.AddArtifactUris("harbor.example.com/rode/api:abc", "", analysis.ResourceUri)
+		analysis.AddArtifactUris("harbor.example.com/rode/web:abc", "harbor.example.com/rode/api:abc")
+
+		Expect(analysis.ArtifactUris).To(Equal([]string{"harbor.example.com/rode/api:abc", "harbor.example.com/rode/web:abc"}))
+		Expect(analysis.ResourceUris()).To(Equal([]string{
+			"git://github.com/rode/collector-sonarqube@abc",
+			"harbor.example.com/rode/api:abc",
+			"harbor.example.com/rode/web:abc",
+		}))
+	})
+})
+
+var _ = Describe("ResourceError", func() {
+	It("should describe each failed resource", func() {
+		err := &ResourceError{
+			Total: 3,
+			Errors: map[string]error{
+				"b": errors.New("unavailable"),
+				"a": errors.New("denied"),
+			},
+		}
+
+		Expect(err.FailedResourceUris()).To(Equal([]string{"a", "b"}))
+		Expect(err.Error()).To(Equal("unable to record analysis for 2 of 3 resources: a: denied; b: unavailable"))
+	})
+})
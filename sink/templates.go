@@ -0,0 +1,171 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// relatedUrlKeys name the links that the Rode sink adds to each note, in the order they're added
+var relatedUrlKeys = []string{"project", "dashboard", "qualityGate", "issues", "task", "pipeline"}
+
+// NoteTemplatesConfig customizes the text of the notes created by the Rode sink. Each template is a Go text/template
+// (https://pkg.go.dev/text/template) that's rendered against a TemplateData. The default text is used for any template
+// that isn't set.
+//
+//	{
+//	  "shortDescription": "{{ .Event.Project.Name }}{{ with .Component }} ({{ . }}){{ end }}",
+//	  "longDescription": "[team-a] {{ .Default }}",
+//	  "noteId": "team-a-{{ .Event.Project.Key | slug }}-{{ .Event.TaskId }}",
+//	  "relatedUrlLabels": {"dashboard": "{{ .Event.Project.Name }} in SonarQube"},
+//	  "remediation": "Ask #team-a for help with {{ .Event.Project.Name }}: {{ .Default }}"
+//	}
+type NoteTemplatesConfig struct {
+	ShortDescription string `json:"shortDescription,omitempty"`
+	LongDescription  string `json:"longDescription,omitempty"`
+	// NoteId must end with "-" and the compute engine task id, which is how the reconciler finds the analyses that
+	// have been recorded
+	NoteId string `json:"noteId,omitempty"`
+	// RelatedUrlLabels are keyed by link: project, dashboard, qualityGate, issues, task or pipeline
+	RelatedUrlLabels map[string]string `json:"relatedUrlLabels,omitempty"`
+	// Remediation is the remediation of the occurrence that marks the end of a failed analysis
+	Remediation string `json:"remediation,omitempty"`
+	// StatusMessage is the status message of the occurrence that marks the end of the analysis, which is only set
+	// when the quality gate failed, passed with warnings or has an unknown status
+	StatusMessage string `json:"statusMessage,omitempty"`
+}
+
+// TemplateData is what note templates are rendered against. The analysis includes the event, along with what the
+// listener added to it, such as the component, metadata and pipeline run.
+type TemplateData struct {
+	*Analysis
+	// Default is the text that's used when there's no template
+	Default string
+}
+
+// NoteTemplates are parsed note templates. A nil *NoteTemplates renders the default text.
+type NoteTemplates struct {
+	templates map[string]*template.Template
+}
+
+// LoadNoteTemplates reads note templates from a JSON file and parses them.
+func LoadNoteTemplates(path string) (*NoteTemplates, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config := &NoteTemplatesConfig{}
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("error reading note templates %s: %v", path, err)
+	}
+
+	templates, err := ParseNoteTemplates(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid note templates %s: %v", path, err)
+	}
+
+	return templates, nil
+}
+
+// ParseNoteTemplates parses every template in the config, so that syntax errors are found at startup rather than when
+// an analysis is recorded.
+func ParseNoteTemplates(config *NoteTemplatesConfig) (*NoteTemplates, error) {
+	sources := map[string]string{
+		"shortDescription": config.ShortDescription,
+		"longDescription":  config.LongDescription,
+		"noteId":           config.NoteId,
+		"remediation":      config.Remediation,
+		"statusMessage":    config.StatusMessage,
+	}
+
+	for key, source := range config.RelatedUrlLabels {
+		if !isRelatedUrlKey(key) {
+			return nil, fmt.Errorf("unknown related url %q, expected one of %s", key, strings.Join(relatedUrlKeys, ", "))
+		}
+
+		sources[relatedUrlTemplateName(key)] = source
+	}
+
+	// sorted, so that the same error is reported for the same config
+	var names []string
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	templates := &NoteTemplates{templates: map[string]*template.Template{}}
+	for _, name := range names {
+		if sources[name] == "" {
+			continue
+		}
+
+		t, err := template.New(name).Option("missingkey=error").Funcs(templateFuncs).Parse(sources[name])
+		if err != nil {
+			return nil, err
+		}
+
+		templates.templates[name] = t
+	}
+
+	return templates, nil
+}
+
+var templateFuncs = template.FuncMap{
+	"slug":  componentSlug,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	// replace takes the string last, so that it can be used at the end of a pipeline
+	"replace": func(old, new, s string) string {
+		return strings.ReplaceAll(s, old, new)
+	},
+}
+
+// render executes the named template against the analysis, or returns the default text when there's no template.
+// Surrounding whitespace is removed, so that templates can be split across lines.
+func (n *NoteTemplates) render(name string, analysis *Analysis, defaultText string) (string, error) {
+	if n == nil || n.templates[name] == nil {
+		return defaultText, nil
+	}
+
+	var text strings.Builder
+	if err := n.templates[name].Execute(&text, &TemplateData{Analysis: analysis, Default: defaultText}); err != nil {
+		return "", fmt.Errorf("error rendering %s template: %w", name, err)
+	}
+
+	return strings.TrimSpace(text.String()), nil
+}
+
+func isRelatedUrlKey(key string) bool {
+	for _, k := range relatedUrlKeys {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+func relatedUrlTemplateName(key string) string {
+	return "relatedUrlLabels." + key
+}
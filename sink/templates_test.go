@@ -0,0 +1,167 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/collector-sonarqube/sonar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("NoteTemplates", func() {
+	var analysis *Analysis
+
+	BeforeEach(func() {
+		analysis = &Analysis{
+			Event: &sonar.Event{
+				TaskId:  fake.LetterN(10),
+				Project: &sonar.Project{Key: "payment-api", Name: "Payment API"},
+			},
+			Component: "services/Payment_API",
+			Metadata:  map[string]string{"team": "a"},
+		}
+	})
+
+	render := func(config *NoteTemplatesConfig, name string) string {
+		templates, err := ParseNoteTemplates(config)
+		Expect(err).ToNot(HaveOccurred())
+
+		text, err := templates.render(name, analysis, "SonarQube Analysis")
+		Expect(err).ToNot(HaveOccurred())
+
+		return text
+	}
+
+	It("should render the default text when there's no template", func() {
+		var templates *NoteTemplates
+
+		text, err := templates.render("shortDescription", analysis, "SonarQube Analysis")
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(text).To(Equal("SonarQube Analysis"))
+	})
+
+	It("should render the event and enrichment data", func() {
+		text := render(&NoteTemplatesConfig{
+			LongDescription: "{{ .Default }} of {{ .Event.Project.Name }} for team {{ .Metadata.team | upper }}",
+		}, "longDescription")
+
+		Expect(text).To(Equal("SonarQube Analysis of Payment API for team A"))
+	})
+
+	It("should provide functions for building ids", func() {
+		text := render(&NoteTemplatesConfig{
+			NoteId: "{{ .Component | slug }}-{{ .Event.Project.Key | replace \"-\" \".\" }}",
+		}, "noteId")
+
+		Expect(text).To(Equal("services-payment-api-payment.api"))
+	})
+
+	It("should trim surrounding whitespace", func() {
+		text := render(&NoteTemplatesConfig{
+			ShortDescription: `
+				{{ .Event.Project.Name }}
+			`,
+		}, "shortDescription")
+
+		Expect(text).To(Equal("Payment API"))
+	})
+
+	It("should render related url labels", func() {
+		text := render(&NoteTemplatesConfig{
+			RelatedUrlLabels: map[string]string{"dashboard": "{{ .Event.Project.Name }} dashboard"},
+		}, relatedUrlTemplateName("dashboard"))
+
+		Expect(text).To(Equal("Payment API dashboard"))
+	})
+
+	It("should render occurrence remediation and status messages", func() {
+		config := &NoteTemplatesConfig{
+			Remediation:   "Ask team {{ .Metadata.team }}. {{ .Default }}",
+			StatusMessage: "{{ .Default | upper }}",
+		}
+
+		Expect(render(config, "remediation")).To(Equal("Ask team a. SonarQube Analysis"))
+		Expect(render(config, "statusMessage")).To(Equal("SONARQUBE ANALYSIS"))
+	})
+
+	It("should return an error when a key is missing", func() {
+		templates, err := ParseNoteTemplates(&NoteTemplatesConfig{ShortDescription: "{{ .Metadata.owner }}"})
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = templates.render("shortDescription", analysis, "")
+
+		Expect(err).To(MatchError(ContainSubstring("error rendering shortDescription template")))
+	})
+
+	It("should reject templates with syntax errors", func() {
+		_, err := ParseNoteTemplates(&NoteTemplatesConfig{LongDescription: "{{ .Default"})
+
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should reject unknown related urls", func() {
+		_, err := ParseNoteTemplates(&NoteTemplatesConfig{RelatedUrlLabels: map[string]string{"wiki": "Wiki"}})
+
+		Expect(err).To(MatchError(ContainSubstring(`unknown related url "wiki"`)))
+	})
+
+	Context("LoadNoteTemplates", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "templates")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		write := func(contents string) string {
+			path := filepath.Join(dir, "templates.json")
+			Expect(ioutil.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+
+			return path
+		}
+
+		It("should read and parse templates from a file", func() {
+			templates, err := LoadNoteTemplates(write(`{"shortDescription": "{{ .Event.Project.Name }}"}`))
+			Expect(err).ToNot(HaveOccurred())
+
+			text, err := templates.render("shortDescription", analysis, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(text).To(Equal("Payment API"))
+		})
+
+		It("should reject unknown fields", func() {
+			_, err := LoadNoteTemplates(write(`{"description": "{{ .Default }}"}`))
+
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should name the file in parse errors", func() {
+			path := write(`{"noteId": "{{ .Event.TaskId"}`)
+
+			_, err := LoadNoteTemplates(path)
+
+			Expect(err).To(MatchError(ContainSubstring(path)))
+		})
+	})
+})
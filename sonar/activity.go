@@ -0,0 +1,325 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonar
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// activityPageSize is the largest page size that api/ce/activity allows
+	activityPageSize = 1000
+	// analysesPageSize and maxAnalysesPages bound the search for the analysis produced by a task. The analysis is
+	// almost always on the first page, since analyses are listed newest first.
+	analysesPageSize = 100
+	maxAnalysesPages = 10
+)
+
+// ActivityQuery filters the compute engine tasks returned by ListActivity.
+type ActivityQuery struct {
+	// Component is the key of a project to list tasks for. All projects are included when it's empty.
+	Component string
+	// MinSubmittedAt excludes tasks that were submitted earlier.
+	MinSubmittedAt time.Time
+	// Statuses excludes tasks with other statuses.
+	Statuses []EventStatus
+}
+
+// ProjectAnalysis is an analysis, as returned by api/project_analyses/search.
+type ProjectAnalysis struct {
+	Key            string `json:"key"`
+	Date           string `json:"date"`
+	ProjectVersion string `json:"projectVersion"`
+	Revision       string `json:"revision"`
+}
+
+type paging struct {
+	PageIndex int `json:"pageIndex"`
+	PageSize  int `json:"pageSize"`
+	Total     int `json:"total"`
+}
+
+// ListActivity returns the analysis report tasks that match the query, newest first.
+func (c *client) ListActivity(ctx context.Context, query *ActivityQuery) ([]*Task, error) {
+	params := url.Values{
+		"type": {"REPORT"},
+		"ps":   {strconv.Itoa(activityPageSize)},
+	}
+	if query.Component != "" {
+		params.Set("component", query.Component)
+	}
+	if !query.MinSubmittedAt.IsZero() {
+		params.Set("minSubmittedAt", query.MinSubmittedAt.Format("2006-01-02T15:04:05-0700"))
+	}
+	if len(query.Statuses) > 0 {
+		var statuses []string
+		for _, status := range query.Statuses {
+			statuses = append(statuses, string(status))
+		}
+		params.Set("status", strings.Join(statuses, ","))
+	}
+
+	var tasks []*Task
+	for page := 1; ; page++ {
+		params.Set("p", strconv.Itoa(page))
+
+		response := struct {
+			Tasks  []*Task `json:"tasks"`
+			Paging *paging `json:"paging"`
+		}{}
+		if err := c.get(ctx, "api/ce/activity", params, &response); err != nil {
+			return nil, err
+		}
+
+		tasks = append(tasks, response.Tasks...)
+		// older versions of SonarQube don't page activity
+		if response.Paging == nil || len(response.Tasks) == 0 || len(tasks) >= response.Paging.Total {
+			return tasks, nil
+		}
+	}
+}
+
+// GetAnalysis returns the analysis that was produced by the task.
+func (c *client) GetAnalysis(ctx context.Context, task *Task) (*ProjectAnalysis, error) {
+	if task.AnalysisId == "" {
+		return nil, fmt.Errorf("task %s did not produce an analysis", task.Id)
+	}
+
+	params := url.Values{
+		"project": {task.ComponentKey},
+		"ps":      {strconv.Itoa(analysesPageSize)},
+	}
+	switch {
+	case task.PullRequest != "":
+		params.Set("pullRequest", task.PullRequest)
+	case task.Branch != "":
+		params.Set("branch", task.Branch)
+	}
+
+	for page := 1; page <= maxAnalysesPages; page++ {
+		params.Set("p", strconv.Itoa(page))
+
+		response := struct {
+			Analyses []*ProjectAnalysis `json:"analyses"`
+		}{}
+		if err := c.get(ctx, "api/project_analyses/search", params, &response); err != nil {
+			return nil, err
+		}
+
+		for _, analysis := range response.Analyses {
+			if analysis.Key == task.AnalysisId {
+				return analysis, nil
+			}
+		}
+
+		if len(response.Analyses) < analysesPageSize {
+			break
+		}
+	}
+
+	return nil, fmt.Errorf("analysis %s of project %s not found", task.AnalysisId, task.ComponentKey)
+}
+
+// projectStatusCondition is a quality gate condition, as returned by api/qualitygates/project_status. The fields differ
+// from the conditions in webhook payloads.
+type projectStatusCondition struct {
+	Status           ConditionStatus `json:"status"`
+	MetricKey        string          `json:"metricKey"`
+	Comparator       string          `json:"comparator"`
+	PeriodIndex      int             `json:"periodIndex"`
+	ErrorThreshold   string          `json:"errorThreshold"`
+	WarningThreshold string          `json:"warningThreshold"`
+	ActualValue      string          `json:"actualValue"`
+}
+
+var comparatorOperators = map[string]ConditionOperator{
+	"GT": OPERATOR_GREATER_THAN,
+	"LT": OPERATOR_LESS_THAN,
+	"EQ": OPERATOR_EQUALS,
+	"NE": OPERATOR_NOT_EQUALS,
+}
+
+// GetQualityGate returns the result of the quality gate that was evaluated against the analysis, in the same form as a
+// webhook payload. The name of the gate is looked up separately, and is left empty if it can't be.
+func (c *client) GetQualityGate(ctx context.Context, projectKey, analysisId string) (*QualityGate, error) {
+	response := struct {
+		ProjectStatus struct {
+			Status     EventStatus               `json:"status"`
+			Conditions []*projectStatusCondition `json:"conditions"`
+		} `json:"projectStatus"`
+	}{}
+	if err := c.get(ctx, "api/qualitygates/project_status", url.Values{"analysisId": {analysisId}}, &response); err != nil {
+		return nil, err
+	}
+
+	gate := &QualityGate{
+		Status: response.ProjectStatus.Status,
+	}
+	for _, condition := range response.ProjectStatus.Conditions {
+		operator, ok := comparatorOperators[condition.Comparator]
+		if !ok {
+			operator = ConditionOperator(condition.Comparator)
+		}
+
+		gate.Conditions = append(gate.Conditions, &Condition{
+			ErrorThreshold:   condition.ErrorThreshold,
+			WarningThreshold: condition.WarningThreshold,
+			Metric:           condition.MetricKey,
+			OnLeakPeriod:     condition.PeriodIndex > 0 || strings.HasPrefix(condition.MetricKey, "new_"),
+			Operator:         operator,
+			Status:           condition.Status,
+			Value:            condition.ActualValue,
+		})
+	}
+
+	params := url.Values{"project": {projectKey}}
+	if c.organization != "" {
+		params.Set("organization", c.organization)
+	}
+
+	byProject := struct {
+		QualityGate struct {
+			Name string `json:"name"`
+		} `json:"qualityGate"`
+	}{}
+	if err := c.get(ctx, "api/qualitygates/get_by_project", params, &byProject); err == nil {
+		gate.Name = byProject.QualityGate.Name
+	}
+
+	return gate, nil
+}
+
+// GetScannerContext returns the "sonar.analysis.*" properties that the scanner was run with, which are the same
+// properties that are included in webhook payloads. SonarQube only keeps the scanner context of recent tasks.
+func (c *client) GetScannerContext(ctx context.Context, taskId string) (map[string]string, error) {
+	response := struct {
+		Task *struct {
+			ScannerContext string `json:"scannerContext"`
+		} `json:"task"`
+	}{}
+	query := url.Values{"id": {taskId}, "additionalFields": {"scannerContext"}}
+	if err := c.get(ctx, "api/ce/task", query, &response); err != nil {
+		return nil, err
+	}
+
+	if response.Task == nil {
+		return nil, fmt.Errorf("task %s not found", taskId)
+	}
+
+	return parseScannerContext(response.Task.ScannerContext), nil
+}
+
+// EventForTask builds the event that a webhook would have sent for a finished compute engine task, for instances that
+// can't reach the collector. Tasks that failed or were canceled don't produce an analysis, so their events only include
+// the project, branch and scanner properties.
+func EventForTask(ctx context.Context, client Client, serverUrl string, task *Task) (*Event, error) {
+	serverUrl = strings.TrimSuffix(serverUrl, "/")
+	event := &Event{
+		ServerUrl:  serverUrl,
+		TaskId:     task.Id,
+		Status:     task.Status,
+		AnalysedAt: task.ExecutedAt,
+		Project: &Project{
+			Key:  task.ComponentKey,
+			Name: task.ComponentName,
+			URL:  fmt.Sprintf("%s/dashboard?%s", serverUrl, url.Values{"id": {task.ComponentKey}}.Encode()),
+		},
+	}
+
+	switch {
+	case task.PullRequest != "":
+		event.Branch = &Branch{
+			Name: task.PullRequest,
+			Type: BRANCH_TYPE_PULL_REQUEST,
+			URL:  fmt.Sprintf("%s/dashboard?%s", serverUrl, url.Values{"id": {task.ComponentKey}, "pullRequest": {task.PullRequest}}.Encode()),
+		}
+	case task.Branch != "":
+		event.Branch = &Branch{
+			Name: task.Branch,
+			Type: task.BranchType,
+			URL:  fmt.Sprintf("%s/dashboard?%s", serverUrl, url.Values{"id": {task.ComponentKey}, "branch": {task.Branch}}.Encode()),
+		}
+	}
+
+	properties, err := client.GetScannerContext(ctx, task.Id)
+	if err != nil {
+		return nil, fmt.Errorf("error getting scanner context: %v", err)
+	}
+	event.Properties = properties
+
+	if task.Status != STATUS_SUCCESS || task.AnalysisId == "" {
+		return event, nil
+	}
+
+	analysis, err := client.GetAnalysis(ctx, task)
+	if err != nil {
+		return nil, fmt.Errorf("error getting analysis: %v", err)
+	}
+	event.Revision = analysis.Revision
+	if analysis.Date != "" {
+		event.AnalysedAt = analysis.Date
+	}
+
+	event.QualityGate, err = client.GetQualityGate(ctx, task.ComponentKey, task.AnalysisId)
+	if err != nil {
+		return nil, fmt.Errorf("error getting quality gate status: %v", err)
+	}
+
+	return event, nil
+}
+
+// parseScannerContext reads the analysis properties from the "Project scanner properties" section of the scanner context:
+//
+//	Project scanner properties:
+//	  - sonar.analysis.resourceUriPrefix=github.com/rode/collector-sonarqube
+//	  - sonar.host.url=https://sonar.example.com
+func parseScannerContext(scannerContext string) map[string]string {
+	properties := map[string]string{}
+	inScannerProperties := false
+
+	scanner := bufio.NewScanner(strings.NewReader(scannerContext))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, " ") {
+			inScannerProperties = strings.TrimSpace(line) == "Project scanner properties:"
+			continue
+		}
+
+		entry := strings.TrimPrefix(strings.TrimSpace(line), "- ")
+		name, value, found := cut(entry, "=")
+		if !inScannerProperties || !found || !strings.HasPrefix(name, analysisPropertyPrefix) {
+			continue
+		}
+
+		properties[name] = value
+	}
+
+	return properties
+}
+
+// cut is strings.Cut, which isn't available in the version of Go that the collector is built with.
+func cut(s, separator string) (string, string, bool) {
+	if i := strings.Index(s, separator); i >= 0 {
+		return s[:i], s[i+len(separator):], true
+	}
+
+	return s, "", false
+}
@@ -0,0 +1,273 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonar
+
+import (
+	"context"
+	"fmt"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientListActivity(t *testing.T) {
+	Expect := NewGomegaWithT(t).Expect
+
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		_, _ = fmt.Fprintf(w, `{"tasks":[{"id":"task-%s","componentKey":"my-project","status":"SUCCESS"}],"paging":{"pageIndex":%[1]s,"pageSize":1,"total":2}}`, r.URL.Query().Get("p"))
+	}))
+	defer server.Close()
+
+	minSubmittedAt := time.Date(2021, 5, 27, 19, 8, 23, 0, time.UTC)
+	tasks, err := NewClient(server.Client(), server.URL, "token").ListActivity(context.Background(), &ActivityQuery{
+		Component:      "my-project",
+		MinSubmittedAt: minSubmittedAt,
+		Statuses:       []EventStatus{STATUS_SUCCESS, STATUS_FAILED},
+	})
+
+	Expect(err).ToNot(HaveOccurred())
+	Expect(tasks).To(HaveLen(2))
+	Expect(tasks[0].Id).To(Equal("task-1"))
+	Expect(tasks[1].Id).To(Equal("task-2"))
+
+	Expect(requests).To(HaveLen(2))
+	query := requests[0].URL.Query()
+	Expect(requests[0].URL.Path).To(Equal("/api/ce/activity"))
+	Expect(query.Get("type")).To(Equal("REPORT"))
+	Expect(query.Get("component")).To(Equal("my-project"))
+	Expect(query.Get("minSubmittedAt")).To(Equal("2021-05-27T19:08:23+0000"))
+	Expect(query.Get("status")).To(Equal("SUCCESS,FAILED"))
+}
+
+func TestClientGetAnalysis(t *testing.T) {
+	Expect := NewGomegaWithT(t).Expect
+
+	for _, tc := range []struct {
+		name          string
+		task          *Task
+		body          string
+		expectedQuery map[string]string
+		expected      *ProjectAnalysis
+		expectedError string
+	}{
+		{
+			name: "branch analysis",
+			task: &Task{Id: "task", ComponentKey: "my-project", AnalysisId: "AXmv", Branch: "feature"},
+			body: `{"analyses":[{"key":"AXmw","revision":"other"},{"key":"AXmv","date":"2021-05-27T19:08:23+0000","revision":"abc123"}]}`,
+			expectedQuery: map[string]string{
+				"project": "my-project",
+				"branch":  "feature",
+			},
+			expected: &ProjectAnalysis{Key: "AXmv", Date: "2021-05-27T19:08:23+0000", Revision: "abc123"},
+		},
+		{
+			name: "pull request analysis",
+			task: &Task{Id: "task", ComponentKey: "my-project", AnalysisId: "AXmv", Branch: "feature", PullRequest: "12"},
+			body: `{"analyses":[{"key":"AXmv","revision":"abc123"}]}`,
+			expectedQuery: map[string]string{
+				"project":     "my-project",
+				"pullRequest": "12",
+				"branch":      "",
+			},
+			expected: &ProjectAnalysis{Key: "AXmv", Revision: "abc123"},
+		},
+		{
+			name:          "analysis not found",
+			task:          &Task{Id: "task", ComponentKey: "my-project", AnalysisId: "AXmv"},
+			body:          `{"analyses":[]}`,
+			expectedError: "analysis AXmv of project my-project not found",
+		},
+		{
+			name:          "task without analysis",
+			task:          &Task{Id: "task", ComponentKey: "my-project"},
+			expectedError: "task task did not produce an analysis",
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			var request *http.Request
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				request = r
+				_, _ = w.Write([]byte(tc.body))
+			}))
+			defer server.Close()
+
+			analysis, err := NewClient(server.Client(), server.URL, "token").GetAnalysis(context.Background(), tc.task)
+
+			if tc.expectedError != "" {
+				Expect(err).To(MatchError(tc.expectedError))
+				return
+			}
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(analysis).To(Equal(tc.expected))
+			Expect(request.URL.Path).To(Equal("/api/project_analyses/search"))
+			for name, value := range tc.expectedQuery {
+				Expect(request.URL.Query().Get(name)).To(Equal(value))
+			}
+		})
+	}
+}
+
+func TestCloudClientGetQualityGate(t *testing.T) {
+	Expect := NewGomegaWithT(t).Expect
+
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		switch r.URL.Path {
+		case "/api/qualitygates/project_status":
+			_, _ = w.Write([]byte(`{"projectStatus":{"status":"ERROR","conditions":[
+				{"status":"ERROR","metricKey":"new_coverage","comparator":"LT","periodIndex":1,"errorThreshold":"80","actualValue":"72.5"},
+				{"status":"OK","metricKey":"bugs","comparator":"GT","errorThreshold":"0","actualValue":"0"}
+			]}}`))
+		case "/api/qualitygates/get_by_project":
+			_, _ = w.Write([]byte(`{"qualityGate":{"id":"1","name":"Sonar way","default":true}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	gate, err := NewCloudClient(server.Client(), server.URL, "token", "rode").GetQualityGate(context.Background(), "my-project", "AXmv")
+
+	Expect(err).ToNot(HaveOccurred())
+	Expect(gate).To(Equal(&QualityGate{
+		Name:   "Sonar way",
+		Status: STATUS_ERROR,
+		Conditions: []*Condition{
+			{
+				ErrorThreshold: "80",
+				Metric:         "new_coverage",
+				OnLeakPeriod:   true,
+				Operator:       OPERATOR_LESS_THAN,
+				Status:         CONDITION_STATUS_ERROR,
+				Value:          "72.5",
+			},
+			{
+				ErrorThreshold: "0",
+				Metric:         "bugs",
+				Operator:       OPERATOR_GREATER_THAN,
+				Status:         CONDITION_STATUS_OK,
+				Value:          "0",
+			},
+		},
+	}))
+	Expect(requests).To(HaveLen(2))
+	Expect(requests[0].URL.Query().Get("analysisId")).To(Equal("AXmv"))
+	Expect(requests[1].URL.Query().Get("project")).To(Equal("my-project"))
+	Expect(requests[1].URL.Query().Get("organization")).To(Equal("rode"))
+}
+
+func TestClientGetScannerContext(t *testing.T) {
+	Expect := NewGomegaWithT(t).Expect
+
+	var request *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		_, _ = w.Write([]byte(`{"task":{"id":"AXmu","scannerContext":"SonarQube plugins:\n  - Java 6.15 (java)\nGlobal server settings:\n  - sonar.analysis.ignored=true\nProject scanner properties:\n  - sonar.analysis.resourceUriPrefix=github.com/rode/collector-sonarqube\n  - sonar.analysis.expression=a=b\n  - sonar.host.url=https://sonar.example.com\n  - sonar.projectKey=my-project\n"}}`))
+	}))
+	defer server.Close()
+
+	properties, err := NewClient(server.Client(), server.URL, "token").GetScannerContext(context.Background(), "AXmu")
+
+	Expect(err).ToNot(HaveOccurred())
+	Expect(properties).To(Equal(map[string]string{
+		"sonar.analysis.resourceUriPrefix": "github.com/rode/collector-sonarqube",
+		"sonar.analysis.expression":        "a=b",
+	}))
+	Expect(request.URL.Path).To(Equal("/api/ce/task"))
+	Expect(request.URL.Query().Get("id")).To(Equal("AXmu"))
+	Expect(request.URL.Query().Get("additionalFields")).To(Equal("scannerContext"))
+}
+
+type fakeActivityClient struct {
+	Client
+
+	properties map[string]string
+	analysis   *ProjectAnalysis
+	gate       *QualityGate
+}
+
+func (f *fakeActivityClient) GetScannerContext(context.Context, string) (map[string]string, error) {
+	return f.properties, nil
+}
+
+func (f *fakeActivityClient) GetAnalysis(context.Context, *Task) (*ProjectAnalysis, error) {
+	return f.analysis, nil
+}
+
+func (f *fakeActivityClient) GetQualityGate(context.Context, string, string) (*QualityGate, error) {
+	return f.gate, nil
+}
+
+func TestEventForTask(t *testing.T) {
+	Expect := NewGomegaWithT(t).Expect
+
+	client := &fakeActivityClient{
+		properties: map[string]string{"sonar.analysis.resourceUriPrefix": "github.com/rode/collector-sonarqube"},
+		analysis:   &ProjectAnalysis{Key: "AXmv", Date: "2021-05-27T19:08:20+0000", Revision: "abc123"},
+		gate:       &QualityGate{Name: "Sonar way", Status: STATUS_OK},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		task     *Task
+		expected *Event
+	}{
+		{
+			name: "successful branch analysis",
+			task: &Task{Id: "AXmu", ComponentKey: "my-project", ComponentName: "My Project", Status: STATUS_SUCCESS, ExecutedAt: "2021-05-27T19:08:23+0000", AnalysisId: "AXmv", Branch: "feature", BranchType: BRANCH_TYPE_BRANCH},
+			expected: &Event{
+				ServerUrl:   "https://sonar.example.com",
+				TaskId:      "AXmu",
+				Status:      STATUS_SUCCESS,
+				AnalysedAt:  "2021-05-27T19:08:20+0000",
+				Revision:    "abc123",
+				Project:     &Project{Key: "my-project", Name: "My Project", URL: "https://sonar.example.com/dashboard?id=my-project"},
+				QualityGate: client.gate,
+				Branch:      &Branch{Name: "feature", Type: BRANCH_TYPE_BRANCH, URL: "https://sonar.example.com/dashboard?branch=feature&id=my-project"},
+				Properties:  client.properties,
+			},
+		},
+		{
+			name: "failed pull request analysis",
+			task: &Task{Id: "AXmu", ComponentKey: "my-project", Status: STATUS_FAILED, ExecutedAt: "2021-05-27T19:08:23+0000", PullRequest: "12"},
+			expected: &Event{
+				ServerUrl:  "https://sonar.example.com",
+				TaskId:     "AXmu",
+				Status:     STATUS_FAILED,
+				AnalysedAt: "2021-05-27T19:08:23+0000",
+				Project:    &Project{Key: "my-project", URL: "https://sonar.example.com/dashboard?id=my-project"},
+				Branch:     &Branch{Name: "12", Type: BRANCH_TYPE_PULL_REQUEST, URL: "https://sonar.example.com/dashboard?id=my-project&pullRequest=12"},
+				Properties: client.properties,
+			},
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			event, err := EventForTask(context.Background(), client, "https://sonar.example.com/", tc.task)
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(event).To(Equal(tc.expected))
+		})
+	}
+}
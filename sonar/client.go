@@ -0,0 +1,213 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonar
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Flavor distinguishes self-hosted SonarQube from SonarCloud, whose web APIs differ.
+type Flavor string
+
+const (
+	FLAVOR_SONARQUBE  Flavor = "sonarqube"
+	FLAVOR_SONARCLOUD Flavor = "sonarcloud"
+)
+
+// SonarCloudUrl is the base URL of SonarCloud's web API.
+const SonarCloudUrl = "https://sonarcloud.io"
+
+// Client is used to read from the SonarQube web API.
+type Client interface {
+	GetTask(ctx context.Context, id string) (*Task, error)
+	GetProjectBinding(ctx context.Context, projectKey string) (*ProjectBinding, error)
+	ListActivity(ctx context.Context, query *ActivityQuery) ([]*Task, error)
+	GetAnalysis(ctx context.Context, task *Task) (*ProjectAnalysis, error)
+	GetQualityGate(ctx context.Context, projectKey, analysisId string) (*QualityGate, error)
+	GetScannerContext(ctx context.Context, taskId string) (map[string]string, error)
+	GetProjectTags(ctx context.Context, projectKey string) ([]string, error)
+}
+
+// Task is a compute engine task, as returned by api/ce/task.
+type Task struct {
+	Id            string      `json:"id"`
+	Type          string      `json:"type"`
+	ComponentKey  string      `json:"componentKey"`
+	ComponentName string      `json:"componentName"`
+	Status        EventStatus `json:"status"`
+	SubmittedAt   string      `json:"submittedAt"`
+	StartedAt     string      `json:"startedAt"`
+	ExecutedAt    string      `json:"executedAt"`
+	AnalysisId    string      `json:"analysisId"`
+	Branch        string      `json:"branch"`
+	BranchType    string      `json:"branchType"`
+	PullRequest   string      `json:"pullRequest"`
+	ErrorMessage  string      `json:"errorMessage"`
+}
+
+// ProjectBinding is the repository that a project is bound to in its ALM (GitHub, Bitbucket, Azure DevOps or GitLab).
+type ProjectBinding struct {
+	Alm string `json:"key"`
+	// Url is the web URL of the repository, e.g. "https://github.com/rode/collector-sonarqube"
+	Url string `json:"url"`
+}
+
+// ResourceUriPrefix returns the git resource uri prefix for the bound repository, e.g.
+// "git://github.com/rode/collector-sonarqube".
+func (b *ProjectBinding) ResourceUriPrefix() (string, error) {
+	u, err := url.Parse(b.Url)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("unable to parse %s repository url %q", b.Alm, b.Url)
+	}
+
+	path := strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), ".git")
+
+	return fmt.Sprintf("git://%s%s", u.Host, path), nil
+}
+
+type client struct {
+	baseUrl      string
+	token        string
+	flavor       Flavor
+	organization string
+	httpClient   *http.Client
+}
+
+// NewClient returns a client for the SonarQube instance at baseUrl. The token is optional, but most instances require
+// authentication to read task details.
+func NewClient(httpClient *http.Client, baseUrl, token string) Client {
+	return &client{
+		baseUrl:    strings.TrimSuffix(baseUrl, "/"),
+		token:      token,
+		flavor:     FLAVOR_SONARQUBE,
+		httpClient: httpClient,
+	}
+}
+
+// NewCloudClient returns a client for SonarCloud. Projects are looked up within the given organization.
+func NewCloudClient(httpClient *http.Client, baseUrl, token, organization string) Client {
+	return &client{
+		baseUrl:      strings.TrimSuffix(baseUrl, "/"),
+		token:        token,
+		flavor:       FLAVOR_SONARCLOUD,
+		organization: organization,
+		httpClient:   httpClient,
+	}
+}
+
+func (c *client) GetTask(ctx context.Context, id string) (*Task, error) {
+	response := struct {
+		Task *Task `json:"task"`
+	}{}
+
+	if err := c.get(ctx, "api/ce/task", url.Values{"id": {id}}, &response); err != nil {
+		return nil, err
+	}
+
+	if response.Task == nil {
+		return nil, fmt.Errorf("task %s not found", id)
+	}
+
+	return response.Task, nil
+}
+
+// GetProjectBinding returns the repository that the project is bound to. Bindings are only exposed by SonarCloud; the
+// equivalent SonarQube API doesn't include enough detail to locate the repository, so nil is returned for self-hosted
+// instances without making a request.
+func (c *client) GetProjectBinding(ctx context.Context, projectKey string) (*ProjectBinding, error) {
+	if c.flavor != FLAVOR_SONARCLOUD {
+		return nil, nil
+	}
+
+	query := url.Values{"component": {projectKey}}
+	if c.organization != "" {
+		query.Set("organization", c.organization)
+	}
+
+	response := struct {
+		Alm *ProjectBinding `json:"alm"`
+	}{}
+
+	if err := c.get(ctx, "api/navigation/component", query, &response); err != nil {
+		return nil, err
+	}
+
+	if response.Alm == nil || response.Alm.Url == "" {
+		return nil, fmt.Errorf("project %s is not bound to a repository", projectKey)
+	}
+
+	return response.Alm, nil
+}
+
+// GetProjectTags returns the tags that have been applied to the project.
+func (c *client) GetProjectTags(ctx context.Context, projectKey string) ([]string, error) {
+	response := struct {
+		Component struct {
+			Tags []string `json:"tags"`
+		} `json:"component"`
+	}{}
+
+	if err := c.get(ctx, "api/components/show", url.Values{"component": {projectKey}}, &response); err != nil {
+		return nil, err
+	}
+
+	return response.Component.Tags, nil
+}
+
+// apiError is the body that SonarQube responds with when a request fails.
+type apiError struct {
+	Errors []struct {
+		Msg string `json:"msg"`
+	} `json:"errors"`
+}
+
+func (c *client) get(ctx context.Context, path string, query url.Values, target interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/%s?%s", c.baseUrl, path, query.Encode()), nil)
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Accept", "application/json")
+	switch {
+	case c.token == "":
+	case c.flavor == FLAVOR_SONARCLOUD:
+		request.Header.Set("Authorization", "Bearer "+c.token)
+	default:
+		// tokens are sent as the username, with an empty password
+		request.SetBasicAuth(c.token, "")
+	}
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		body := &apiError{}
+		if err := json.NewDecoder(response.Body).Decode(body); err == nil && len(body.Errors) > 0 {
+			return fmt.Errorf("error calling %s: %s: %s", path, response.Status, body.Errors[0].Msg)
+		}
+
+		return fmt.Errorf("error calling %s: %s", path, response.Status)
+	}
+
+	return json.NewDecoder(response.Body).Decode(target)
+}
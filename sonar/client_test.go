@@ -0,0 +1,210 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonar
+
+import (
+	"context"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientGetTask(t *testing.T) {
+	Expect := NewGomegaWithT(t).Expect
+
+	for _, tc := range []struct {
+		name          string
+		status        int
+		body          string
+		expected      *Task
+		expectedError string
+	}{
+		{
+			name:   "task found",
+			status: http.StatusOK,
+			body:   `{"task":{"id":"AXmu","componentKey":"my-project","status":"SUCCESS","executedAt":"2021-05-27T19:08:23+0000"}}`,
+			expected: &Task{
+				Id:           "AXmu",
+				ComponentKey: "my-project",
+				Status:       STATUS_SUCCESS,
+				ExecutedAt:   "2021-05-27T19:08:23+0000",
+			},
+		},
+		{
+			name:          "sonar error",
+			status:        http.StatusNotFound,
+			body:          `{"errors":[{"msg":"No activity found for task 'AXmu'"}]}`,
+			expectedError: "No activity found for task 'AXmu'",
+		},
+		{
+			name:          "unexpected response",
+			status:        http.StatusBadGateway,
+			body:          "bad gateway",
+			expectedError: "502 Bad Gateway",
+		},
+		{
+			name:          "missing task",
+			status:        http.StatusOK,
+			body:          `{}`,
+			expectedError: "task AXmu not found",
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			var request *http.Request
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				request = r
+				w.WriteHeader(tc.status)
+				_, _ = w.Write([]byte(tc.body))
+			}))
+			defer server.Close()
+
+			task, err := NewClient(server.Client(), server.URL+"/", "token").GetTask(context.Background(), "AXmu")
+
+			Expect(request.URL.Path).To(Equal("/api/ce/task"))
+			Expect(request.URL.Query().Get("id")).To(Equal("AXmu"))
+			username, password, ok := request.BasicAuth()
+			Expect(ok).To(BeTrue())
+			Expect(username).To(Equal("token"))
+			Expect(password).To(BeEmpty())
+
+			if tc.expectedError != "" {
+				Expect(err).To(MatchError(ContainSubstring(tc.expectedError)))
+			} else {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(task).To(Equal(tc.expected))
+			}
+		})
+	}
+}
+
+func TestCloudClientGetProjectBinding(t *testing.T) {
+	Expect := NewGomegaWithT(t).Expect
+
+	var request *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		_, _ = w.Write([]byte(`{"organization":"rode","key":"rode_collector","alm":{"key":"github","url":"https://github.com/rode/collector-sonarqube"}}`))
+	}))
+	defer server.Close()
+
+	binding, err := NewCloudClient(server.Client(), server.URL, "token", "rode").GetProjectBinding(context.Background(), "rode_collector")
+
+	Expect(err).ToNot(HaveOccurred())
+	Expect(binding).To(Equal(&ProjectBinding{Alm: "github", Url: "https://github.com/rode/collector-sonarqube"}))
+	Expect(request.URL.Path).To(Equal("/api/navigation/component"))
+	Expect(request.URL.Query().Get("component")).To(Equal("rode_collector"))
+	Expect(request.URL.Query().Get("organization")).To(Equal("rode"))
+	Expect(request.Header.Get("Authorization")).To(Equal("Bearer token"))
+}
+
+func TestCloudClientGetProjectBindingUnbound(t *testing.T) {
+	Expect := NewGomegaWithT(t).Expect
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"organization":"rode","key":"rode_collector"}`))
+	}))
+	defer server.Close()
+
+	_, err := NewCloudClient(server.Client(), server.URL, "token", "rode").GetProjectBinding(context.Background(), "rode_collector")
+
+	Expect(err).To(MatchError("project rode_collector is not bound to a repository"))
+}
+
+func TestClientGetProjectBindingSelfHosted(t *testing.T) {
+	Expect := NewGomegaWithT(t).Expect
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	binding, err := NewClient(server.Client(), server.URL, "").GetProjectBinding(context.Background(), "foo")
+
+	Expect(err).ToNot(HaveOccurred())
+	Expect(binding).To(BeNil())
+}
+
+func TestClientGetProjectTags(t *testing.T) {
+	Expect := NewGomegaWithT(t).Expect
+
+	var request *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		_, _ = w.Write([]byte(`{"component":{"key":"my-project","name":"My Project","qualifier":"TRK","tags":["sandbox","team-a"]}}`))
+	}))
+	defer server.Close()
+
+	tags, err := NewClient(server.Client(), server.URL, "token").GetProjectTags(context.Background(), "my-project")
+
+	Expect(err).ToNot(HaveOccurred())
+	Expect(tags).To(Equal([]string{"sandbox", "team-a"}))
+	Expect(request.URL.Path).To(Equal("/api/components/show"))
+	Expect(request.URL.Query().Get("component")).To(Equal("my-project"))
+}
+
+func TestProjectBindingResourceUriPrefix(t *testing.T) {
+	Expect := NewGomegaWithT(t).Expect
+
+	for _, tc := range []struct {
+		name        string
+		binding     *ProjectBinding
+		expected    string
+		expectError bool
+	}{
+		{
+			name:     "github",
+			binding:  &ProjectBinding{Alm: "github", Url: "https://github.com/rode/collector-sonarqube"},
+			expected: "git://github.com/rode/collector-sonarqube",
+		},
+		{
+			name:     "bitbucket cloud",
+			binding:  &ProjectBinding{Alm: "bitbucketcloud", Url: "https://bitbucket.org/rode/collector-sonarqube/"},
+			expected: "git://bitbucket.org/rode/collector-sonarqube",
+		},
+		{
+			name:     "azure devops",
+			binding:  &ProjectBinding{Alm: "azure", Url: "https://dev.azure.com/rode/collectors/_git/collector-sonarqube"},
+			expected: "git://dev.azure.com/rode/collectors/_git/collector-sonarqube",
+		},
+		{
+			name:     "clone url",
+			binding:  &ProjectBinding{Alm: "gitlab", Url: "https://gitlab.com/rode/collector-sonarqube.git"},
+			expected: "git://gitlab.com/rode/collector-sonarqube",
+		},
+		{
+			name:        "invalid url",
+			binding:     &ProjectBinding{Alm: "github", Url: "collector-sonarqube"},
+			expectError: true,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			actual, err := tc.binding.ResourceUriPrefix()
+
+			if tc.expectError {
+				Expect(err).To(HaveOccurred())
+			} else {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(actual).To(Equal(tc.expected))
+			}
+		})
+	}
+}
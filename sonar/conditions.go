@@ -0,0 +1,219 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonar
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ConditionStatus is the result of evaluating a single quality gate condition.
+type ConditionStatus string
+
+const (
+	CONDITION_STATUS_OK       ConditionStatus = "OK"
+	CONDITION_STATUS_WARN     ConditionStatus = "WARN"
+	CONDITION_STATUS_ERROR    ConditionStatus = "ERROR"
+	CONDITION_STATUS_NO_VALUE ConditionStatus = "NO_VALUE"
+)
+
+// ConditionOperator is the comparison used to evaluate a metric against a condition's thresholds.
+type ConditionOperator string
+
+const (
+	OPERATOR_GREATER_THAN ConditionOperator = "GREATER_THAN"
+	OPERATOR_LESS_THAN    ConditionOperator = "LESS_THAN"
+	// older versions of SonarQube also allow equality conditions
+	OPERATOR_EQUALS     ConditionOperator = "EQUALS"
+	OPERATOR_NOT_EQUALS ConditionOperator = "NOT_EQUALS"
+)
+
+func (o ConditionOperator) String() string {
+	switch o {
+	case OPERATOR_GREATER_THAN:
+		return "greater than"
+	case OPERATOR_LESS_THAN:
+		return "less than"
+	case OPERATOR_EQUALS:
+		return "equal to"
+	case OPERATOR_NOT_EQUALS:
+		return "not equal to"
+	}
+
+	return strings.ToLower(string(o))
+}
+
+// MetricType determines how condition thresholds and values should be interpreted. Webhook payloads don't include the
+// metric type, so it's inferred from the metric key.
+type MetricType string
+
+const (
+	METRIC_TYPE_INT      MetricType = "INT"
+	METRIC_TYPE_FLOAT    MetricType = "FLOAT"
+	METRIC_TYPE_PERCENT  MetricType = "PERCENT"
+	METRIC_TYPE_RATING   MetricType = "RATING"
+	METRIC_TYPE_WORK_DUR MetricType = "WORK_DUR"
+	METRIC_TYPE_LEVEL    MetricType = "LEVEL"
+)
+
+var knownMetricTypes = map[string]MetricType{
+	"alert_status":                             METRIC_TYPE_LEVEL,
+	"coverage":                                 METRIC_TYPE_PERCENT,
+	"line_coverage":                            METRIC_TYPE_PERCENT,
+	"branch_coverage":                          METRIC_TYPE_PERCENT,
+	"duplicated_lines_density":                 METRIC_TYPE_PERCENT,
+	"comment_lines_density":                    METRIC_TYPE_PERCENT,
+	"sqale_debt_ratio":                         METRIC_TYPE_PERCENT,
+	"security_hotspots_reviewed":               METRIC_TYPE_PERCENT,
+	"sqale_index":                              METRIC_TYPE_WORK_DUR,
+	"technical_debt":                           METRIC_TYPE_WORK_DUR,
+	"reliability_remediation_effort":           METRIC_TYPE_WORK_DUR,
+	"security_remediation_effort":              METRIC_TYPE_WORK_DUR,
+	"effort_to_reach_maintainability_rating_a": METRIC_TYPE_WORK_DUR,
+	"maintainability_rating":                   METRIC_TYPE_RATING,
+	"sqale_rating":                             METRIC_TYPE_RATING,
+	"reliability_rating":                       METRIC_TYPE_RATING,
+	"security_rating":                          METRIC_TYPE_RATING,
+	"security_review_rating":                   METRIC_TYPE_RATING,
+	"complexity":                               METRIC_TYPE_INT,
+	"cognitive_complexity":                     METRIC_TYPE_INT,
+	"lines":                                    METRIC_TYPE_INT,
+	"ncloc":                                    METRIC_TYPE_INT,
+	"bugs":                                     METRIC_TYPE_INT,
+	"vulnerabilities":                          METRIC_TYPE_INT,
+	"code_smells":                              METRIC_TYPE_INT,
+	"security_hotspots":                        METRIC_TYPE_INT,
+	"violations":                               METRIC_TYPE_INT,
+	"blocker_violations":                       METRIC_TYPE_INT,
+	"critical_violations":                      METRIC_TYPE_INT,
+	"major_violations":                         METRIC_TYPE_INT,
+	"minor_violations":                         METRIC_TYPE_INT,
+	"info_violations":                          METRIC_TYPE_INT,
+	"duplicated_lines":                         METRIC_TYPE_INT,
+	"duplicated_blocks":                        METRIC_TYPE_INT,
+	"uncovered_lines":                          METRIC_TYPE_INT,
+	"uncovered_conditions":                     METRIC_TYPE_INT,
+}
+
+// MetricTypeOf returns the type of the given metric. Metrics on new code ("new_coverage") share the type of the
+// overall metric, and unrecognized metrics are treated as floats.
+func MetricTypeOf(metric string) MetricType {
+	key := strings.TrimPrefix(metric, "new_")
+	if metricType, ok := knownMetricTypes[key]; ok {
+		return metricType
+	}
+
+	switch {
+	case strings.HasSuffix(key, "_rating"):
+		return METRIC_TYPE_RATING
+	case strings.HasSuffix(key, "_coverage"), strings.HasSuffix(key, "_density"), strings.HasSuffix(key, "_percent"):
+		return METRIC_TYPE_PERCENT
+	case strings.HasSuffix(key, "_effort"):
+		return METRIC_TYPE_WORK_DUR
+	}
+
+	return METRIC_TYPE_FLOAT
+}
+
+// MetricValue is a condition threshold or measured value, parsed according to its metric type.
+type MetricValue struct {
+	Type MetricType
+	Raw  string
+	// Number is the numeric form of the value. For ratings, 1 is an "A" and 5 is an "E". Levels are not numeric.
+	Number float64
+}
+
+// ParseMetricValue interprets the raw value based on the type of the metric.
+func ParseMetricValue(metric, raw string) (*MetricValue, error) {
+	value := &MetricValue{
+		Type: MetricTypeOf(metric),
+		Raw:  raw,
+	}
+
+	if value.Type == METRIC_TYPE_LEVEL {
+		return value, nil
+	}
+
+	number, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse value %q for metric %s: %v", raw, metric, err)
+	}
+
+	if value.Type == METRIC_TYPE_RATING && (number < 1 || number > 5) {
+		return nil, fmt.Errorf("rating %q for metric %s is out of range", raw, metric)
+	}
+
+	value.Number = number
+
+	return value, nil
+}
+
+func (v *MetricValue) String() string {
+	switch v.Type {
+	case METRIC_TYPE_RATING:
+		return string(rune('A' + int(v.Number) - 1))
+	case METRIC_TYPE_PERCENT:
+		return strconv.FormatFloat(v.Number, 'f', -1, 64) + "%"
+	case METRIC_TYPE_WORK_DUR:
+		return fmt.Sprintf("%smin", strconv.FormatFloat(v.Number, 'f', -1, 64))
+	case METRIC_TYPE_LEVEL:
+		return v.Raw
+	}
+
+	return strconv.FormatFloat(v.Number, 'f', -1, 64)
+}
+
+// Threshold returns the error threshold of the condition, or the warning threshold if the condition only warns.
+func (c *Condition) Threshold() (*MetricValue, error) {
+	threshold := c.ErrorThreshold
+	if c.Status == CONDITION_STATUS_WARN && c.WarningThreshold != "" {
+		threshold = c.WarningThreshold
+	}
+
+	return ParseMetricValue(c.Metric, threshold)
+}
+
+// MeasuredValue returns the value of the metric at the time of analysis, or nil when SonarQube didn't report one.
+func (c *Condition) MeasuredValue() (*MetricValue, error) {
+	if c.Value == "" || c.Status == CONDITION_STATUS_NO_VALUE {
+		return nil, nil
+	}
+
+	return ParseMetricValue(c.Metric, c.Value)
+}
+
+// Describe returns a human-readable summary of the condition, e.g. "coverage is 72.5% (less than 80%)".
+func (c *Condition) Describe() string {
+	metric := c.Metric
+	if c.OnLeakPeriod && !strings.HasPrefix(metric, "new_") {
+		metric = "new " + metric
+	}
+
+	threshold, err := c.Threshold()
+	if err != nil {
+		return fmt.Sprintf("%s is %s (%s %s)", metric, c.Value, c.Operator, c.ErrorThreshold)
+	}
+
+	value, err := c.MeasuredValue()
+	if err != nil {
+		return fmt.Sprintf("%s is %s (%s %s)", metric, c.Value, c.Operator, threshold)
+	}
+	if value == nil {
+		return fmt.Sprintf("%s has no value (%s %s)", metric, c.Operator, threshold)
+	}
+
+	return fmt.Sprintf("%s is %s (%s %s)", metric, value, c.Operator, threshold)
+}
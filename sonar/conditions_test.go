@@ -0,0 +1,175 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonar
+
+import (
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestParseMetricValue(t *testing.T) {
+	Expect := NewGomegaWithT(t).Expect
+
+	for _, tc := range []struct {
+		name        string
+		metric      string
+		raw         string
+		expected    *MetricValue
+		expectedStr string
+		expectError bool
+	}{
+		{
+			name:        "percentage",
+			metric:      "coverage",
+			raw:         "72.5",
+			expected:    &MetricValue{Type: METRIC_TYPE_PERCENT, Raw: "72.5", Number: 72.5},
+			expectedStr: "72.5%",
+		},
+		{
+			name:        "percentage on new code",
+			metric:      "new_duplicated_lines_density",
+			raw:         "3",
+			expected:    &MetricValue{Type: METRIC_TYPE_PERCENT, Raw: "3", Number: 3},
+			expectedStr: "3%",
+		},
+		{
+			name:        "rating",
+			metric:      "new_security_rating",
+			raw:         "3",
+			expected:    &MetricValue{Type: METRIC_TYPE_RATING, Raw: "3", Number: 3},
+			expectedStr: "C",
+		},
+		{
+			name:        "rating out of range",
+			metric:      "security_rating",
+			raw:         "6",
+			expectError: true,
+		},
+		{
+			name:        "integer",
+			metric:      "bugs",
+			raw:         "12",
+			expected:    &MetricValue{Type: METRIC_TYPE_INT, Raw: "12", Number: 12},
+			expectedStr: "12",
+		},
+		{
+			name:        "work duration",
+			metric:      "sqale_index",
+			raw:         "30",
+			expected:    &MetricValue{Type: METRIC_TYPE_WORK_DUR, Raw: "30", Number: 30},
+			expectedStr: "30min",
+		},
+		{
+			name:        "level",
+			metric:      "alert_status",
+			raw:         "ERROR",
+			expected:    &MetricValue{Type: METRIC_TYPE_LEVEL, Raw: "ERROR"},
+			expectedStr: "ERROR",
+		},
+		{
+			name:        "unknown metric",
+			metric:      "custom_metric",
+			raw:         "0.25",
+			expected:    &MetricValue{Type: METRIC_TYPE_FLOAT, Raw: "0.25", Number: 0.25},
+			expectedStr: "0.25",
+		},
+		{
+			name:        "not a number",
+			metric:      "coverage",
+			raw:         "foo",
+			expectError: true,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			value, err := ParseMetricValue(tc.metric, tc.raw)
+
+			if tc.expectError {
+				Expect(err).To(HaveOccurred())
+			} else {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(value).To(Equal(tc.expected))
+				Expect(value.String()).To(Equal(tc.expectedStr))
+			}
+		})
+	}
+}
+
+func TestConditionDescribe(t *testing.T) {
+	Expect := NewGomegaWithT(t).Expect
+
+	for _, tc := range []struct {
+		name      string
+		condition *Condition
+		expected  string
+	}{
+		{
+			name: "error",
+			condition: &Condition{
+				Metric:         "new_coverage",
+				Operator:       OPERATOR_LESS_THAN,
+				ErrorThreshold: "80",
+				Value:          "72.5",
+				Status:         CONDITION_STATUS_ERROR,
+			},
+			expected: "new_coverage is 72.5% (less than 80%)",
+		},
+		{
+			name: "warning",
+			condition: &Condition{
+				Metric:           "code_smells",
+				OnLeakPeriod:     true,
+				Operator:         OPERATOR_GREATER_THAN,
+				ErrorThreshold:   "50",
+				WarningThreshold: "10",
+				Value:            "20",
+				Status:           CONDITION_STATUS_WARN,
+			},
+			expected: "new code_smells is 20 (greater than 10)",
+		},
+		{
+			name: "no value",
+			condition: &Condition{
+				Metric:         "security_rating",
+				Operator:       OPERATOR_GREATER_THAN,
+				ErrorThreshold: "1",
+				Status:         CONDITION_STATUS_NO_VALUE,
+			},
+			expected: "security_rating has no value (greater than A)",
+		},
+		{
+			name: "unparseable threshold",
+			condition: &Condition{
+				Metric:         "coverage",
+				Operator:       OPERATOR_LESS_THAN,
+				ErrorThreshold: "foo",
+				Value:          "10",
+				Status:         CONDITION_STATUS_ERROR,
+			},
+			expected: "coverage is 10 (less than foo)",
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			Expect(tc.condition.Describe()).To(Equal(tc.expected))
+		})
+	}
+}
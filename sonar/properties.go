@@ -0,0 +1,151 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonar
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// analysisPropertyPrefix is added by SonarQube to every scanner property passed with "-Dsonar.analysis.<name>".
+const analysisPropertyPrefix = "sonar.analysis."
+
+// PropertyFilter selects the scanner properties that are copied from an event. Each pattern is either an exact property
+// name, or a prefix followed by "*" (e.g., "sonar.analysis.*").
+type PropertyFilter struct {
+	exact    map[string]bool
+	prefixes []string
+}
+
+// NewPropertyFilter returns a filter that allows properties matching any of the patterns. Blank patterns are ignored.
+func NewPropertyFilter(patterns []string) *PropertyFilter {
+	filter := &PropertyFilter{exact: map[string]bool{}}
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		switch {
+		case pattern == "":
+		case strings.HasSuffix(pattern, "*"):
+			filter.prefixes = append(filter.prefixes, strings.TrimSuffix(pattern, "*"))
+		default:
+			filter.exact[pattern] = true
+		}
+	}
+
+	return filter
+}
+
+// Allows returns true if the property should be copied.
+func (f *PropertyFilter) Allows(name string) bool {
+	if f == nil {
+		return false
+	}
+
+	if f.exact[name] {
+		return true
+	}
+
+	for _, prefix := range f.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Filter returns the allowed properties, or nil if none are allowed.
+func (f *PropertyFilter) Filter(properties map[string]string) map[string]string {
+	var allowed map[string]string
+	for name, value := range properties {
+		if !f.Allows(name) {
+			continue
+		}
+
+		if allowed == nil {
+			allowed = map[string]string{}
+		}
+		allowed[name] = value
+	}
+
+	return allowed
+}
+
+// CIProvider is the CI system that ran the scanner.
+type CIProvider string
+
+const (
+	CI_PROVIDER_JENKINS        CIProvider = "jenkins"
+	CI_PROVIDER_GITHUB_ACTIONS CIProvider = "github-actions"
+	CI_PROVIDER_GITLAB         CIProvider = "gitlab"
+)
+
+// CIRun identifies the pipeline run that produced an analysis.
+type CIRun struct {
+	Provider CIProvider `json:"provider"`
+	Id       string     `json:"id,omitempty"`
+	Url      string     `json:"url,omitempty"`
+}
+
+// DetectCIRun recognizes the properties that CI systems are commonly configured to pass to the scanner, such as
+// "-Dsonar.analysis.buildUrl=$BUILD_URL" in Jenkins or "-Dsonar.analysis.githubRunId=$GITHUB_RUN_ID" in GitHub Actions.
+// Names are matched regardless of case and separators, so "sonar.analysis.GITHUB_RUN_ID" is also recognized. Nil is
+// returned if the event doesn't identify a pipeline run.
+func DetectCIRun(properties map[string]string) *CIRun {
+	normalized := map[string]string{}
+	for name, value := range properties {
+		if !strings.HasPrefix(name, analysisPropertyPrefix) || value == "" {
+			continue
+		}
+
+		key := strings.ToLower(strings.TrimPrefix(name, analysisPropertyPrefix))
+		key = strings.NewReplacer("_", "", "-", "", ".", "").Replace(key)
+		normalized[key] = value
+	}
+
+	first := func(keys ...string) string {
+		for _, key := range keys {
+			if value, ok := normalized[key]; ok {
+				return value
+			}
+		}
+
+		return ""
+	}
+
+	if runId := first("githubrunid"); runId != "" {
+		run := &CIRun{Provider: CI_PROVIDER_GITHUB_ACTIONS, Id: runId}
+		if repository := first("githubrepository"); repository != "" {
+			serverUrl := first("githubserverurl")
+			if serverUrl == "" {
+				serverUrl = "https://github.com"
+			}
+
+			run.Url = fmt.Sprintf("%s/%s/actions/runs/%s", strings.TrimSuffix(serverUrl, "/"), repository, url.PathEscape(runId))
+		}
+
+		return run
+	}
+
+	if id, pipelineUrl := first("cipipelineid", "gitlabpipelineid"), first("cipipelineurl", "gitlabpipelineurl"); id != "" || pipelineUrl != "" {
+		return &CIRun{Provider: CI_PROVIDER_GITLAB, Id: id, Url: pipelineUrl}
+	}
+
+	if id, buildUrl := first("jenkinsbuildnumber", "buildnumber"), first("jenkinsbuildurl", "buildurl"); id != "" || buildUrl != "" {
+		return &CIRun{Provider: CI_PROVIDER_JENKINS, Id: id, Url: buildUrl}
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonar
+
+import (
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestPropertyFilter(t *testing.T) {
+	Expect := NewGomegaWithT(t).Expect
+
+	properties := map[string]string{
+		"sonar.analysis.resourceUriPrefix": "git://github.com/rode/collector-sonarqube",
+		"sonar.analysis.buildUrl":          "https://jenkins.example.com/job/foo/1/",
+		"sonar.projectVersion":             "1.0.0",
+	}
+
+	for _, tc := range []struct {
+		name     string
+		filter   *PropertyFilter
+		expected map[string]string
+	}{
+		{
+			name:   "nil filter",
+			filter: nil,
+		},
+		{
+			name:   "no patterns",
+			filter: NewPropertyFilter(nil),
+		},
+		{
+			name:   "exact name",
+			filter: NewPropertyFilter([]string{"sonar.projectVersion", " "}),
+			expected: map[string]string{
+				"sonar.projectVersion": "1.0.0",
+			},
+		},
+		{
+			name:   "prefix",
+			filter: NewPropertyFilter([]string{"sonar.analysis.*"}),
+			expected: map[string]string{
+				"sonar.analysis.resourceUriPrefix": "git://github.com/rode/collector-sonarqube",
+				"sonar.analysis.buildUrl":          "https://jenkins.example.com/job/foo/1/",
+			},
+		},
+		{
+			name:     "everything",
+			filter:   NewPropertyFilter([]string{"*"}),
+			expected: properties,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			Expect(tc.filter.Filter(properties)).To(Equal(tc.expected))
+		})
+	}
+}
+
+func TestDetectCIRun(t *testing.T) {
+	Expect := NewGomegaWithT(t).Expect
+
+	for _, tc := range []struct {
+		name       string
+		properties map[string]string
+		expected   *CIRun
+	}{
+		{
+			name: "jenkins",
+			properties: map[string]string{
+				"sonar.analysis.buildUrl":    "https://jenkins.example.com/job/foo/12/",
+				"sonar.analysis.buildNumber": "12",
+			},
+			expected: &CIRun{Provider: CI_PROVIDER_JENKINS, Id: "12", Url: "https://jenkins.example.com/job/foo/12/"},
+		},
+		{
+			name: "jenkins environment variable names",
+			properties: map[string]string{
+				"sonar.analysis.BUILD_URL": "https://jenkins.example.com/job/foo/12/",
+			},
+			expected: &CIRun{Provider: CI_PROVIDER_JENKINS, Url: "https://jenkins.example.com/job/foo/12/"},
+		},
+		{
+			name: "github actions",
+			properties: map[string]string{
+				"sonar.analysis.githubRunId":      "1234567",
+				"sonar.analysis.githubRepository": "rode/collector-sonarqube",
+			},
+			expected: &CIRun{Provider: CI_PROVIDER_GITHUB_ACTIONS, Id: "1234567", Url: "https://github.com/rode/collector-sonarqube/actions/runs/1234567"},
+		},
+		{
+			name: "github enterprise",
+			properties: map[string]string{
+				"sonar.analysis.GITHUB_RUN_ID":     "1234567",
+				"sonar.analysis.GITHUB_REPOSITORY": "rode/collector-sonarqube",
+				"sonar.analysis.GITHUB_SERVER_URL": "https://github.example.com/",
+			},
+			expected: &CIRun{Provider: CI_PROVIDER_GITHUB_ACTIONS, Id: "1234567", Url: "https://github.example.com/rode/collector-sonarqube/actions/runs/1234567"},
+		},
+		{
+			name: "github actions without a repository",
+			properties: map[string]string{
+				"sonar.analysis.githubRunId": "1234567",
+			},
+			expected: &CIRun{Provider: CI_PROVIDER_GITHUB_ACTIONS, Id: "1234567"},
+		},
+		{
+			name: "gitlab",
+			properties: map[string]string{
+				"sonar.analysis.CI_PIPELINE_ID":  "89",
+				"sonar.analysis.CI_PIPELINE_URL": "https://gitlab.com/rode/collector-sonarqube/-/pipelines/89",
+			},
+			expected: &CIRun{Provider: CI_PROVIDER_GITLAB, Id: "89", Url: "https://gitlab.com/rode/collector-sonarqube/-/pipelines/89"},
+		},
+		{
+			name: "properties without the analysis prefix",
+			properties: map[string]string{
+				"buildUrl": "https://jenkins.example.com/job/foo/12/",
+			},
+		},
+		{
+			name: "no ci properties",
+			properties: map[string]string{
+				"sonar.analysis.resourceUriPrefix": "git://github.com/rode/collector-sonarqube",
+			},
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			Expect(DetectCIRun(tc.properties)).To(Equal(tc.expected))
+		})
+	}
+}
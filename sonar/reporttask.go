@@ -0,0 +1,99 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonar
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ReportTask is the report-task.txt file that the scanner writes once it has submitted an analysis, identifying the
+// compute engine task that will process it.
+type ReportTask struct {
+	ProjectKey    string
+	ServerUrl     string
+	ServerVersion string
+	DashboardUrl  string
+	CeTaskId      string
+	CeTaskUrl     string
+}
+
+// ParseReportTask reads a report task, which is in the Java properties format:
+//
+//	projectKey=my-project
+//	serverUrl=https://sonar.example.com
+//	ceTaskId=AXmu
+func ParseReportTask(reader io.Reader) (*ReportTask, error) {
+	properties := map[string]string{}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+
+		name, value, _ := cut(line, "=")
+		// the scanner escapes the colons in urls
+		properties[strings.TrimSpace(name)] = strings.ReplaceAll(strings.TrimSpace(value), `\:`, ":")
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading report task: %v", err)
+	}
+
+	reportTask := &ReportTask{
+		ProjectKey:    properties["projectKey"],
+		ServerUrl:     properties["serverUrl"],
+		ServerVersion: properties["serverVersion"],
+		DashboardUrl:  properties["dashboardUrl"],
+		CeTaskId:      properties["ceTaskId"],
+		CeTaskUrl:     properties["ceTaskUrl"],
+	}
+
+	if reportTask.CeTaskId == "" {
+		return nil, errors.New("report task is missing ceTaskId")
+	}
+
+	if reportTask.ProjectKey == "" {
+		return nil, errors.New("report task is missing projectKey")
+	}
+
+	return reportTask, nil
+}
+
+// WaitForTask checks the compute engine task once per interval until it has finished or the context is done.
+func WaitForTask(ctx context.Context, client Client, id string, interval time.Duration) (*Task, error) {
+	for {
+		task, err := client.GetTask(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if task.Status.IsFinal() {
+			return task, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("task %s did not finish: %w", id, ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonar
+
+import (
+	"context"
+	"errors"
+	. "github.com/onsi/gomega"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseReportTask(t *testing.T) {
+	Expect := NewGomegaWithT(t).Expect
+
+	for _, tc := range []struct {
+		name          string
+		contents      string
+		expected      *ReportTask
+		expectedError string
+	}{
+		{
+			name: "scanner output",
+			contents: `projectKey=my-project
+serverUrl=https\://sonar.example.com
+serverVersion=8.9.0.43852
+dashboardUrl=https\://sonar.example.com/dashboard?id=my-project
+ceTaskId=AXmu
+ceTaskUrl=https\://sonar.example.com/api/ce/task?id=AXmu
+`,
+			expected: &ReportTask{
+				ProjectKey:    "my-project",
+				ServerUrl:     "https://sonar.example.com",
+				ServerVersion: "8.9.0.43852",
+				DashboardUrl:  "https://sonar.example.com/dashboard?id=my-project",
+				CeTaskId:      "AXmu",
+				CeTaskUrl:     "https://sonar.example.com/api/ce/task?id=AXmu",
+			},
+		},
+		{
+			name:     "comments and blank lines",
+			contents: "# written by the scanner\n\nprojectKey = my-project\nceTaskId=AXmu\n",
+			expected: &ReportTask{ProjectKey: "my-project", CeTaskId: "AXmu"},
+		},
+		{
+			name:          "missing task id",
+			contents:      "projectKey=my-project\n",
+			expectedError: "report task is missing ceTaskId",
+		},
+		{
+			name:          "missing project key",
+			contents:      "ceTaskId=AXmu\n",
+			expectedError: "report task is missing projectKey",
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			reportTask, err := ParseReportTask(strings.NewReader(tc.contents))
+
+			if tc.expectedError != "" {
+				Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(reportTask).To(Equal(tc.expected))
+			}
+		})
+	}
+}
+
+type fakeTaskClient struct {
+	Client
+
+	statuses []EventStatus
+	err      error
+	calls    int
+}
+
+func (f *fakeTaskClient) GetTask(_ context.Context, id string) (*Task, error) {
+	status := f.statuses[f.calls]
+	f.calls++
+
+	return &Task{Id: id, Status: status}, f.err
+}
+
+func TestWaitForTask(t *testing.T) {
+	Expect := NewGomegaWithT(t).Expect
+
+	t.Run("finished", func(t *testing.T) {
+		client := &fakeTaskClient{statuses: []EventStatus{STATUS_PENDING, STATUS_IN_PROGRESS, STATUS_SUCCESS}}
+
+		task, err := WaitForTask(context.Background(), client, "AXmu", time.Millisecond)
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(task.Status).To(Equal(STATUS_SUCCESS))
+		Expect(client.calls).To(Equal(3))
+	})
+
+	t.Run("timed out", func(t *testing.T) {
+		client := &fakeTaskClient{statuses: []EventStatus{STATUS_PENDING}}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := WaitForTask(ctx, client, "AXmu", time.Hour)
+
+		Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+	})
+
+	t.Run("error", func(t *testing.T) {
+		client := &fakeTaskClient{statuses: []EventStatus{STATUS_PENDING}, err: errors.New("unauthorized")}
+
+		_, err := WaitForTask(context.Background(), client, "AXmu", time.Millisecond)
+
+		Expect(err).To(MatchError("unauthorized"))
+	})
+}
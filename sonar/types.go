@@ -14,8 +14,39 @@
 
 package sonar
 
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// timestampLayouts are the forms that SonarQube has used for timestamps across versions. Most versions use a numeric
+// offset without a colon, while newer versions and SonarCloud may use RFC3339.
+var timestampLayouts = []string{
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02T15:04:05.000-0700",
+	time.RFC3339,
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+}
+
+// ParseTimestamp parses a timestamp from an event or the web API, preserving its original offset. Timestamps without an
+// offset are assumed to be in UTC.
+func ParseTimestamp(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unrecognized timestamp %q", value)
+}
+
 // Event is...
 type Event struct {
+	ServerUrl   string            `json:"serverUrl,omitempty"`
 	TaskId      string            `json:"taskId"`
 	Status      EventStatus       `json:"status"`
 	AnalysedAt  string            `json:"analysedAt"`
@@ -26,6 +57,11 @@ type Event struct {
 	Properties  map[string]string `json:"properties"`
 }
 
+// AnalysisTime parses the time that the analysis was performed.
+func (e *Event) AnalysisTime() (time.Time, error) {
+	return ParseTimestamp(e.AnalysedAt)
+}
+
 // Branch is...
 type Branch struct {
 	Name   string `json:"name"`
@@ -34,6 +70,18 @@ type Branch struct {
 	URL    string `json:"url"`
 }
 
+// branch types
+const (
+	BRANCH_TYPE_BRANCH       = "BRANCH"
+	BRANCH_TYPE_PULL_REQUEST = "PULL_REQUEST"
+)
+
+// IsPullRequest returns true if the analysis was of a pull request rather than a branch. For pull requests, the name is
+// the pull request id.
+func (b *Branch) IsPullRequest() bool {
+	return b.Type == BRANCH_TYPE_PULL_REQUEST
+}
+
 // Project is
 type Project struct {
 	Key  string `json:"key"`
@@ -41,6 +89,21 @@ type Project struct {
 	URL  string `json:"url"`
 }
 
+// ServerURL returns the base URL of the SonarQube instance that the project belongs to, derived from the project's
+// dashboard URL (e.g., "https://sonar.example.com/dashboard?id=key" becomes "https://sonar.example.com").
+func (p *Project) ServerURL() string {
+	u, err := url.Parse(p.URL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+
+	u.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/dashboard")
+	u.RawQuery = ""
+	u.Fragment = ""
+
+	return strings.TrimSuffix(u.String(), "/")
+}
+
 // QualityGate is...
 type QualityGate struct {
 	Conditions []*Condition `json:"conditions"`
@@ -48,20 +111,67 @@ type QualityGate struct {
 	Status     EventStatus  `json:"status"`
 }
 
+// EventStatus is used for both the status of the compute engine task that produced the analysis, and the status of the
+// quality gate that was evaluated against it.
 type EventStatus string
 
+// compute engine task statuses
+const (
+	STATUS_PENDING     EventStatus = "PENDING"
+	STATUS_IN_PROGRESS EventStatus = "IN_PROGRESS"
+	STATUS_SUCCESS     EventStatus = "SUCCESS"
+	STATUS_FAILED      EventStatus = "FAILED"
+	STATUS_CANCELED    EventStatus = "CANCELED"
+)
+
+// quality gate statuses
 const (
-	STATUS_SUCCESS EventStatus = "SUCCESS"
-	STATUS_OK      EventStatus = "OK"
-	STATUS_ERROR   EventStatus = "ERROR"
-	STATUS_FAILED  EventStatus = "FAILED"
+	STATUS_OK    EventStatus = "OK"
+	STATUS_WARN  EventStatus = "WARN"
+	STATUS_ERROR EventStatus = "ERROR"
+	STATUS_NONE  EventStatus = "NONE"
 )
 
+// IsTaskStatus returns true if the status is one of the known compute engine task statuses.
+func (s EventStatus) IsTaskStatus() bool {
+	switch s {
+	case STATUS_PENDING, STATUS_IN_PROGRESS, STATUS_SUCCESS, STATUS_FAILED, STATUS_CANCELED:
+		return true
+	}
+
+	return false
+}
+
+// IsFinal returns true if the compute engine task will not change status again.
+func (s EventStatus) IsFinal() bool {
+	return s == STATUS_SUCCESS || s == STATUS_FAILED || s == STATUS_CANCELED
+}
+
+// HasQualityGate returns true if a quality gate was evaluated as part of the analysis. Projects without a quality gate
+// assigned will either omit the gate entirely or report a status of NONE.
+func (e *Event) HasQualityGate() bool {
+	return e.QualityGate != nil && e.QualityGate.Status != "" && e.QualityGate.Status != STATUS_NONE
+}
+
 // Condition is...
 type Condition struct {
-	ErrorThreshold string `json:"errorThreshold"`
-	Metric         string `json:"metric"`
-	OnLeakPeriod   bool   `json:"onLeakPeriod"`
-	Operator       string `json:"operator"`
-	Status         string `json:"status"`
+	ErrorThreshold   string            `json:"errorThreshold"`
+	WarningThreshold string            `json:"warningThreshold,omitempty"`
+	Metric           string            `json:"metric"`
+	OnLeakPeriod     bool              `json:"onLeakPeriod"`
+	Operator         ConditionOperator `json:"operator"`
+	Status           ConditionStatus   `json:"status"`
+	Value            string            `json:"value,omitempty"`
+}
+
+// ConditionsWithStatus returns the gate's conditions that evaluated to the given status.
+func (q *QualityGate) ConditionsWithStatus(status ConditionStatus) []*Condition {
+	var conditions []*Condition
+	for _, condition := range q.Conditions {
+		if condition.Status == status {
+			conditions = append(conditions, condition)
+		}
+	}
+
+	return conditions
 }
@@ -0,0 +1,92 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonar
+
+import (
+	. "github.com/onsi/gomega"
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	Expect := NewGomegaWithT(t).Expect
+
+	for _, tc := range []struct {
+		name        string
+		value       string
+		expected    time.Time
+		expectError bool
+	}{
+		{
+			name:     "numeric offset",
+			value:    "2021-05-27T19:08:23+0000",
+			expected: time.Date(2021, 5, 27, 19, 8, 23, 0, time.UTC),
+		},
+		{
+			name:     "milliseconds with a non-UTC offset",
+			value:    "2021-05-27T21:08:23.512+0200",
+			expected: time.Date(2021, 5, 27, 19, 8, 23, 512000000, time.UTC),
+		},
+		{
+			name:     "RFC3339",
+			value:    "2021-05-27T14:08:23-05:00",
+			expected: time.Date(2021, 5, 27, 19, 8, 23, 0, time.UTC),
+		},
+		{
+			name:     "RFC3339 with nanoseconds",
+			value:    "2021-05-27T19:08:23.123456789Z",
+			expected: time.Date(2021, 5, 27, 19, 8, 23, 123456789, time.UTC),
+		},
+		{
+			name:     "no offset",
+			value:    "2021-05-27T19:08:23",
+			expected: time.Date(2021, 5, 27, 19, 8, 23, 0, time.UTC),
+		},
+		{
+			name:        "empty",
+			value:       "",
+			expectError: true,
+		},
+		{
+			name:        "garbage",
+			value:       "yesterday",
+			expectError: true,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			actual, err := ParseTimestamp(tc.value)
+
+			if tc.expectError {
+				Expect(err).To(HaveOccurred())
+			} else {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(actual.Equal(tc.expected)).To(BeTrue(), "expected %s to equal %s", actual, tc.expected)
+			}
+		})
+	}
+}
+
+func TestParseTimestampPreservesOffset(t *testing.T) {
+	Expect := NewGomegaWithT(t).Expect
+
+	actual, err := ParseTimestamp("2021-05-27T21:08:23+0200")
+
+	Expect(err).ToNot(HaveOccurred())
+	Expect(actual.Format(time.RFC3339)).To(Equal("2021-05-27T21:08:23+02:00"))
+}
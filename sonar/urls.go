@@ -0,0 +1,94 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonar
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ServerURL returns the base URL of the instance that sent the event. Older versions of SonarQube don't include it in
+// the payload, in which case it's derived from the project's dashboard URL.
+func (e *Event) ServerURL() string {
+	if e.ServerUrl != "" {
+		return strings.TrimSuffix(e.ServerUrl, "/")
+	}
+
+	if e.Project != nil {
+		return e.Project.ServerURL()
+	}
+
+	return ""
+}
+
+// DashboardURL returns the dashboard for the branch or pull request that was analyzed, falling back to the project's
+// dashboard for instances that don't support branches.
+func (e *Event) DashboardURL() string {
+	if e.Branch != nil && e.Branch.URL != "" {
+		return e.Branch.URL
+	}
+
+	if e.Project != nil {
+		return e.Project.URL
+	}
+
+	return ""
+}
+
+// IssuesURL returns the list of open issues for the branch or pull request that was analyzed.
+func (e *Event) IssuesURL() string {
+	serverUrl := e.ServerURL()
+	if serverUrl == "" || e.Project == nil {
+		return ""
+	}
+
+	query := url.Values{
+		"id":       {e.Project.Key},
+		"resolved": {"false"},
+	}
+
+	if e.Branch != nil && e.Branch.Name != "" {
+		switch {
+		case e.Branch.IsPullRequest():
+			query.Set("pullRequest", e.Branch.Name)
+		case !e.Branch.IsMain:
+			query.Set("branch", e.Branch.Name)
+		}
+	}
+
+	return fmt.Sprintf("%s/project/issues?%s", serverUrl, query.Encode())
+}
+
+// QualityGateURL returns the definition of the quality gate that was evaluated. Webhooks only include the name of the
+// gate, which newer versions of SonarQube use to identify it.
+func (e *Event) QualityGateURL() string {
+	serverUrl := e.ServerURL()
+	if serverUrl == "" || !e.HasQualityGate() || e.QualityGate.Name == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("%s/quality_gates/show/%s", serverUrl, url.PathEscape(e.QualityGate.Name))
+}
+
+// TaskURL returns the compute engine task that produced the analysis.
+func (e *Event) TaskURL() string {
+	serverUrl := e.ServerURL()
+	if serverUrl == "" || e.TaskId == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("%s/api/ce/task?%s", serverUrl, url.Values{"id": {e.TaskId}}.Encode())
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonar
+
+import (
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestEventURLs(t *testing.T) {
+	Expect := NewGomegaWithT(t).Expect
+
+	for _, tc := range []struct {
+		name                string
+		event               *Event
+		expectedServer      string
+		expectedDashboard   string
+		expectedIssues      string
+		expectedQualityGate string
+		expectedTask        string
+	}{
+		{
+			name: "main branch",
+			event: &Event{
+				TaskId:  "AXmu",
+				Project: &Project{Key: "my-project", URL: "https://sonar.example.com/dashboard?id=my-project"},
+				Branch:  &Branch{Name: "main", Type: BRANCH_TYPE_BRANCH, IsMain: true, URL: "https://sonar.example.com/dashboard?id=my-project"},
+				QualityGate: &QualityGate{
+					Name:   "Sonar way",
+					Status: STATUS_OK,
+				},
+			},
+			expectedServer:      "https://sonar.example.com",
+			expectedDashboard:   "https://sonar.example.com/dashboard?id=my-project",
+			expectedIssues:      "https://sonar.example.com/project/issues?id=my-project&resolved=false",
+			expectedQualityGate: "https://sonar.example.com/quality_gates/show/Sonar%20way",
+			expectedTask:        "https://sonar.example.com/api/ce/task?id=AXmu",
+		},
+		{
+			name: "feature branch with server url",
+			event: &Event{
+				ServerUrl: "https://sonar.example.com/sonar/",
+				TaskId:    "AXmu",
+				Project:   &Project{Key: "my-project", URL: "https://sonar.example.com/sonar/dashboard?id=my-project"},
+				Branch:    &Branch{Name: "feature/foo", Type: BRANCH_TYPE_BRANCH, URL: "https://sonar.example.com/sonar/dashboard?id=my-project&branch=feature%2Ffoo"},
+			},
+			expectedServer:    "https://sonar.example.com/sonar",
+			expectedDashboard: "https://sonar.example.com/sonar/dashboard?id=my-project&branch=feature%2Ffoo",
+			expectedIssues:    "https://sonar.example.com/sonar/project/issues?branch=feature%2Ffoo&id=my-project&resolved=false",
+			expectedTask:      "https://sonar.example.com/sonar/api/ce/task?id=AXmu",
+		},
+		{
+			name: "pull request",
+			event: &Event{
+				TaskId:  "AXmu",
+				Project: &Project{Key: "my-project", URL: "https://sonarcloud.io/dashboard?id=my-project"},
+				Branch:  &Branch{Name: "42", Type: BRANCH_TYPE_PULL_REQUEST, URL: "https://sonarcloud.io/dashboard?id=my-project&pullRequest=42"},
+			},
+			expectedServer:    "https://sonarcloud.io",
+			expectedDashboard: "https://sonarcloud.io/dashboard?id=my-project&pullRequest=42",
+			expectedIssues:    "https://sonarcloud.io/project/issues?id=my-project&pullRequest=42&resolved=false",
+			expectedTask:      "https://sonarcloud.io/api/ce/task?id=AXmu",
+		},
+		{
+			name: "unknown server",
+			event: &Event{
+				TaskId:  "AXmu",
+				Project: &Project{Key: "my-project"},
+			},
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			Expect(tc.event.ServerURL()).To(Equal(tc.expectedServer))
+			Expect(tc.event.DashboardURL()).To(Equal(tc.expectedDashboard))
+			Expect(tc.event.IssuesURL()).To(Equal(tc.expectedIssues))
+			Expect(tc.event.QualityGateURL()).To(Equal(tc.expectedQualityGate))
+			Expect(tc.event.TaskURL()).To(Equal(tc.expectedTask))
+		})
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package status
+
+import (
+	"context"
+	"embed"
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/rode/collector-sonarqube/filter"
+	"github.com/rode/collector-sonarqube/listener"
+	"github.com/rode/collector-sonarqube/poller"
+	"github.com/rode/collector-sonarqube/reconcile"
+	"github.com/rode/collector-sonarqube/sink"
+	"github.com/rode/collector-sonarqube/store"
+	pb "github.com/rode/rode/proto/v1alpha1"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultEvents = 25
+	// defaultScanRecords bounds how much of the history is read on each render
+	defaultScanRecords = 1000
+	// rodeTimeout keeps the page responsive when Rode can't be reached
+	rodeTimeout = 5 * time.Second
+)
+
+//go:embed templates
+var templates embed.FS
+
+var page = template.Must(template.New("status.html").Funcs(template.FuncMap{
+	"source":       source,
+	"outcomeClass": outcomeClass,
+}).ParseFS(templates, "templates/status.html"))
+
+// Instance is a SonarQube instance that the collector reads from.
+type Instance struct {
+	Url          string
+	Flavor       string
+	PollInterval time.Duration
+}
+
+// Options describe what's shown on the page.
+type Options struct {
+	StartedAt time.Time
+	Instances []*Instance
+	// Events is how many of the most recent events are listed
+	Events int
+	// ScanRecords is how many of the most recent events the errors by reason are counted from
+	ScanRecords int
+	// DryRun is set when requests to Rode are printed rather than sent, so there's no connection to check
+	DryRun bool
+	// Sinks returns the outcomes of sending analyses to each sink
+	Sinks func() []sink.Stats
+	// Filter returns the counts of events evaluated and skipped by the filter rules, when there are any
+	Filter func() filter.Stats
+	// Reconcile returns the totals of the scheduled reconciliations, when they're enabled
+	Reconcile func() reconcile.Stats
+	// Poller returns the tasks waiting to be retried by the poller, when polling is enabled
+	Poller func() poller.Stats
+}
+
+// RodeStatus is the result of a request to Rode made while rendering the page.
+type RodeStatus struct {
+	DryRun    bool
+	Connected bool
+	Latency   time.Duration
+	Error     string
+}
+
+// ErrorCount is the number of events that failed or were rejected for the same reason.
+type ErrorCount struct {
+	Outcome listener.Outcome
+	Reason  string
+	Count   int
+}
+
+// Status is everything shown on the page.
+type Status struct {
+	GeneratedAt time.Time
+	Uptime      time.Duration
+	Instances   []*Instance
+	Rode        *RodeStatus
+	Events      []*store.Record
+	Errors      []*ErrorCount
+	Sinks       []sink.Stats
+	Filter      *filter.Stats
+	Reconcile   *reconcile.Stats
+	// Poller is set when polling is enabled
+	Poller *poller.Stats
+	// DeadLetters is the number of events in the history whose most recent attempt failed
+	DeadLetters int
+	// Scanned is the number of events that Errors were counted from
+	Scanned int
+}
+
+type handler struct {
+	logger     *zap.Logger
+	store      *store.Store
+	rodeClient pb.RodeClient
+	options    *Options
+	now        func() time.Time
+}
+
+// NewHandler returns a handler that renders the status page from the event history.
+func NewHandler(logger *zap.Logger, st *store.Store, rodeClient pb.RodeClient, options *Options) http.HandlerFunc {
+	h := &handler{
+		logger:     logger,
+		store:      st,
+		rodeClient: rodeClient,
+		options:    options,
+		now:        time.Now,
+	}
+
+	return h.ServeHTTP
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, err := h.status(request.Context())
+	if err != nil {
+		h.logger.Error("error reading event history", zap.Error(err))
+		http.Error(w, "error reading event history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := page.Execute(w, status); err != nil {
+		h.logger.Error("error rendering status page", zap.Error(err))
+	}
+}
+
+func (h *handler) status(ctx context.Context) (*Status, error) {
+	now := h.now()
+	status := &Status{
+		GeneratedAt: now,
+		Uptime:      now.Sub(h.options.StartedAt).Truncate(time.Second),
+		Instances:   h.options.Instances,
+		Rode:        h.checkRode(ctx),
+	}
+
+	if h.options.Sinks != nil {
+		status.Sinks = h.options.Sinks()
+	}
+	if h.options.Filter != nil {
+		stats := h.options.Filter()
+		status.Filter = &stats
+	}
+	if h.options.Reconcile != nil {
+		stats := h.options.Reconcile()
+		status.Reconcile = &stats
+	}
+	if h.options.Poller != nil {
+		stats := h.options.Poller()
+		status.Poller = &stats
+	}
+
+	deadLetters, err := h.store.Count(store.DeadLetter)
+	if err != nil {
+		return nil, err
+	}
+	status.DeadLetters = deadLetters
+
+	scanRecords := h.options.ScanRecords
+	if scanRecords <= 0 {
+		scanRecords = defaultScanRecords
+	}
+
+	records, err := h.store.List(scanRecords, nil)
+	if err != nil {
+		return nil, err
+	}
+	status.Scanned = len(records)
+
+	limit := h.options.Events
+	if limit <= 0 {
+		limit = defaultEvents
+	}
+	if len(records) < limit {
+		limit = len(records)
+	}
+	status.Events = records[:limit]
+
+	counts := map[ErrorCount]int{}
+	for _, r := range records {
+		if r.Outcome == listener.OUTCOME_FAILED || r.Outcome == listener.OUTCOME_REJECTED {
+			counts[ErrorCount{Outcome: r.Outcome, Reason: r.Reason}]++
+		}
+	}
+
+	for key, count := range counts {
+		errorCount := key
+		errorCount.Count = count
+		status.Errors = append(status.Errors, &errorCount)
+	}
+	sort.Slice(status.Errors, func(i, j int) bool {
+		if status.Errors[i].Count != status.Errors[j].Count {
+			return status.Errors[i].Count > status.Errors[j].Count
+		}
+
+		return status.Errors[i].Reason < status.Errors[j].Reason
+	})
+
+	return status, nil
+}
+
+// checkRode makes the smallest request that Rode will answer, to confirm that it can be reached with the configured
+// credentials.
+func (h *handler) checkRode(ctx context.Context) *RodeStatus {
+	if h.options.DryRun {
+		return &RodeStatus{DryRun: true}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rodeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	_, err := h.rodeClient.ListOccurrences(ctx, &pb.ListOccurrencesRequest{PageSize: 1})
+	if err != nil {
+		return &RodeStatus{Error: err.Error()}
+	}
+
+	return &RodeStatus{
+		Connected: true,
+		Latency:   time.Since(start).Truncate(time.Millisecond),
+	}
+}
+
+func source(r *store.Record) listener.Source {
+	if len(r.Attempts) == 0 {
+		return ""
+	}
+
+	return r.Attempts[len(r.Attempts)-1].Source
+}
+
+func outcomeClass(outcome listener.Outcome) string {
+	switch outcome {
+	case listener.OUTCOME_RECORDED:
+		return "ok"
+	case listener.OUTCOME_FAILED, listener.OUTCOME_REJECTED:
+		return "error"
+	}
+
+	return "muted"
+}
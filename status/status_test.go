@@ -0,0 +1,308 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package status
+
+import (
+	"context"
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/collector-sonarqube/filter"
+	"github.com/rode/collector-sonarqube/listener"
+	"github.com/rode/collector-sonarqube/poller"
+	"github.com/rode/collector-sonarqube/reconcile"
+	"github.com/rode/collector-sonarqube/sink"
+	"github.com/rode/collector-sonarqube/sonar"
+	"github.com/rode/collector-sonarqube/store"
+	pb "github.com/rode/rode/proto/v1alpha1"
+	"github.com/rode/rode/proto/v1alpha1fakes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("Status", func() {
+	var (
+		dir        string
+		st         *store.Store
+		rodeClient *v1alpha1fakes.FakeRodeClient
+		options    *Options
+		h          *handler
+		startedAt  time.Time
+	)
+
+	record := func(taskId string, outcome listener.Outcome, reason string) {
+		event := &sonar.Event{
+			TaskId:  taskId,
+			Status:  sonar.STATUS_SUCCESS,
+			Project: &sonar.Project{Key: "my-project"},
+		}
+
+		Expect(st.Record(context.Background(), event, &listener.ProcessOptions{Source: listener.SOURCE_WEBHOOK}, &listener.Result{
+			TaskId:  taskId,
+			Outcome: outcome,
+			Reason:  reason,
+		})).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "status")
+		Expect(err).ToNot(HaveOccurred())
+
+		st, err = store.Open(logger, filepath.Join(dir, "state.db"), &store.Options{})
+		Expect(err).ToNot(HaveOccurred())
+
+		rodeClient = &v1alpha1fakes.FakeRodeClient{}
+		rodeClient.ListOccurrencesReturns(&pb.ListOccurrencesResponse{}, nil)
+
+		startedAt = time.Date(2021, 5, 27, 19, 8, 23, 0, time.UTC)
+		options = &Options{
+			StartedAt: startedAt,
+			Instances: []*Instance{{Url: "https://sonar.example.com", Flavor: "sonarqube", PollInterval: 5 * time.Minute}},
+			Events:    2,
+		}
+
+		record("first", listener.OUTCOME_FAILED, "rode is unavailable")
+		record("second", listener.OUTCOME_RECORDED, "")
+		record("third", listener.OUTCOME_REJECTED, "missing revision")
+		record("fourth", listener.OUTCOME_FAILED, "rode is unavailable")
+	})
+
+	JustBeforeEach(func() {
+		h = &handler{
+			logger:     logger,
+			store:      st,
+			rodeClient: rodeClient,
+			options:    options,
+			now:        func() time.Time { return startedAt.Add(90 * time.Minute) },
+		}
+	})
+
+	AfterEach(func() {
+		Expect(st.Close()).To(Succeed())
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("should summarize the event history", func() {
+		status, err := h.status(context.Background())
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(status.Uptime).To(Equal(90 * time.Minute))
+		Expect(status.Instances).To(Equal(options.Instances))
+		Expect(status.DeadLetters).To(Equal(2))
+		Expect(status.Scanned).To(Equal(4))
+		Expect(status.Poller).To(BeNil())
+
+		Expect(status.Events).To(HaveLen(2))
+		Expect(status.Events[0].TaskId).To(Equal("fourth"))
+		Expect(status.Events[1].TaskId).To(Equal("third"))
+
+		Expect(status.Errors).To(Equal([]*ErrorCount{
+			{Outcome: listener.OUTCOME_FAILED, Reason: "rode is unavailable", Count: 2},
+			{Outcome: listener.OUTCOME_REJECTED, Reason: "missing revision", Count: 1},
+		}))
+	})
+
+	It("should report that rode is connected", func() {
+		status, err := h.status(context.Background())
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(status.Rode.Connected).To(BeTrue())
+		Expect(rodeClient.ListOccurrencesCallCount()).To(Equal(1))
+	})
+
+	When("only some of the history is scanned", func() {
+		BeforeEach(func() {
+			options.ScanRecords = 2
+		})
+
+		It("should count errors from the most recent events", func() {
+			status, err := h.status(context.Background())
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(status.Scanned).To(Equal(2))
+			Expect(status.Errors).To(Equal([]*ErrorCount{
+				{Outcome: listener.OUTCOME_REJECTED, Reason: "missing revision", Count: 1},
+				{Outcome: listener.OUTCOME_FAILED, Reason: "rode is unavailable", Count: 1},
+			}))
+		})
+
+		It("should count every dead letter", func() {
+			status, err := h.status(context.Background())
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(status.DeadLetters).To(Equal(2))
+		})
+	})
+
+	When("polling is enabled", func() {
+		BeforeEach(func() {
+			options.Poller = func() poller.Stats {
+				return poller.Stats{PendingRetries: 3}
+			}
+		})
+
+		It("should show the tasks waiting to be retried", func() {
+			response := httptest.NewRecorder()
+			h.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+			body := response.Body.String()
+			Expect(body).To(ContainSubstring("Pending poll retries"))
+			Expect(body).To(ContainSubstring("3 task(s) to be retried on the next poll"))
+		})
+	})
+
+	When("requests to rode are printed instead of sent", func() {
+		BeforeEach(func() {
+			options.DryRun = true
+		})
+
+		It("should not check the connection", func() {
+			status, err := h.status(context.Background())
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(status.Rode.DryRun).To(BeTrue())
+			Expect(status.Rode.Connected).To(BeFalse())
+			Expect(rodeClient.ListOccurrencesCallCount()).To(Equal(0))
+		})
+
+		It("should say so on the page", func() {
+			response := httptest.NewRecorder()
+			h.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+			Expect(response.Body.String()).To(ContainSubstring("dry run"))
+		})
+	})
+
+	When("rode can't be reached", func() {
+		BeforeEach(func() {
+			rodeClient.ListOccurrencesReturns(nil, errors.New("connection refused"))
+		})
+
+		It("should report the error", func() {
+			status, err := h.status(context.Background())
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(status.Rode.Connected).To(BeFalse())
+			Expect(status.Rode.Error).To(Equal("connection refused"))
+		})
+	})
+
+	It("should render the page", func() {
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+		Expect(response.Code).To(Equal(http.StatusOK))
+		Expect(response.Header().Get("Content-Type")).To(HavePrefix("text/html"))
+
+		body := response.Body.String()
+		Expect(body).To(ContainSubstring("1h30m0s"))
+		Expect(body).To(ContainSubstring("https://sonar.example.com"))
+		Expect(body).To(ContainSubstring("fourth"))
+		Expect(body).ToNot(ContainSubstring("<td>first</td>"))
+		Expect(body).To(ContainSubstring("rode is unavailable"))
+		Expect(body).To(ContainSubstring("Dead letters"))
+		Expect(body).To(ContainSubstring("2 event(s) whose last attempt failed"))
+		Expect(body).ToNot(ContainSubstring("Pending poll retries"))
+		Expect(body).ToNot(ContainSubstring("http://"))
+	})
+
+	When("filter rules are configured", func() {
+		BeforeEach(func() {
+			options.Filter = func() filter.Stats {
+				return filter.Stats{
+					Evaluated:     10,
+					Skipped:       3,
+					SkippedByRule: map[string]int64{"sandboxes": 2, "": 1},
+				}
+			}
+		})
+
+		It("should include the filter stats", func() {
+			status, err := h.status(context.Background())
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(status.Filter.Skipped).To(BeEquivalentTo(3))
+		})
+
+		It("should render the skips by rule", func() {
+			response := httptest.NewRecorder()
+			h.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+			body := response.Body.String()
+			Expect(body).To(ContainSubstring("10 event(s) evaluated, 3 skipped"))
+			Expect(body).To(ContainSubstring("<td>sandboxes</td><td>2</td>"))
+			Expect(body).To(ContainSubstring("no include rule matched"))
+		})
+	})
+
+	When("reconciliation is scheduled", func() {
+		BeforeEach(func() {
+			lastRun := startedAt.Add(time.Hour)
+			options.Reconcile = func() reconcile.Stats {
+				return reconcile.Stats{Runs: 4, Checked: 40, Skipped: 6, Missing: 2, Reingested: 1, LastMissing: 1, LastRunTime: &lastRun}
+			}
+		})
+
+		It("should render the totals", func() {
+			response := httptest.NewRecorder()
+			h.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+			body := response.Body.String()
+			Expect(body).To(ContainSubstring("Reconciliation"))
+			Expect(body).To(ContainSubstring("40 checked, 6 skipped, 2 missing, 1 re-ingested"))
+		})
+	})
+
+	When("sink stats are available", func() {
+		BeforeEach(func() {
+			failedAt := startedAt.Add(time.Hour)
+			options.Sinks = func() []sink.Stats {
+				return []sink.Stats{
+					{Name: "rode", Required: true, Succeeded: 3},
+					{Name: "cloudevents", Succeeded: 1, Failed: 2, LastError: "broker unavailable", LastFailureTime: &failedAt},
+				}
+			}
+		})
+
+		It("should include them", func() {
+			status, err := h.status(context.Background())
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(status.Sinks).To(HaveLen(2))
+		})
+
+		It("should render them", func() {
+			response := httptest.NewRecorder()
+			h.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+			body := response.Body.String()
+			Expect(body).To(ContainSubstring("cloudevents"))
+			Expect(body).To(ContainSubstring("broker unavailable"))
+			Expect(body).To(ContainSubstring("2021-05-27 20:08:23"))
+		})
+	})
+
+	It("should only allow gets", func() {
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/status", nil))
+
+		Expect(response.Code).To(Equal(http.StatusMethodNotAllowed))
+	})
+})
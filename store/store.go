@@ -0,0 +1,385 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rode/collector-sonarqube/listener"
+	"github.com/rode/collector-sonarqube/sonar"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+var (
+	// recordsBucket holds each record by task id
+	recordsBucket = []byte("records")
+	// processedBucket orders task ids by the time they were last processed, for listing and retention
+	processedBucket = []byte("processed")
+
+	ErrNotFound = errors.New("record not found")
+)
+
+// maxAttempts limits the size of a record for an event that is delivered over and over.
+const maxAttempts = 20
+
+// Attempt is a single time that an event was processed.
+type Attempt struct {
+	Time               time.Time        `json:"time"`
+	Source             listener.Source  `json:"source"`
+	Outcome            listener.Outcome `json:"outcome"`
+	Reason             string           `json:"reason,omitempty"`
+	ResourceUri        string           `json:"resourceUri,omitempty"`
+	ArtifactUris       []string         `json:"artifactUris,omitempty"`
+	FailedResourceUris []string         `json:"failedResourceUris,omitempty"`
+	NoteName           string           `json:"noteName,omitempty"`
+	OccurrenceNames    []string         `json:"occurrenceNames,omitempty"`
+}
+
+// Record is the history of a single compute engine task: the event as it was last received, every attempt to process
+// it, and the outcome of the latest attempt.
+type Record struct {
+	TaskId          string           `json:"taskId"`
+	ProjectKey      string           `json:"projectKey,omitempty"`
+	Event           *sonar.Event     `json:"event"`
+	FirstReceivedAt time.Time        `json:"firstReceivedAt"`
+	LastProcessedAt time.Time        `json:"lastProcessedAt"`
+	Outcome         listener.Outcome `json:"outcome"`
+	Reason          string           `json:"reason,omitempty"`
+	ResourceUri     string           `json:"resourceUri,omitempty"`
+	NoteName        string           `json:"noteName,omitempty"`
+	OccurrenceNames []string         `json:"occurrenceNames,omitempty"`
+	Attempts        []*Attempt       `json:"attempts"`
+}
+
+// Options control how long records are kept. A zero value means no limit.
+type Options struct {
+	MaxAge     time.Duration
+	MaxRecords int
+}
+
+// Store is an embedded database of processed events, which answers "what happened to the analysis for task X?".
+type Store struct {
+	logger  *zap.Logger
+	db      *bolt.DB
+	options *Options
+	now     func() time.Time
+}
+
+// Open opens the store at the given path, creating it if it doesn't exist. Only one process can have the store open.
+func Open(logger *zap.Logger, path string, options *Options) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening store: %v", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{recordsBucket, processedBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error initializing store: %v", err)
+	}
+
+	return &Store{
+		logger:  logger,
+		db:      db,
+		options: options,
+		now:     time.Now,
+	}, nil
+}
+
+// Close closes the underlying database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Record adds an attempt to the record for the event's task, which is created the first time the task is seen. Events
+// without a task id can't be matched with earlier attempts, so each gets a record of its own.
+func (s *Store) Record(_ context.Context, event *sonar.Event, options *listener.ProcessOptions, result *listener.Result) error {
+	now := s.now()
+
+	taskId := event.TaskId
+	if taskId == "" {
+		taskId = fmt.Sprintf("unknown-%d", now.UnixNano())
+	}
+
+	attempt := &Attempt{
+		Time:               now,
+		Outcome:            result.Outcome,
+		Reason:             result.Reason,
+		ResourceUri:        result.ResourceUri,
+		ArtifactUris:       result.ArtifactUris,
+		FailedResourceUris: result.FailedResourceUris,
+		NoteName:           result.NoteName,
+		OccurrenceNames:    result.OccurrenceNames,
+	}
+	if options != nil {
+		attempt.Source = options.Source
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		record, err := getRecord(tx, taskId)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			record = &Record{TaskId: taskId, FirstReceivedAt: now}
+		case err != nil:
+			return err
+		default:
+			if err := tx.Bucket(processedBucket).Delete(processedKey(record)); err != nil {
+				return err
+			}
+		}
+
+		record.Event = event
+		if event.Project != nil {
+			record.ProjectKey = event.Project.Key
+		}
+		record.LastProcessedAt = now
+		record.Outcome = attempt.Outcome
+		record.Reason = attempt.Reason
+		// earlier resource uris and rode records are kept when a later attempt is skipped or rejected
+		if attempt.ResourceUri != "" {
+			record.ResourceUri = attempt.ResourceUri
+		}
+		if attempt.NoteName != "" {
+			record.NoteName = attempt.NoteName
+			record.OccurrenceNames = attempt.OccurrenceNames
+		}
+
+		record.Attempts = append(record.Attempts, attempt)
+		if len(record.Attempts) > maxAttempts {
+			record.Attempts = record.Attempts[len(record.Attempts)-maxAttempts:]
+		}
+
+		return putRecord(tx, record)
+	})
+}
+
+// Get returns the record for the task, or ErrNotFound.
+func (s *Store) Get(taskId string) (*Record, error) {
+	var record *Record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		record, err = getRecord(tx, taskId)
+
+		return err
+	})
+
+	return record, err
+}
+
+// List returns up to limit records that match the filter, most recently processed first. A nil filter matches every
+// record, and a limit of zero returns all of them.
+func (s *Store) List(limit int, filter func(*Record) bool) ([]*Record, error) {
+	records := []*Record{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(processedBucket).Cursor()
+		for key, taskId := cursor.Last(); key != nil; key, taskId = cursor.Prev() {
+			record, err := getRecord(tx, string(taskId))
+			if err != nil {
+				return err
+			}
+
+			if filter != nil && !filter(record) {
+				continue
+			}
+
+			records = append(records, record)
+			if limit > 0 && len(records) == limit {
+				return nil
+			}
+		}
+
+		return nil
+	})
+
+	return records, err
+}
+
+// Count returns the number of records that match the filter.
+func (s *Store) Count(filter func(*Record) bool) (int, error) {
+	count := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(recordsBucket).ForEach(func(taskId, value []byte) error {
+			record := &Record{}
+			if err := json.Unmarshal(value, record); err != nil {
+				return fmt.Errorf("error decoding record for task %s: %v", taskId, err)
+			}
+
+			if filter(record) {
+				count++
+			}
+
+			return nil
+		})
+	})
+
+	return count, err
+}
+
+// DeadLetter matches the records whose most recent attempt failed to record in Rode, which can be reprocessed or
+// purged with the admin API.
+func DeadLetter(r *Record) bool {
+	return r.Outcome == listener.OUTCOME_FAILED
+}
+
+// Delete removes every record that matches the filter, and returns the number removed.
+func (s *Store) Delete(filter func(*Record) bool) (int, error) {
+	removed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		records := tx.Bucket(recordsBucket)
+		cursor := tx.Bucket(processedBucket).Cursor()
+		for key, taskId := cursor.First(); key != nil; {
+			record, err := getRecord(tx, string(taskId))
+			if err != nil {
+				return err
+			}
+
+			if !filter(record) {
+				key, taskId = cursor.Next()
+				continue
+			}
+
+			next := append([]byte(nil), key...)
+			if err := records.Delete(taskId); err != nil {
+				return err
+			}
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+			removed++
+
+			// the key that followed the deleted one is now the first at or after it
+			key, taskId = cursor.Seek(next)
+		}
+
+		return nil
+	})
+
+	return removed, err
+}
+
+// Prune removes records that were last processed before the maximum age, then the oldest records beyond the maximum
+// number. It returns the number of records removed.
+func (s *Store) Prune() (int, error) {
+	removed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		records := tx.Bucket(recordsBucket)
+		processed := tx.Bucket(processedBucket)
+
+		excess := 0
+		if s.options.MaxRecords > 0 {
+			excess = records.Stats().KeyN - s.options.MaxRecords
+		}
+
+		var cutoff []byte
+		if s.options.MaxAge > 0 {
+			cutoff = timeKey(s.now().Add(-s.options.MaxAge))
+		}
+
+		cursor := processed.Cursor()
+		for key, taskId := cursor.First(); key != nil; key, taskId = cursor.First() {
+			expired := cutoff != nil && bytes.Compare(key[:len(cutoff)], cutoff) < 0
+			if !expired && removed >= excess {
+				return nil
+			}
+
+			if err := records.Delete(taskId); err != nil {
+				return err
+			}
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+			removed++
+		}
+
+		return nil
+	})
+
+	return removed, err
+}
+
+// RunRetention prunes the store once per interval until the context is canceled.
+func (s *Store) RunRetention(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		removed, err := s.Prune()
+		if err != nil {
+			s.logger.Error("error pruning store", zap.Error(err))
+		} else if removed > 0 {
+			s.logger.Info("pruned store", zap.Int("removed", removed))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func getRecord(tx *bolt.Tx, taskId string) (*Record, error) {
+	value := tx.Bucket(recordsBucket).Get([]byte(taskId))
+	if value == nil {
+		return nil, ErrNotFound
+	}
+
+	record := &Record{}
+	if err := json.Unmarshal(value, record); err != nil {
+		return nil, fmt.Errorf("error decoding record for task %s: %v", taskId, err)
+	}
+
+	return record, nil
+}
+
+func putRecord(tx *bolt.Tx, record *Record) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Bucket(recordsBucket).Put([]byte(record.TaskId), value); err != nil {
+		return err
+	}
+
+	return tx.Bucket(processedBucket).Put(processedKey(record), []byte(record.TaskId))
+}
+
+// processedKey sorts by the time the record was last processed, with the task id keeping keys unique.
+func processedKey(record *Record) []byte {
+	return append(timeKey(record.LastProcessedAt), []byte(record.TaskId)...)
+}
+
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+
+	return key
+}
@@ -0,0 +1,259 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/collector-sonarqube/listener"
+	"github.com/rode/collector-sonarqube/sonar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("Store", func() {
+	var (
+		dir     string
+		options *Options
+		store   *Store
+		now     time.Time
+	)
+
+	event := func(taskId string) *sonar.Event {
+		return &sonar.Event{
+			TaskId:  taskId,
+			Status:  sonar.STATUS_SUCCESS,
+			Project: &sonar.Project{Key: "my-project"},
+		}
+	}
+
+	record := func(taskId string, source listener.Source, result *listener.Result) {
+		now = now.Add(time.Second)
+		Expect(store.Record(context.Background(), event(taskId), &listener.ProcessOptions{Source: source}, result)).To(Succeed())
+	}
+
+	recorded := &listener.Result{
+		Outcome:         listener.OUTCOME_RECORDED,
+		ResourceUri:     "git://github.com/rode/collector-sonarqube@abc123",
+		NoteName:        "projects/rode/notes/sonar-scan-first",
+		OccurrenceNames: []string{"projects/rode/occurrences/1", "projects/rode/occurrences/2"},
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "store")
+		Expect(err).ToNot(HaveOccurred())
+
+		now = time.Date(2021, 5, 27, 19, 8, 23, 0, time.UTC)
+		options = &Options{}
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		store, err = Open(logger, filepath.Join(dir, "state.db"), options)
+		Expect(err).ToNot(HaveOccurred())
+		store.now = func() time.Time { return now }
+	})
+
+	AfterEach(func() {
+		Expect(store.Close()).To(Succeed())
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("should record each attempt to process an event", func() {
+		record("first", listener.SOURCE_WEBHOOK, &listener.Result{Outcome: listener.OUTCOME_FAILED, Reason: "rode is unavailable"})
+		record("first", listener.SOURCE_RECONCILE, recorded)
+
+		r, err := store.Get("first")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(r.ProjectKey).To(Equal("my-project"))
+		Expect(r.Outcome).To(Equal(listener.OUTCOME_RECORDED))
+		Expect(r.Reason).To(BeEmpty())
+		Expect(r.ResourceUri).To(Equal(recorded.ResourceUri))
+		Expect(r.NoteName).To(Equal(recorded.NoteName))
+		Expect(r.OccurrenceNames).To(Equal(recorded.OccurrenceNames))
+		Expect(r.FirstReceivedAt).To(BeTemporally("==", now.Add(-time.Second)))
+		Expect(r.LastProcessedAt).To(BeTemporally("==", now))
+
+		Expect(r.Attempts).To(HaveLen(2))
+		Expect(r.Attempts[0].Source).To(Equal(listener.SOURCE_WEBHOOK))
+		Expect(r.Attempts[0].Reason).To(Equal("rode is unavailable"))
+		Expect(r.Attempts[1].Source).To(Equal(listener.SOURCE_RECONCILE))
+	})
+
+	It("should keep the rode records when a later attempt is skipped", func() {
+		record("first", listener.SOURCE_WEBHOOK, recorded)
+		record("first", listener.SOURCE_POLL, &listener.Result{Outcome: listener.OUTCOME_SKIPPED, Reason: "analysis was canceled"})
+
+		r, err := store.Get("first")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(r.Outcome).To(Equal(listener.OUTCOME_SKIPPED))
+		Expect(r.NoteName).To(Equal(recorded.NoteName))
+		Expect(r.ResourceUri).To(Equal(recorded.ResourceUri))
+	})
+
+	It("should limit the number of attempts kept", func() {
+		for i := 0; i < maxAttempts+5; i++ {
+			record("first", listener.SOURCE_WEBHOOK, &listener.Result{Outcome: listener.OUTCOME_FAILED, Reason: fmt.Sprint(i)})
+		}
+
+		r, err := store.Get("first")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(r.Attempts).To(HaveLen(maxAttempts))
+		Expect(r.Attempts[0].Reason).To(Equal("5"))
+	})
+
+	It("should give events without a task id a record of their own", func() {
+		record("", listener.SOURCE_WEBHOOK, &listener.Result{Outcome: listener.OUTCOME_REJECTED})
+		record("", listener.SOURCE_WEBHOOK, &listener.Result{Outcome: listener.OUTCOME_REJECTED})
+
+		records, err := store.List(0, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(records).To(HaveLen(2))
+	})
+
+	It("should return an error for an unknown task", func() {
+		_, err := store.Get("unknown")
+
+		Expect(err).To(MatchError(ErrNotFound))
+	})
+
+	It("should list the most recently processed records first", func() {
+		record("first", listener.SOURCE_WEBHOOK, recorded)
+		record("second", listener.SOURCE_WEBHOOK, &listener.Result{Outcome: listener.OUTCOME_FAILED})
+		record("third", listener.SOURCE_WEBHOOK, recorded)
+		record("first", listener.SOURCE_REPLAY, recorded)
+
+		records, err := store.List(0, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(taskIds(records)).To(Equal([]string{"first", "third", "second"}))
+
+		records, err = store.List(1, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(taskIds(records)).To(Equal([]string{"first"}))
+
+		records, err = store.List(0, func(r *Record) bool { return r.Outcome == listener.OUTCOME_FAILED })
+		Expect(err).ToNot(HaveOccurred())
+		Expect(taskIds(records)).To(Equal([]string{"second"}))
+	})
+
+	It("should keep records after the store is reopened", func() {
+		record("first", listener.SOURCE_WEBHOOK, recorded)
+		Expect(store.Close()).To(Succeed())
+
+		var err error
+		store, err = Open(logger, filepath.Join(dir, "state.db"), options)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = store.Get("first")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should count the dead letters", func() {
+		record("first", listener.SOURCE_WEBHOOK, &listener.Result{Outcome: listener.OUTCOME_FAILED})
+		record("second", listener.SOURCE_WEBHOOK, recorded)
+		record("third", listener.SOURCE_POLL, &listener.Result{Outcome: listener.OUTCOME_FAILED})
+		record("third", listener.SOURCE_POLL, recorded)
+		record("fourth", listener.SOURCE_WEBHOOK, &listener.Result{Outcome: listener.OUTCOME_REJECTED})
+
+		count, err := store.Count(DeadLetter)
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(Equal(1))
+	})
+
+	It("should delete the records that match a filter", func() {
+		record("first", listener.SOURCE_WEBHOOK, &listener.Result{Outcome: listener.OUTCOME_FAILED})
+		record("second", listener.SOURCE_WEBHOOK, recorded)
+		record("third", listener.SOURCE_WEBHOOK, &listener.Result{Outcome: listener.OUTCOME_FAILED})
+		record("fourth", listener.SOURCE_WEBHOOK, &listener.Result{Outcome: listener.OUTCOME_FAILED})
+
+		removed, err := store.Delete(func(r *Record) bool { return r.Outcome == listener.OUTCOME_FAILED })
+		Expect(err).ToNot(HaveOccurred())
+		Expect(removed).To(Equal(3))
+
+		records, err := store.List(0, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(taskIds(records)).To(Equal([]string{"second"}))
+
+		_, err = store.Get("first")
+		Expect(err).To(MatchError(ErrNotFound))
+	})
+
+	Context("retention", func() {
+		JustBeforeEach(func() {
+			record("first", listener.SOURCE_WEBHOOK, recorded)
+			now = now.Add(time.Hour)
+			record("second", listener.SOURCE_WEBHOOK, recorded)
+			record("third", listener.SOURCE_WEBHOOK, recorded)
+		})
+
+		When("records are older than the maximum age", func() {
+			BeforeEach(func() {
+				options.MaxAge = 30 * time.Minute
+			})
+
+			It("should remove them", func() {
+				removed, err := store.Prune()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(removed).To(Equal(1))
+
+				records, err := store.List(0, nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(taskIds(records)).To(Equal([]string{"third", "second"}))
+			})
+		})
+
+		When("there are more than the maximum number of records", func() {
+			BeforeEach(func() {
+				options.MaxRecords = 1
+			})
+
+			It("should remove the oldest", func() {
+				removed, err := store.Prune()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(removed).To(Equal(2))
+
+				_, err = store.Get("second")
+				Expect(err).To(MatchError(ErrNotFound))
+
+				records, err := store.List(0, nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(taskIds(records)).To(Equal([]string{"third"}))
+			})
+		})
+
+		When("there are no limits", func() {
+			It("should keep every record", func() {
+				removed, err := store.Prune()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(removed).To(BeZero())
+			})
+		})
+	})
+})
+
+func taskIds(records []*Record) []string {
+	var ids []string
+	for _, r := range records {
+		ids = append(ids, r.TaskId)
+	}
+
+	return ids
+}